@@ -0,0 +1,106 @@
+package api
+
+import (
+	"net/http"
+	"rm-thierry/Proxmox-API/src/handlers"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *VMHandler) GetAgentStatus(c *gin.Context) {
+	h.handleAgentCall(c, "get agent status", func(node, vmid string) (interface{}, error) {
+		return handlers.AgentStatus(h.api(c), node, vmid)
+	})
+}
+
+func (h *VMHandler) GetAgentNetwork(c *gin.Context) {
+	h.handleAgentCall(c, "get network interfaces", func(node, vmid string) (interface{}, error) {
+		return handlers.AgentNetworkInterfaces(h.api(c), node, vmid)
+	})
+}
+
+func (h *VMHandler) GetAgentOSInfo(c *gin.Context) {
+	h.handleAgentCall(c, "get OS info", func(node, vmid string) (interface{}, error) {
+		return handlers.AgentOSInfo(h.api(c), node, vmid)
+	})
+}
+
+func (h *VMHandler) AgentExec(c *gin.Context) {
+	var req handlers.AgentExecRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, "Invalid request: "+err.Error())
+		return
+	}
+
+	h.handleAgentCall(c, "run command", func(node, vmid string) (interface{}, error) {
+		return handlers.AgentExec(h.api(c), node, vmid, &req)
+	})
+}
+
+func (h *VMHandler) AgentExecStatus(c *gin.Context) {
+	h.handleAgentCall(c, "get command status", func(node, vmid string) (interface{}, error) {
+		return handlers.AgentExecStatus(h.api(c), node, vmid, c.Param("pid"))
+	})
+}
+
+func (h *VMHandler) AgentFileRead(c *gin.Context) {
+	h.handleAgentCall(c, "read file", func(node, vmid string) (interface{}, error) {
+		return handlers.AgentFileRead(h.api(c), node, vmid, c.Query("path"))
+	})
+}
+
+func (h *VMHandler) AgentFileWrite(c *gin.Context) {
+	var req handlers.AgentFileWriteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, "Invalid request: "+err.Error())
+		return
+	}
+
+	h.handleAgentCall(c, "write file", func(node, vmid string) (interface{}, error) {
+		return handlers.AgentFileWrite(h.api(c), node, vmid, &req)
+	})
+}
+
+func (h *VMHandler) AgentFSFreeze(c *gin.Context) {
+	action := c.Param("action")
+	h.handleAgentCall(c, action+" filesystems", func(node, vmid string) (interface{}, error) {
+		return handlers.AgentFSFreeze(h.api(c), node, vmid, action)
+	})
+}
+
+func (h *VMHandler) AgentSetPassword(c *gin.Context) {
+	var req handlers.AgentPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, "Invalid request: "+err.Error())
+		return
+	}
+
+	h.handleAgentCall(c, "set password", func(node, vmid string) (interface{}, error) {
+		return handlers.AgentSetPassword(h.api(c), node, vmid, &req)
+	})
+}
+
+func (h *VMHandler) handleAgentCall(c *gin.Context, operation string, call func(node, vmid string) (interface{}, error)) {
+	guest, ok := h.resolveGuest(c, "vmid", "qemu")
+	if !ok {
+		return
+	}
+
+	result, err := call(guest.Node, guest.VMID)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		switch {
+		case strings.Contains(err.Error(), "invalid"), strings.Contains(err.Error(), "required"):
+			statusCode = http.StatusBadRequest
+		case strings.Contains(err.Error(), "not running"):
+			statusCode = http.StatusConflict
+		case strings.Contains(err.Error(), "not found"), strings.Contains(err.Error(), "does not exist"):
+			statusCode = http.StatusNotFound
+		}
+		sendResponse(c, statusCode, false, nil, "Failed to "+operation+": "+err.Error())
+		return
+	}
+
+	sendResponse(c, http.StatusOK, true, result, "")
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"net/http"
+	"rm-thierry/Proxmox-API/src/handlers"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *VMHandler) BulkVMOperation(c *gin.Context) {
+	h.handleBulkOperation(c, "qemu")
+}
+
+func (h *VMHandler) BulkContainerOperation(c *gin.Context) {
+	h.handleBulkOperation(c, "lxc")
+}
+
+func (h *VMHandler) handleBulkOperation(c *gin.Context, guestType string) {
+	action := c.Param("action")
+
+	var req handlers.BulkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, "Invalid request: "+err.Error())
+		return
+	}
+
+	if isDryRun(c) {
+		req.DryRun = true
+	}
+
+	op, err := handlers.RunBulkOperation(h.api(c), guestType, action, &req)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		switch {
+		case strings.Contains(err.Error(), "ambiguous"):
+			statusCode = http.StatusConflict
+		case strings.Contains(err.Error(), "invalid"), strings.Contains(err.Error(), "no guests matched"):
+			statusCode = http.StatusBadRequest
+		case strings.Contains(err.Error(), "not found"):
+			statusCode = http.StatusNotFound
+		}
+		sendResponse(c, statusCode, false, nil, "Failed to run bulk "+action+": "+err.Error())
+		return
+	}
+
+	switch {
+	case req.Async:
+		sendResponse(c, http.StatusAccepted, true, op, "")
+	case op.Failed > 0:
+		sendResponse(c, http.StatusMultiStatus, false, op, "")
+	default:
+		sendResponse(c, http.StatusOK, true, op, "")
+	}
+}
+
+func (h *VMHandler) GetBulkOperation(c *gin.Context) {
+	op, err := handlers.GetBulkOperation(c.Param("id"))
+	if err != nil {
+		sendResponse(c, http.StatusNotFound, false, nil, err.Error())
+		return
+	}
+	sendResponse(c, http.StatusOK, true, op, "")
+}
@@ -0,0 +1,197 @@
+package api
+
+import (
+	"net/http"
+	"rm-thierry/Proxmox-API/src/handlers"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *VMHandler) ListContainers(c *gin.Context) {
+	node := c.DefaultQuery("node", h.api(c).Node)
+
+	if hasInventoryQuery(c) {
+		items, err := handlers.ListContainerItems(h.api(c), node)
+		if err != nil {
+			sendResponse(c, http.StatusInternalServerError, false, nil, "Failed to list containers: "+err.Error())
+			return
+		}
+		sendQueriedList(c, items, "containers")
+		return
+	}
+
+	containers, err := handlers.GetContainers(h.api(c), node)
+	if err != nil {
+		sendResponse(c, http.StatusInternalServerError, false, nil, "Failed to list containers: "+err.Error())
+		return
+	}
+	sendResponse(c, http.StatusOK, true, containers, "")
+}
+
+func (h *VMHandler) CreateContainer(c *gin.Context) {
+	config := handlers.NewDefaultContainerConfig(h.api(c).Node)
+	if err := c.ShouldBindJSON(&config); err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, "Invalid request: "+err.Error())
+		return
+	}
+
+	if config.Node == "" {
+		config.Node = h.api(c).Node
+	}
+	if isDryRun(c) {
+		config.DryRun = true
+	}
+
+	result, err := handlers.CreateContainer(h.api(c), config)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		switch {
+		case strings.Contains(err.Error(), "already exists"):
+			statusCode = http.StatusConflict
+		case strings.Contains(err.Error(), "required"), strings.Contains(err.Error(), "invalid"):
+			statusCode = http.StatusBadRequest
+		case strings.Contains(err.Error(), "not found"):
+			statusCode = http.StatusNotFound
+		}
+		sendResponse(c, statusCode, false, nil, "Failed to create container: "+err.Error())
+		return
+	}
+
+	sendCreated(c, result)
+}
+
+func (h *VMHandler) GetContainer(c *gin.Context) {
+	guest, ok := h.resolveGuest(c, "ctid", "lxc")
+	if !ok {
+		return
+	}
+	node, ctid := guest.Node, guest.VMID
+
+	container, err := handlers.GetContainer(h.api(c), node, ctid)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		if strings.Contains(err.Error(), "does not exist") {
+			statusCode = http.StatusNotFound
+		}
+		sendResponse(c, statusCode, false, nil, "Failed to get container: "+err.Error())
+		return
+	}
+
+	sendResponse(c, http.StatusOK, true, container, "")
+}
+
+func (h *VMHandler) DeleteContainer(c *gin.Context) {
+	h.handleContainerOperation(c, "delete")
+}
+
+func (h *VMHandler) StartContainer(c *gin.Context) {
+	h.handleContainerOperation(c, "start")
+}
+
+func (h *VMHandler) StopContainer(c *gin.Context) {
+	h.handleContainerOperation(c, "stop")
+}
+
+func (h *VMHandler) handleContainerOperation(c *gin.Context, operation string) {
+	guest, ok := h.resolveGuest(c, "ctid", "lxc")
+	if !ok {
+		return
+	}
+	node, ctid := guest.Node, guest.VMID
+
+	var result map[string]interface{}
+	var err error
+	switch operation {
+	case "delete":
+		if isDryRun(c) {
+			result, err = handlers.DeleteContainerDryRun(h.api(c), node, ctid)
+		} else {
+			result, err = handlers.DeleteContainer(h.api(c), node, ctid)
+		}
+	case "start":
+		result, err = handlers.StartContainer(h.api(c), node, ctid)
+	case "stop":
+		result, err = handlers.StopContainer(h.api(c), node, ctid)
+	}
+
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		if strings.Contains(err.Error(), "does not exist") {
+			statusCode = http.StatusNotFound
+		}
+		sendResponse(c, statusCode, false, nil, "Failed to "+operation+" container: "+err.Error())
+		return
+	}
+
+	sendResponse(c, http.StatusOK, true, result, "")
+}
+
+func (h *VMHandler) GetContainerConfig(c *gin.Context) {
+	h.handleContainerConfigCall(c, "get container config", func(node, ctid string) (map[string]interface{}, error) {
+		return handlers.GetContainerConfig(h.api(c), node, ctid)
+	})
+}
+
+func (h *VMHandler) UpdateContainerConfig(c *gin.Context) {
+	var req handlers.ContainerConfigUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, "Invalid request: "+err.Error())
+		return
+	}
+
+	h.handleContainerConfigCall(c, "update container config", func(node, ctid string) (map[string]interface{}, error) {
+		if isDryRun(c) {
+			return handlers.UpdateContainerConfigDryRun(h.api(c), node, ctid, &req)
+		}
+		return handlers.UpdateContainerConfig(h.api(c), node, ctid, &req)
+	})
+}
+
+func (h *VMHandler) ResizeContainerDisk(c *gin.Context) {
+	var req handlers.ContainerResizeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, "Invalid request: "+err.Error())
+		return
+	}
+
+	h.handleContainerConfigCall(c, "resize container disk", func(node, ctid string) (map[string]interface{}, error) {
+		return handlers.ResizeContainerDisk(h.api(c), node, ctid, &req)
+	})
+}
+
+func (h *VMHandler) AddContainerMountPoint(c *gin.Context) {
+	var req handlers.ContainerMountPoint
+	if err := c.ShouldBindJSON(&req); err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, "Invalid request: "+err.Error())
+		return
+	}
+
+	h.handleContainerConfigCall(c, "add mount point", func(node, ctid string) (map[string]interface{}, error) {
+		return handlers.AddContainerMountPoint(h.api(c), node, ctid, req)
+	})
+}
+
+func (h *VMHandler) handleContainerConfigCall(c *gin.Context, operation string, call func(node, ctid string) (map[string]interface{}, error)) {
+	guest, ok := h.resolveGuest(c, "ctid", "lxc")
+	if !ok {
+		return
+	}
+
+	result, err := call(guest.Node, guest.VMID)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		switch {
+		case strings.Contains(err.Error(), "invalid"), strings.Contains(err.Error(), "no configuration changes"):
+			statusCode = http.StatusBadRequest
+		case strings.Contains(err.Error(), "not found"), strings.Contains(err.Error(), "does not exist"):
+			statusCode = http.StatusNotFound
+		case strings.Contains(err.Error(), "no free mount point"):
+			statusCode = http.StatusConflict
+		}
+		sendResponse(c, statusCode, false, nil, "Failed to "+operation+": "+err.Error())
+		return
+	}
+
+	sendResponse(c, http.StatusOK, true, result, "")
+}
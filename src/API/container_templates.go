@@ -0,0 +1,98 @@
+package api
+
+import (
+	"net/http"
+	"rm-thierry/Proxmox-API/src/handlers"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *VMHandler) GetContainerTemplates(c *gin.Context) {
+	node := c.DefaultQuery("node", h.api(c).Node)
+
+	if ref := c.Query("name"); ref != "" {
+		volid, err := handlers.ResolveContainerTemplate(h.api(c), node, ref)
+		if err != nil {
+			statusCode := http.StatusInternalServerError
+			if strings.Contains(err.Error(), "not found") {
+				statusCode = http.StatusNotFound
+			}
+			sendResponse(c, statusCode, false, nil, "Failed to resolve template: "+err.Error())
+			return
+		}
+		sendResponse(c, http.StatusOK, true, gin.H{"name": ref, "volid": volid}, "")
+		return
+	}
+
+	catalog, err := handlers.GetContainerTemplateCatalog(h.api(c), node)
+	if err != nil {
+		sendResponse(c, http.StatusInternalServerError, false, nil, "Failed to get container templates: "+err.Error())
+		return
+	}
+	sendResponse(c, http.StatusOK, true, catalog, "")
+}
+
+func (h *VMHandler) DownloadContainerTemplate(c *gin.Context) {
+	var req handlers.ApplianceDownloadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, "Invalid request: "+err.Error())
+		return
+	}
+
+	node := c.DefaultQuery("node", h.api(c).Node)
+	result, err := handlers.DownloadAppliance(h.api(c), node, &req)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		switch {
+		case strings.Contains(err.Error(), "required"), strings.Contains(err.Error(), "invalid"):
+			statusCode = http.StatusBadRequest
+		case strings.Contains(err.Error(), "not found"):
+			statusCode = http.StatusNotFound
+		}
+		sendResponse(c, statusCode, false, nil, "Failed to download template: "+err.Error())
+		return
+	}
+
+	sendResponse(c, http.StatusAccepted, true, result, "")
+}
+
+// GetTask reports the status of a Proxmox task, e.g. a template download.
+// With wait=true it blocks until the task stops or wait_timeout expires
+func (h *VMHandler) GetTask(c *gin.Context) {
+	upid := c.Param("upid")
+	node := c.Query("node")
+
+	var status map[string]interface{}
+	var err error
+	if c.Query("wait") == "true" {
+		opts, optErr := parsePowerOptions(c)
+		if optErr != nil {
+			sendResponse(c, http.StatusBadRequest, false, nil, optErr.Error())
+			return
+		}
+		if opts.WaitTimeout <= 0 {
+			opts.WaitTimeout = 10 * time.Minute
+		}
+		status, err = handlers.WaitForTask(h.api(c), node, upid, opts.WaitTimeout)
+		if err != nil && status != nil {
+			// The task failed or is still running, its status says which
+			sendResponse(c, http.StatusOK, false, status, err.Error())
+			return
+		}
+	} else {
+		status, err = handlers.GetTaskStatus(h.api(c), node, upid)
+	}
+
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		if strings.Contains(err.Error(), "invalid") {
+			statusCode = http.StatusBadRequest
+		}
+		sendResponse(c, statusCode, false, nil, "Failed to get task: "+err.Error())
+		return
+	}
+
+	sendResponse(c, http.StatusOK, true, status, "")
+}
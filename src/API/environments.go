@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http"
+	"rm-thierry/Proxmox-API/src/handlers"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Environment plans, applies or destroys a spec sent as JSON or YAML.
+// The action comes from ?action=plan|apply|destroy and defaults to plan,
+// apply only deletes guests removed from the spec with ?prune=true
+func (h *VMHandler) Environment(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, "Invalid request: "+err.Error())
+		return
+	}
+
+	spec, err := handlers.ParseEnvironmentSpec(body)
+	if err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, err.Error())
+		return
+	}
+
+	var result interface{}
+	action := c.DefaultQuery("action", "plan")
+	switch action {
+	case "plan":
+		result, err = handlers.PlanEnvironment(h.api(c), spec)
+	case "apply":
+		result, err = handlers.ApplyEnvironment(h.api(c), spec, c.Query("prune") == "true")
+	case "destroy":
+		result, err = handlers.DestroyEnvironment(h.api(c), spec)
+	default:
+		sendResponse(c, http.StatusBadRequest, false, nil, "Invalid action '"+action+"', must be plan, apply or destroy")
+		return
+	}
+
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		switch {
+		case strings.Contains(err.Error(), "invalid"):
+			statusCode = http.StatusBadRequest
+		case strings.Contains(err.Error(), "ambiguous"):
+			statusCode = http.StatusConflict
+		}
+		sendResponse(c, statusCode, false, nil, "Failed to "+action+" environment: "+err.Error())
+		return
+	}
+
+	if run, ok := result.(*handlers.EnvironmentResult); ok && run.Failed > 0 {
+		sendResponse(c, http.StatusMultiStatus, false, run, "")
+		return
+	}
+	sendResponse(c, http.StatusOK, true, result, "")
+}
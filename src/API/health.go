@@ -0,0 +1,55 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"rm-thierry/Proxmox-API/src/auth"
+	"rm-thierry/Proxmox-API/src/handlers"
+	"rm-thierry/Proxmox-API/src/manager"
+	"rm-thierry/Proxmox-API/src/version"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readinessTimeout bounds each dependency check of /readyz
+const readinessTimeout = 5 * time.Second
+
+// registerHealthRoutes adds the probes and /version, which need no token.
+// /readyz only shows the status of each dependency unless the request has
+// the API token or METRICS_TOKEN
+func registerHealthRoutes(router *gin.Engine, apiManager *manager.APIManager, authService *auth.Service, metricsToken string) {
+	router.GET("/healthz", func(c *gin.Context) {
+		sendResponse(c, http.StatusOK, true, gin.H{"status": "ok"}, "")
+	})
+
+	router.GET("/readyz", func(c *gin.Context) {
+		readiness := handlers.CheckReadiness(apiManager.WithContext(c.Request.Context()), readinessTimeout)
+		if !readinessDetailsAllowed(c, authService, metricsToken) {
+			readiness = readiness.StatusOnly()
+		}
+		if !readiness.Ready {
+			sendResponse(c, http.StatusServiceUnavailable, false, readiness, "not ready")
+			return
+		}
+		sendResponse(c, http.StatusOK, true, readiness, "")
+	})
+
+	router.GET("/version", func(c *gin.Context) {
+		sendResponse(c, http.StatusOK, true, version.Get(), "")
+	})
+}
+
+// readinessDetailsAllowed reports whether the request has the API token or
+// the metrics token. A missing or wrong token is not an error here, it only
+// hides the details
+func readinessDetailsAllowed(c *gin.Context, authService *auth.Service, metricsToken string) bool {
+	token, err := auth.ExtractTokenFromHeader(c)
+	if err != nil {
+		return false
+	}
+	if authService.ValidateToken(token) == nil {
+		return true
+	}
+	return metricsToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(metricsToken)) == 1
+}
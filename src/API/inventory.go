@@ -0,0 +1,94 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"rm-thierry/Proxmox-API/src/handlers"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errInvalidLimit = errors.New("limit must be a non-negative number")
+
+var inventoryQueryParams = []string{"type", "status", "tag", "pool", "name", "sort", "fields", "limit", "cursor"}
+
+func (h *VMHandler) GetInventory(c *gin.Context) {
+	query, err := parseInventoryQuery(c)
+	if err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, err.Error())
+		return
+	}
+	query.Node = c.Query("node")
+
+	page, err := handlers.GetInventory(h.api(c), query)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		if strings.Contains(err.Error(), "invalid") {
+			statusCode = http.StatusBadRequest
+		}
+		sendResponse(c, statusCode, false, nil, "Failed to get inventory: "+err.Error())
+		return
+	}
+
+	sendResponse(c, http.StatusOK, true, page, "")
+}
+
+func parseInventoryQuery(c *gin.Context) (*handlers.InventoryQuery, error) {
+	query := &handlers.InventoryQuery{
+		Type:   c.Query("type"),
+		Status: c.Query("status"),
+		Tag:    c.Query("tag"),
+		Pool:   c.Query("pool"),
+		Name:   c.Query("name"),
+		Sort:   c.Query("sort"),
+		Cursor: c.Query("cursor"),
+	}
+
+	if fields := c.Query("fields"); fields != "" {
+		query.Fields = strings.Split(fields, ",")
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return nil, errInvalidLimit
+		}
+		query.Limit = n
+	}
+
+	return query, nil
+}
+
+// hasInventoryQuery reports whether any filter, sort or paging option was given
+func hasInventoryQuery(c *gin.Context) bool {
+	for _, param := range inventoryQueryParams {
+		if _, ok := c.GetQuery(param); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sendQueriedList applies the inventory query options to a node's guests.
+// The response stays a list, paging details are returned in headers
+func sendQueriedList(c *gin.Context, items []handlers.InventoryItem, kind string) {
+	query, err := parseInventoryQuery(c)
+	if err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, err.Error())
+		return
+	}
+
+	page, err := handlers.QueryInventory(items, query)
+	if err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, "Failed to list "+kind+": "+err.Error())
+		return
+	}
+
+	c.Header("X-Total-Count", strconv.Itoa(page.Total))
+	if page.NextCursor != "" {
+		c.Header("X-Next-Cursor", page.NextCursor)
+	}
+	sendResponse(c, http.StatusOK, true, page.Items, "")
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"log/slog"
+	"rm-thierry/Proxmox-API/src/auth"
+	"rm-thierry/Proxmox-API/src/logging"
+	"rm-thierry/Proxmox-API/src/tracing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errorKey holds the error message sendResponse returned, for the request log
+const errorKey = "error"
+
+// quietRoutes are polled by orchestrators and scrapers, successful requests
+// are only logged at debug level
+var quietRoutes = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+// requestLogger logs every request as one JSON line with the Proxmox calls
+// it made. The request ID comes from X-Request-ID or is generated, and is
+// sent back in the response
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		started := time.Now()
+		requestLog := logging.NewRequestLog(c.GetHeader("X-Request-ID"))
+		c.Request = c.Request.WithContext(logging.NewContext(c.Request.Context(), requestLog))
+		c.Header("X-Request-ID", requestLog.ID)
+
+		c.Next()
+
+		principal := c.GetString(auth.PrincipalKey)
+		if principal == "" {
+			principal = "anonymous"
+		}
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		case quietRoutes[route]:
+			level = slog.LevelDebug
+		}
+
+		attrs := []any{
+			"request_id", requestLog.ID,
+			"method", c.Request.Method,
+			"route", route,
+			"path", c.Request.URL.Path,
+			"status", status,
+			"latency_ms", float64(time.Since(started).Microseconds()) / 1000,
+			"client_ip", c.ClientIP(),
+			"principal", principal,
+			"upstream_calls", requestLog.Calls(),
+		}
+		if traceID := tracing.TraceID(c.Request.Context()); traceID != "" {
+			attrs = append(attrs, "trace_id", traceID)
+		}
+		if message := c.GetString(errorKey); message != "" {
+			attrs = append(attrs, "error", message)
+		}
+		slog.Log(c.Request.Context(), level, "request", attrs...)
+	}
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"net/http"
+	"rm-thierry/Proxmox-API/src/handlers"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// resolveGuest reads the guest reference from the route. Besides a numeric
+// ID it accepts "name:<hostname>", or "lookup" together with a name query
+// parameter. It sends the error response itself and returns false on failure
+func (h *VMHandler) resolveGuest(c *gin.Context, param, guestType string) (*handlers.GuestRef, bool) {
+	ref := c.Param(param)
+	if ref == "lookup" {
+		ref = "name:" + c.Query("name")
+	}
+
+	guest, err := handlers.ResolveGuest(h.api(c), guestType, ref, c.Query("node"))
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		switch {
+		case strings.Contains(err.Error(), "ambiguous"):
+			statusCode = http.StatusConflict
+		case strings.Contains(err.Error(), "not found"):
+			statusCode = http.StatusNotFound
+		case strings.Contains(err.Error(), "invalid"):
+			statusCode = http.StatusBadRequest
+		}
+		sendResponse(c, statusCode, false, nil, "Failed to resolve guest: "+err.Error())
+		return nil, false
+	}
+
+	return guest, true
+}
+
+// LookupGuests finds VMs and containers across the cluster by name and tags
+func (h *VMHandler) LookupGuests(c *gin.Context) {
+	var tags []string
+	if tag := c.Query("tag"); tag != "" {
+		tags = strings.Split(tag, ",")
+	}
+
+	guests, err := handlers.FindGuests(h.api(c), c.Query("type"), c.Query("name"), tags)
+	if err != nil {
+		sendResponse(c, http.StatusInternalServerError, false, nil, "Failed to look up guests: "+err.Error())
+		return
+	}
+	if guests == nil {
+		guests = []handlers.GuestRef{}
+	}
+
+	sendResponse(c, http.StatusOK, true, guests, "")
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"net/http"
+	"rm-thierry/Proxmox-API/src/handlers"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *VMHandler) EvacuateNode(c *gin.Context) {
+	h.handleEvacuation(c, "evacuate")
+}
+
+func (h *VMHandler) ReturnGuests(c *gin.Context) {
+	h.handleEvacuation(c, "return")
+}
+
+func (h *VMHandler) handleEvacuation(c *gin.Context, operation string) {
+	node := c.Param("node")
+
+	var req handlers.EvacuationRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			sendResponse(c, http.StatusBadRequest, false, nil, "Invalid request: "+err.Error())
+			return
+		}
+	}
+	if isDryRun(c) {
+		req.DryRun = true
+	}
+
+	var plan *handlers.EvacuationPlan
+	var err error
+	switch operation {
+	case "evacuate":
+		plan, err = handlers.EvacuateNode(h.api(c), node, &req)
+	case "return":
+		plan, err = handlers.ReturnGuests(h.api(c), node, &req)
+	}
+
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		switch {
+		case strings.Contains(err.Error(), "not found"):
+			statusCode = http.StatusNotFound
+		case strings.Contains(err.Error(), "no online target"):
+			statusCode = http.StatusConflict
+		}
+		sendResponse(c, statusCode, false, nil, "Failed to "+operation+" node: "+err.Error())
+		return
+	}
+
+	statusCode := http.StatusOK
+	if plan.Failed > 0 {
+		statusCode = http.StatusMultiStatus
+	}
+	sendResponse(c, statusCode, plan.Failed == 0, plan, "")
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"net/http"
+	"rm-thierry/Proxmox-API/src/handlers"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *VMHandler) GetTemplates(c *gin.Context) {
+	templates, err := handlers.ListVMTemplates(h.api(c))
+	if err != nil {
+		sendResponse(c, http.StatusInternalServerError, false, nil,
+			"Failed to get templates: "+err.Error())
+		return
+	}
+	sendResponse(c, http.StatusOK, true, templates, "")
+}
+
+func (h *VMHandler) GetTemplate(c *gin.Context) {
+	template, err := handlers.GetVMTemplate(h.api(c), c.Param("name"))
+	if err != nil {
+		sendTemplateError(c, "Failed to get template: ", err)
+		return
+	}
+	sendResponse(c, http.StatusOK, true, template, "")
+}
+
+func (h *VMHandler) CreateTemplate(c *gin.Context) {
+	var entry handlers.VMTemplate
+	if err := c.ShouldBindJSON(&entry); err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, "Invalid request: "+err.Error())
+		return
+	}
+
+	if err := handlers.CreateVMTemplateEntry(&entry); err != nil {
+		sendTemplateError(c, "Failed to create template: ", err)
+		return
+	}
+	h.sendTemplate(c, http.StatusCreated, entry.Name)
+}
+
+// BuildTemplate builds a template from a cloud image and registers it. The
+// import can take several minutes, the request waits for it
+func (h *VMHandler) BuildTemplate(c *gin.Context) {
+	var req handlers.TemplateBuildRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, "Invalid request: "+err.Error())
+		return
+	}
+
+	if req.Node == "" {
+		req.Node = h.api(c).Node
+	}
+
+	result, err := handlers.BuildVMTemplate(h.api(c), &req)
+	if err != nil {
+		sendTemplateError(c, "Failed to build template: ", err)
+		return
+	}
+
+	statusCode := http.StatusCreated
+	if result["status"] == "exists" {
+		statusCode = http.StatusOK
+	}
+	sendResponse(c, statusCode, true, result, "")
+}
+
+func (h *VMHandler) UpdateTemplate(c *gin.Context) {
+	var entry handlers.VMTemplate
+	if err := c.ShouldBindJSON(&entry); err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, "Invalid request: "+err.Error())
+		return
+	}
+
+	name := c.Param("name")
+	if err := handlers.UpdateVMTemplateEntry(name, &entry); err != nil {
+		sendTemplateError(c, "Failed to update template: ", err)
+		return
+	}
+	h.sendTemplate(c, http.StatusOK, name)
+}
+
+func (h *VMHandler) DeleteTemplate(c *gin.Context) {
+	if err := handlers.DeleteVMTemplateEntry(c.Param("name")); err != nil {
+		sendTemplateError(c, "Failed to delete template: ", err)
+		return
+	}
+	sendResponse(c, http.StatusOK, true, gin.H{"message": "Template removed from the registry"}, "")
+}
+
+// sendTemplate responds with the merged view of a template that was just
+// saved, or with the saved entry alone if the cluster cannot be reached
+func (h *VMHandler) sendTemplate(c *gin.Context, statusCode int, name string) {
+	template, err := handlers.GetVMTemplate(h.api(c), name)
+	if err != nil {
+		sendResponse(c, statusCode, true, gin.H{"name": name}, "")
+		return
+	}
+	sendResponse(c, statusCode, true, template, "")
+}
+
+func sendTemplateError(c *gin.Context, prefix string, err error) {
+	statusCode := http.StatusInternalServerError
+	switch {
+	case strings.Contains(err.Error(), "already exists"):
+		statusCode = http.StatusConflict
+	case strings.Contains(err.Error(), "invalid"), strings.Contains(err.Error(), "required"):
+		statusCode = http.StatusBadRequest
+	case strings.Contains(err.Error(), "not found"):
+		statusCode = http.StatusNotFound
+	}
+	sendResponse(c, statusCode, false, nil, prefix+err.Error())
+}
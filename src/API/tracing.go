@@ -0,0 +1,52 @@
+package api
+
+import (
+	"errors"
+	"rm-thierry/Proxmox-API/src/auth"
+	"rm-thierry/Proxmox-API/src/logging"
+	"rm-thierry/Proxmox-API/src/tracing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracingMiddleware starts a server span per request, continuing the trace
+// of an incoming traceparent header. Handlers pass the request context on
+// to the API manager, so their steps and Proxmox calls become child spans
+func tracingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !tracing.Enabled() {
+			c.Next()
+			return
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		ctx, span := tracing.Tracer().Start(ctx, c.Request.Method+" "+c.Request.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(tracing.Attributes(
+				"http.method", c.Request.Method,
+				"http.target", c.Request.URL.Path,
+				"request_id", logging.RequestID(ctx))...))
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		span.SetName(c.Request.Method + " " + route)
+		span.SetAttributes(tracing.Attributes("http.route", route, "http.status_code", c.Writer.Status())...)
+		if principal := c.GetString(auth.PrincipalKey); principal != "" {
+			span.SetAttributes(tracing.Attributes("principal", principal)...)
+		}
+
+		var err error
+		if message := c.GetString(errorKey); message != "" && c.Writer.Status() >= 500 {
+			err = errors.New(message)
+		}
+		tracing.End(span, err)
+	}
+}
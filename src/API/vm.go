@@ -1,12 +1,16 @@
 package api
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"os"
 	"rm-thierry/Proxmox-API/src/auth"
 	"rm-thierry/Proxmox-API/src/handlers"
 	"rm-thierry/Proxmox-API/src/manager"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -23,24 +27,34 @@ type VMHandler struct {
 }
 
 type VMCreateRequest struct {
-	Node         string `json:"node"`
-	VMID         string `json:"vmid"`
-	Name         string `json:"name"`
-	Cores        int    `json:"cores"`
-	Memory       int    `json:"memory"`
-	Disk         string `json:"disk"`
-	Net          string `json:"net"`
-	ISO          string `json:"iso"`
-	OSType       string `json:"ostype"`
-	CPU          string `json:"cpu"`
-	Sockets      int    `json:"sockets"`
-	Template     string `json:"template,omitempty"`
-	CloudInit    bool   `json:"cloudinit,omitempty"`
-	SSHKeys      string `json:"sshkeys,omitempty"`
-	Nameserver   string `json:"nameserver,omitempty"`
-	Searchdomain string `json:"searchdomain,omitempty"`
-	Ciuser       string `json:"ciuser,omitempty"`
-	Cipassword   string `json:"cipassword,omitempty"`
+	Node         string   `json:"node"`
+	VMID         string   `json:"vmid"`
+	Name         string   `json:"name"`
+	Cores        int      `json:"cores"`
+	Memory       int      `json:"memory"`
+	Disk         string   `json:"disk"`
+	Net          string   `json:"net"`
+	ISO          string   `json:"iso"`
+	OSType       string   `json:"ostype"`
+	CPU          string   `json:"cpu"`
+	Sockets      int      `json:"sockets"`
+	Template     string   `json:"template,omitempty"`
+	CloudInit    bool     `json:"cloudinit,omitempty"`
+	SSHKeys      string   `json:"sshkeys,omitempty"`
+	Nameserver   string   `json:"nameserver,omitempty"`
+	Searchdomain string   `json:"searchdomain,omitempty"`
+	Ciuser       string   `json:"ciuser,omitempty"`
+	Cipassword   string   `json:"cipassword,omitempty"`
+	Placement    string   `json:"placement,omitempty"`
+	Affinity     []string `json:"affinity,omitempty"`
+	AntiAffinity []string `json:"anti_affinity,omitempty"`
+	Team         string   `json:"team,omitempty"`
+	WaitForIP    bool     `json:"wait_for_ip,omitempty"`
+	WaitTimeout  int      `json:"wait_timeout,omitempty"`
+	CloneType    string   `json:"clone_type,omitempty"`
+	DryRun       bool     `json:"dry_run,omitempty"`
+	// KeepOnFailure leaves the clone of a failed template deploy for debugging
+	KeepOnFailure bool `json:"keep_on_failure,omitempty"`
 }
 
 type VMCloneRequest struct {
@@ -49,47 +63,143 @@ type VMCloneRequest struct {
 	TargetNode string `json:"target_node"`
 	TargetVMID string `json:"target_vmid"`
 	Name       string `json:"name"`
+	// CloneType is "full", "linked" or empty for a full clone
+	CloneType   string `json:"clone_type,omitempty"`
+	Storage     string `json:"storage,omitempty"`
+	Format      string `json:"format,omitempty"`
+	Pool        string `json:"pool,omitempty"`
+	Description string `json:"description,omitempty"`
+	Snapshot    string `json:"snapshot,omitempty"`
+	BWLimit     int    `json:"bwlimit,omitempty"`
+	DryRun      bool   `json:"dry_run,omitempty"`
 }
 
 func NewVMHandler(apiManager *manager.APIManager) *VMHandler {
 	return &VMHandler{apiManager: apiManager}
 }
 
+// api returns the API manager for a request, so its Proxmox calls are
+// logged with the request
+func (h *VMHandler) api(c *gin.Context) *manager.APIManager {
+	return h.apiManager.WithContext(c.Request.Context())
+}
+
 func SetupRoutes(router *gin.Engine, apiManager *manager.APIManager, authService *auth.Service) {
 	corsConfig := cors.DefaultConfig()
 	corsConfig.AllowAllOrigins = true
-	corsConfig.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
-	corsConfig.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization"}
+	corsConfig.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	corsConfig.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization", "X-Request-ID", "traceparent"}
+	corsConfig.ExposeHeaders = []string{"X-Request-ID"}
+	router.Use(requestLogger())
+	router.Use(tracingMiddleware())
 	router.Use(cors.New(corsConfig))
+	router.Use(metricsMiddleware())
+
+	// Scraped without the API token, METRICS_TOKEN protects it if set
+	router.GET("/metrics", metricsHandler(os.Getenv("METRICS_TOKEN")))
+	registerHealthRoutes(router, apiManager, authService, os.Getenv("METRICS_TOKEN"))
 
 	handler := NewVMHandler(apiManager)
 
 	// Apply authentication middleware to all API routes
 	api := router.Group("/api/v1")
 	api.Use(authService.AuthMiddleware())
+	registerRoutes(api, handler)
+}
+
+// NewLocalRouter serves the API routes without authentication or CORS. The
+// CLI uses it to run commands in-process when no remote server is given
+func NewLocalRouter(apiManager *manager.APIManager) *gin.Engine {
+	router := gin.New()
+	registerRoutes(router.Group("/api/v1"), NewVMHandler(apiManager))
+	return router
+}
+
+func registerRoutes(api *gin.RouterGroup, handler *VMHandler) {
 	{
 		// VM operations
 		api.GET("/vms", handler.ListVMs)
 		api.POST("/vms", handler.CreateVM)
 		api.POST("/vms/template", handler.CreateVMFromTemplate)
 		api.POST("/vms/clone", handler.CloneVM)
+		api.POST("/vms/bulk/:action", handler.BulkVMOperation)
 		api.GET("/vms/:vmid", handler.GetVM)
 		api.DELETE("/vms/:vmid", handler.DeleteVM)
 		api.POST("/vms/:vmid/start", handler.StartVM)
 		api.POST("/vms/:vmid/stop", handler.StopVM)
 		api.POST("/vms/:vmid/reboot", handler.RebootVM)
+		api.POST("/vms/:vmid/shutdown", handler.ShutdownVM)
+		api.POST("/vms/:vmid/suspend", handler.SuspendVM)
+		api.POST("/vms/:vmid/resume", handler.ResumeVM)
+		api.POST("/vms/:vmid/reset", handler.ResetVM)
+		api.GET("/vms/:vmid/config", handler.GetVMConfig)
+		api.PATCH("/vms/:vmid/config", handler.UpdateVMConfig)
+
+		// QEMU guest agent
+		api.GET("/vms/:vmid/agent", handler.GetAgentStatus)
+		api.GET("/vms/:vmid/agent/network", handler.GetAgentNetwork)
+		api.GET("/vms/:vmid/agent/osinfo", handler.GetAgentOSInfo)
+		api.POST("/vms/:vmid/agent/exec", handler.AgentExec)
+		api.GET("/vms/:vmid/agent/exec/:pid", handler.AgentExecStatus)
+		api.GET("/vms/:vmid/agent/file", handler.AgentFileRead)
+		api.POST("/vms/:vmid/agent/file", handler.AgentFileWrite)
+		api.POST("/vms/:vmid/agent/fsfreeze/:action", handler.AgentFSFreeze)
+		api.POST("/vms/:vmid/agent/password", handler.AgentSetPassword)
+
+		// Container operations
+		api.GET("/containers", handler.ListContainers)
+		api.POST("/containers", handler.CreateContainer)
+		api.POST("/containers/bulk/:action", handler.BulkContainerOperation)
+		api.GET("/containers/templates", handler.GetContainerTemplates)
+		api.POST("/containers/templates/download", handler.DownloadContainerTemplate)
+		api.GET("/containers/:ctid", handler.GetContainer)
+		api.DELETE("/containers/:ctid", handler.DeleteContainer)
+		api.POST("/containers/:ctid/start", handler.StartContainer)
+		api.POST("/containers/:ctid/stop", handler.StopContainer)
+		api.GET("/containers/:ctid/config", handler.GetContainerConfig)
+		api.PATCH("/containers/:ctid/config", handler.UpdateContainerConfig)
+		api.PUT("/containers/:ctid/resize", handler.ResizeContainerDisk)
+		api.POST("/containers/:ctid/mountpoints", handler.AddContainerMountPoint)
 
 		// Resources and infrastructure
 		api.GET("/resources", handler.GetResources)
+		api.GET("/inventory", handler.GetInventory)
+		api.GET("/lookup", handler.LookupGuests)
+		api.GET("/bulk/:id", handler.GetBulkOperation)
+		api.GET("/tasks/:upid", handler.GetTask)
+		api.GET("/workflows", handler.ListWorkflows)
+		api.GET("/workflows/:id", handler.GetWorkflow)
+		api.POST("/environments", handler.Environment)
 		api.GET("/nodes", handler.GetNodes)
+		api.POST("/nodes/:node/evacuate", handler.EvacuateNode)
+		api.POST("/nodes/:node/return", handler.ReturnGuests)
 		api.GET("/storages", handler.GetStorages)
 		api.GET("/networks", handler.GetNetworks)
 		api.GET("/isos", handler.GetISOs)
 		api.GET("/templates", handler.GetTemplates)
+		api.GET("/templates/:name", handler.GetTemplate)
+		api.POST("/templates", handler.CreateTemplate)
+		api.POST("/templates/build", handler.BuildTemplate)
+		api.PUT("/templates/:name", handler.UpdateTemplate)
+		api.DELETE("/templates/:name", handler.DeleteTemplate)
+
+		// Webhooks
+		api.GET("/webhooks", handler.ListWebhooks)
+		api.POST("/webhooks", handler.CreateWebhook)
+		api.GET("/webhooks/:id", handler.GetWebhook)
+		api.PUT("/webhooks/:id", handler.UpdateWebhook)
+		api.DELETE("/webhooks/:id", handler.DeleteWebhook)
+		api.POST("/webhooks/:id/ping", handler.PingWebhook)
+		api.GET("/webhooks/:id/deliveries", handler.ListWebhookDeliveries)
+		api.GET("/webhooks/:id/deliveries/:delivery", handler.GetWebhookDelivery)
+		api.POST("/webhooks/:id/deliveries/:delivery/redeliver", handler.RedeliverWebhook)
 	}
 }
 
 func sendResponse(c *gin.Context, statusCode int, success bool, data interface{}, err string) {
+	if err != "" {
+		c.Set(errorKey, err)
+	}
 	c.JSON(statusCode, Response{
 		Success: success,
 		Data:    data,
@@ -98,8 +208,19 @@ func sendResponse(c *gin.Context, statusCode int, success bool, data interface{}
 }
 
 func (h *VMHandler) ListVMs(c *gin.Context) {
-	node := c.DefaultQuery("node", h.apiManager.Node)
-	vms, err := handlers.ListVMs(h.apiManager, node)
+	node := c.DefaultQuery("node", h.api(c).Node)
+
+	if hasInventoryQuery(c) {
+		items, err := handlers.ListVMItems(h.api(c), node)
+		if err != nil {
+			sendResponse(c, http.StatusInternalServerError, false, nil, "Failed to list VMs: "+err.Error())
+			return
+		}
+		sendQueriedList(c, items, "VMs")
+		return
+	}
+
+	vms, err := handlers.ListVMs(h.api(c), node)
 	if err != nil {
 		sendResponse(c, http.StatusInternalServerError, false, nil, "Failed to list VMs: "+err.Error())
 		return
@@ -115,28 +236,37 @@ func (h *VMHandler) CreateVM(c *gin.Context) {
 	}
 
 	if req.Node == "" {
-		req.Node = h.apiManager.Node
-	}
-
-	vm, err := handlers.CreateVM(h.apiManager, &handlers.VMCreateRequest{
-		Node:         req.Node,
-		VMID:         req.VMID,
-		Name:         req.Name,
-		Cores:        req.Cores,
-		Memory:       req.Memory,
-		Disk:         req.Disk,
-		Net:          req.Net,
-		ISO:          req.ISO,
-		OSType:       req.OSType,
-		CPU:          req.CPU,
-		Sockets:      req.Sockets,
-		Template:     req.Template,
-		CloudInit:    req.CloudInit,
-		SSHKeys:      req.SSHKeys,
-		Nameserver:   req.Nameserver,
-		Searchdomain: req.Searchdomain,
-		Ciuser:       req.Ciuser,
-		Cipassword:   req.Cipassword,
+		req.Node = h.api(c).Node
+	}
+
+	vm, err := handlers.CreateVM(h.api(c), &handlers.VMCreateRequest{
+		Node:          req.Node,
+		VMID:          req.VMID,
+		Name:          req.Name,
+		Cores:         req.Cores,
+		Memory:        req.Memory,
+		Disk:          req.Disk,
+		Net:           req.Net,
+		ISO:           req.ISO,
+		OSType:        req.OSType,
+		CPU:           req.CPU,
+		Sockets:       req.Sockets,
+		Template:      req.Template,
+		CloudInit:     req.CloudInit,
+		SSHKeys:       req.SSHKeys,
+		Nameserver:    req.Nameserver,
+		Searchdomain:  req.Searchdomain,
+		Ciuser:        req.Ciuser,
+		Cipassword:    req.Cipassword,
+		Placement:     req.Placement,
+		Affinity:      req.Affinity,
+		AntiAffinity:  req.AntiAffinity,
+		Team:          req.Team,
+		WaitForIP:     req.WaitForIP,
+		WaitTimeout:   req.WaitTimeout,
+		CloneType:     req.CloneType,
+		KeepOnFailure: req.KeepOnFailure,
+		DryRun:        req.DryRun || isDryRun(c),
 	})
 	if err != nil {
 		statusCode := http.StatusInternalServerError
@@ -152,7 +282,7 @@ func (h *VMHandler) CreateVM(c *gin.Context) {
 		return
 	}
 
-	sendResponse(c, http.StatusCreated, true, vm, "")
+	sendCreated(c, vm)
 }
 
 func (h *VMHandler) CreateVMFromTemplate(c *gin.Context) {
@@ -163,7 +293,7 @@ func (h *VMHandler) CreateVMFromTemplate(c *gin.Context) {
 	}
 
 	if req.Node == "" {
-		req.Node = h.apiManager.Node
+		req.Node = h.api(c).Node
 	}
 
 	if req.Template == "" {
@@ -175,21 +305,30 @@ func (h *VMHandler) CreateVMFromTemplate(c *gin.Context) {
 	// This ensures the CloudInit settings will be applied
 	req.CloudInit = true
 
-	vm, err := handlers.CreateVMFromTemplate(h.apiManager, &handlers.VMCreateRequest{
-		Node:         req.Node,
-		VMID:         req.VMID,
-		Name:         req.Name,
-		Cores:        req.Cores,
-		Memory:       req.Memory,
-		Disk:         req.Disk,
-		Net:          req.Net,
-		Template:     req.Template,
-		CloudInit:    req.CloudInit,
-		SSHKeys:      req.SSHKeys,
-		Nameserver:   req.Nameserver,
-		Searchdomain: req.Searchdomain,
-		Ciuser:       req.Ciuser,
-		Cipassword:   req.Cipassword,
+	vm, err := handlers.CreateVMFromTemplate(h.api(c), &handlers.VMCreateRequest{
+		Node:          req.Node,
+		VMID:          req.VMID,
+		Name:          req.Name,
+		Cores:         req.Cores,
+		Memory:        req.Memory,
+		Disk:          req.Disk,
+		Net:           req.Net,
+		Template:      req.Template,
+		CloudInit:     req.CloudInit,
+		SSHKeys:       req.SSHKeys,
+		Nameserver:    req.Nameserver,
+		Searchdomain:  req.Searchdomain,
+		Ciuser:        req.Ciuser,
+		Cipassword:    req.Cipassword,
+		Placement:     req.Placement,
+		Affinity:      req.Affinity,
+		AntiAffinity:  req.AntiAffinity,
+		Team:          req.Team,
+		WaitForIP:     req.WaitForIP,
+		WaitTimeout:   req.WaitTimeout,
+		CloneType:     req.CloneType,
+		DryRun:        req.DryRun || isDryRun(c),
+		KeepOnFailure: req.KeepOnFailure,
 	})
 	if err != nil {
 		statusCode := http.StatusInternalServerError
@@ -203,23 +342,27 @@ func (h *VMHandler) CreateVMFromTemplate(c *gin.Context) {
 		case strings.Contains(err.Error(), "template"):
 			statusCode = http.StatusBadRequest
 		}
-		sendResponse(c, statusCode, false, nil, "Failed to create VM from template: "+err.Error())
+
+		// Say which steps succeeded and what was cleaned up
+		var data interface{}
+		var deployErr *handlers.DeployError
+		if errors.As(err, &deployErr) {
+			data = deployErr
+		}
+		sendResponse(c, statusCode, false, data, "Failed to create VM from template: "+err.Error())
 		return
 	}
 
-	sendResponse(c, http.StatusCreated, true, vm, "")
+	sendCreated(c, vm)
 }
 
 func (h *VMHandler) GetVM(c *gin.Context) {
-	node := c.DefaultQuery("node", h.apiManager.Node)
-	vmid := c.Param("vmid")
-
-	if _, err := strconv.Atoi(vmid); err != nil {
-		sendResponse(c, http.StatusBadRequest, false, nil, "VMID must be a number")
+	guest, ok := h.resolveGuest(c, "vmid", "qemu")
+	if !ok {
 		return
 	}
 
-	vm, err := handlers.GetVM(h.apiManager, node, vmid)
+	vm, err := handlers.GetVM(h.api(c), guest.Node, guest.VMID)
 	if err != nil {
 		statusCode := http.StatusInternalServerError
 		if strings.Contains(err.Error(), "not found") {
@@ -232,16 +375,73 @@ func (h *VMHandler) GetVM(c *gin.Context) {
 	sendResponse(c, http.StatusOK, true, vm, "")
 }
 
+func (h *VMHandler) GetVMConfig(c *gin.Context) {
+	guest, ok := h.resolveGuest(c, "vmid", "qemu")
+	if !ok {
+		return
+	}
+
+	config, err := handlers.GetVMConfig(h.api(c), guest.Node, guest.VMID)
+	if err != nil {
+		sendResponse(c, http.StatusInternalServerError, false, nil, "Failed to get VM config: "+err.Error())
+		return
+	}
+
+	sendResponse(c, http.StatusOK, true, config, "")
+}
+
+func (h *VMHandler) UpdateVMConfig(c *gin.Context) {
+	guest, ok := h.resolveGuest(c, "vmid", "qemu")
+	if !ok {
+		return
+	}
+
+	var options map[string]interface{}
+	if err := c.ShouldBindJSON(&options); err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, "Invalid request: "+err.Error())
+		return
+	}
+
+	var result map[string]interface{}
+	var err error
+	if isDryRun(c) {
+		result, err = handlers.UpdateVMConfigDryRun(h.api(c), guest.Node, guest.VMID, options)
+	} else {
+		result, err = handlers.UpdateVMConfig(h.api(c), guest.Node, guest.VMID, options)
+	}
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		if strings.Contains(err.Error(), "invalid") || strings.Contains(err.Error(), "no configuration") {
+			statusCode = http.StatusBadRequest
+		}
+		sendResponse(c, statusCode, false, nil, "Failed to update VM config: "+err.Error())
+		return
+	}
+
+	sendResponse(c, http.StatusOK, true, result, "")
+}
+
 func (h *VMHandler) DeleteVM(c *gin.Context) {
-	node := c.DefaultQuery("node", h.apiManager.Node)
-	vmid := c.Param("vmid")
+	guest, ok := h.resolveGuest(c, "vmid", "qemu")
+	if !ok {
+		return
+	}
 
-	if _, err := strconv.Atoi(vmid); err != nil {
-		sendResponse(c, http.StatusBadRequest, false, nil, "VMID must be a number")
+	if isDryRun(c) {
+		result, err := handlers.DeleteVMDryRun(h.api(c), guest.Node, guest.VMID)
+		if err != nil {
+			statusCode := http.StatusInternalServerError
+			if strings.Contains(err.Error(), "not found") {
+				statusCode = http.StatusNotFound
+			}
+			sendResponse(c, statusCode, false, nil, "Failed to delete VM: "+err.Error())
+			return
+		}
+		sendResponse(c, http.StatusOK, true, result, "")
 		return
 	}
 
-	if err := handlers.DeleteVM(h.apiManager, node, vmid); err != nil {
+	if err := handlers.DeleteVM(h.api(c), guest.Node, guest.VMID); err != nil {
 		statusCode := http.StatusInternalServerError
 		if strings.Contains(err.Error(), "not found") {
 			statusCode = http.StatusNotFound
@@ -265,27 +465,79 @@ func (h *VMHandler) RebootVM(c *gin.Context) {
 	h.handleVMOperation(c, "reboot")
 }
 
+func (h *VMHandler) ShutdownVM(c *gin.Context) {
+	h.handleVMOperation(c, "shutdown")
+}
+
+func (h *VMHandler) SuspendVM(c *gin.Context) {
+	h.handleVMOperation(c, "suspend")
+}
+
+func (h *VMHandler) ResumeVM(c *gin.Context) {
+	h.handleVMOperation(c, "resume")
+}
+
+func (h *VMHandler) ResetVM(c *gin.Context) {
+	h.handleVMOperation(c, "reset")
+}
+
+// isDryRun reports whether the request asks to validate only. Mutating
+// handlers then return the Proxmox calls they would make
+func isDryRun(c *gin.Context) bool {
+	return c.Query("dry_run") == "true"
+}
+
+// sendCreated answers a create request, with 200 instead of 201 for dry runs
+func sendCreated(c *gin.Context, result map[string]interface{}) {
+	if dryRun, _ := result["dry_run"].(bool); dryRun {
+		sendResponse(c, http.StatusOK, true, result, "")
+		return
+	}
+	sendResponse(c, http.StatusCreated, true, result, "")
+}
+
+// parsePowerOptions reads timeout, force_stop, todisk, wait and
+// wait_timeout from the query string
+func parsePowerOptions(c *gin.Context) (handlers.PowerOptions, error) {
+	var opts handlers.PowerOptions
+
+	if timeout := c.Query("timeout"); timeout != "" {
+		n, err := strconv.Atoi(timeout)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("timeout must be a non-negative number of seconds")
+		}
+		opts.Timeout = n
+	}
+	if waitTimeout := c.Query("wait_timeout"); waitTimeout != "" {
+		n, err := strconv.Atoi(waitTimeout)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("wait_timeout must be a non-negative number of seconds")
+		}
+		opts.WaitTimeout = time.Duration(n) * time.Second
+	}
+
+	opts.ForceStop = c.Query("force_stop") == "true"
+	opts.ToDisk = c.Query("todisk") == "true"
+	opts.Wait = c.Query("wait") == "true"
+	return opts, nil
+}
+
 func (h *VMHandler) handleVMOperation(c *gin.Context, operation string) {
-	// Get node and VMID from request
-	node := c.DefaultQuery("node", h.apiManager.Node)
-	vmid := c.Param("vmid")
+	// Resolve the VM from its ID or name
+	guest, ok := h.resolveGuest(c, "vmid", "qemu")
+	if !ok {
+		return
+	}
+	node, vmid := guest.Node, guest.VMID
 
-	// Validate VMID
-	if _, err := strconv.Atoi(vmid); err != nil {
-		sendResponse(c, http.StatusBadRequest, false, nil, "VMID must be a number")
+	opts, err := parsePowerOptions(c)
+	if err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, err.Error())
 		return
 	}
 
 	// Perform the operation
-	var err error
-	switch operation {
-	case "start":
-		err = handlers.StartVM(h.apiManager, node, vmid)
-	case "stop":
-		err = handlers.StopVM(h.apiManager, node, vmid)
-	case "reboot":
-		err = handlers.RebootVM(h.apiManager, node, vmid)
-	}
+	result, err := handlers.VMPowerOperation(h.api(c), node, vmid, operation, opts)
 
 	// Handle errors
 	if err != nil {
@@ -293,17 +545,17 @@ func (h *VMHandler) handleVMOperation(c *gin.Context, operation string) {
 		if strings.Contains(err.Error(), "not found") {
 			statusCode = http.StatusNotFound
 		}
-		sendResponse(c, statusCode, false, nil, "Failed to "+operation+" VM: "+err.Error())
+		sendResponse(c, statusCode, false, result, "Failed to "+operation+" VM: "+err.Error())
 		return
 	}
 
 	// Return success response
-	sendResponse(c, http.StatusOK, true, nil, "VM "+operation+" operation successful")
+	sendResponse(c, http.StatusOK, true, result, "VM "+operation+" operation successful")
 }
 
 func (h *VMHandler) GetResources(c *gin.Context) {
-	node := c.DefaultQuery("node", h.apiManager.Node)
-	resources, err := handlers.GetResources(h.apiManager, node)
+	node := c.DefaultQuery("node", h.api(c).Node)
+	resources, err := handlers.GetResources(h.api(c), node)
 	if err != nil {
 		sendResponse(c, http.StatusInternalServerError, false, nil,
 			"Failed to get resources: "+err.Error())
@@ -313,7 +565,7 @@ func (h *VMHandler) GetResources(c *gin.Context) {
 }
 
 func (h *VMHandler) GetNodes(c *gin.Context) {
-	nodes, err := handlers.GetNodes(h.apiManager)
+	nodes, err := handlers.GetNodes(h.api(c))
 	if err != nil {
 		sendResponse(c, http.StatusInternalServerError, false, nil,
 			"Failed to get nodes: "+err.Error())
@@ -323,8 +575,8 @@ func (h *VMHandler) GetNodes(c *gin.Context) {
 }
 
 func (h *VMHandler) GetStorages(c *gin.Context) {
-	node := c.DefaultQuery("node", h.apiManager.Node)
-	storages, err := handlers.GetStorages(h.apiManager, node)
+	node := c.DefaultQuery("node", h.api(c).Node)
+	storages, err := handlers.GetStorages(h.api(c), node)
 	if err != nil {
 		sendResponse(c, http.StatusInternalServerError, false, nil,
 			"Failed to get storages: "+err.Error())
@@ -334,8 +586,8 @@ func (h *VMHandler) GetStorages(c *gin.Context) {
 }
 
 func (h *VMHandler) GetNetworks(c *gin.Context) {
-	node := c.DefaultQuery("node", h.apiManager.Node)
-	networks, err := handlers.GetNetworks(h.apiManager, node)
+	node := c.DefaultQuery("node", h.api(c).Node)
+	networks, err := handlers.GetNetworks(h.api(c), node)
 	if err != nil {
 		sendResponse(c, http.StatusInternalServerError, false, nil,
 			"Failed to get networks: "+err.Error())
@@ -353,14 +605,23 @@ func (h *VMHandler) CloneVM(c *gin.Context) {
 
 	// Set default values if not provided
 	if req.SourceNode == "" {
-		req.SourceNode = h.apiManager.Node
+		req.SourceNode = h.api(c).Node
 	}
 	if req.TargetNode == "" {
-		req.TargetNode = h.apiManager.Node
+		req.TargetNode = h.api(c).Node
 	}
 
 	// Clone the VM
-	result, err := handlers.CloneVM(h.apiManager, req.SourceNode, req.SourceVMID, req.TargetNode, req.TargetVMID, req.Name)
+	result, err := handlers.CloneVM(h.api(c), req.SourceNode, req.SourceVMID, req.TargetNode, req.TargetVMID, req.Name, handlers.CloneOptions{
+		CloneType:   req.CloneType,
+		Storage:     req.Storage,
+		Format:      req.Format,
+		Pool:        req.Pool,
+		Description: req.Description,
+		Snapshot:    req.Snapshot,
+		BWLimit:     req.BWLimit,
+		DryRun:      req.DryRun || isDryRun(c),
+	})
 	if err != nil {
 		statusCode := http.StatusInternalServerError
 		switch {
@@ -375,22 +636,12 @@ func (h *VMHandler) CloneVM(c *gin.Context) {
 		return
 	}
 
-	sendResponse(c, http.StatusCreated, true, result, "")
-}
-
-func (h *VMHandler) GetTemplates(c *gin.Context) {
-	templates, err := handlers.GetVMTemplates()
-	if err != nil {
-		sendResponse(c, http.StatusInternalServerError, false, nil,
-			"Failed to get templates: "+err.Error())
-		return
-	}
-	sendResponse(c, http.StatusOK, true, templates, "")
+	sendCreated(c, result)
 }
 
 func (h *VMHandler) GetISOs(c *gin.Context) {
-	node := c.DefaultQuery("node", h.apiManager.Node)
-	isos, err := handlers.GetISOs(h.apiManager, node)
+	node := c.DefaultQuery("node", h.api(c).Node)
+	isos, err := handlers.GetISOs(h.api(c), node)
 	if err != nil {
 		sendResponse(c, http.StatusInternalServerError, false, nil,
 			"Failed to get ISOs: "+err.Error())
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"net/http"
+	"rm-thierry/Proxmox-API/src/handlers"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *VMHandler) ListWebhooks(c *gin.Context) {
+	webhooks, err := handlers.ListWebhooks()
+	if err != nil {
+		sendWebhookError(c, "Failed to list webhooks: ", err)
+		return
+	}
+	sendResponse(c, http.StatusOK, true, webhooks, "")
+}
+
+func (h *VMHandler) GetWebhook(c *gin.Context) {
+	webhook, err := handlers.GetWebhook(c.Param("id"))
+	if err != nil {
+		sendWebhookError(c, "Failed to get webhook: ", err)
+		return
+	}
+	sendResponse(c, http.StatusOK, true, webhook, "")
+}
+
+// CreateWebhook responds with the signing secret, which is not shown again
+func (h *VMHandler) CreateWebhook(c *gin.Context) {
+	var req handlers.WebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, "Invalid request: "+err.Error())
+		return
+	}
+
+	webhook, err := handlers.CreateWebhook(&req)
+	if err != nil {
+		sendWebhookError(c, "Failed to create webhook: ", err)
+		return
+	}
+	sendResponse(c, http.StatusCreated, true, webhook, "")
+}
+
+func (h *VMHandler) UpdateWebhook(c *gin.Context) {
+	var req handlers.WebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		sendResponse(c, http.StatusBadRequest, false, nil, "Invalid request: "+err.Error())
+		return
+	}
+
+	webhook, err := handlers.UpdateWebhook(c.Param("id"), &req)
+	if err != nil {
+		sendWebhookError(c, "Failed to update webhook: ", err)
+		return
+	}
+	sendResponse(c, http.StatusOK, true, webhook, "")
+}
+
+func (h *VMHandler) DeleteWebhook(c *gin.Context) {
+	if err := handlers.DeleteWebhook(c.Param("id")); err != nil {
+		sendWebhookError(c, "Failed to delete webhook: ", err)
+		return
+	}
+	sendResponse(c, http.StatusOK, true, gin.H{"message": "Webhook deleted"}, "")
+}
+
+// PingWebhook queues a ping event to check the receiver and its signature
+// verification
+func (h *VMHandler) PingWebhook(c *gin.Context) {
+	delivery, err := handlers.PingWebhook(c.Param("id"))
+	if err != nil {
+		sendWebhookError(c, "Failed to ping webhook: ", err)
+		return
+	}
+	sendResponse(c, http.StatusAccepted, true, delivery, "")
+}
+
+// ListWebhookDeliveries shows the delivery log of a webhook, filtered by
+// ?status=pending|delivered|failed and limited by ?limit (default 100)
+func (h *VMHandler) ListWebhookDeliveries(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	deliveries, err := handlers.ListDeliveries(c.Param("id"), c.Query("status"), limit)
+	if err != nil {
+		sendWebhookError(c, "Failed to list deliveries: ", err)
+		return
+	}
+	sendResponse(c, http.StatusOK, true, deliveries, "")
+}
+
+func (h *VMHandler) GetWebhookDelivery(c *gin.Context) {
+	delivery, err := handlers.GetDelivery(c.Param("id"), c.Param("delivery"))
+	if err != nil {
+		sendWebhookError(c, "Failed to get delivery: ", err)
+		return
+	}
+	sendResponse(c, http.StatusOK, true, delivery, "")
+}
+
+// RedeliverWebhook sends the event of a delivery again as a new delivery
+func (h *VMHandler) RedeliverWebhook(c *gin.Context) {
+	delivery, err := handlers.Redeliver(c.Param("id"), c.Param("delivery"))
+	if err != nil {
+		sendWebhookError(c, "Failed to redeliver: ", err)
+		return
+	}
+	sendResponse(c, http.StatusAccepted, true, delivery, "")
+}
+
+func sendWebhookError(c *gin.Context, prefix string, err error) {
+	statusCode := http.StatusInternalServerError
+	switch {
+	case strings.Contains(err.Error(), "invalid"):
+		statusCode = http.StatusBadRequest
+	case strings.Contains(err.Error(), "not found"):
+		statusCode = http.StatusNotFound
+	}
+	sendResponse(c, statusCode, false, nil, prefix+err.Error())
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"net/http"
+	"rm-thierry/Proxmox-API/src/handlers"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListWorkflows shows the journaled multi-step operations, filtered by
+// ?status=running|completed|failed|rolled_back
+func (h *VMHandler) ListWorkflows(c *gin.Context) {
+	workflows, err := handlers.ListWorkflows()
+	if err != nil {
+		sendResponse(c, http.StatusInternalServerError, false, nil, "Failed to list workflows: "+err.Error())
+		return
+	}
+
+	if status := c.Query("status"); status != "" {
+		filtered := make([]handlers.Workflow, 0, len(workflows))
+		for _, wf := range workflows {
+			if wf.Status == status {
+				filtered = append(filtered, wf)
+			}
+		}
+		workflows = filtered
+	}
+	sendResponse(c, http.StatusOK, true, workflows, "")
+}
+
+func (h *VMHandler) GetWorkflow(c *gin.Context) {
+	wf, err := handlers.GetWorkflow(c.Param("id"))
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		if strings.Contains(err.Error(), "not found") {
+			statusCode = http.StatusNotFound
+		}
+		sendResponse(c, statusCode, false, nil, err.Error())
+		return
+	}
+	sendResponse(c, http.StatusOK, true, wf, "")
+}
@@ -1,17 +1,34 @@
 package auth
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
+	"rm-thierry/Proxmox-API/src/metrics"
 
 	"github.com/gin-gonic/gin"
 )
 
+// PrincipalKey is the gin context key of the authenticated caller
+const PrincipalKey = "principal"
+
+// Principal names the caller of a valid token in logs without revealing it
+func Principal(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:4])
+}
+
 // AuthMiddleware creates middleware for API token authentication
 func (s *Service) AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Extract token from header
 		tokenString, err := ExtractTokenFromHeader(c)
 		if err != nil {
+			reason := "malformed_header"
+			if c.GetHeader("Authorization") == "" {
+				reason = "missing_header"
+			}
+			metrics.AuthFailures.WithLabelValues(reason).Inc()
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"success": false,
 				"error":   "unauthorized: " + err.Error(),
@@ -23,6 +40,7 @@ func (s *Service) AuthMiddleware() gin.HandlerFunc {
 		// Validate token
 		err = s.ValidateToken(tokenString)
 		if err != nil {
+			metrics.AuthFailures.WithLabelValues("invalid_token").Inc()
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"success": false,
 				"error":   "unauthorized: invalid token",
@@ -31,6 +49,7 @@ func (s *Service) AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		c.Set(PrincipalKey, Principal(tokenString))
 		c.Next()
 	}
 }
@@ -0,0 +1,132 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	api "rm-thierry/Proxmox-API/src/API"
+	"rm-thierry/Proxmox-API/src/manager"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Backend sends a request to the REST API and returns the "data" field of
+// the response. The data is returned together with the error when the
+// server sent both, e.g. for partially failed bulk operations
+type Backend interface {
+	Call(method, path string, query url.Values, body interface{}) (interface{}, error)
+}
+
+type envelope struct {
+	Success bool        `json:"success"`
+	Data    interface{} `json:"data"`
+	Error   string      `json:"error"`
+}
+
+// localBackend runs the API handlers in-process, talking to Proxmox
+// directly with the credentials from env/.env
+type localBackend struct {
+	router http.Handler
+}
+
+func newLocalBackend() (*localBackend, error) {
+	apiManager := manager.NewAPIManager()
+	if apiManager.TokenID == "" || apiManager.TokenSecret == "" {
+		return nil, fmt.Errorf("Proxmox API credentials not found, set PROXMOX_TOKEN_ID and PROXMOX_TOKEN_SECRET or use --remote")
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	return &localBackend{router: api.NewLocalRouter(apiManager)}, nil
+}
+
+func (b *localBackend) Call(method, path string, query url.Values, body interface{}) (interface{}, error) {
+	req, err := newRequest(method, "/api/v1"+path, query, body)
+	if err != nil {
+		return nil, err
+	}
+
+	recorder := httptest.NewRecorder()
+	b.router.ServeHTTP(recorder, req)
+	return decodeEnvelope(recorder.Code, recorder.Body.Bytes())
+}
+
+// remoteBackend calls a running instance of the API server
+type remoteBackend struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func newRemoteBackend(baseURL, token string) *remoteBackend {
+	return &remoteBackend{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: 30 * time.Minute},
+	}
+}
+
+func (b *remoteBackend) Call(method, path string, query url.Values, body interface{}) (interface{}, error) {
+	req, err := newRequest(method, b.baseURL+"/api/v1"+path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.token)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	return decodeEnvelope(resp.StatusCode, data)
+}
+
+func newRequest(method, target string, query url.Values, body interface{}) (*http.Request, error) {
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+func decodeEnvelope(status int, data []byte) (interface{}, error) {
+	var resp envelope
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("unexpected response (HTTP %d): %s", status, strings.TrimSpace(string(data)))
+	}
+
+	if !resp.Success || status >= 300 {
+		message := resp.Error
+		if message == "" {
+			message = fmt.Sprintf("request failed with HTTP %d", status)
+		}
+		return resp.Data, fmt.Errorf("%s", message)
+	}
+	return resp.Data, nil
+}
@@ -0,0 +1,547 @@
+// Package cli implements the proxmox-api command line client. Commands map
+// onto the REST API and either run its handlers in-process or call a
+// remote instance of the server
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"rm-thierry/Proxmox-API/src/logging"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Options holds the flags shared by all commands
+type Options struct {
+	Output  string
+	Node    string
+	Cluster bool
+	File    string
+	Set     []string
+	Wait    bool
+	DryRun  bool
+	Timeout int
+	Remote  string
+	Token   string
+}
+
+type command struct {
+	group   string
+	name    string
+	args    string
+	summary string
+	// columns shown first in table output
+	columns []string
+	// minArgs is the number of positional arguments required
+	minArgs int
+	// dryRun is set for commands that support --dry-run
+	dryRun bool
+	run    func(ctx *context, args []string) (interface{}, error)
+}
+
+type context struct {
+	backend Backend
+	opts    *Options
+}
+
+var (
+	guestColumns    = []string{"vmid", "name", "node", "status", "cpus", "maxmem", "tags"}
+	nodeColumns     = []string{"node", "status", "cpu", "maxcpu", "mem", "maxmem", "uptime"}
+	storageColumns  = []string{"storage", "type", "content", "active", "avail", "total"}
+	templateColumns = []string{"name", "os", "version", "vmids", "match", "curated"}
+	taskColumns     = []string{"upid", "node", "type", "status", "exitstatus"}
+	bulkColumns     = []string{"vmid", "name", "node", "group", "status", "task_id", "error"}
+)
+
+var commands = []*command{
+	{group: "vm", name: "list", summary: "List VMs on a node, or the whole cluster with --cluster", columns: guestColumns, run: listGuests("qemu", "/vms")},
+	{group: "vm", name: "get", args: "<vmid|name>", summary: "Show the status of a VM", minArgs: 1, run: getPath("/vms/")},
+	{group: "vm", name: "create", summary: "Create a VM from -f and --set fields", dryRun: true, run: createVM},
+	{group: "vm", name: "clone", args: "<source-vmid>", summary: "Clone a VM or template", minArgs: 1, dryRun: true, run: cloneVM},
+	{group: "vm", name: "delete", args: "<vmid|name>", summary: "Delete a VM", minArgs: 1, dryRun: true, run: deletePath("/vms/")},
+	{group: "vm", name: "start", args: "<vmid|name>", summary: "Start a VM", minArgs: 1, run: guestAction("/vms/", "start")},
+	{group: "vm", name: "stop", args: "<vmid|name>", summary: "Stop a VM", minArgs: 1, run: guestAction("/vms/", "stop")},
+	{group: "vm", name: "shutdown", args: "<vmid|name>", summary: "Shut down a VM through ACPI", minArgs: 1, run: guestAction("/vms/", "shutdown")},
+	{group: "vm", name: "reboot", args: "<vmid|name>", summary: "Reboot a VM", minArgs: 1, run: guestAction("/vms/", "reboot")},
+	{group: "vm", name: "suspend", args: "<vmid|name>", summary: "Suspend a VM", minArgs: 1, run: guestAction("/vms/", "suspend")},
+	{group: "vm", name: "resume", args: "<vmid|name>", summary: "Resume a suspended VM", minArgs: 1, run: guestAction("/vms/", "resume")},
+	{group: "vm", name: "reset", args: "<vmid|name>", summary: "Reset a VM", minArgs: 1, run: guestAction("/vms/", "reset")},
+	{group: "vm", name: "bulk", args: "<action>", summary: "Run an action on the VMs selected by -f and --set", minArgs: 1, dryRun: true, columns: bulkColumns, run: bulkAction("/vms/bulk/")},
+	{group: "vm", name: "config", args: "<vmid|name>", summary: "Show a VM's config, or change it with --set", minArgs: 1, dryRun: true, run: guestConfig("/vms/")},
+
+	{group: "ct", name: "list", summary: "List containers on a node, or the whole cluster with --cluster", columns: guestColumns, run: listGuests("lxc", "/containers")},
+	{group: "ct", name: "get", args: "<ctid|name>", summary: "Show the status of a container", minArgs: 1, run: getPath("/containers/")},
+	{group: "ct", name: "create", summary: "Create a container from -f and --set fields", dryRun: true, run: createContainer},
+	{group: "ct", name: "delete", args: "<ctid|name>", summary: "Delete a container", minArgs: 1, dryRun: true, run: deletePath("/containers/")},
+	{group: "ct", name: "start", args: "<ctid|name>", summary: "Start a container", minArgs: 1, run: guestAction("/containers/", "start")},
+	{group: "ct", name: "stop", args: "<ctid|name>", summary: "Stop a container", minArgs: 1, run: guestAction("/containers/", "stop")},
+	{group: "ct", name: "config", args: "<ctid|name>", summary: "Show a container's config, or change it with --set", minArgs: 1, dryRun: true, run: guestConfig("/containers/")},
+	{group: "ct", name: "bulk", args: "<action>", summary: "Run an action on the containers selected by -f and --set", minArgs: 1, dryRun: true, columns: bulkColumns, run: bulkAction("/containers/bulk/")},
+	{group: "ct", name: "templates", summary: "List container templates and downloadable appliances", columns: []string{"name", "version", "storage", "volid", "section"}, run: listContainerTemplates},
+
+	{group: "node", name: "list", summary: "List cluster nodes", columns: nodeColumns, run: getStatic("/nodes")},
+	{group: "node", name: "evacuate", args: "<node>", summary: "Migrate all guests off a node", minArgs: 1, dryRun: true, run: nodeAction("evacuate")},
+	{group: "node", name: "return", args: "<node>", summary: "Move evacuated guests back to a node", minArgs: 1, dryRun: true, run: nodeAction("return")},
+
+	{group: "storage", name: "list", summary: "List storages of a node", columns: storageColumns, run: getOnNode("/storages")},
+	{group: "storage", name: "isos", summary: "List ISO images of a node", columns: []string{"volid", "storage", "size"}, run: getOnNode("/isos")},
+
+	{group: "template", name: "list", summary: "List VM templates", columns: templateColumns, run: getStatic("/templates")},
+	{group: "template", name: "get", args: "<name>", summary: "Show a VM template", minArgs: 1, run: getPath("/templates/")},
+	{group: "template", name: "delete", args: "<name>", summary: "Remove a VM template from the registry", minArgs: 1, run: deletePath("/templates/")},
+	{group: "template", name: "build", summary: "Build a VM template from a cloud image", run: buildTemplate},
+
+	{group: "task", name: "status", args: "<upid>", summary: "Show the status of a task", minArgs: 1, columns: taskColumns, run: taskStatus(false)},
+	{group: "task", name: "wait", args: "<upid>", summary: "Wait for a task to finish", minArgs: 1, columns: taskColumns, run: taskStatus(true)},
+}
+
+// Run executes the command given by args and returns the exit code
+func Run(args []string) int {
+	return run(args, os.Stdout, os.Stderr)
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	opts := &Options{}
+	fs := newFlagSet(opts, stderr)
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	// A --token given on the command line is redacted like API_TOKEN
+	logging.AddSecret(opts.Token)
+
+	if len(positional) == 0 || positional[0] == "help" {
+		printUsage(stdout)
+		return 0
+	}
+
+	if positional[0] == "completion" {
+		if len(positional) < 2 {
+			fmt.Fprintln(stderr, "Error: completion requires a shell: bash, zsh or fish")
+			return 2
+		}
+		if err := writeCompletion(stdout, positional[1]); err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return 2
+		}
+		return 0
+	}
+
+	cmd := findCommand(positional)
+	if cmd == nil {
+		fmt.Fprintf(stderr, "Error: unknown command '%s'\n\n", strings.Join(positional, " "))
+		printUsage(stderr)
+		return 2
+	}
+
+	cmdArgs := positional[2:]
+	if len(cmdArgs) < cmd.minArgs {
+		fmt.Fprintf(stderr, "Usage: %s %s %s\n", cmd.group, cmd.name, cmd.args)
+		return 2
+	}
+	if opts.DryRun && !cmd.dryRun {
+		fmt.Fprintf(stderr, "Error: %s %s does not support --dry-run\n", cmd.group, cmd.name)
+		return 2
+	}
+
+	var backend Backend
+	if opts.Remote != "" {
+		backend = newRemoteBackend(opts.Remote, opts.Token)
+	} else {
+		local, err := newLocalBackend()
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return 1
+		}
+		backend = local
+	}
+
+	data, err := cmd.run(&context{backend: backend, opts: opts}, cmdArgs)
+	if data != nil {
+		if printErr := printResult(stdout, data, opts.Output, cmd.columns); printErr != nil {
+			fmt.Fprintln(stderr, "Error:", printErr)
+			return 2
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func newFlagSet(opts *Options, output io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("proxmox-api", flag.ContinueOnError)
+	fs.SetOutput(output)
+
+	fs.StringVar(&opts.Output, "o", "table", "Output format: table, json or yaml")
+	fs.StringVar(&opts.Output, "output", "table", "Output format: table, json or yaml")
+	fs.StringVar(&opts.Node, "node", "", "Node to operate on (default NODE)")
+	fs.BoolVar(&opts.Cluster, "cluster", false, "List guests of the whole cluster")
+	fs.StringVar(&opts.File, "f", "", "Request body as a YAML or JSON file, - for stdin")
+	fs.StringVar(&opts.File, "file", "", "Request body as a YAML or JSON file, - for stdin")
+	fs.Var((*stringList)(&opts.Set), "set", "Set a field as key=value, may be repeated")
+	fs.BoolVar(&opts.Wait, "wait", false, "Wait for the task to finish")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "Validate and print the Proxmox calls without making them")
+	fs.IntVar(&opts.Timeout, "timeout", 0, "Seconds to wait for a task")
+	fs.StringVar(&opts.Remote, "remote", os.Getenv("API_SERVER"), "URL of a running API server instead of calling Proxmox directly")
+	fs.StringVar(&opts.Token, "token", os.Getenv("API_TOKEN"), "Bearer token for --remote")
+	fs.Usage = func() { printUsage(output) }
+	return fs
+}
+
+// parseArgs parses flags anywhere on the command line, so they may follow
+// the subcommand and its arguments
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func findCommand(positional []string) *command {
+	if len(positional) < 2 {
+		return nil
+	}
+	for _, cmd := range commands {
+		if cmd.group == positional[0] && cmd.name == positional[1] {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: proxmox-api <command> <subcommand> [arguments] [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands {
+		usage := strings.TrimSpace(cmd.group + " " + cmd.name + " " + cmd.args)
+		fmt.Fprintf(w, "  %-32s %s\n", usage, cmd.summary)
+	}
+	fmt.Fprintf(w, "  %-32s %s\n", "completion <bash|zsh|fish>", "Print a shell completion script")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Flags:")
+	fs := newFlagSet(&Options{}, w)
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "o" || f.Name == "f" {
+			return
+		}
+		fmt.Fprintf(w, "  --%-12s %s\n", f.Name, f.Usage)
+	})
+}
+
+// stringList collects a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// nodeQuery returns the query string for --node
+func (ctx *context) nodeQuery() url.Values {
+	query := url.Values{}
+	if ctx.opts.Node != "" {
+		query.Set("node", ctx.opts.Node)
+	}
+	return query
+}
+
+// mutationQuery adds --dry-run to query
+func (ctx *context) mutationQuery(query url.Values) url.Values {
+	if ctx.opts.DryRun {
+		query.Set("dry_run", "true")
+	}
+	return query
+}
+
+// waitQuery adds --wait and --timeout to query
+func (ctx *context) waitQuery(query url.Values) url.Values {
+	if ctx.opts.Wait {
+		query.Set("wait", "true")
+	}
+	if ctx.opts.Timeout > 0 {
+		query.Set("wait_timeout", strconv.Itoa(ctx.opts.Timeout))
+	}
+	return query
+}
+
+// body reads the request body from --file and applies --set on top of it
+func (ctx *context) body() (map[string]interface{}, error) {
+	body := make(map[string]interface{})
+
+	if ctx.opts.File != "" {
+		var data []byte
+		var err error
+		if ctx.opts.File == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(ctx.opts.File)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", ctx.opts.File, err)
+		}
+		if err := decodeBody(data, &body); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", ctx.opts.File, err)
+		}
+	}
+
+	for _, field := range ctx.opts.Set {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid --set '%s', expected key=value", field)
+		}
+		body[key] = parseValue(key, value)
+	}
+	return body, nil
+}
+
+// decodeBody parses JSON or YAML into v. YAML is converted through JSON so
+// nested maps get string keys
+func decodeBody(data []byte, v interface{}) error {
+	if err := json.Unmarshal(data, v); err == nil {
+		return nil
+	}
+
+	var generic interface{}
+	if err := yaml.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+	converted, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(converted, v)
+}
+
+// parseValue turns a --set value into a number, boolean or string. Tags
+// and other list fields are split on commas, IDs stay strings
+func parseValue(key, value string) interface{} {
+	switch key {
+	case "tags", "ids", "affinity", "anti_affinity", "targets", "delete":
+		if value == "" {
+			return []string{}
+		}
+		return strings.Split(value, ",")
+	}
+
+	// IDs are strings in the API
+	if strings.HasSuffix(key, "vmid") || strings.HasSuffix(key, "ctid") {
+		return value
+	}
+	if n, err := strconv.Atoi(value); err == nil {
+		return n
+	}
+	if b, err := strconv.ParseBool(value); err == nil && (value == "true" || value == "false") {
+		return b
+	}
+	return value
+}
+
+func listGuests(guestType, path string) func(*context, []string) (interface{}, error) {
+	return func(ctx *context, args []string) (interface{}, error) {
+		if ctx.opts.Cluster {
+			query := url.Values{"type": {guestType}, "sort": {"vmid"}}
+			if ctx.opts.Node != "" {
+				query.Set("node", ctx.opts.Node)
+			}
+			return ctx.backend.Call("GET", "/inventory", query, nil)
+		}
+		data, err := ctx.backend.Call("GET", path, ctx.nodeQuery(), nil)
+		if list, ok := data.([]interface{}); ok {
+			sortByVMID(list)
+		}
+		return data, err
+	}
+}
+
+func getStatic(path string) func(*context, []string) (interface{}, error) {
+	return func(ctx *context, args []string) (interface{}, error) {
+		return ctx.backend.Call("GET", path, nil, nil)
+	}
+}
+
+func getOnNode(path string) func(*context, []string) (interface{}, error) {
+	return func(ctx *context, args []string) (interface{}, error) {
+		return ctx.backend.Call("GET", path, ctx.nodeQuery(), nil)
+	}
+}
+
+func getPath(prefix string) func(*context, []string) (interface{}, error) {
+	return func(ctx *context, args []string) (interface{}, error) {
+		return ctx.backend.Call("GET", prefix+url.PathEscape(args[0]), ctx.nodeQuery(), nil)
+	}
+}
+
+func deletePath(prefix string) func(*context, []string) (interface{}, error) {
+	return func(ctx *context, args []string) (interface{}, error) {
+		return ctx.backend.Call("DELETE", prefix+url.PathEscape(args[0]), ctx.mutationQuery(ctx.nodeQuery()), nil)
+	}
+}
+
+func guestAction(prefix, action string) func(*context, []string) (interface{}, error) {
+	return func(ctx *context, args []string) (interface{}, error) {
+		path := prefix + url.PathEscape(args[0]) + "/" + action
+		return ctx.backend.Call("POST", path, ctx.waitQuery(ctx.nodeQuery()), nil)
+	}
+}
+
+func guestConfig(prefix string) func(*context, []string) (interface{}, error) {
+	return func(ctx *context, args []string) (interface{}, error) {
+		path := prefix + url.PathEscape(args[0]) + "/config"
+		if len(ctx.opts.Set) == 0 && ctx.opts.File == "" {
+			return ctx.backend.Call("GET", path, ctx.nodeQuery(), nil)
+		}
+
+		body, err := ctx.body()
+		if err != nil {
+			return nil, err
+		}
+		return ctx.backend.Call("PATCH", path, ctx.mutationQuery(ctx.nodeQuery()), body)
+	}
+}
+
+func createVM(ctx *context, args []string) (interface{}, error) {
+	body, err := ctx.body()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := body["node"]; !ok && ctx.opts.Node != "" {
+		body["node"] = ctx.opts.Node
+	}
+
+	path := "/vms"
+	if _, ok := body["template"]; ok {
+		path = "/vms/template"
+	}
+	return ctx.backend.Call("POST", path, ctx.mutationQuery(url.Values{}), body)
+}
+
+func cloneVM(ctx *context, args []string) (interface{}, error) {
+	body, err := ctx.body()
+	if err != nil {
+		return nil, err
+	}
+	body["source_vmid"] = args[0]
+	if _, ok := body["target_node"]; !ok && ctx.opts.Node != "" {
+		body["target_node"] = ctx.opts.Node
+	}
+	return ctx.backend.Call("POST", "/vms/clone", ctx.mutationQuery(url.Values{}), body)
+}
+
+func createContainer(ctx *context, args []string) (interface{}, error) {
+	body, err := ctx.body()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := body["node"]; !ok && ctx.opts.Node != "" {
+		body["node"] = ctx.opts.Node
+	}
+	return ctx.backend.Call("POST", "/containers", ctx.mutationQuery(url.Values{}), body)
+}
+
+func listContainerTemplates(ctx *context, args []string) (interface{}, error) {
+	data, err := ctx.backend.Call("GET", "/containers/templates", ctx.nodeQuery(), nil)
+	if err != nil || ctx.opts.Output == "json" || ctx.opts.Output == "yaml" {
+		return data, err
+	}
+
+	// Tables show downloaded templates followed by appliances
+	catalog, ok := data.(map[string]interface{})
+	if !ok {
+		return data, nil
+	}
+	var rows []interface{}
+	for _, key := range []string{"local", "appliances"} {
+		if list, ok := catalog[key].([]interface{}); ok {
+			rows = append(rows, list...)
+		}
+	}
+	return rows, nil
+}
+
+func bulkAction(prefix string) func(*context, []string) (interface{}, error) {
+	return func(ctx *context, args []string) (interface{}, error) {
+		body, err := ctx.body()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := body["node"]; !ok && ctx.opts.Node != "" {
+			body["node"] = ctx.opts.Node
+		}
+		data, err := ctx.backend.Call("POST", prefix+url.PathEscape(args[0]), ctx.mutationQuery(url.Values{}), body)
+		if op, ok := data.(map[string]interface{}); ok && ctx.opts.Output != "json" && ctx.opts.Output != "yaml" {
+			// Tables show one row per guest
+			return op["results"], err
+		}
+		return data, err
+	}
+}
+
+func nodeAction(action string) func(*context, []string) (interface{}, error) {
+	return func(ctx *context, args []string) (interface{}, error) {
+		body, err := ctx.body()
+		if err != nil {
+			return nil, err
+		}
+		path := "/nodes/" + url.PathEscape(args[0]) + "/" + action
+		return ctx.backend.Call("POST", path, ctx.mutationQuery(url.Values{}), body)
+	}
+}
+
+func buildTemplate(ctx *context, args []string) (interface{}, error) {
+	body, err := ctx.body()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := body["node"]; !ok && ctx.opts.Node != "" {
+		body["node"] = ctx.opts.Node
+	}
+	return ctx.backend.Call("POST", "/templates/build", nil, body)
+}
+
+func taskStatus(wait bool) func(*context, []string) (interface{}, error) {
+	return func(ctx *context, args []string) (interface{}, error) {
+		query := ctx.nodeQuery()
+		if wait {
+			query.Set("wait", "true")
+			if ctx.opts.Timeout > 0 {
+				query.Set("wait_timeout", strconv.Itoa(ctx.opts.Timeout))
+			}
+		}
+		return ctx.backend.Call("GET", "/tasks/"+url.PathEscape(args[0]), query, nil)
+	}
+}
+
+func sortByVMID(list []interface{}) {
+	vmid := func(v interface{}) float64 {
+		if item, ok := v.(map[string]interface{}); ok {
+			if id, ok := item["vmid"].(float64); ok {
+				return id
+			}
+		}
+		return 0
+	}
+	sort.SliceStable(list, func(i, j int) bool { return vmid(list[i]) < vmid(list[j]) })
+}
@@ -0,0 +1,94 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+var globalFlags = []string{"--output", "--node", "--cluster", "--file", "--set", "--wait", "--dry-run", "--timeout", "--remote", "--token"}
+
+// groups returns the command groups in table order
+func groups() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, cmd := range commands {
+		if !seen[cmd.group] {
+			seen[cmd.group] = true
+			names = append(names, cmd.group)
+		}
+	}
+	return append(names, "completion")
+}
+
+func subcommands(group string) []string {
+	if group == "completion" {
+		return []string{"bash", "zsh", "fish"}
+	}
+	var names []string
+	for _, cmd := range commands {
+		if cmd.group == group {
+			names = append(names, cmd.name)
+		}
+	}
+	return names
+}
+
+// writeCompletion prints a completion script for shell, generated from the
+// command table
+func writeCompletion(w io.Writer, shell string) error {
+	switch shell {
+	case "bash":
+		writeBashCompletion(w)
+	case "zsh":
+		// zsh runs bash completions through bashcompinit
+		fmt.Fprintln(w, "autoload -U +X bashcompinit && bashcompinit")
+		writeBashCompletion(w)
+	case "fish":
+		writeFishCompletion(w)
+	default:
+		return fmt.Errorf("unsupported shell '%s', use bash, zsh or fish", shell)
+	}
+	return nil
+}
+
+func writeBashCompletion(w io.Writer) {
+	fmt.Fprintln(w, "_proxmox_api() {")
+	fmt.Fprintln(w, "    local cur=\"${COMP_WORDS[COMP_CWORD]}\"")
+	fmt.Fprintln(w, "    if [[ \"$cur\" == -* ]]; then")
+	fmt.Fprintf(w, "        COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(globalFlags, " "))
+	fmt.Fprintln(w, "        return")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, "    case \"${COMP_WORDS[COMP_CWORD-1]}\" in")
+	fmt.Fprintln(w, "        -o|--output)")
+	fmt.Fprintln(w, "            COMPREPLY=($(compgen -W \"table json yaml\" -- \"$cur\"))")
+	fmt.Fprintln(w, "            return ;;")
+	fmt.Fprintln(w, "        -f|--file)")
+	fmt.Fprintln(w, "            COMPREPLY=($(compgen -f -- \"$cur\"))")
+	fmt.Fprintln(w, "            return ;;")
+	fmt.Fprintln(w, "    esac")
+	fmt.Fprintln(w, "    if [[ $COMP_CWORD -eq 1 ]]; then")
+	fmt.Fprintf(w, "        COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(groups(), " "))
+	fmt.Fprintln(w, "    elif [[ $COMP_CWORD -eq 2 ]]; then")
+	fmt.Fprintln(w, "        case \"${COMP_WORDS[1]}\" in")
+	for _, group := range groups() {
+		fmt.Fprintf(w, "            %s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", group, strings.Join(subcommands(group), " "))
+	}
+	fmt.Fprintln(w, "        esac")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -F _proxmox_api proxmox-api")
+}
+
+func writeFishCompletion(w io.Writer) {
+	fmt.Fprintln(w, "complete -c proxmox-api -f")
+	fmt.Fprintf(w, "complete -c proxmox-api -n __fish_use_subcommand -a %q\n", strings.Join(groups(), " "))
+	for _, group := range groups() {
+		fmt.Fprintf(w, "complete -c proxmox-api -n '__fish_seen_subcommand_from %s' -a %q\n", group, strings.Join(subcommands(group), " "))
+	}
+	for _, flag := range globalFlags {
+		fmt.Fprintf(w, "complete -c proxmox-api -l %s\n", strings.TrimPrefix(flag, "--"))
+	}
+	fmt.Fprintln(w, "complete -c proxmox-api -s o -l output -x -a 'table json yaml'")
+	fmt.Fprintln(w, "complete -c proxmox-api -s f -l file -r -F")
+}
@@ -0,0 +1,163 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+// printResult writes data as "table", "json" or "yaml". Tables show the
+// preferred columns that are present, or every scalar field
+func printResult(w io.Writer, data interface{}, format string, columns []string) error {
+	switch format {
+	case "json":
+		out, err := json.MarshalIndent(data, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(out))
+		return err
+	case "yaml":
+		out, err := yaml.Marshal(integerValues(data))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(out)
+		return err
+	case "table", "":
+		return printTable(w, data, columns)
+	}
+	return fmt.Errorf("unknown output format '%s', use table, json or yaml", format)
+}
+
+func printTable(w io.Writer, data interface{}, columns []string) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	defer tw.Flush()
+
+	switch value := data.(type) {
+	case []interface{}:
+		rows := make([]map[string]interface{}, 0, len(value))
+		for _, item := range value {
+			if row, ok := item.(map[string]interface{}); ok {
+				rows = append(rows, row)
+			} else {
+				fmt.Fprintln(tw, formatCell(item))
+			}
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+
+		columns = tableColumns(rows, columns)
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(columns, "\t")))
+		for _, row := range rows {
+			cells := make([]string, len(columns))
+			for i, column := range columns {
+				cells[i] = formatCell(row[column])
+			}
+			fmt.Fprintln(tw, strings.Join(cells, "\t"))
+		}
+	case map[string]interface{}:
+		// A paged list such as the inventory
+		if items, ok := value["items"].([]interface{}); ok {
+			return printTable(w, items, columns)
+		}
+
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Fprintln(tw, "KEY\tVALUE")
+		for _, key := range keys {
+			fmt.Fprintf(tw, "%s\t%s\n", key, formatCell(value[key]))
+		}
+	case nil:
+	default:
+		fmt.Fprintln(tw, formatCell(value))
+	}
+	return nil
+}
+
+func tableColumns(rows []map[string]interface{}, preferred []string) []string {
+	present := make(map[string]bool)
+	for _, row := range rows {
+		for key, value := range row {
+			switch value.(type) {
+			case map[string]interface{}, []interface{}:
+				if key != "tags" {
+					continue
+				}
+			}
+			present[key] = true
+		}
+	}
+
+	var columns []string
+	for _, column := range preferred {
+		if present[column] {
+			columns = append(columns, column)
+		}
+	}
+	if len(columns) > 0 {
+		return columns
+	}
+
+	for key := range present {
+		columns = append(columns, key)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+func formatCell(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	case []interface{}:
+		parts := make([]string, len(value))
+		for i, item := range value {
+			parts[i] = formatCell(item)
+		}
+		return strings.Join(parts, ",")
+	}
+	out, _ := json.Marshal(v)
+	return string(out)
+}
+
+// integerValues converts whole numbers decoded as float64 back to integers,
+// so YAML shows 4294967296 instead of 4.294967296e+09
+func integerValues(v interface{}) interface{} {
+	switch value := v.(type) {
+	case float64:
+		if value == math.Trunc(value) && math.Abs(value) < 1<<53 {
+			return int64(value)
+		}
+	case []interface{}:
+		out := make([]interface{}, len(value))
+		for i, item := range value {
+			out[i] = integerValues(item)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			out[key] = integerValues(item)
+		}
+		return out
+	}
+	return v
+}
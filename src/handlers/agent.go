@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"rm-thierry/Proxmox-API/src/manager"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AgentExecRequest struct {
+	Command   []string `json:"command"`
+	InputData string   `json:"input_data,omitempty"`
+}
+
+type AgentFileWriteRequest struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+	// Base64 marks Content as already base64 encoded
+	Base64 bool `json:"base64,omitempty"`
+}
+
+type AgentPasswordRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Crypted  bool   `json:"crypted,omitempty"`
+}
+
+// AgentStatus reports whether the guest agent is enabled in the VM config
+// and responding
+func AgentStatus(api *manager.APIManager, node, vmid string) (map[string]interface{}, error) {
+	config, err := GetVMConfig(api, node, vmid)
+	if err != nil {
+		return nil, err
+	}
+
+	agent, _ := config["agent"].(string)
+	if value, ok := config["agent"].(float64); ok {
+		agent = strconv.Itoa(int(value))
+	}
+	enabled := strings.HasPrefix(agent, "1") || strings.Contains(agent, "enabled=1")
+
+	status := map[string]interface{}{
+		"enabled": enabled,
+		"running": false,
+	}
+	if !enabled {
+		return status, nil
+	}
+
+	if _, err := agentCall(api, "POST", node, vmid, "ping", nil); err != nil {
+		status["error"] = err.Error()
+		return status, nil
+	}
+	status["running"] = true
+	return status, nil
+}
+
+func AgentNetworkInterfaces(api *manager.APIManager, node, vmid string) (interface{}, error) {
+	return agentCall(api, "GET", node, vmid, "network-get-interfaces", nil)
+}
+
+func AgentOSInfo(api *manager.APIManager, node, vmid string) (interface{}, error) {
+	return agentCall(api, "GET", node, vmid, "get-osinfo", nil)
+}
+
+// AgentExec starts a command inside the VM and returns its PID. Use
+// AgentExecStatus to collect the exit code and output
+func AgentExec(api *manager.APIManager, node, vmid string, req *AgentExecRequest) (interface{}, error) {
+	if len(req.Command) == 0 {
+		return nil, fmt.Errorf("command is required")
+	}
+
+	payload := map[string]interface{}{"command": req.Command}
+	if req.InputData != "" {
+		payload["input-data"] = req.InputData
+	}
+	return agentCall(api, "POST", node, vmid, "exec", payload)
+}
+
+func AgentExecStatus(api *manager.APIManager, node, vmid, pid string) (interface{}, error) {
+	if _, err := strconv.Atoi(pid); err != nil {
+		return nil, fmt.Errorf("invalid PID format")
+	}
+	return agentCall(api, "GET", node, vmid, "exec-status?pid="+pid, nil)
+}
+
+func AgentFileRead(api *manager.APIManager, node, vmid, path string) (interface{}, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file path is required")
+	}
+	return agentCall(api, "GET", node, vmid, "file-read?file="+url.QueryEscape(path), nil)
+}
+
+func AgentFileWrite(api *manager.APIManager, node, vmid string, req *AgentFileWriteRequest) (interface{}, error) {
+	if req.Path == "" {
+		return nil, fmt.Errorf("file path is required")
+	}
+
+	payload := map[string]interface{}{
+		"file":    req.Path,
+		"content": req.Content,
+	}
+	if req.Base64 {
+		payload["encode"] = 0
+	}
+	return agentCall(api, "POST", node, vmid, "file-write", payload)
+}
+
+// AgentFSFreeze runs "freeze", "thaw" or "status" on the guest filesystems
+func AgentFSFreeze(api *manager.APIManager, node, vmid, action string) (interface{}, error) {
+	switch action {
+	case "freeze", "thaw", "status":
+		return agentCall(api, "POST", node, vmid, "fsfreeze-"+action, nil)
+	}
+	return nil, fmt.Errorf("invalid fsfreeze action '%s'", action)
+}
+
+func AgentSetPassword(api *manager.APIManager, node, vmid string, req *AgentPasswordRequest) (interface{}, error) {
+	if req.Username == "" || req.Password == "" {
+		return nil, fmt.Errorf("username and password are required")
+	}
+
+	payload := map[string]interface{}{
+		"username": req.Username,
+		"password": req.Password,
+	}
+	if req.Crypted {
+		payload["crypted"] = 1
+	}
+	return agentCall(api, "POST", node, vmid, "set-user-password", payload)
+}
+
+// AgentIPAddresses returns the non-loopback, non-link-local IPv4 addresses
+// reported by the guest agent
+func AgentIPAddresses(api *manager.APIManager, node, vmid string) ([]string, error) {
+	result, err := AgentNetworkInterfaces(api, node, vmid)
+	if err != nil {
+		return nil, err
+	}
+
+	interfaces, _ := result.([]interface{})
+	var ips []string
+	for _, i := range interfaces {
+		iface, ok := i.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if name, _ := iface["name"].(string); name == "lo" {
+			continue
+		}
+
+		addresses, _ := iface["ip-addresses"].([]interface{})
+		for _, a := range addresses {
+			address, ok := a.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if addrType, _ := address["ip-address-type"].(string); addrType != "ipv4" {
+				continue
+			}
+			ip, _ := address["ip-address"].(string)
+			if ip == "" || strings.HasPrefix(ip, "127.") || strings.HasPrefix(ip, "169.254.") {
+				continue
+			}
+			ips = append(ips, ip)
+		}
+	}
+
+	return ips, nil
+}
+
+// WaitForAgentIP polls the guest agent until the VM reports an IPv4 address
+func WaitForAgentIP(api *manager.APIManager, node, vmid string, timeout time.Duration) ([]string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		ips, err := AgentIPAddresses(api, node, vmid)
+		if err == nil && len(ips) > 0 {
+			return ips, nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return nil, fmt.Errorf("timed out waiting for guest agent IP: %w", err)
+			}
+			return nil, fmt.Errorf("timed out waiting for guest agent IP")
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// agentCall calls /nodes/{node}/qemu/{vmid}/agent/{command} and unwraps the
+// "result" field of the agent response
+func agentCall(api *manager.APIManager, method, node, vmid, command string, payload map[string]interface{}) (interface{}, error) {
+	if _, err := strconv.Atoi(vmid); err != nil {
+		return nil, fmt.Errorf("invalid VMID format")
+	}
+
+	endpoint := fmt.Sprintf("/nodes/%s/qemu/%s/agent/%s", node, vmid, command)
+	var response []byte
+	var err error
+	if payload != nil {
+		response, err = api.ApiCall(method, endpoint, payload)
+	} else {
+		response, err = api.ApiCallWithOptions(method, endpoint, nil, false)
+	}
+	if err != nil {
+		name, _, _ := strings.Cut(command, "?")
+		return nil, fmt.Errorf("guest agent %s failed: %w", name, err)
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(response, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	if data, ok := result["data"].(map[string]interface{}); ok {
+		if inner, ok := data["result"]; ok {
+			return inner, nil
+		}
+		return data, nil
+	}
+	return result["data"], nil
+}
@@ -0,0 +1,473 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"rm-thierry/Proxmox-API/src/manager"
+	"rm-thierry/Proxmox-API/src/tracing"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// batchSections maps the lists of a batch document to the kind of their guests
+var batchSections = map[string]string{"items": "", "vms": "vm", "containers": "ct"}
+
+// envReference matches ${VAR} and ${VAR:-default}. $${VAR} is kept as ${VAR}
+var envReference = regexp.MustCompile(`\$(\$?)\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// BatchItem is one VM or container of an input file, with defaults merged in
+type BatchItem struct {
+	Index int                    `json:"index"`
+	Kind  string                 `json:"kind"`
+	Name  string                 `json:"name"`
+	Spec  map[string]interface{} `json:"spec"`
+}
+
+// Batch is the content of an input file. Parallelism is 0 unless the file
+// sets it
+type Batch struct {
+	Items       []BatchItem `json:"items"`
+	Parallelism int         `json:"parallelism,omitempty"`
+}
+
+type BatchResult struct {
+	Index    int     `json:"index"`
+	Kind     string  `json:"kind"`
+	Name     string  `json:"name"`
+	VMID     string  `json:"vmid,omitempty"`
+	Node     string  `json:"node,omitempty"`
+	Status   string  `json:"status"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+// ParseBatch reads VMs and containers from JSON, JSON Lines or (multi
+// document) YAML. A document is a single guest, a list of guests or a map
+// with "defaults", "vms", "containers" and "parallelism". Defaults apply to
+// the guests of their document and all later documents; keys under
+// defaults.vm and defaults.ct only apply to that kind. Guests without a
+// section name their kind with "kind: vm|ct", or are containers when they
+// have a "ctid". ${VAR} and ${VAR:-default} in values are replaced from
+// lookupEnv
+func ParseBatch(data []byte, lookupEnv func(string) (string, bool)) (*Batch, error) {
+	env := &envInterpolator{lookupEnv: lookupEnv}
+	docs, err := decodeDocuments(data, env)
+	if err != nil {
+		return nil, fmt.Errorf("invalid input: %w", err)
+	}
+	if err := env.err(); err != nil {
+		return nil, err
+	}
+
+	batch := &Batch{}
+	defaults := make(map[string]interface{})
+	for _, doc := range docs {
+		switch value := doc.(type) {
+		case nil:
+		case []interface{}:
+			if err := batch.add(value, "", defaults); err != nil {
+				return nil, err
+			}
+		case map[string]interface{}:
+			if !isBatchDocument(value) {
+				if err := batch.add([]interface{}{value}, "", defaults); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			if docDefaults, ok := value["defaults"]; ok {
+				m, ok := docDefaults.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("invalid input: defaults must be a map")
+				}
+				defaults = mergeMaps(defaults, m)
+			}
+			if parallelism, ok := value["parallelism"].(float64); ok {
+				batch.Parallelism = int(parallelism)
+			}
+			for _, key := range []string{"items", "vms", "containers"} {
+				section, ok := value[key]
+				if !ok {
+					continue
+				}
+				list, ok := section.([]interface{})
+				if !ok {
+					return nil, fmt.Errorf("invalid input: %s must be a list", key)
+				}
+				if err := batch.add(list, batchSections[key], defaults); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, fmt.Errorf("invalid input: expected a guest, a list of guests or a batch document")
+		}
+	}
+
+	if len(batch.Items) == 0 {
+		return nil, fmt.Errorf("invalid input: no VMs or containers found")
+	}
+	return batch, nil
+}
+
+// RunBatch creates the guests of a batch with up to parallelism at a time
+// and returns one result per guest in file order
+func RunBatch(api *manager.APIManager, batch *Batch, parallelism int, dryRun bool) []BatchResult {
+	if parallelism <= 0 {
+		parallelism = batch.Parallelism
+	}
+	if parallelism <= 0 {
+		parallelism = 4
+	}
+
+	results := make([]BatchResult, len(batch.Items))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, item := range batch.Items {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, item BatchItem) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			started := time.Now()
+			result := runBatchItem(api, item, dryRun)
+			result.Duration = time.Since(started).Seconds()
+			results[i] = result
+		}(i, item)
+	}
+	wg.Wait()
+	return results
+}
+
+func runBatchItem(api *manager.APIManager, item BatchItem, dryRun bool) BatchResult {
+	// Each guest of a file is its own trace
+	api, span := startStep(api, "batch "+item.Kind, "batch.index", item.Index, "name", item.Name, "dry_run", dryRun)
+	result := runBatchItemSteps(api, item, dryRun)
+	span.SetAttributes(tracing.Attributes("vmid", result.VMID, "proxmox.node", result.Node, "status", result.Status)...)
+	var err error
+	if result.Error != "" {
+		err = errors.New(result.Error)
+	}
+	tracing.End(span, err)
+	return result
+}
+
+func runBatchItemSteps(api *manager.APIManager, item BatchItem, dryRun bool) BatchResult {
+	result := BatchResult{Index: item.Index, Kind: item.Kind, Name: item.Name, Status: "failed"}
+
+	data, err := json.Marshal(item.Spec)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	var created map[string]interface{}
+	switch item.Kind {
+	case "vm":
+		var req VMCreateRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			result.Error = "invalid VM: " + err.Error()
+			return result
+		}
+		if req.Node == "" {
+			req.Node = api.Node
+		}
+		req.DryRun = req.DryRun || dryRun
+
+		created, err = CreateVM(api, &req)
+		result.VMID, result.Node = req.VMID, req.Node
+	case "ct":
+		config := NewDefaultContainerConfig(api.Node)
+		if err := json.Unmarshal(data, &config); err != nil {
+			result.Error = "invalid container: " + err.Error()
+			return result
+		}
+		if config.Node == "" {
+			config.Node = api.Node
+		}
+		config.DryRun = config.DryRun || dryRun
+		result.Node = config.Node
+
+		// CreateContainer takes the config by value, allocate the CTID
+		// here to report it
+		allocated := false
+		if config.CTID == "" {
+			var allocErr error
+			config.CTID, allocated, allocErr = allocateVMID(api, vmidScope(config.Team, "lxc"), config.DryRun)
+			if allocErr != nil {
+				result.Error = "failed to generate CTID: " + allocErr.Error()
+				return result
+			}
+		}
+
+		created, err = CreateContainer(api, config)
+		releaseAllocatedVMID(config.CTID, allocated && err != nil)
+		result.VMID = config.CTID
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	if node, ok := created["node"].(string); ok && node != "" {
+		result.Node = node
+	}
+	result.Status = "created"
+	if dryRun, _ := created["dry_run"].(bool); dryRun {
+		result.Status = "planned"
+	}
+	return result
+}
+
+func (b *Batch) add(list []interface{}, kind string, defaults map[string]interface{}) error {
+	for _, entry := range list {
+		spec, ok := entry.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid input: every VM and container must be a map")
+		}
+
+		itemKind, err := batchItemKind(spec, kind)
+		if err != nil {
+			return err
+		}
+
+		merged := make(map[string]interface{})
+		for key, value := range defaults {
+			if key != "vm" && key != "ct" {
+				merged[key] = value
+			}
+		}
+		if kindDefaults, ok := defaults[itemKind].(map[string]interface{}); ok {
+			merged = mergeMaps(merged, kindDefaults)
+		}
+		merged = mergeMaps(merged, spec)
+		delete(merged, "kind")
+
+		name, _ := merged["name"].(string)
+		b.Items = append(b.Items, BatchItem{Index: len(b.Items) + 1, Kind: itemKind, Name: name, Spec: merged})
+	}
+	return nil
+}
+
+func batchItemKind(spec map[string]interface{}, section string) (string, error) {
+	kind, _ := spec["kind"].(string)
+	switch kind {
+	case "vm", "qemu":
+		kind = "vm"
+	case "ct", "container", "lxc":
+		kind = "ct"
+	case "":
+		kind = section
+		if kind == "" {
+			kind = "vm"
+			if _, ok := spec["ctid"]; ok {
+				kind = "ct"
+			}
+		}
+	default:
+		return "", fmt.Errorf("invalid kind '%s', must be vm or ct", kind)
+	}
+
+	if section != "" && kind != section {
+		return "", fmt.Errorf("invalid kind '%s' in the %s section", kind, section)
+	}
+	return kind, nil
+}
+
+func isBatchDocument(doc map[string]interface{}) bool {
+	for _, key := range []string{"defaults", "vms", "containers", "items", "parallelism"} {
+		if _, ok := doc[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeDocuments splits the input into JSON-compatible values: one JSON
+// document, a stream of JSON documents (JSON Lines), or one per YAML
+// document. Environment references in values are replaced after decoding
+func decodeDocuments(data []byte, env *envInterpolator) ([]interface{}, error) {
+	trimmed := bytes.TrimSpace(data)
+	if json.Valid(trimmed) {
+		var doc interface{}
+		err := json.Unmarshal(trimmed, &doc)
+		return []interface{}{env.value(doc)}, err
+	}
+
+	if docs, ok := decodeJSONStream(trimmed); ok {
+		for i, doc := range docs {
+			docs[i] = env.value(doc)
+		}
+		return docs, nil
+	}
+
+	var docs []interface{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var node yaml.Node
+		err := decoder.Decode(&node)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		env.node(&node)
+
+		var doc interface{}
+		if err := node.Decode(&doc); err != nil {
+			return nil, err
+		}
+
+		// Round trip through JSON so numbers and maps match the JSON inputs
+		converted, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if err := json.Unmarshal(converted, &value); err != nil {
+			return nil, err
+		}
+		docs = append(docs, value)
+	}
+	return docs, nil
+}
+
+// decodeJSONStream reads concatenated JSON values such as JSON Lines
+func decodeJSONStream(data []byte) ([]interface{}, bool) {
+	if len(data) == 0 || (data[0] != '{' && data[0] != '[') {
+		return nil, false
+	}
+
+	var docs []interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc interface{}
+		err := decoder.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			return docs, len(docs) > 0
+		}
+		if err != nil {
+			return nil, false
+		}
+		docs = append(docs, doc)
+	}
+}
+
+// envInterpolator replaces ${VAR} in the string values of decoded
+// documents, so a variable can never add keys or documents. It collects the
+// variables that are not set
+type envInterpolator struct {
+	lookupEnv func(string) (string, bool)
+	missing   []string
+}
+
+func (e *envInterpolator) replace(value string) string {
+	return envReference.ReplaceAllStringFunc(value, func(match string) string {
+		groups := envReference.FindStringSubmatch(match)
+		if groups[1] != "" {
+			return match[1:]
+		}
+
+		name := groups[2]
+		hasDefault := strings.Contains(match, ":-")
+		if value, ok := e.lookupEnv(name); ok && (value != "" || !hasDefault) {
+			return value
+		}
+		if hasDefault {
+			return groups[3]
+		}
+		if !containsString(e.missing, name) {
+			e.missing = append(e.missing, name)
+		}
+		return match
+	})
+}
+
+// value replaces references in the strings of a decoded JSON value
+func (e *envInterpolator) value(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return e.replace(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = e.value(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = e.value(item)
+		}
+	}
+	return value
+}
+
+// node replaces references in the scalar values of a YAML document. Plain
+// scalars get their type from the result, so "memory: ${MEMORY}" is a
+// number, while quoted ones stay strings
+func (e *envInterpolator) node(n *yaml.Node) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		if replaced := e.replace(n.Value); replaced != n.Value {
+			n.Value = replaced
+			if n.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+				n.Tag = ""
+			}
+		}
+	case yaml.MappingNode:
+		// Keys are kept as written
+		for i := 1; i < len(n.Content); i += 2 {
+			e.node(n.Content[i])
+		}
+	default:
+		for _, child := range n.Content {
+			e.node(child)
+		}
+	}
+}
+
+func (e *envInterpolator) err() error {
+	if len(e.missing) == 0 {
+		return nil
+	}
+	sort.Strings(e.missing)
+	return fmt.Errorf("invalid input: environment variables not set: %s", strings.Join(e.missing, ", "))
+}
+
+// mergeMaps returns base with override applied on top, merging nested maps
+func mergeMaps(base, override map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(override))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range override {
+		if nested, ok := value.(map[string]interface{}); ok {
+			if existing, ok := merged[key].(map[string]interface{}); ok {
+				merged[key] = mergeMaps(existing, nested)
+				continue
+			}
+		}
+		merged[key] = value
+	}
+	return merged
+}
+
+// BatchSummary counts the guests that succeeded and failed
+func BatchSummary(results []BatchResult) (succeeded, failed int) {
+	for _, result := range results {
+		if result.Status == "failed" {
+			failed++
+		} else {
+			succeeded++
+		}
+	}
+	return succeeded, failed
+}
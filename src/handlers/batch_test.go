@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseBatch(t *testing.T) {
+	env := map[string]string{
+		"MEMORY":  "4096",
+		"SSH_KEY": "ssh-ed25519 AAAA user@host",
+		"INJECT":  "x\nctid: 5",
+		"EMPTY":   "",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	tests := []struct {
+		name    string
+		input   string
+		want    []BatchItem
+		wantErr string
+	}{
+		{
+			name:  "single YAML guest",
+			input: "name: web-01\nmemory: 2048\n",
+			want:  []BatchItem{{Index: 1, Kind: "vm", Name: "web-01", Spec: map[string]interface{}{"name": "web-01", "memory": 2048.0}}},
+		},
+		{
+			name:  "container by ctid",
+			input: `{"name": "cache", "ctid": "300"}`,
+			want:  []BatchItem{{Index: 1, Kind: "ct", Name: "cache", Spec: map[string]interface{}{"name": "cache", "ctid": "300"}}},
+		},
+		{
+			name:  "JSON Lines",
+			input: "{\"name\": \"a\"}\n{\"name\": \"b\", \"kind\": \"lxc\"}\n",
+			want: []BatchItem{
+				{Index: 1, Kind: "vm", Name: "a", Spec: map[string]interface{}{"name": "a"}},
+				{Index: 2, Kind: "ct", Name: "b", Spec: map[string]interface{}{"name": "b"}},
+			},
+		},
+		{
+			name:  "defaults by kind and later documents",
+			input: "defaults:\n  node: pve\n  vm: {cores: 2}\n  ct: {storage: local-lvm}\nvms:\n  - name: web\ncontainers:\n  - name: db\n---\nname: api\n",
+			want: []BatchItem{
+				{Index: 1, Kind: "vm", Name: "web", Spec: map[string]interface{}{"name": "web", "node": "pve", "cores": 2.0}},
+				{Index: 2, Kind: "ct", Name: "db", Spec: map[string]interface{}{"name": "db", "node": "pve", "storage": "local-lvm"}},
+				{Index: 3, Kind: "vm", Name: "api", Spec: map[string]interface{}{"name": "api", "node": "pve", "cores": 2.0}},
+			},
+		},
+		{
+			name:  "plain YAML values take the type of the variable",
+			input: "name: web\nmemory: ${MEMORY}\ncores: ${CORES:-2}\nssh_public_keys: ${SSH_KEY}\n",
+			want: []BatchItem{{Index: 1, Kind: "vm", Name: "web", Spec: map[string]interface{}{
+				"name": "web", "memory": 4096.0, "cores": 2.0, "ssh_public_keys": "ssh-ed25519 AAAA user@host"}}},
+		},
+		{
+			name:  "quoted YAML and JSON values stay strings",
+			input: "name: web\nmemory: \"${MEMORY}\"\ndescription: 'size ${MEMORY}'\n",
+			want: []BatchItem{{Index: 1, Kind: "vm", Name: "web", Spec: map[string]interface{}{
+				"name": "web", "memory": "4096", "description": "size 4096"}}},
+		},
+		{
+			name:  "JSON values",
+			input: `{"name": "web", "memory": "${MEMORY}"}`,
+			want:  []BatchItem{{Index: 1, Kind: "vm", Name: "web", Spec: map[string]interface{}{"name": "web", "memory": "4096"}}},
+		},
+		{
+			name:  "a value cannot add keys",
+			input: "name: web\ndescription: ${INJECT}\n",
+			want: []BatchItem{{Index: 1, Kind: "vm", Name: "web", Spec: map[string]interface{}{
+				"name": "web", "description": "x\nctid: 5"}}},
+		},
+		{
+			name:  "empty variable uses the default",
+			input: "name: ${EMPTY:-web}\n",
+			want:  []BatchItem{{Index: 1, Kind: "vm", Name: "web", Spec: map[string]interface{}{"name": "web"}}},
+		},
+		{
+			name:  "escaped reference",
+			input: "name: web\ndescription: $${MEMORY}\n",
+			want:  []BatchItem{{Index: 1, Kind: "vm", Name: "web", Spec: map[string]interface{}{"name": "web", "description": "${MEMORY}"}}},
+		},
+		{
+			name:    "unset variables",
+			input:   "name: ${NAME}\ndescription: ${DESCRIPTION} ${NAME}\n",
+			wantErr: "environment variables not set: DESCRIPTION, NAME",
+		},
+		{
+			name:    "kind outside its section",
+			input:   "vms:\n  - name: web\n    kind: ct\n",
+			wantErr: "invalid kind 'ct' in the vm section",
+		},
+		{
+			name:    "no guests",
+			input:   "defaults:\n  node: pve\n",
+			wantErr: "no VMs or containers found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batch, err := ParseBatch([]byte(tt.input), lookupEnv)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseBatch() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseBatch() error = %v", err)
+			}
+			if !reflect.DeepEqual(batch.Items, tt.want) {
+				t.Errorf("ParseBatch() items = %#v, want %#v", batch.Items, tt.want)
+			}
+		})
+	}
+}
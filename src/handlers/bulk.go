@@ -0,0 +1,383 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"rm-thierry/Proxmox-API/src/manager"
+	"sync"
+	"time"
+)
+
+// bulkActions are the actions each guest type supports. Containers have no
+// reset in Proxmox
+var bulkActions = map[string]map[string]bool{
+	"qemu": {
+		"start":    true,
+		"stop":     true,
+		"shutdown": true,
+		"reboot":   true,
+		"suspend":  true,
+		"resume":   true,
+		"reset":    true,
+		"delete":   true,
+	},
+	"lxc": {
+		"start":    true,
+		"stop":     true,
+		"shutdown": true,
+		"reboot":   true,
+		"suspend":  true,
+		"resume":   true,
+		"delete":   true,
+	},
+}
+
+// destructiveBulkActions need confirm unless the guests are picked by ids,
+// tag or pool, so a node or name pattern alone never wipes out a node
+var destructiveBulkActions = map[string]bool{
+	"stop":   true,
+	"reset":  true,
+	"delete": true,
+}
+
+type BulkRequest struct {
+	IDs         []string   `json:"ids,omitempty"`
+	Tag         string     `json:"tag,omitempty"`
+	Pool        string     `json:"pool,omitempty"`
+	Name        string     `json:"name,omitempty"`
+	Node        string     `json:"node,omitempty"`
+	Groups      [][]string `json:"groups,omitempty"`
+	Concurrency int        `json:"concurrency,omitempty"`
+	Timeout     int        `json:"timeout,omitempty"`
+	Async       bool       `json:"async,omitempty"`
+	DryRun      bool       `json:"dry_run,omitempty"`
+	Confirm     bool       `json:"confirm,omitempty"`
+}
+
+type BulkResult struct {
+	VMID   string `json:"vmid"`
+	Name   string `json:"name"`
+	Node   string `json:"node"`
+	Group  int    `json:"group"`
+	Status string `json:"status"`
+	TaskID string `json:"task_id,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Call is set for dry runs
+	Call *PlannedCall `json:"call,omitempty"`
+}
+
+type BulkOperation struct {
+	ID        string       `json:"task_id"`
+	Action    string       `json:"action"`
+	Type      string       `json:"type"`
+	Status    string       `json:"status"`
+	StartedAt time.Time    `json:"started_at"`
+	EndedAt   *time.Time   `json:"ended_at,omitempty"`
+	Results   []BulkResult `json:"results"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+
+	mu sync.Mutex
+}
+
+var (
+	bulkMu         sync.Mutex
+	bulkOperations = make(map[string]*BulkOperation)
+)
+
+// RunBulkOperation applies an action to every selected guest of the type
+// ("qemu" or "lxc"). Guests run group by group, each group with bounded
+// parallelism. Groups run in reverse order for stop, shutdown and delete so
+// that guests started first are stopped last
+func RunBulkOperation(api *manager.APIManager, guestType, action string, req *BulkRequest) (*BulkOperation, error) {
+	if !bulkActions[guestType][action] {
+		return nil, fmt.Errorf("invalid bulk action '%s' for %s", action, guestType)
+	}
+	if destructiveBulkActions[action] && !req.DryRun && !req.Confirm &&
+		len(req.IDs) == 0 && req.Tag == "" && req.Pool == "" {
+		return nil, fmt.Errorf("invalid bulk request: %s by node or name requires \"confirm\": true, or select guests by ids, tag or pool", action)
+	}
+
+	guests, err := SelectGuests(api, guestType, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(guests) == 0 {
+		return nil, fmt.Errorf("no guests matched the selector")
+	}
+
+	groups := orderGuests(guests, req.Groups)
+	if action == "stop" || action == "shutdown" || action == "delete" {
+		for i, j := 0, len(groups)-1; i < j; i, j = i+1, j-1 {
+			groups[i], groups[j] = groups[j], groups[i]
+		}
+	}
+
+	op := &BulkOperation{
+		ID:        newBulkID(),
+		Action:    action,
+		Type:      guestType,
+		Status:    "running",
+		StartedAt: time.Now(),
+	}
+	for g, group := range groups {
+		for _, guest := range group {
+			op.Results = append(op.Results, BulkResult{
+				VMID:   guest.VMID,
+				Name:   guest.Name,
+				Node:   guest.Node,
+				Group:  g,
+				Status: "pending",
+			})
+		}
+	}
+
+	// Dry runs list the calls in the order they would run and are not kept
+	if req.DryRun {
+		op.ID = ""
+		op.Status = "dry_run"
+		for i := range op.Results {
+			call := guestActionCall(guestType, op.Results[i].Node, op.Results[i].VMID, action)
+			op.Results[i].Status = "planned"
+			op.Results[i].Call = &call
+		}
+		return op, nil
+	}
+
+	bulkMu.Lock()
+	pruneBulkOperations()
+	bulkOperations[op.ID] = op
+	bulkMu.Unlock()
+
+	if req.Async {
+		go runBulkGroups(api, op, req)
+		return op.snapshot(), nil
+	}
+
+	runBulkGroups(api, op, req)
+	return op.snapshot(), nil
+}
+
+func GetBulkOperation(id string) (*BulkOperation, error) {
+	bulkMu.Lock()
+	op, ok := bulkOperations[id]
+	bulkMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("bulk operation %s not found", id)
+	}
+	return op.snapshot(), nil
+}
+
+// SelectGuests resolves explicit IDs (or "name:<hostname>" references) and
+// selector filters to a list of guests across the cluster
+func SelectGuests(api *manager.APIManager, guestType string, req *BulkRequest) ([]GuestRef, error) {
+	var guests []GuestRef
+	seen := make(map[string]bool)
+
+	for _, ref := range req.IDs {
+		guest, err := ResolveGuest(api, guestType, ref, req.Node)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[guest.VMID] {
+			seen[guest.VMID] = true
+			guests = append(guests, *guest)
+		}
+	}
+
+	if req.Tag == "" && req.Pool == "" && req.Name == "" && (req.Node == "" || len(req.IDs) > 0) {
+		return guests, nil
+	}
+
+	resources, err := GetClusterResources(api, "vm")
+	if err != nil {
+		return nil, err
+	}
+
+	query := &InventoryQuery{Type: guestType, Tag: req.Tag, Pool: req.Pool, Name: req.Name, Node: req.Node}
+	for _, resource := range resources {
+		item := inventoryItemFromResource(resource)
+		if item.Template {
+			continue
+		}
+		matched, err := matchesInventoryQuery(item, query)
+		if err != nil {
+			return nil, err
+		}
+		vmid := fmt.Sprintf("%d", item.VMID)
+		if matched && !seen[vmid] {
+			seen[vmid] = true
+			guests = append(guests, GuestRef{VMID: vmid, Node: item.Node, Type: item.Type, Name: item.Name, Tags: item.Tags})
+		}
+	}
+
+	return guests, nil
+}
+
+// GuestAction runs a power or lifecycle action and returns the task ID
+func GuestAction(api *manager.APIManager, guestType, node, vmid, action string) (string, error) {
+	call := guestActionCall(guestType, node, vmid, action)
+
+	var response []byte
+	var err error
+	if action == "delete" {
+		response, err = api.ApiCall(call.Method, call.Endpoint, nil)
+	} else {
+		response, err = api.ApiCallWithOptions(call.Method, call.Endpoint, nil, false)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to %s %s: %w", action, vmid, err)
+	}
+
+	result, err := parseResponse(response)
+	if err != nil {
+		return "", err
+	}
+	taskID, _ := result["task_id"].(string)
+	return taskID, nil
+}
+
+// orderGuests splits the guests into the requested ordering groups. Guests
+// not listed in any group run last
+func orderGuests(guests []GuestRef, order [][]string) [][]GuestRef {
+	groupOf := make(map[string]int)
+	for g, ids := range order {
+		for _, id := range ids {
+			groupOf[id] = g
+		}
+	}
+
+	groups := make([][]GuestRef, len(order)+1)
+	for _, guest := range guests {
+		g, ok := groupOf[guest.VMID]
+		if !ok {
+			g, ok = groupOf["name:"+guest.Name]
+		}
+		if !ok {
+			g = len(order)
+		}
+		groups[g] = append(groups[g], guest)
+	}
+
+	var ordered [][]GuestRef
+	for _, group := range groups {
+		if len(group) > 0 {
+			ordered = append(ordered, group)
+		}
+	}
+	return ordered
+}
+
+func runBulkGroups(api *manager.APIManager, op *BulkOperation, req *BulkRequest) {
+	concurrency := req.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	timeout := time.Duration(req.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Minute
+	}
+
+	group := -1
+	for {
+		group++
+		var indexes []int
+		for i := range op.Results {
+			if op.Results[i].Group == group {
+				indexes = append(indexes, i)
+			}
+		}
+		if len(indexes) == 0 {
+			break
+		}
+
+		sem := make(chan struct{}, concurrency)
+		var wg sync.WaitGroup
+		for _, i := range indexes {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				op.mu.Lock()
+				r := op.Results[i]
+				op.Results[i].Status = "running"
+				op.mu.Unlock()
+
+				taskID, err := GuestAction(api, op.Type, r.Node, r.VMID, op.Action)
+				if err == nil && taskID != "" {
+					op.setTask(i, taskID)
+					_, err = WaitForTask(api, r.Node, taskID, timeout)
+				}
+				op.finish(i, err)
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	now := time.Now()
+	op.EndedAt = &now
+	op.Status = "completed"
+	if op.Failed > 0 {
+		op.Status = "failed"
+	}
+}
+
+func (op *BulkOperation) setTask(i int, taskID string) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.Results[i].TaskID = taskID
+}
+
+func (op *BulkOperation) finish(i int, err error) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if err != nil {
+		op.Results[i].Status = "failed"
+		op.Results[i].Error = err.Error()
+		op.Failed++
+		return
+	}
+	op.Results[i].Status = "ok"
+	op.Succeeded++
+}
+
+func (op *BulkOperation) snapshot() *BulkOperation {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return &BulkOperation{
+		ID:        op.ID,
+		Action:    op.Action,
+		Type:      op.Type,
+		Status:    op.Status,
+		StartedAt: op.StartedAt,
+		EndedAt:   op.EndedAt,
+		Results:   append([]BulkResult(nil), op.Results...),
+		Succeeded: op.Succeeded,
+		Failed:    op.Failed,
+	}
+}
+
+// pruneBulkOperations forgets operations that finished more than a day ago.
+// The caller must hold bulkMu
+func pruneBulkOperations() {
+	cutoff := time.Now().Add(-24 * time.Hour)
+	for id, op := range bulkOperations {
+		op.mu.Lock()
+		expired := op.EndedAt != nil && op.EndedAt.Before(cutoff)
+		op.mu.Unlock()
+		if expired {
+			delete(bulkOperations, id)
+		}
+	}
+}
+
+func newBulkID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return "BULK:" + hex.EncodeToString(b)
+}
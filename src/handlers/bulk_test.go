@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rm-thierry/Proxmox-API/src/manager"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRunBulkOperationActions(t *testing.T) {
+	tests := []struct {
+		guestType string
+		action    string
+		wantErr   string
+	}{
+		{"qemu", "reset", "no guests matched"},
+		{"qemu", "suspend", "no guests matched"},
+		{"lxc", "resume", "no guests matched"},
+		{"lxc", "delete", "no guests matched"},
+		{"lxc", "reset", "invalid bulk action 'reset' for lxc"},
+		{"qemu", "migrate", "invalid bulk action 'migrate' for qemu"},
+		{"lxc", "", "invalid bulk action '' for lxc"},
+		{"docker", "start", "invalid bulk action 'start' for docker"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.guestType+" "+tt.action, func(t *testing.T) {
+			// An empty cluster, so valid actions stop at the selection
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				w.Write([]byte(`{"data":[]}`))
+			}))
+			defer server.Close()
+			api := &manager.APIManager{BaseURL: server.URL, Node: "pve"}
+
+			_, err := RunBulkOperation(api, tt.guestType, tt.action, &BulkRequest{Tag: "staging"})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("RunBulkOperation() error = %v, want %q", err, tt.wantErr)
+			}
+			if strings.HasPrefix(tt.wantErr, "invalid") && calls.Load() != 0 {
+				t.Errorf("RunBulkOperation() called Proxmox %d times for an invalid action", calls.Load())
+			}
+		})
+	}
+}
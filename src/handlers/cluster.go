@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"rm-thierry/Proxmox-API/src/manager"
+)
+
+// GetClusterResources lists resources across all nodes. resourceType can be
+// "vm", "storage", "node" or "sdn", or empty for everything
+func GetClusterResources(api *manager.APIManager, resourceType string) ([]map[string]interface{}, error) {
+	endpoint := "/cluster/resources"
+	if resourceType != "" {
+		endpoint += "?type=" + resourceType
+	}
+
+	response, err := api.ApiCall("GET", endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cluster resources: %w", err)
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(response, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse cluster resources: %w", err)
+	}
+
+	data, ok := result["data"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid cluster resources format")
+	}
+
+	resources := make([]map[string]interface{}, 0, len(data))
+	for _, item := range data {
+		if resource, ok := item.(map[string]interface{}); ok {
+			resources = append(resources, resource)
+		}
+	}
+
+	return resources, nil
+}
@@ -8,20 +8,36 @@ import (
 )
 
 type ContainerConfig struct {
-	Node         string `json:"node"`
-	CTID         string `json:"ctid"`
-	Name         string `json:"name"`
-	Memory       string `json:"memory"`
-	Swap         string `json:"swap"`
-	Cores        string `json:"cores"`
-	Disk         string `json:"disk"`
-	Storage      string `json:"storage"`
-	Net          string `json:"net"`
-	Password     string `json:"password"`
-	Template     string `json:"template"`
-	Unprivileged bool   `json:"unprivileged"`
+	Node         string                         `json:"node"`
+	CTID         string                         `json:"ctid"`
+	Name         string                         `json:"name"`
+	Memory       int                            `json:"memory"`
+	Swap         int                            `json:"swap"`
+	Cores        int                            `json:"cores"`
+	Disk         int                            `json:"disk"`
+	Storage      string                         `json:"storage"`
+	Net          string                         `json:"net,omitempty"`
+	Networks     []ContainerNetwork             `json:"networks,omitempty"`
+	Nameserver   string                         `json:"nameserver,omitempty"`
+	Searchdomain string                         `json:"searchdomain,omitempty"`
+	Password     string                         `json:"password,omitempty"`
+	SSHKeys      string                         `json:"ssh_public_keys,omitempty"`
+	Template     string                         `json:"template"`
+	Unprivileged bool                           `json:"unprivileged"`
+	OnBoot       bool                           `json:"onboot,omitempty"`
+	Startup      *ContainerStartup              `json:"startup,omitempty"`
+	Start        bool                           `json:"start,omitempty"`
+	Placement    string                         `json:"placement,omitempty"`
+	Affinity     []string                       `json:"affinity,omitempty"`
+	AntiAffinity []string                       `json:"anti_affinity,omitempty"`
+	Team         string                         `json:"team,omitempty"`
+	Features     *ContainerFeatures             `json:"features,omitempty"`
+	MountPoints  map[string]ContainerMountPoint `json:"mountpoints,omitempty"`
+	DryRun       bool                           `json:"dry_run,omitempty"`
 }
 
+// Template holds short template references, which CreateContainer resolves
+// to the newest matching vztmpl volume on the target node
 type Template struct {
 	Debian string `json:"debian"`
 	Ubuntu string `json:"ubuntu"`
@@ -30,22 +46,27 @@ type Template struct {
 
 func GetTemplates() Template {
 	return Template{
-		Debian: "local:vztmpl/debian-12-standard_12.7-1_amd64.tar.zst",
+		Debian: "debian:12",
+		Ubuntu: "ubuntu:24.04",
+		Alpine: "alpine:3",
 	}
 }
 
-func NewDefaultContainerConfig() ContainerConfig {
+// NewDefaultContainerConfig returns the defaults for a container on the
+// node, usually the APIManager's default node
+func NewDefaultContainerConfig(node string) ContainerConfig {
 	return ContainerConfig{
-		Node:         manager.NewAPIManager().Node,
-		Memory:       "2000",
-		Swap:         "2000",
-		Cores:        "2",
-		Disk:         "8",
-		Storage:      "local",
-		Net:          "name=eth0,bridge=vmbr0,ip=dhcp",
+		Node:    node,
+		Memory:  2000,
+		Swap:    2000,
+		Cores:   2,
+		Disk:    8,
+		Storage: "local",
+		Networks: []ContainerNetwork{
+			{Name: "eth0", Bridge: "vmbr0", IP: "dhcp"},
+		},
 		Template:     GetTemplates().Debian,
 		Unprivileged: true,
-		Password:     "",
 	}
 }
 
@@ -54,8 +75,20 @@ func validateContainer(apiManager *manager.APIManager, config ContainerConfig) e
 		return fmt.Errorf("CTID and Name are required")
 	}
 
-	if config.Password == "" {
-		return fmt.Errorf("root password is required")
+	if config.Password == "" && config.SSHKeys == "" {
+		return fmt.Errorf("root password or SSH public keys are required")
+	}
+
+	if config.Password != "" && len(config.Password) < 5 {
+		return fmt.Errorf("invalid password: must be at least 5 characters")
+	}
+
+	if config.Memory <= 0 || config.Cores <= 0 || config.Swap < 0 {
+		return fmt.Errorf("invalid resources: memory and cores must be greater than 0")
+	}
+
+	if err := validateContainerNetworks(config.Networks); err != nil {
+		return err
 	}
 
 	exists, err := checkContainerExists(apiManager, config.Node, config.CTID)
@@ -70,9 +103,16 @@ func validateContainer(apiManager *manager.APIManager, config ContainerConfig) e
 		return err
 	}
 
-	if config.Disk == "" {
+	if config.Disk <= 0 {
 		return fmt.Errorf("disk size is required")
 	}
+	if err := checkStorageSpace(apiManager, config.Node, config.Storage, int64(config.Disk)<<30); err != nil {
+		return err
+	}
+
+	if err := validateContainerOptions(apiManager, config.Node, config.Unprivileged, config.Features, config.MountPoints); err != nil {
+		return err
+	}
 
 	return validateContainerTemplate(apiManager, config)
 }
@@ -94,7 +134,12 @@ func checkContainerExists(apiManager *manager.APIManager, node, ctid string) (bo
 }
 
 func validateContainerTemplate(apiManager *manager.APIManager, config ContainerConfig) error {
-	response, err := apiManager.ApiCall("GET", fmt.Sprintf("/nodes/%s/storage/%s/content", config.Node, config.Storage), nil)
+	storage, _, ok := strings.Cut(config.Template, ":")
+	if !ok || !strings.Contains(config.Template, ":vztmpl/") {
+		return fmt.Errorf("invalid template '%s', expected storage:vztmpl/file or a short name", config.Template)
+	}
+
+	response, err := apiManager.ApiCall("GET", fmt.Sprintf("/nodes/%s/storage/%s/content?content=vztmpl", config.Node, storage), nil)
 	if err != nil {
 		return fmt.Errorf("failed to check template: %v", err)
 	}
@@ -109,10 +154,9 @@ func validateContainerTemplate(apiManager *manager.APIManager, config ContainerC
 		return fmt.Errorf("invalid template response")
 	}
 
-	templateName := strings.Split(config.Template, "/")[1]
 	for _, t := range data {
 		if template, ok := t.(map[string]interface{}); ok {
-			if volid, ok := template["volid"].(string); ok && strings.Contains(volid, templateName) {
+			if volid, ok := template["volid"].(string); ok && volid == config.Template {
 				return nil
 			}
 		}
@@ -121,19 +165,59 @@ func validateContainerTemplate(apiManager *manager.APIManager, config ContainerC
 }
 
 func buildContainerPayload(config ContainerConfig) map[string]interface{} {
-	return map[string]interface{}{
+	payload := map[string]interface{}{
 		"vmid":         config.CTID,
 		"hostname":     config.Name,
 		"cores":        config.Cores,
 		"memory":       config.Memory,
 		"swap":         config.Swap,
 		"storage":      config.Storage,
-		"rootfs":       fmt.Sprintf("%s:%s", config.Storage, config.Disk),
-		"net0":         config.Net,
+		"rootfs":       fmt.Sprintf("%s:%d", config.Storage, config.Disk),
 		"ostemplate":   config.Template,
 		"unprivileged": config.Unprivileged,
-		"password":     config.Password,
 	}
+
+	if config.Password != "" {
+		payload["password"] = config.Password
+	}
+	if config.SSHKeys != "" {
+		payload["ssh-public-keys"] = config.SSHKeys
+	}
+
+	// A raw net string overrides the structured definitions for net0
+	for i, n := range config.Networks {
+		payload[fmt.Sprintf("net%d", i)] = formatContainerNetwork(n)
+	}
+	if config.Net != "" {
+		payload["net0"] = config.Net
+	}
+
+	if config.Nameserver != "" {
+		payload["nameserver"] = config.Nameserver
+	}
+	if config.Searchdomain != "" {
+		payload["searchdomain"] = config.Searchdomain
+	}
+	if config.OnBoot {
+		payload["onboot"] = 1
+	}
+	if config.Startup != nil {
+		if startup := formatContainerStartup(config.Startup); startup != "" {
+			payload["startup"] = startup
+		}
+	}
+	if config.Start {
+		payload["start"] = 1
+	}
+
+	for key, mp := range config.MountPoints {
+		payload[key] = formatMountPoint(mp)
+	}
+	if config.Features != nil {
+		payload["features"] = mergeFeatures("", config.Features)
+	}
+
+	return payload
 }
 
 // Function to parse API response
@@ -243,25 +327,54 @@ func GetContainerIDByName(apiManager *manager.APIManager, node string, name stri
 }
 
 func CreateContainer(apiManager *manager.APIManager, config ContainerConfig) (map[string]interface{}, error) {
+	decision, err := resolveContainerNode(apiManager, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	allocated := false
+	if config.CTID == "" {
+		config.CTID, allocated, err = allocateVMID(apiManager, vmidScope(config.Team, "lxc"), config.DryRun)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate CTID: %w", err)
+		}
+	}
+
+	template, err := ResolveContainerTemplate(apiManager, config.Node, config.Template)
+	if err != nil {
+		releaseAllocatedVMID(config.CTID, allocated)
+		return nil, err
+	}
+	config.Template = template
+
 	if err := validateContainer(apiManager, config); err != nil {
+		releaseAllocatedVMID(config.CTID, allocated)
 		return nil, err
 	}
 
 	payload := buildContainerPayload(config)
-	response, err := apiManager.ApiCall("POST", fmt.Sprintf("/nodes/%s/lxc", config.Node), payload)
+	endpoint := fmt.Sprintf("/nodes/%s/lxc", config.Node)
+	if config.DryRun {
+		result := dryRunResult(PlannedCall{Method: "POST", Endpoint: endpoint, Payload: payload})
+		result["ctid"] = config.CTID
+		return addPlacement(result, config.Node, decision), nil
+	}
+	response, err := apiManager.ApiCall("POST", endpoint, payload)
 	if err != nil {
+		releaseAllocatedVMID(config.CTID, allocated)
 		return nil, fmt.Errorf("failed to create container: %v", err)
 	}
-	return parseAPIResponse(response)
-}
 
-func DeleteContainer(apiManager *manager.APIManager, node string, ctid string) (map[string]interface{}, error) {
-	exists, err := checkContainerExists(apiManager, node, ctid)
+	result, err := parseAPIResponse(response)
 	if err != nil {
 		return nil, err
 	}
-	if !exists {
-		return nil, fmt.Errorf("Container with ID %s does not exist", ctid)
+	return addPlacement(result, config.Node, decision), nil
+}
+
+func DeleteContainer(apiManager *manager.APIManager, node string, ctid string) (map[string]interface{}, error) {
+	if err := validateDeleteContainer(apiManager, node, ctid); err != nil {
+		return nil, err
 	}
 
 	response, err := apiManager.ApiCall("DELETE", fmt.Sprintf("/nodes/%s/lxc/%s", node, ctid), nil)
@@ -272,6 +385,17 @@ func DeleteContainer(apiManager *manager.APIManager, node string, ctid string) (
 	return parseAPIResponse(response)
 }
 
+func validateDeleteContainer(apiManager *manager.APIManager, node, ctid string) error {
+	exists, err := checkContainerExists(apiManager, node, ctid)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("Container with ID %s does not exist", ctid)
+	}
+	return nil
+}
+
 func StartContainer(apiManager *manager.APIManager, node string, ctid string) (map[string]interface{}, error) {
 	exists, err := checkContainerExists(apiManager, node, ctid)
 	if err != nil {
@@ -305,36 +429,3 @@ func StopContainer(apiManager *manager.APIManager, node string, ctid string) (ma
 
 	return parseAPIResponse(response)
 }
-
-func GetHighestContainerID(apiManager *manager.APIManager, node string) (int, error) {
-	response, err := apiManager.ApiCall("GET", fmt.Sprintf("/nodes/%s/lxc", node), nil)
-	if err != nil {
-		return 0, fmt.Errorf("failed to get containers: %w", err)
-	}
-
-	var result map[string]interface{}
-	if err := json.Unmarshal(response, &result); err != nil {
-		return 0, fmt.Errorf("failed to parse response: %w", err)
-	}
-
-	data, ok := result["data"].([]interface{})
-	if !ok {
-		return 101, nil
-	}
-
-	highest := 100
-	for _, item := range data {
-		container, ok := item.(map[string]interface{})
-		if !ok {
-			continue
-		}
-
-		if ctid, ok := container["vmid"].(float64); ok {
-			if int(ctid) > highest {
-				highest = int(ctid)
-			}
-		}
-	}
-
-	return highest + 1, nil
-}
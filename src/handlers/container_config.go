@@ -0,0 +1,338 @@
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"rm-thierry/Proxmox-API/src/manager"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	mountPointKey = regexp.MustCompile(`^mp([0-9]|[1-9][0-9]|1[0-9][0-9]|2[0-4][0-9]|25[0-5])$`)
+	diskSizeValue = regexp.MustCompile(`^\+?[0-9]+(\.[0-9]+)?[KMGT]?$`)
+)
+
+type ContainerFeatures struct {
+	Nesting *bool `json:"nesting,omitempty"`
+	Keyctl  *bool `json:"keyctl,omitempty"`
+	Fuse    *bool `json:"fuse,omitempty"`
+}
+
+// ContainerMountPoint is either a volume (Storage and Size in GB) or a bind
+// mount of a host directory (HostPath)
+type ContainerMountPoint struct {
+	Storage  string `json:"storage,omitempty"`
+	Size     int    `json:"size,omitempty"`
+	HostPath string `json:"host_path,omitempty"`
+	Path     string `json:"path"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+	Backup   bool   `json:"backup,omitempty"`
+}
+
+// ContainerConfigUpdate only changes the fields that are set
+type ContainerConfigUpdate struct {
+	Memory       *int                           `json:"memory,omitempty"`
+	Swap         *int                           `json:"swap,omitempty"`
+	Cores        *int                           `json:"cores,omitempty"`
+	Hostname     *string                        `json:"hostname,omitempty"`
+	Description  *string                        `json:"description,omitempty"`
+	Tags         []string                       `json:"tags,omitempty"`
+	Nameserver   *string                        `json:"nameserver,omitempty"`
+	Searchdomain *string                        `json:"searchdomain,omitempty"`
+	MountPoints  map[string]ContainerMountPoint `json:"mountpoints,omitempty"`
+	Features     *ContainerFeatures             `json:"features,omitempty"`
+	Delete       []string                       `json:"delete,omitempty"`
+}
+
+type ContainerResizeRequest struct {
+	Disk string `json:"disk"`
+	Size string `json:"size"`
+}
+
+func GetContainerConfig(apiManager *manager.APIManager, node, ctid string) (map[string]interface{}, error) {
+	if _, err := strconv.Atoi(ctid); err != nil {
+		return nil, fmt.Errorf("invalid CTID format")
+	}
+
+	response, err := apiManager.ApiCall("GET", fmt.Sprintf("/nodes/%s/lxc/%s/config", node, ctid), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get container config: %w", err)
+	}
+
+	return parseResponse(response)
+}
+
+func UpdateContainerConfig(apiManager *manager.APIManager, node, ctid string, update *ContainerConfigUpdate) (map[string]interface{}, error) {
+	call, err := planUpdateContainerConfig(apiManager, node, ctid, update)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := apiManager.ApiCall(call.Method, call.Endpoint, call.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update container config: %w", err)
+	}
+
+	result, err := parseAPIResponse(response)
+	if err != nil {
+		return nil, err
+	}
+	result["changed"] = sortedKeys(call.Payload)
+	return result, nil
+}
+
+func planUpdateContainerConfig(apiManager *manager.APIManager, node, ctid string, update *ContainerConfigUpdate) (PlannedCall, error) {
+	if err := validateContainerResources(apiManager, node, update); err != nil {
+		return PlannedCall{}, err
+	}
+
+	current, err := GetContainerConfig(apiManager, node, ctid)
+	if err != nil {
+		return PlannedCall{}, err
+	}
+
+	unprivileged := false
+	if value, ok := current["unprivileged"].(float64); ok {
+		unprivileged = value == 1
+	}
+	if err := validateContainerOptions(apiManager, node, unprivileged, update.Features, update.MountPoints); err != nil {
+		return PlannedCall{}, err
+	}
+
+	payload := buildContainerConfigPayload(update, current)
+	if len(payload) == 0 {
+		return PlannedCall{}, fmt.Errorf("no configuration changes given")
+	}
+
+	return PlannedCall{Method: "PUT", Endpoint: fmt.Sprintf("/nodes/%s/lxc/%s/config", node, ctid), Payload: payload}, nil
+}
+
+// AddContainerMountPoint attaches a mount point on the first free mpN slot
+func AddContainerMountPoint(apiManager *manager.APIManager, node, ctid string, mp ContainerMountPoint) (map[string]interface{}, error) {
+	current, err := GetContainerConfig(apiManager, node, ctid)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < 256; i++ {
+		key := fmt.Sprintf("mp%d", i)
+		if _, used := current[key]; used {
+			continue
+		}
+		return UpdateContainerConfig(apiManager, node, ctid, &ContainerConfigUpdate{
+			MountPoints: map[string]ContainerMountPoint{key: mp},
+		})
+	}
+
+	return nil, fmt.Errorf("no free mount point slot")
+}
+
+// ResizeContainerDisk grows rootfs or a mount point. Size is absolute
+// ("20G") or relative ("+5G"), Proxmox cannot shrink volumes
+func ResizeContainerDisk(apiManager *manager.APIManager, node, ctid string, req *ContainerResizeRequest) (map[string]interface{}, error) {
+	if req.Disk != "rootfs" && !mountPointKey.MatchString(req.Disk) {
+		return nil, fmt.Errorf("invalid disk '%s', must be rootfs or mpN", req.Disk)
+	}
+	if !diskSizeValue.MatchString(req.Size) {
+		return nil, fmt.Errorf("invalid size '%s'", req.Size)
+	}
+
+	current, err := GetContainerConfig(apiManager, node, ctid)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := current[req.Disk]; !ok {
+		return nil, fmt.Errorf("disk %s not found on container %s", req.Disk, ctid)
+	}
+
+	payload := map[string]interface{}{
+		"disk": req.Disk,
+		"size": req.Size,
+	}
+	response, err := apiManager.ApiCall("PUT", fmt.Sprintf("/nodes/%s/lxc/%s/resize", node, ctid), payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resize container disk: %w", err)
+	}
+
+	return parseAPIResponse(response)
+}
+
+// validateContainerResources checks memory (MB), swap (MB) and cores, and
+// that cores and memory fit on the node
+func validateContainerResources(apiManager *manager.APIManager, node string, update *ContainerConfigUpdate) error {
+	if update.Memory != nil && *update.Memory <= 0 {
+		return fmt.Errorf("invalid memory %d, must be greater than 0", *update.Memory)
+	}
+	if update.Swap != nil && *update.Swap < 0 {
+		return fmt.Errorf("invalid swap %d, must not be negative", *update.Swap)
+	}
+	if update.Cores != nil && *update.Cores <= 0 {
+		return fmt.Errorf("invalid cores %d, must be greater than 0", *update.Cores)
+	}
+	if update.Memory == nil && update.Cores == nil {
+		return nil
+	}
+
+	nodes, err := GetNodes(apiManager)
+	if err != nil {
+		return fmt.Errorf("failed to check node capacity: %w", err)
+	}
+	for _, n := range nodes {
+		if name, _ := n["node"].(string); name != node {
+			continue
+		}
+		maxCPU, _ := n["maxcpu"].(float64)
+		maxMem, _ := n["maxmem"].(float64)
+		if update.Cores != nil && maxCPU > 0 && float64(*update.Cores) > maxCPU {
+			return fmt.Errorf("invalid cores: node %s has %d CPUs, %d requested", node, int(maxCPU), *update.Cores)
+		}
+		if update.Memory != nil && maxMem > 0 && int64(*update.Memory)<<20 > int64(maxMem) {
+			return fmt.Errorf("invalid memory: node %s has %d MB, %d MB requested", node, int64(maxMem)>>20, *update.Memory)
+		}
+		break
+	}
+	return nil
+}
+
+// validateContainerOptions checks features and mount points against the
+// target node. Proxmox only lets root@pam set bind mounts and most features,
+// which it reports when the config is applied
+func validateContainerOptions(apiManager *manager.APIManager, node string, unprivileged bool, features *ContainerFeatures, mountPoints map[string]ContainerMountPoint) error {
+	if features != nil && features.Keyctl != nil && *features.Keyctl && !unprivileged {
+		return fmt.Errorf("invalid features: keyctl is only available for unprivileged containers")
+	}
+
+	checked := make(map[string]bool)
+	for key, mp := range mountPoints {
+		if !mountPointKey.MatchString(key) {
+			return fmt.Errorf("invalid mount point '%s', must be mp0 to mp255", key)
+		}
+		if !strings.HasPrefix(mp.Path, "/") {
+			return fmt.Errorf("invalid mount point %s: path must be absolute", key)
+		}
+
+		switch {
+		case mp.HostPath != "" && mp.Storage != "":
+			return fmt.Errorf("invalid mount point %s: use either storage or host_path", key)
+		case mp.HostPath != "":
+			if !strings.HasPrefix(mp.HostPath, "/") {
+				return fmt.Errorf("invalid mount point %s: host_path must be absolute", key)
+			}
+		case mp.Storage != "":
+			if mp.Size <= 0 {
+				return fmt.Errorf("invalid mount point %s: size is required for volumes", key)
+			}
+			if !checked[mp.Storage] {
+				if err := validateContainerStorage(apiManager, node, mp.Storage); err != nil {
+					return err
+				}
+				checked[mp.Storage] = true
+			}
+		default:
+			return fmt.Errorf("invalid mount point %s: storage or host_path is required", key)
+		}
+	}
+
+	return nil
+}
+
+func buildContainerConfigPayload(update *ContainerConfigUpdate, current map[string]interface{}) map[string]interface{} {
+	payload := make(map[string]interface{})
+
+	if update.Memory != nil {
+		payload["memory"] = *update.Memory
+	}
+	if update.Swap != nil {
+		payload["swap"] = *update.Swap
+	}
+	if update.Cores != nil {
+		payload["cores"] = *update.Cores
+	}
+	if update.Hostname != nil {
+		payload["hostname"] = *update.Hostname
+	}
+	if update.Description != nil {
+		payload["description"] = *update.Description
+	}
+	if update.Tags != nil {
+		payload["tags"] = strings.Join(update.Tags, ";")
+	}
+	if update.Nameserver != nil {
+		payload["nameserver"] = *update.Nameserver
+	}
+	if update.Searchdomain != nil {
+		payload["searchdomain"] = *update.Searchdomain
+	}
+	for key, mp := range update.MountPoints {
+		payload[key] = formatMountPoint(mp)
+	}
+	if update.Features != nil {
+		existing, _ := current["features"].(string)
+		payload["features"] = mergeFeatures(existing, update.Features)
+	}
+	if len(update.Delete) > 0 {
+		payload["delete"] = strings.Join(update.Delete, ",")
+	}
+
+	return payload
+}
+
+func formatMountPoint(mp ContainerMountPoint) string {
+	volume := mp.HostPath
+	if volume == "" {
+		volume = fmt.Sprintf("%s:%d", mp.Storage, mp.Size)
+	}
+
+	value := fmt.Sprintf("%s,mp=%s", volume, mp.Path)
+	if mp.ReadOnly {
+		value += ",ro=1"
+	}
+	if mp.Backup {
+		value += ",backup=1"
+	}
+	return value
+}
+
+// mergeFeatures applies the requested flags on top of the existing
+// "nesting=1,keyctl=0" string so unrelated features are kept
+func mergeFeatures(existing string, features *ContainerFeatures) string {
+	values := make(map[string]string)
+	for _, part := range strings.Split(existing, ",") {
+		if key, value, ok := strings.Cut(part, "="); ok {
+			values[key] = value
+		}
+	}
+
+	for key, flag := range map[string]*bool{
+		"nesting": features.Nesting,
+		"keyctl":  features.Keyctl,
+		"fuse":    features.Fuse,
+	} {
+		if flag == nil {
+			continue
+		}
+		if *flag {
+			values[key] = "1"
+		} else {
+			values[key] = "0"
+		}
+	}
+
+	parts := make([]string, 0, len(values))
+	for key, value := range values {
+		parts = append(parts, key+"="+value)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
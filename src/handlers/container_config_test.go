@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rm-thierry/Proxmox-API/src/manager"
+	"strings"
+	"testing"
+)
+
+func TestPlanUpdateContainerConfigResources(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/nodes":
+			w.Write([]byte(`{"data":[{"node":"pve","maxcpu":8,"maxmem":17179869184},{"node":"small","maxcpu":2,"maxmem":1073741824}]}`))
+		case "/nodes/pve/lxc/101/config":
+			w.Write([]byte(`{"data":{"hostname":"cache","memory":512,"cores":1}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	api := &manager.APIManager{BaseURL: server.URL, Node: "pve"}
+
+	intPtr := func(v int) *int { return &v }
+	tests := []struct {
+		name    string
+		update  ContainerConfigUpdate
+		want    map[string]interface{}
+		wantErr string
+	}{
+		{
+			name:   "within capacity",
+			update: ContainerConfigUpdate{Memory: intPtr(16384), Cores: intPtr(8), Swap: intPtr(0)},
+			want:   map[string]interface{}{"memory": 16384, "cores": 8, "swap": 0},
+		},
+		{name: "zero memory", update: ContainerConfigUpdate{Memory: intPtr(0)}, wantErr: "invalid memory 0"},
+		{name: "negative swap", update: ContainerConfigUpdate{Swap: intPtr(-1)}, wantErr: "invalid swap -1"},
+		{name: "zero cores", update: ContainerConfigUpdate{Cores: intPtr(0)}, wantErr: "invalid cores 0"},
+		{name: "more cores than the node", update: ContainerConfigUpdate{Cores: intPtr(9)}, wantErr: "invalid cores: node pve has 8 CPUs, 9 requested"},
+		{name: "more memory than the node", update: ContainerConfigUpdate{Memory: intPtr(16385)}, wantErr: "invalid memory: node pve has 16384 MB, 16385 MB requested"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			call, err := planUpdateContainerConfig(api, "pve", "101", &tt.update)
+			_, dryRunErr := UpdateContainerConfigDryRun(api, "pve", "101", &tt.update)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("planUpdateContainerConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				if dryRunErr == nil || dryRunErr.Error() != err.Error() {
+					t.Errorf("UpdateContainerConfigDryRun() error = %v, want %v", dryRunErr, err)
+				}
+				return
+			}
+			if err != nil || dryRunErr != nil {
+				t.Fatalf("planUpdateContainerConfig() error = %v, dry run error = %v", err, dryRunErr)
+			}
+			for key, value := range tt.want {
+				if call.Payload[key] != value {
+					t.Errorf("payload %s = %v, want %v", key, call.Payload[key], value)
+				}
+			}
+		})
+	}
+}
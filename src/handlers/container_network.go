@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ContainerNetwork describes one netN interface. IP is "dhcp", "manual" or
+// an address in CIDR notation, IP6 additionally accepts "auto"
+type ContainerNetwork struct {
+	Name     string `json:"name"`
+	Bridge   string `json:"bridge"`
+	VLAN     int    `json:"vlan,omitempty"`
+	IP       string `json:"ip,omitempty"`
+	Gateway  string `json:"gateway,omitempty"`
+	IP6      string `json:"ip6,omitempty"`
+	Gateway6 string `json:"gateway6,omitempty"`
+	Firewall bool   `json:"firewall,omitempty"`
+	HWAddr   string `json:"hwaddr,omitempty"`
+	MTU      int    `json:"mtu,omitempty"`
+	Rate     int    `json:"rate,omitempty"`
+}
+
+type ContainerStartup struct {
+	Order int `json:"order,omitempty"`
+	Up    int `json:"up,omitempty"`
+	Down  int `json:"down,omitempty"`
+}
+
+func validateContainerNetworks(networks []ContainerNetwork) error {
+	names := make(map[string]bool)
+	for i, n := range networks {
+		if n.Name == "" {
+			return fmt.Errorf("invalid network net%d: name is required", i)
+		}
+		if names[n.Name] {
+			return fmt.Errorf("invalid network net%d: interface name %s is used twice", i, n.Name)
+		}
+		names[n.Name] = true
+
+		if n.Bridge == "" {
+			return fmt.Errorf("invalid network net%d: bridge is required", i)
+		}
+		if n.VLAN < 0 || n.VLAN > 4094 {
+			return fmt.Errorf("invalid network net%d: vlan must be between 1 and 4094", i)
+		}
+
+		if err := validateContainerIP(n.IP, n.Gateway, false); err != nil {
+			return fmt.Errorf("invalid network net%d: %v", i, err)
+		}
+		if err := validateContainerIP(n.IP6, n.Gateway6, true); err != nil {
+			return fmt.Errorf("invalid network net%d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func validateContainerIP(ip, gateway string, v6 bool) error {
+	switch ip {
+	case "", "dhcp", "manual":
+		if gateway != "" {
+			return fmt.Errorf("gateway requires a static IP")
+		}
+		return nil
+	case "auto":
+		if !v6 {
+			return fmt.Errorf("ip 'auto' is only valid for IPv6")
+		}
+		return nil
+	}
+
+	addr, _, err := net.ParseCIDR(ip)
+	if err != nil {
+		return fmt.Errorf("ip '%s' must be dhcp, manual or CIDR notation", ip)
+	}
+	if (addr.To4() == nil) != v6 {
+		return fmt.Errorf("ip '%s' has the wrong address family", ip)
+	}
+	if gateway != "" && net.ParseIP(gateway) == nil {
+		return fmt.Errorf("gateway '%s' is not an IP address", gateway)
+	}
+	return nil
+}
+
+func formatContainerNetwork(n ContainerNetwork) string {
+	parts := []string{"name=" + n.Name, "bridge=" + n.Bridge}
+	if n.VLAN > 0 {
+		parts = append(parts, fmt.Sprintf("tag=%d", n.VLAN))
+	}
+	if n.IP != "" {
+		parts = append(parts, "ip="+n.IP)
+	}
+	if n.Gateway != "" {
+		parts = append(parts, "gw="+n.Gateway)
+	}
+	if n.IP6 != "" {
+		parts = append(parts, "ip6="+n.IP6)
+	}
+	if n.Gateway6 != "" {
+		parts = append(parts, "gw6="+n.Gateway6)
+	}
+	if n.Firewall {
+		parts = append(parts, "firewall=1")
+	}
+	if n.HWAddr != "" {
+		parts = append(parts, "hwaddr="+n.HWAddr)
+	}
+	if n.MTU > 0 {
+		parts = append(parts, fmt.Sprintf("mtu=%d", n.MTU))
+	}
+	if n.Rate > 0 {
+		parts = append(parts, fmt.Sprintf("rate=%d", n.Rate))
+	}
+	return strings.Join(parts, ",")
+}
+
+func formatContainerStartup(s *ContainerStartup) string {
+	var parts []string
+	if s.Order > 0 {
+		parts = append(parts, fmt.Sprintf("order=%d", s.Order))
+	}
+	if s.Up > 0 {
+		parts = append(parts, fmt.Sprintf("up=%d", s.Up))
+	}
+	if s.Down > 0 {
+		parts = append(parts, fmt.Sprintf("down=%d", s.Down))
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"rm-thierry/Proxmox-API/src/manager"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type ContainerTemplate struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Package     string `json:"package"`
+	Template    string `json:"template"`
+	VolID       string `json:"volid,omitempty"`
+	Storage     string `json:"storage,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Source      string `json:"source"`
+	Section     string `json:"section,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type ContainerTemplateCatalog struct {
+	Local      []ContainerTemplate `json:"local"`
+	Appliances []ContainerTemplate `json:"appliances"`
+}
+
+type ApplianceDownloadRequest struct {
+	Storage  string `json:"storage"`
+	Template string `json:"template"`
+}
+
+// GetContainerTemplateCatalog lists the templates already on the node's
+// storages and the appliances that can be downloaded
+func GetContainerTemplateCatalog(api *manager.APIManager, node string) (*ContainerTemplateCatalog, error) {
+	local, err := ListContainerTemplates(api, node)
+	if err != nil {
+		return nil, err
+	}
+
+	appliances, err := ListAppliances(api, node)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ContainerTemplateCatalog{Local: local, Appliances: appliances}, nil
+}
+
+// ListContainerTemplates returns the vztmpl content of every storage on the node
+func ListContainerTemplates(api *manager.APIManager, node string) ([]ContainerTemplate, error) {
+	storages, err := GetStorages(api, node)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := []ContainerTemplate{}
+	for _, storage := range storages {
+		name, _ := storage["storage"].(string)
+		content, _ := storage["content"].(string)
+		if name == "" || !strings.Contains(content, "vztmpl") {
+			continue
+		}
+
+		response, err := api.ApiCall("GET", fmt.Sprintf("/nodes/%s/storage/%s/content?content=vztmpl", node, name), nil)
+		if err != nil {
+			continue
+		}
+
+		var result map[string]interface{}
+		if err := json.Unmarshal(response, &result); err != nil {
+			continue
+		}
+
+		data, _ := result["data"].([]interface{})
+		for _, item := range data {
+			entry, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			volid, _ := entry["volid"].(string)
+			size, _ := entry["size"].(float64)
+			template := parseTemplateFilename(volid[strings.LastIndex(volid, "/")+1:])
+			template.VolID = volid
+			template.Storage = name
+			template.Size = int64(size)
+			template.Source = "local"
+			templates = append(templates, template)
+		}
+	}
+
+	return templates, nil
+}
+
+// ListAppliances returns the appliance index of the node (/nodes/{node}/aplinfo)
+func ListAppliances(api *manager.APIManager, node string) ([]ContainerTemplate, error) {
+	response, err := api.ApiCall("GET", fmt.Sprintf("/nodes/%s/aplinfo", node), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get appliance index: %w", err)
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(response, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse appliance index: %w", err)
+	}
+
+	data, ok := result["data"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid appliance index format")
+	}
+
+	appliances := []ContainerTemplate{}
+	for _, item := range data {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if kind, _ := entry["type"].(string); kind != "" && kind != "lxc" {
+			continue
+		}
+
+		filename, _ := entry["template"].(string)
+		template := parseTemplateFilename(filename)
+		if version, ok := entry["version"].(string); ok {
+			template.Version = version
+		}
+		template.Source = "appliance"
+		template.Section, _ = entry["section"].(string)
+		template.Description, _ = entry["headline"].(string)
+		appliances = append(appliances, template)
+	}
+
+	return appliances, nil
+}
+
+// DownloadAppliance downloads an appliance to the storage and returns the
+// Proxmox task tracking the download. Template is the appliance file name
+// or a short name such as "debian-12" or "alpine:3.20"
+func DownloadAppliance(api *manager.APIManager, node string, req *ApplianceDownloadRequest) (map[string]interface{}, error) {
+	if req.Storage == "" || req.Template == "" {
+		return nil, fmt.Errorf("storage and template are required")
+	}
+
+	if err := validateContainerStorage(api, node, req.Storage); err != nil {
+		return nil, err
+	}
+
+	appliances, err := ListAppliances(api, node)
+	if err != nil {
+		return nil, err
+	}
+
+	appliance, err := matchTemplate(appliances, req.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := map[string]interface{}{
+		"storage":  req.Storage,
+		"template": appliance.Template,
+	}
+	response, err := api.ApiCall("POST", fmt.Sprintf("/nodes/%s/aplinfo", node), payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download appliance: %w", err)
+	}
+
+	result, err := parseResponse(response)
+	if err != nil {
+		return nil, err
+	}
+	result["template"] = appliance.Template
+	result["volid"] = fmt.Sprintf("%s:vztmpl/%s", req.Storage, appliance.Template)
+	return result, nil
+}
+
+// ResolveContainerTemplate turns a template reference into a volume ID.
+// Full volume IDs ("local:vztmpl/...") are returned as they are, short names
+// pick the newest matching template on the node's storages
+func ResolveContainerTemplate(api *manager.APIManager, node, ref string) (string, error) {
+	if strings.Contains(ref, ":vztmpl/") {
+		return ref, nil
+	}
+
+	templates, err := ListContainerTemplates(api, node)
+	if err != nil {
+		return "", err
+	}
+
+	template, err := matchTemplate(templates, ref)
+	if err != nil {
+		if appliances, aplErr := ListAppliances(api, node); aplErr == nil {
+			if appliance, aplErr := matchTemplate(appliances, ref); aplErr == nil {
+				return "", fmt.Errorf("template %s not found on node %s, download appliance %s first", ref, node, appliance.Template)
+			}
+		}
+		return "", err
+	}
+
+	return template.VolID, nil
+}
+
+// matchTemplate finds the newest template matching "name", "name-version",
+// "name:version" or an exact file name
+func matchTemplate(templates []ContainerTemplate, ref string) (*ContainerTemplate, error) {
+	name, version, _ := strings.Cut(ref, ":")
+
+	var matches []ContainerTemplate
+	for _, t := range templates {
+		if t.Template == ref {
+			return &t, nil
+		}
+
+		switch {
+		case version != "" && t.Name == name:
+			distroVersion := strings.TrimPrefix(t.Package, t.Name+"-")
+			if versionMatches(t.Version, version) || versionMatches(distroVersion, version) {
+				matches = append(matches, t)
+			}
+		case version == "" && (t.Name == name || t.Package == name || strings.HasPrefix(t.Package, name+"-")):
+			matches = append(matches, t)
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("template %s not found", ref)
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return compareVersions(matches[i].Version, matches[j].Version) > 0
+	})
+	return &matches[0], nil
+}
+
+// versionMatches accepts "12" for "12.7-1" but not for "1.2"
+func versionMatches(full, prefix string) bool {
+	if !strings.HasPrefix(full, prefix) {
+		return false
+	}
+	rest := full[len(prefix):]
+	return rest == "" || rest[0] == '.' || rest[0] == '-'
+}
+
+// parseTemplateFilename splits "debian-12-standard_12.7-1_amd64.tar.zst"
+// into the package "debian-12-standard", the distribution name "debian"
+// and the version "12.7-1"
+func parseTemplateFilename(filename string) ContainerTemplate {
+	parts := strings.Split(filename, "_")
+	template := ContainerTemplate{Template: filename, Package: parts[0]}
+	if len(parts) > 1 {
+		template.Version = parts[1]
+	}
+
+	template.Name = template.Package
+	if i := strings.Index(template.Package, "-"); i > 0 {
+		template.Name = template.Package[:i]
+	}
+	return template
+}
+
+// compareVersions compares dotted or dashed versions numerically
+func compareVersions(a, b string) int {
+	split := func(v string) []string {
+		return strings.FieldsFunc(v, func(r rune) bool { return r == '.' || r == '-' })
+	}
+	pa, pb := split(a), split(b)
+
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		na, errA := strconv.Atoi(pa[i])
+		nb, errB := strconv.Atoi(pb[i])
+		if errA != nil || errB != nil {
+			if c := strings.Compare(pa[i], pb[i]); c != 0 {
+				return c
+			}
+			continue
+		}
+		if na != nb {
+			if na > nb {
+				return 1
+			}
+			return -1
+		}
+	}
+	return len(pa) - len(pb)
+}
@@ -0,0 +1,345 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"rm-thierry/Proxmox-API/src/manager"
+	"rm-thierry/Proxmox-API/src/tracing"
+	"strings"
+	"time"
+)
+
+const templateWorkflow = "template_deploy"
+
+// templateDeploy is the journaled state of a deploy from a template, enough
+// to finish it or clean it up in another process. Allocated is set when the
+// deploy allocated the VMID rather than taking it from the request
+type templateDeploy struct {
+	Request    VMCreateRequest `json:"request"`
+	SourceNode string          `json:"source_node"`
+	SourceVMID string          `json:"source_vmid"`
+	Allocated  bool            `json:"allocated,omitempty"`
+}
+
+// workflowRecoverers continue workflows of the given type after a restart
+var workflowRecoverers = map[string]func(*manager.APIManager, *Workflow) error{
+	templateWorkflow: recoverTemplateDeploy,
+}
+
+// StartWorkflowRecovery recovers workflows left running by a stopped or
+// crashed instance, at startup and then every interval
+func StartWorkflowRecovery(api *manager.APIManager, interval time.Duration) {
+	go func() {
+		for {
+			RecoverWorkflows(api)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// RecoverWorkflows claims the running workflows whose lease ran out and
+// resumes them, or rolls them back when resuming fails or
+// WORKFLOW_RECOVERY is rollback
+func RecoverWorkflows(api *manager.APIManager) {
+	journal := defaultWorkflowJournal()
+	workflows, err := journal.list()
+	if err != nil {
+		slog.Warn("unable to read workflows for recovery", "error", err)
+		return
+	}
+
+	for _, wf := range workflows {
+		if wf.Status != "running" || time.Since(wf.UpdatedAt) < workflowLease {
+			continue
+		}
+		recoverer, ok := workflowRecoverers[wf.Type]
+		if !ok {
+			continue
+		}
+		claimed, err := journal.claim(wf)
+		if err != nil {
+			slog.Warn("unable to claim workflow", "workflow", wf.ID, "error", err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		slog.Info("recovering workflow", "workflow", wf.ID, "type", wf.Type, "node", wf.Node, "vmid", wf.VMID)
+		if err := recoverer(api, wf); err != nil {
+			slog.Error("workflow recovery failed", "workflow", wf.ID, "type", wf.Type, "vmid", wf.VMID, "error", err)
+			continue
+		}
+		slog.Info("workflow recovered", "workflow", wf.ID, "status", wf.Status)
+	}
+}
+
+// recoverTemplateDeploy finishes the clone, configure and start steps of an
+// interrupted deploy, or removes the clone
+func recoverTemplateDeploy(api *manager.APIManager, wf *Workflow) error {
+	var deploy templateDeploy
+	if err := json.Unmarshal(wf.State, &deploy); err != nil {
+		err = fmt.Errorf("failed to read workflow state: %w", err)
+		wf.Finish("failed", err)
+		return err
+	}
+
+	if strings.ToLower(os.Getenv("WORKFLOW_RECOVERY")) == "rollback" {
+		return rollbackTemplateDeploy(api, wf, &deploy, fmt.Errorf("interrupted"))
+	}
+
+	if err := resumeTemplateDeploy(api, wf, &deploy); err != nil {
+		slog.Warn("unable to resume workflow, rolling back", "workflow", wf.ID, "error", err)
+		return rollbackTemplateDeploy(api, wf, &deploy, err)
+	}
+	wf.Finish("completed", nil)
+	return nil
+}
+
+func resumeTemplateDeploy(api *manager.APIManager, wf *Workflow, deploy *templateDeploy) error {
+	req := &deploy.Request
+
+	if !wf.Done("clone") {
+		exists, err := VMExists(api, req.Node, req.VMID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			// The clone was requested but the process stopped before its
+			// task was journaled
+			if err := checkDeployedVM(api, req); err != nil {
+				return err
+			}
+			wf.Complete("clone", "")
+		} else {
+			result, err := CloneVM(api, deploy.SourceNode, deploy.SourceVMID, req.Node, req.VMID, req.Name, CloneOptions{CloneType: req.CloneType})
+			if err != nil {
+				wf.Fail("clone", err)
+				return fmt.Errorf("failed to clone template VM: %w", err)
+			}
+			upid, _ := result["task_id"].(string)
+			wf.Complete("clone", upid)
+		}
+	}
+
+	if !wf.Done("clone_wait") {
+		var err error
+		if upid := wf.Detail("clone"); upid != "" {
+			err = waitForClone(api, deploy.SourceNode, map[string]interface{}{"task_id": upid}, req.WaitTimeout)
+		} else {
+			err = waitForUnlock(api, req.Node, req.VMID, deployTimeout(req.WaitTimeout))
+		}
+		if err != nil {
+			wf.Fail("clone_wait", err)
+			return fmt.Errorf("failed to clone template VM: %w", err)
+		}
+		wf.Complete("clone_wait", "")
+	}
+
+	if !wf.Done("configure") {
+		if err := applyTemplateConfig(api, req); err != nil {
+			wf.Fail("configure", err)
+			return err
+		}
+		wf.Complete("configure", "")
+	}
+
+	if req.CloudInit && !wf.Done("start") {
+		status, err := GetVM(api, req.Node, req.VMID)
+		if err != nil {
+			return err
+		}
+		if status["status"] != "running" {
+			if err := StartVM(api, req.Node, req.VMID); err != nil {
+				wf.Fail("start", err)
+				return err
+			}
+		}
+		wf.Complete("start", "")
+	}
+	return nil
+}
+
+// cleanupTimeout bounds each compensating action of a failed deploy
+const cleanupTimeout = 5 * time.Minute
+
+// DeployError is returned when a deploy from a template failed after it
+// started. Steps says which steps succeeded and which failed, Cleanup what
+// was undone. Status is rolled_back, kept when keep_on_failure left the VM
+// for debugging, or cleanup_failed
+type DeployError struct {
+	Err        error          `json:"-"`
+	WorkflowID string         `json:"workflow_id"`
+	Status     string         `json:"status"`
+	Steps      []WorkflowStep `json:"steps"`
+	Cleanup    []WorkflowStep `json:"cleanup"`
+}
+
+func (e *DeployError) Error() string {
+	switch e.Status {
+	case "kept":
+		return fmt.Sprintf("%v (VM kept for debugging)", e.Err)
+	case "cleanup_failed":
+		return fmt.Sprintf("%v (cleanup failed)", e.Err)
+	}
+	return fmt.Sprintf("%v (rolled back)", e.Err)
+}
+
+func (e *DeployError) Unwrap() error {
+	return e.Err
+}
+
+// failTemplateDeploy records the failed step and undoes the deploy
+func failTemplateDeploy(api *manager.APIManager, wf *Workflow, deploy *templateDeploy, step string, err error) *DeployError {
+	wf.Fail(step, err)
+	return compensateTemplateDeploy(api, wf, deploy, err)
+}
+
+// compensateTemplateDeploy undoes a failed deploy: the clone is stopped and
+// destroyed, unless keep_on_failure is set, and an allocated VMID released.
+// The VM is only touched when this deploy created it, never when the clone
+// was refused because the VMID was taken
+func compensateTemplateDeploy(api *manager.APIManager, wf *Workflow, deploy *templateDeploy, cause error) *DeployError {
+	req := &deploy.Request
+	api, span := startStep(api, "Rollback", "proxmox.node", req.Node, "vmid", req.VMID)
+	deployErr := &DeployError{Err: cause, WorkflowID: wf.ID, Status: "rolled_back", Steps: wf.History()}
+	undo := len(deployErr.Steps)
+
+	switch {
+	case !wf.Done("clone"):
+		releaseDeployVMID(wf, deploy)
+	case req.KeepOnFailure:
+		deployErr.Status = "kept"
+		wf.Skip("delete_vm", "keep_on_failure")
+	default:
+		removed, err := removeDeployedVM(api, req, cleanupTimeout)
+		switch {
+		case err != nil:
+			deployErr.Status = "cleanup_failed"
+			wf.Fail("delete_vm", err)
+		case removed:
+			wf.Complete("delete_vm", req.VMID)
+		default:
+			wf.Skip("delete_vm", "VM does not exist")
+		}
+		if err == nil {
+			releaseDeployVMID(wf, deploy)
+		}
+	}
+
+	deployErr.Cleanup = wf.History()[undo:]
+	span.SetAttributes(tracing.Attributes("rollback.status", deployErr.Status)...)
+	if deployErr.Status == "cleanup_failed" {
+		tracing.End(span, deployErr)
+	} else {
+		tracing.End(span, nil)
+	}
+	switch deployErr.Status {
+	case "rolled_back":
+		wf.Finish("rolled_back", cause)
+	default:
+		wf.Finish("failed", deployErr)
+	}
+	slog.Warn("template deploy failed", "workflow", wf.ID, "vmid", req.VMID, "status", deployErr.Status, "error", cause)
+	return deployErr
+}
+
+// releaseDeployVMID releases the VMID when the deploy allocated it. A VMID
+// from the request may belong to another guest or reservation
+func releaseDeployVMID(wf *Workflow, deploy *templateDeploy) {
+	if !deploy.Allocated {
+		return
+	}
+	ReleaseVMID(deploy.Request.VMID)
+	wf.Complete("release_vmid", deploy.Request.VMID)
+}
+
+// rollbackTemplateDeploy undoes a deploy that could not be recovered
+func rollbackTemplateDeploy(api *manager.APIManager, wf *Workflow, deploy *templateDeploy, cause error) error {
+	if deployErr := compensateTemplateDeploy(api, wf, deploy, cause); deployErr.Status == "cleanup_failed" {
+		return deployErr
+	}
+	return nil
+}
+
+// removeDeployedVM stops and destroys the VM of a deploy. It reports false
+// when the VM does not exist
+func removeDeployedVM(api *manager.APIManager, req *VMCreateRequest, timeout time.Duration) (bool, error) {
+	exists, err := VMExists(api, req.Node, req.VMID)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, nil
+	}
+	if err := checkDeployedVM(api, req); err != nil {
+		return false, err
+	}
+	if err := waitForUnlock(api, req.Node, req.VMID, timeout); err != nil {
+		return false, err
+	}
+
+	status, err := GetVM(api, req.Node, req.VMID)
+	if err != nil {
+		return false, err
+	}
+	if status["status"] == "running" {
+		response, err := api.ApiCallWithOptions("POST", fmt.Sprintf("/nodes/%s/qemu/%s/status/stop", req.Node, req.VMID), nil, false)
+		if err != nil {
+			return false, fmt.Errorf("failed to stop VM: %w", err)
+		}
+		if err := waitForResponseTask(api, req.Node, response, timeout); err != nil {
+			return false, fmt.Errorf("failed to stop VM: %w", err)
+		}
+	}
+
+	response, err := api.ApiCall("DELETE", fmt.Sprintf("/nodes/%s/qemu/%s?purge=1&destroy-unreferenced-disks=1", req.Node, req.VMID), nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete VM: %w", err)
+	}
+	if err := waitForResponseTask(api, req.Node, response, timeout); err != nil {
+		return false, fmt.Errorf("failed to delete VM: %w", err)
+	}
+	return true, nil
+}
+
+// checkDeployedVM makes sure the VM with the deploy's VMID is the clone, so
+// a VM that took over the VMID is never configured or removed
+func checkDeployedVM(api *manager.APIManager, req *VMCreateRequest) error {
+	config, err := GetVMConfig(api, req.Node, req.VMID)
+	if err != nil {
+		return err
+	}
+	if name, _ := config["name"].(string); name != req.Name {
+		return fmt.Errorf("VM %s is named '%s' instead of '%s', leaving it in place", req.VMID, name, req.Name)
+	}
+	return nil
+}
+
+// waitForUnlock waits until no task such as a clone holds a lock on the VM
+func waitForUnlock(api *manager.APIManager, node, vmid string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		config, err := GetVMConfig(api, node, vmid)
+		if err != nil {
+			return err
+		}
+		lock, _ := config["lock"].(string)
+		if lock == "" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("VM %s still locked (%s) after %s", vmid, lock, timeout)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func deployTimeout(waitTimeout int) time.Duration {
+	if waitTimeout <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(waitTimeout) * time.Second
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"rm-thierry/Proxmox-API/src/manager"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDeployAPI serves the calls that remove a deployed VM and records the
+// changes made. exists, name and status describe the VM, deleteFails makes
+// the DELETE fail
+func fakeDeployAPI(t *testing.T, vmid string, exists bool, name, status string, deleteFails bool) (*manager.APIManager, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var changes []string
+
+	vmPath := "/nodes/pve/qemu/" + vmid
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data interface{}
+		switch {
+		case r.Method != "GET":
+			mu.Lock()
+			changes = append(changes, r.Method+" "+r.URL.Path)
+			mu.Unlock()
+			switch {
+			case r.Method == "DELETE" && r.URL.Path == vmPath && deleteFails:
+				http.Error(w, `{"data":null}`, http.StatusInternalServerError)
+				return
+			case r.Method == "DELETE" && r.URL.Path == vmPath:
+				data = "UPID:pve:0001:0002:6AD50000:qmdestroy:" + vmid + ":root@pam:"
+			case r.Method == "POST" && r.URL.Path == vmPath+"/status/stop":
+				data = "UPID:pve:0001:0002:6AD50000:qmstop:" + vmid + ":root@pam:"
+			default:
+				http.NotFound(w, r)
+				return
+			}
+		case r.URL.Path == "/nodes/pve/qemu":
+			guests := []map[string]interface{}{}
+			if exists {
+				id, _ := strconv.Atoi(vmid)
+				guests = append(guests, map[string]interface{}{"vmid": id, "name": name})
+			}
+			data = guests
+		case r.URL.Path == vmPath+"/config":
+			data = map[string]interface{}{"name": name}
+		case r.URL.Path == vmPath+"/status/current":
+			data = map[string]interface{}{"status": status}
+		case strings.HasPrefix(r.URL.Path, "/nodes/pve/tasks/"):
+			data = map[string]interface{}{"status": "stopped", "exitstatus": "OK"}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	t.Cleanup(server.Close)
+
+	return &manager.APIManager{BaseURL: server.URL, Node: "pve"}, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, changes...)
+	}
+}
+
+func TestFailTemplateDeploy(t *testing.T) {
+	// Keep the journal out of the source tree
+	journal := defaultWorkflowJournal()
+	journal.mu.Lock()
+	oldPath, oldEntries := journal.path, journal.entries
+	journal.path, journal.entries = filepath.Join(t.TempDir(), "workflows.json"), nil
+	journal.mu.Unlock()
+	t.Cleanup(func() {
+		journal.mu.Lock()
+		journal.path, journal.entries = oldPath, oldEntries
+		journal.mu.Unlock()
+	})
+
+	tests := []struct {
+		name          string
+		vmid          string
+		cloned        bool
+		allocated     bool
+		keepOnFailure bool
+		exists        bool
+		vmName        string
+		deleteFails   bool
+		wantStatus    string
+		wantCleanup   []string
+		wantChanges   []string
+		wantReleased  bool
+	}{
+		{
+			name:         "clone failed",
+			vmid:         "4301",
+			allocated:    true,
+			wantStatus:   "rolled_back",
+			wantCleanup:  []string{"release_vmid done"},
+			wantReleased: true,
+		},
+		{
+			name:        "clone failed with the VMID of the request",
+			vmid:        "4302",
+			wantStatus:  "rolled_back",
+			wantCleanup: []string{},
+		},
+		{
+			name:          "keep on failure",
+			vmid:          "4303",
+			cloned:        true,
+			allocated:     true,
+			keepOnFailure: true,
+			exists:        true,
+			vmName:        "app",
+			wantStatus:    "kept",
+			wantCleanup:   []string{"delete_vm skipped"},
+		},
+		{
+			name:         "clone removed",
+			vmid:         "4304",
+			cloned:       true,
+			allocated:    true,
+			exists:       true,
+			vmName:       "app",
+			wantStatus:   "rolled_back",
+			wantCleanup:  []string{"delete_vm done", "release_vmid done"},
+			wantChanges:  []string{"POST /nodes/pve/qemu/4304/status/stop", "DELETE /nodes/pve/qemu/4304"},
+			wantReleased: true,
+		},
+		{
+			name:        "clone removed with the VMID of the request",
+			vmid:        "4305",
+			cloned:      true,
+			exists:      true,
+			vmName:      "app",
+			wantStatus:  "rolled_back",
+			wantCleanup: []string{"delete_vm done"},
+			wantChanges: []string{"POST /nodes/pve/qemu/4305/status/stop", "DELETE /nodes/pve/qemu/4305"},
+		},
+		{
+			name:         "clone already gone",
+			vmid:         "4306",
+			cloned:       true,
+			allocated:    true,
+			wantStatus:   "rolled_back",
+			wantCleanup:  []string{"delete_vm skipped", "release_vmid done"},
+			wantReleased: true,
+		},
+		{
+			name:        "delete fails",
+			vmid:        "4307",
+			cloned:      true,
+			allocated:   true,
+			exists:      true,
+			vmName:      "app",
+			deleteFails: true,
+			wantStatus:  "cleanup_failed",
+			wantCleanup: []string{"delete_vm failed"},
+			wantChanges: []string{"POST /nodes/pve/qemu/4307/status/stop", "DELETE /nodes/pve/qemu/4307"},
+		},
+		{
+			name:        "VMID taken over by another VM",
+			vmid:        "4308",
+			cloned:      true,
+			allocated:   true,
+			exists:      true,
+			vmName:      "other",
+			wantStatus:  "cleanup_failed",
+			wantCleanup: []string{"delete_vm failed"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, changes := fakeDeployAPI(t, tt.vmid, tt.exists, tt.vmName, "running", tt.deleteFails)
+
+			// The reservation stands for the deploy's own or, for a VMID
+			// from the request, another request's
+			id, _ := strconv.Atoi(tt.vmid)
+			allocator := defaultVMIDAllocator()
+			allocator.mu.Lock()
+			allocator.reservations[id] = time.Now().Add(time.Minute)
+			allocator.mu.Unlock()
+			t.Cleanup(func() { allocator.Release(id) })
+
+			deploy := &templateDeploy{
+				Request:   VMCreateRequest{Node: "pve", VMID: tt.vmid, Name: "app", KeepOnFailure: tt.keepOnFailure},
+				Allocated: tt.allocated,
+			}
+			wf := &Workflow{ID: "test-" + tt.vmid, Type: templateWorkflow, Node: "pve", VMID: tt.vmid, Status: "running", Steps: []WorkflowStep{}}
+			step := "clone"
+			if tt.cloned {
+				wf.Complete("clone", "")
+				step = "configure"
+			}
+
+			deployErr := failTemplateDeploy(api, wf, deploy, step, errors.New("step failed"))
+
+			if deployErr.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", deployErr.Status, tt.wantStatus)
+			}
+			if cause := errors.Unwrap(deployErr); cause == nil || cause.Error() != "step failed" {
+				t.Errorf("error = %v, want it to wrap the failed step", deployErr)
+			}
+			if last := deployErr.Steps[len(deployErr.Steps)-1]; last.Name != step || last.Status != "failed" {
+				t.Errorf("last step = %s %s, want %s failed", last.Name, last.Status, step)
+			}
+
+			cleanup := make([]string, len(deployErr.Cleanup))
+			for i, s := range deployErr.Cleanup {
+				cleanup[i] = s.Name + " " + s.Status
+			}
+			if !reflect.DeepEqual(cleanup, tt.wantCleanup) {
+				t.Errorf("cleanup = %v, want %v", cleanup, tt.wantCleanup)
+			}
+			if got := changes(); len(got)+len(tt.wantChanges) > 0 && !reflect.DeepEqual(got, tt.wantChanges) {
+				t.Errorf("changes = %v, want %v", got, tt.wantChanges)
+			}
+
+			allocator.mu.Lock()
+			_, reserved := allocator.reservations[id]
+			allocator.mu.Unlock()
+			if reserved == tt.wantReleased {
+				t.Errorf("VMID still reserved = %v, want %v", reserved, !tt.wantReleased)
+			}
+
+			wantWorkflow := "failed"
+			if tt.wantStatus == "rolled_back" {
+				wantWorkflow = "rolled_back"
+			}
+			if wf.Status != wantWorkflow {
+				t.Errorf("workflow status = %q, want %q", wf.Status, wantWorkflow)
+			}
+		})
+	}
+}
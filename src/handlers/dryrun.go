@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"fmt"
+	"rm-thierry/Proxmox-API/src/manager"
+	"strconv"
+)
+
+// PlannedCall is a Proxmox call a dry run would have made
+type PlannedCall struct {
+	Method   string                 `json:"method"`
+	Endpoint string                 `json:"endpoint"`
+	Payload  map[string]interface{} `json:"payload,omitempty"`
+}
+
+// dryRunResult reports the calls of an operation that passed validation
+func dryRunResult(calls ...PlannedCall) map[string]interface{} {
+	return map[string]interface{}{"dry_run": true, "calls": calls}
+}
+
+// plannedCalls returns the calls of a dry run result
+func plannedCalls(result map[string]interface{}) []PlannedCall {
+	calls, _ := result["calls"].([]PlannedCall)
+	return calls
+}
+
+// guestActionCall is the call GuestAction makes
+func guestActionCall(guestType, node, vmid, action string) PlannedCall {
+	if action == "delete" {
+		return PlannedCall{Method: "DELETE", Endpoint: fmt.Sprintf("/nodes/%s/%s/%s", node, guestType, vmid)}
+	}
+	return PlannedCall{Method: "POST", Endpoint: fmt.Sprintf("/nodes/%s/%s/%s/status/%s", node, guestType, vmid, action)}
+}
+
+// DeleteVMDryRun runs the checks of DeleteVM and returns the call it would make
+func DeleteVMDryRun(api *manager.APIManager, node, vmid string) (map[string]interface{}, error) {
+	if err := validateDeleteVM(api, node, vmid); err != nil {
+		return nil, err
+	}
+	return dryRunResult(guestActionCall("qemu", node, vmid, "delete")), nil
+}
+
+// DeleteContainerDryRun runs the checks of DeleteContainer and returns the
+// call it would make
+func DeleteContainerDryRun(apiManager *manager.APIManager, node, ctid string) (map[string]interface{}, error) {
+	if err := validateDeleteContainer(apiManager, node, ctid); err != nil {
+		return nil, err
+	}
+	return dryRunResult(guestActionCall("lxc", node, ctid, "delete")), nil
+}
+
+// UpdateVMConfigDryRun returns the config change UpdateVMConfig would send
+func UpdateVMConfigDryRun(api *manager.APIManager, node, vmid string, options map[string]interface{}) (map[string]interface{}, error) {
+	call, err := planUpdateVMConfig(api, node, vmid, options)
+	if err != nil {
+		return nil, err
+	}
+	result := dryRunResult(call)
+	result["changed"] = sortedKeys(call.Payload)
+	return result, nil
+}
+
+// UpdateContainerConfigDryRun returns the config change UpdateContainerConfig
+// would send
+func UpdateContainerConfigDryRun(apiManager *manager.APIManager, node, ctid string, update *ContainerConfigUpdate) (map[string]interface{}, error) {
+	call, err := planUpdateContainerConfig(apiManager, node, ctid, update)
+	if err != nil {
+		return nil, err
+	}
+	result := dryRunResult(call)
+	result["changed"] = sortedKeys(call.Payload)
+	return result, nil
+}
+
+// formatGB formats a size in bytes as whole gigabytes
+func formatGB(size int64) string {
+	return strconv.FormatInt(size>>30, 10) + "G"
+}
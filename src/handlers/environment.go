@@ -0,0 +1,758 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"rm-thierry/Proxmox-API/src/manager"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var environmentNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// EnvironmentSpec describes a set of guests that are managed together.
+// Every guest gets the tag "env-{name}", which is how apply finds guests
+// that were removed from the spec and how destroy finds what to delete
+type EnvironmentSpec struct {
+	Name    string      `json:"name"`
+	Node    string      `json:"node,omitempty"`
+	Timeout int         `json:"timeout,omitempty"`
+	Guests  []GuestSpec `json:"guests"`
+}
+
+// GuestSpec is one VM or container. Memory and Swap are in MB, Disk in GB.
+// Guests are matched to existing ones by name
+type GuestSpec struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type,omitempty"`
+	Node        string   `json:"node,omitempty"`
+	Template    string   `json:"template,omitempty"`
+	Cores       int      `json:"cores,omitempty"`
+	Memory      int      `json:"memory,omitempty"`
+	Swap        *int     `json:"swap,omitempty"`
+	Disk        int      `json:"disk,omitempty"`
+	Storage     string   `json:"storage,omitempty"`
+	Bridge      string   `json:"bridge,omitempty"`
+	ISO         string   `json:"iso,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Description string   `json:"description,omitempty"`
+	OnBoot      bool     `json:"onboot,omitempty"`
+	Start       bool     `json:"start,omitempty"`
+	SSHKeys     string   `json:"ssh_public_keys,omitempty"`
+	Password    string   `json:"password,omitempty"`
+	Ciuser      string   `json:"ciuser,omitempty"`
+	Team        string   `json:"team,omitempty"`
+	DependsOn   []string `json:"depends_on,omitempty"`
+}
+
+type FieldChange struct {
+	Field          string `json:"field"`
+	From           string `json:"from"`
+	To             string `json:"to"`
+	RebootRequired bool   `json:"reboot_required,omitempty"`
+}
+
+// PlanAction is "create", "update", "delete" or "none" for one guest
+type PlanAction struct {
+	Action         string        `json:"action"`
+	Name           string        `json:"name"`
+	Type           string        `json:"type"`
+	Node           string        `json:"node,omitempty"`
+	VMID           string        `json:"vmid,omitempty"`
+	Changes        []FieldChange `json:"changes,omitempty"`
+	RebootRequired bool          `json:"reboot_required,omitempty"`
+	Warnings       []string      `json:"warnings,omitempty"`
+
+	spec    *GuestSpec
+	running bool
+}
+
+type EnvironmentPlan struct {
+	Environment string       `json:"environment"`
+	Actions     []PlanAction `json:"actions"`
+	Creates     int          `json:"creates"`
+	Updates     int          `json:"updates"`
+	Deletes     int          `json:"deletes"`
+	Unchanged   int          `json:"unchanged"`
+}
+
+// EnvironmentStep is the outcome of one plan action. Status is "done",
+// "failed", "skipped" or "kept" for a guest that apply did not delete
+// because prune was not set. RebootRequired means the update is only
+// applied once the guest is rebooted, which apply does not do
+type EnvironmentStep struct {
+	Action         string `json:"action"`
+	Name           string `json:"name"`
+	VMID           string `json:"vmid,omitempty"`
+	Status         string `json:"status"`
+	Error          string `json:"error,omitempty"`
+	Note           string `json:"note,omitempty"`
+	RebootRequired bool   `json:"reboot_required,omitempty"`
+}
+
+type EnvironmentResult struct {
+	Environment string            `json:"environment"`
+	Plan        *EnvironmentPlan  `json:"plan"`
+	Steps       []EnvironmentStep `json:"steps"`
+	Succeeded   int               `json:"succeeded"`
+	Failed      int               `json:"failed"`
+	Skipped     int               `json:"skipped"`
+	Kept        int               `json:"kept"`
+}
+
+// ParseEnvironmentSpec reads a spec in JSON or YAML
+func ParseEnvironmentSpec(data []byte) (*EnvironmentSpec, error) {
+	if !json.Valid(data) {
+		// Decode YAML generically and reuse the JSON field names
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("invalid environment spec: %w", err)
+		}
+		converted, err := json.Marshal(doc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid environment spec: %w", err)
+		}
+		data = converted
+	}
+
+	var spec EnvironmentSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("invalid environment spec: %w", err)
+	}
+	return &spec, nil
+}
+
+func (spec *EnvironmentSpec) tag() string {
+	return "env-" + spec.Name
+}
+
+func (spec *EnvironmentSpec) timeout() time.Duration {
+	if spec.Timeout > 0 {
+		return time.Duration(spec.Timeout) * time.Second
+	}
+	return 10 * time.Minute
+}
+
+// PlanEnvironment compares the spec with the cluster. Creates and updates
+// are listed in dependency order, deletes of guests that carry the
+// environment tag but are no longer in the spec come last
+func PlanEnvironment(api *manager.APIManager, spec *EnvironmentSpec) (*EnvironmentPlan, error) {
+	ordered, err := validateEnvironment(api, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, orphans, err := matchEnvironmentGuests(api, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &EnvironmentPlan{Environment: spec.Name, Actions: []PlanAction{}}
+	for _, guest := range ordered {
+		current, ok := existing[guest.Name]
+		if !ok {
+			plan.Actions = append(plan.Actions, PlanAction{
+				Action: "create",
+				Name:   guest.Name,
+				Type:   guest.Type,
+				Node:   guest.Node,
+				spec:   guest,
+			})
+			plan.Creates++
+			continue
+		}
+
+		action, err := diffGuest(api, spec, guest, current)
+		if err != nil {
+			return nil, err
+		}
+		if action.Action == "update" {
+			plan.Updates++
+		} else {
+			plan.Unchanged++
+		}
+		plan.Actions = append(plan.Actions, *action)
+	}
+
+	for _, orphan := range orphans {
+		plan.Actions = append(plan.Actions, deleteAction(orphan))
+		plan.Deletes++
+	}
+	return plan, nil
+}
+
+// ApplyEnvironment converges the cluster to the spec. When a step fails,
+// the guests that depend on it are skipped and everything else continues.
+// Tagged guests that were removed from the spec are only stopped and
+// deleted with prune, otherwise they are kept and reported
+func ApplyEnvironment(api *manager.APIManager, spec *EnvironmentSpec, prune bool) (*EnvironmentResult, error) {
+	plan, err := PlanEnvironment(api, spec)
+	if err != nil {
+		return nil, err
+	}
+	return runEnvironmentPlan(api, spec, plan, prune), nil
+}
+
+// DestroyEnvironment deletes every guest that carries the environment tag,
+// dependents first. Guests with a matching name but without the tag are kept
+func DestroyEnvironment(api *manager.APIManager, spec *EnvironmentSpec) (*EnvironmentResult, error) {
+	ordered, err := validateEnvironment(api, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, orphans, err := matchEnvironmentGuests(api, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &EnvironmentPlan{Environment: spec.Name, Actions: []PlanAction{}}
+	for _, orphan := range orphans {
+		plan.Actions = append(plan.Actions, deleteAction(orphan))
+	}
+	for i := len(ordered) - 1; i >= 0; i-- {
+		current, ok := existing[ordered[i].Name]
+		if !ok || !containsString(current.Tags, spec.tag()) {
+			continue
+		}
+		action := deleteAction(current)
+		action.spec = ordered[i]
+		plan.Actions = append(plan.Actions, action)
+	}
+	plan.Deletes = len(plan.Actions)
+
+	return runEnvironmentPlan(api, spec, plan, true), nil
+}
+
+func runEnvironmentPlan(api *manager.APIManager, spec *EnvironmentSpec, plan *EnvironmentPlan, prune bool) *EnvironmentResult {
+	result := &EnvironmentResult{Environment: spec.Name, Plan: plan, Steps: []EnvironmentStep{}}
+	failed := make(map[string]bool)
+
+	for i := range plan.Actions {
+		action := &plan.Actions[i]
+		if action.Action == "none" {
+			continue
+		}
+
+		step := EnvironmentStep{Action: action.Action, Name: action.Name, VMID: action.VMID}
+		if action.Action == "delete" && !prune {
+			step.Status = "kept"
+			step.Note = "removed from the spec, apply with prune to delete it"
+			result.Kept++
+			result.Steps = append(result.Steps, step)
+			continue
+		}
+		if blocked := blockedBy(action, failed); blocked != "" {
+			step.Status = "skipped"
+			step.Error = fmt.Sprintf("depends on %s, which failed", blocked)
+			failed[action.Name] = true
+			result.Skipped++
+			result.Steps = append(result.Steps, step)
+			continue
+		}
+
+		var err error
+		switch action.Action {
+		case "create":
+			step.VMID, err = createEnvironmentGuest(api, spec, action.spec)
+		case "update":
+			err = updateEnvironmentGuest(api, action)
+		case "delete":
+			err = deleteEnvironmentGuest(api, action, spec.timeout())
+		}
+
+		if err != nil {
+			step.Status = "failed"
+			step.Error = err.Error()
+			failed[action.Name] = true
+			result.Failed++
+		} else {
+			step.Status = "done"
+			result.Succeeded++
+			if action.Action == "update" && action.RebootRequired {
+				step.RebootRequired = true
+				step.Note = "reboot the guest to apply " + strings.Join(rebootFields(action), " and ")
+			}
+		}
+		result.Steps = append(result.Steps, step)
+	}
+
+	return result
+}
+
+// rebootFields lists the changes that only apply after a reboot
+func rebootFields(action *PlanAction) []string {
+	var fields []string
+	for _, change := range action.Changes {
+		if change.RebootRequired {
+			fields = append(fields, change.Field)
+		}
+	}
+	return fields
+}
+
+func blockedBy(action *PlanAction, failed map[string]bool) string {
+	if action.spec == nil || action.Action == "delete" {
+		return ""
+	}
+	for _, dep := range action.spec.DependsOn {
+		if failed[dep] {
+			return dep
+		}
+	}
+	return ""
+}
+
+// validateEnvironment fills in defaults and returns the guests in
+// dependency order
+func validateEnvironment(api *manager.APIManager, spec *EnvironmentSpec) ([]*GuestSpec, error) {
+	if !environmentNamePattern.MatchString(spec.Name) {
+		return nil, fmt.Errorf("invalid environment name '%s', use lowercase letters, digits, '.', '_' and '-'", spec.Name)
+	}
+	if spec.Node == "" {
+		spec.Node = api.Node
+	}
+
+	byName := make(map[string]*GuestSpec)
+	for i := range spec.Guests {
+		guest := &spec.Guests[i]
+		if guest.Name == "" {
+			return nil, fmt.Errorf("invalid environment: guest %d has no name", i)
+		}
+		if _, dup := byName[guest.Name]; dup {
+			return nil, fmt.Errorf("invalid environment: guest %s is defined twice", guest.Name)
+		}
+		switch guest.Type {
+		case "":
+			guest.Type = "qemu"
+		case "qemu", "lxc":
+		default:
+			return nil, fmt.Errorf("invalid environment: guest %s has type '%s', must be qemu or lxc", guest.Name, guest.Type)
+		}
+		if guest.Node == "" {
+			guest.Node = spec.Node
+		}
+		byName[guest.Name] = guest
+	}
+
+	// Kahn's algorithm, always taking the first ready guest of the spec so
+	// independent guests keep their order
+	pending := make(map[string]int)
+	for _, guest := range spec.Guests {
+		for _, dep := range guest.DependsOn {
+			if _, ok := byName[dep]; !ok {
+				return nil, fmt.Errorf("invalid environment: guest %s depends on unknown guest %s", guest.Name, dep)
+			}
+		}
+		pending[guest.Name] = len(guest.DependsOn)
+	}
+
+	ordered := make([]*GuestSpec, 0, len(spec.Guests))
+	done := make(map[string]bool)
+	for len(ordered) < len(spec.Guests) {
+		progressed := false
+		for i := range spec.Guests {
+			guest := &spec.Guests[i]
+			if done[guest.Name] || pending[guest.Name] > 0 {
+				continue
+			}
+			done[guest.Name] = true
+			ordered = append(ordered, guest)
+			progressed = true
+			for _, other := range spec.Guests {
+				for _, dep := range other.DependsOn {
+					if dep == guest.Name {
+						pending[other.Name]--
+					}
+				}
+			}
+			break
+		}
+		if !progressed {
+			return nil, fmt.Errorf("invalid environment: depends_on has a cycle")
+		}
+	}
+
+	return ordered, nil
+}
+
+// matchEnvironmentGuests finds the existing guest for every spec entry by
+// name, preferring guests that already carry the environment tag, and the
+// tagged guests that are no longer in the spec
+func matchEnvironmentGuests(api *manager.APIManager, spec *EnvironmentSpec) (map[string]InventoryItem, []InventoryItem, error) {
+	resources, err := GetClusterResources(api, "vm")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byName := make(map[string][]InventoryItem)
+	var tagged []InventoryItem
+	for _, resource := range resources {
+		item := inventoryItemFromResource(resource)
+		if item.Type != "qemu" && item.Type != "lxc" {
+			continue
+		}
+		byName[item.Type+"/"+item.Name] = append(byName[item.Type+"/"+item.Name], item)
+		if containsString(item.Tags, spec.tag()) {
+			tagged = append(tagged, item)
+		}
+	}
+
+	existing := make(map[string]InventoryItem)
+	for _, guest := range spec.Guests {
+		candidates := byName[guest.Type+"/"+guest.Name]
+		var inEnv []InventoryItem
+		for _, c := range candidates {
+			if containsString(c.Tags, spec.tag()) {
+				inEnv = append(inEnv, c)
+			}
+		}
+		if len(inEnv) > 0 {
+			candidates = inEnv
+		}
+
+		switch len(candidates) {
+		case 0:
+		case 1:
+			existing[guest.Name] = candidates[0]
+		default:
+			return nil, nil, fmt.Errorf("guest name %s is ambiguous, %d guests match", guest.Name, len(candidates))
+		}
+	}
+
+	var orphans []InventoryItem
+	for _, item := range tagged {
+		if current, ok := existing[item.Name]; ok && current.VMID == item.VMID {
+			continue
+		}
+		orphans = append(orphans, item)
+	}
+	return existing, orphans, nil
+}
+
+// diffGuest compares the managed fields. Fields that are not set in the
+// spec are left alone
+func diffGuest(api *manager.APIManager, spec *EnvironmentSpec, guest *GuestSpec, current InventoryItem) (*PlanAction, error) {
+	vmid := strconv.Itoa(current.VMID)
+	action := &PlanAction{
+		Action:  "none",
+		Name:    guest.Name,
+		Type:    guest.Type,
+		Node:    current.Node,
+		VMID:    vmid,
+		spec:    guest,
+		running: current.Status == "running",
+	}
+
+	var config map[string]interface{}
+	var err error
+	if guest.Type == "lxc" {
+		config, err = GetContainerConfig(api, current.Node, vmid)
+	} else {
+		config, err = GetVMConfig(api, current.Node, vmid)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hotplug, _ := config["hotplug"].(string)
+	if hotplug == "" {
+		hotplug = "network,disk,usb"
+	}
+
+	desired := desiredGuestConfig(spec, guest)
+	for _, field := range sortedKeys(desired) {
+		want := fmt.Sprint(desired[field])
+		have := configString(config[field])
+		if field == "tags" {
+			have = normalizeTags(parseTags(config[field]))
+		}
+		if field == "onboot" && have == "" {
+			have = "0"
+		}
+		if want == have {
+			continue
+		}
+
+		change := FieldChange{Field: field, From: have, To: want}
+		if guest.Type == "qemu" && action.running {
+			switch {
+			case field == "cores" && !strings.Contains(hotplug, "cpu"),
+				field == "memory" && !strings.Contains(hotplug, "memory"):
+				change.RebootRequired = true
+				action.RebootRequired = true
+			}
+		}
+		action.Changes = append(action.Changes, change)
+	}
+
+	// Only container root filesystems are resized, and only upwards
+	if guest.Type == "lxc" && guest.Disk > 0 {
+		rootfs, _ := config["rootfs"].(string)
+		if size := volumeSizeGB(rootfs); size > 0 && guest.Disk != size {
+			if guest.Disk > size {
+				action.Changes = append(action.Changes, FieldChange{
+					Field: "disk", From: fmt.Sprintf("%dG", size), To: fmt.Sprintf("%dG", guest.Disk),
+				})
+			} else {
+				action.Warnings = append(action.Warnings, fmt.Sprintf("disk cannot shrink from %dG to %dG", size, guest.Disk))
+			}
+		}
+	}
+
+	if len(action.Changes) > 0 {
+		action.Action = "update"
+	}
+	return action, nil
+}
+
+func desiredGuestConfig(spec *EnvironmentSpec, guest *GuestSpec) map[string]interface{} {
+	desired := map[string]interface{}{
+		"tags": normalizeTags(append([]string{spec.tag()}, guest.Tags...)),
+	}
+	if guest.OnBoot {
+		desired["onboot"] = 1
+	} else {
+		desired["onboot"] = 0
+	}
+	if guest.Cores > 0 {
+		desired["cores"] = guest.Cores
+	}
+	if guest.Memory > 0 {
+		desired["memory"] = guest.Memory
+	}
+	if guest.Swap != nil && guest.Type == "lxc" {
+		desired["swap"] = *guest.Swap
+	}
+	if guest.Description != "" {
+		desired["description"] = guest.Description
+	}
+	return desired
+}
+
+func createEnvironmentGuest(api *manager.APIManager, spec *EnvironmentSpec, guest *GuestSpec) (string, error) {
+	var result map[string]interface{}
+	var node, vmid string
+
+	if guest.Type == "lxc" {
+		config := NewDefaultContainerConfig(guest.Node)
+		config.Name = guest.Name
+		config.Team = guest.Team
+		config.Password = guest.Password
+		config.SSHKeys = guest.SSHKeys
+		config.OnBoot = guest.OnBoot
+		if guest.Template != "" {
+			config.Template = guest.Template
+		}
+		if guest.Cores > 0 {
+			config.Cores = guest.Cores
+		}
+		if guest.Memory > 0 {
+			config.Memory = guest.Memory
+		}
+		if guest.Swap != nil {
+			config.Swap = *guest.Swap
+		}
+		if guest.Disk > 0 {
+			config.Disk = guest.Disk
+		}
+		if guest.Storage != "" {
+			config.Storage = guest.Storage
+		}
+		if guest.Bridge != "" {
+			config.Networks[0].Bridge = guest.Bridge
+		}
+
+		// Allocate here, CreateContainer works on a copy of the config
+		var allocated bool
+		var err error
+		config.CTID, allocated, err = allocateVMID(api, vmidScope(guest.Team, "lxc"), false)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate CTID: %w", err)
+		}
+		vmid = config.CTID
+
+		result, err = CreateContainer(api, config)
+		releaseAllocatedVMID(config.CTID, allocated && err != nil)
+		if err != nil {
+			return vmid, err
+		}
+	} else {
+		req := &VMCreateRequest{
+			Node:       guest.Node,
+			Name:       guest.Name,
+			Cores:      guest.Cores,
+			Memory:     guest.Memory,
+			Net:        guest.Bridge,
+			ISO:        guest.ISO,
+			Template:   guest.Template,
+			SSHKeys:    guest.SSHKeys,
+			Ciuser:     guest.Ciuser,
+			Cipassword: guest.Password,
+			Team:       guest.Team,
+			OSType:     "l26",
+			Sockets:    1,
+			// Template clones are started below once they are tagged
+			CloudInit: guest.Template == "" && guest.ISO == "",
+		}
+		if guest.Disk > 0 {
+			req.Disk = fmt.Sprintf("%s:%dG", guest.Storage, guest.Disk)
+		}
+
+		var err error
+		result, err = CreateVM(api, req)
+		if err != nil {
+			return req.VMID, err
+		}
+		vmid, node = req.VMID, req.Node
+	}
+
+	if node == "" {
+		node = guest.Node
+	}
+	if placed, ok := result["node"].(string); ok {
+		node = placed
+	}
+
+	// A clone runs on the node of the template copy, not the target node
+	if upid := resultTaskID(result); upid != "" {
+		if _, err := WaitForTask(api, TaskNode(upid), upid, spec.timeout()); err != nil {
+			return vmid, err
+		}
+	}
+
+	payload := map[string]interface{}{}
+	for key, value := range desiredGuestConfig(spec, guest) {
+		payload[key] = value
+	}
+	if _, err := api.ApiCall("PUT", fmt.Sprintf("/nodes/%s/%s/%s/config", node, guest.Type, vmid), payload); err != nil {
+		return vmid, fmt.Errorf("created but failed to set tags: %w", err)
+	}
+
+	if guest.Start {
+		upid, err := GuestAction(api, guest.Type, node, vmid, "start")
+		if err != nil {
+			return vmid, err
+		}
+		if upid != "" {
+			if _, err := WaitForTask(api, TaskNode(upid), upid, spec.timeout()); err != nil {
+				return vmid, err
+			}
+		}
+	}
+	return vmid, nil
+}
+
+func updateEnvironmentGuest(api *manager.APIManager, action *PlanAction) error {
+	payload := map[string]interface{}{}
+	for _, change := range action.Changes {
+		if change.Field == "disk" {
+			continue
+		}
+		payload[change.Field] = change.To
+	}
+
+	if len(payload) > 0 {
+		endpoint := fmt.Sprintf("/nodes/%s/%s/%s/config", action.Node, action.Type, action.VMID)
+		if _, err := api.ApiCall("PUT", endpoint, payload); err != nil {
+			return fmt.Errorf("failed to update %s: %w", action.Name, err)
+		}
+	}
+
+	for _, change := range action.Changes {
+		if change.Field != "disk" {
+			continue
+		}
+		_, err := ResizeContainerDisk(api, action.Node, action.VMID, &ContainerResizeRequest{Disk: "rootfs", Size: change.To})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteEnvironmentGuest(api *manager.APIManager, action *PlanAction, timeout time.Duration) error {
+	if action.running {
+		upid, err := GuestAction(api, action.Type, action.Node, action.VMID, "stop")
+		if err != nil {
+			return err
+		}
+		if upid != "" {
+			if _, err := WaitForTask(api, action.Node, upid, timeout); err != nil {
+				return err
+			}
+		}
+	}
+
+	upid, err := GuestAction(api, action.Type, action.Node, action.VMID, "delete")
+	if err != nil {
+		return err
+	}
+	if upid != "" {
+		_, err = WaitForTask(api, action.Node, upid, timeout)
+	}
+	return err
+}
+
+func deleteAction(item InventoryItem) PlanAction {
+	return PlanAction{
+		Action:  "delete",
+		Name:    item.Name,
+		Type:    item.Type,
+		Node:    item.Node,
+		VMID:    strconv.Itoa(item.VMID),
+		running: item.Status == "running",
+	}
+}
+
+// resultTaskID finds the UPID in a create result, which is either parsed
+// ("task_id") or the raw Proxmox response ("data")
+func resultTaskID(result map[string]interface{}) string {
+	if upid, ok := result["task_id"].(string); ok {
+		return upid
+	}
+	upid, _ := result["data"].(string)
+	return upid
+}
+
+func normalizeTags(tags []string) string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, tag := range tags {
+		tag = strings.ToLower(tag)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			unique = append(unique, tag)
+		}
+	}
+	sort.Strings(unique)
+	return strings.Join(unique, ";")
+}
+
+func configString(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case string:
+		return value
+	}
+	return fmt.Sprint(v)
+}
+
+// volumeSizeGB reads the size option of a volume string such as
+// "local-lvm:vm-100-disk-0,size=8G"
+func volumeSizeGB(volume string) int {
+	for _, part := range strings.Split(volume, ",") {
+		if size, ok := strings.CutPrefix(part, "size="); ok {
+			return int(parseSizeGB(size) / (1024 * 1024 * 1024))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"reflect"
+	"rm-thierry/Proxmox-API/src/manager"
+	"strings"
+	"testing"
+)
+
+func TestValidateEnvironment(t *testing.T) {
+	guest := func(name string, deps ...string) GuestSpec {
+		return GuestSpec{Name: name, DependsOn: deps}
+	}
+
+	tests := []struct {
+		name    string
+		spec    EnvironmentSpec
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "spec order without dependencies",
+			spec: EnvironmentSpec{Name: "staging", Guests: []GuestSpec{guest("web"), guest("db"), guest("cache")}},
+			want: []string{"web", "db", "cache"},
+		},
+		{
+			name: "dependencies first",
+			spec: EnvironmentSpec{Name: "staging", Guests: []GuestSpec{guest("web", "db", "cache"), guest("db"), guest("cache", "db")}},
+			want: []string{"db", "cache", "web"},
+		},
+		{
+			name: "independent guests keep their order",
+			spec: EnvironmentSpec{Name: "staging", Guests: []GuestSpec{guest("app", "db"), guest("db"), guest("proxy"), guest("worker", "db")}},
+			want: []string{"db", "app", "proxy", "worker"},
+		},
+		{
+			name: "chain",
+			spec: EnvironmentSpec{Name: "staging", Guests: []GuestSpec{guest("c", "b"), guest("b", "a"), guest("a")}},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name:    "cycle",
+			spec:    EnvironmentSpec{Name: "staging", Guests: []GuestSpec{guest("a", "b"), guest("b", "a"), guest("c")}},
+			wantErr: "depends_on has a cycle",
+		},
+		{
+			name:    "depends on itself",
+			spec:    EnvironmentSpec{Name: "staging", Guests: []GuestSpec{guest("a", "a")}},
+			wantErr: "depends_on has a cycle",
+		},
+		{
+			name:    "unknown dependency",
+			spec:    EnvironmentSpec{Name: "staging", Guests: []GuestSpec{guest("web", "db")}},
+			wantErr: "guest web depends on unknown guest db",
+		},
+		{
+			name:    "duplicate guest",
+			spec:    EnvironmentSpec{Name: "staging", Guests: []GuestSpec{guest("web"), guest("web")}},
+			wantErr: "guest web is defined twice",
+		},
+		{
+			name:    "guest without name",
+			spec:    EnvironmentSpec{Name: "staging", Guests: []GuestSpec{guest("")}},
+			wantErr: "guest 0 has no name",
+		},
+		{
+			name:    "invalid type",
+			spec:    EnvironmentSpec{Name: "staging", Guests: []GuestSpec{{Name: "web", Type: "docker"}}},
+			wantErr: "must be qemu or lxc",
+		},
+		{
+			name:    "invalid environment name",
+			spec:    EnvironmentSpec{Name: "Staging Env", Guests: []GuestSpec{guest("web")}},
+			wantErr: "invalid environment name",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &manager.APIManager{Node: "pve"}
+			ordered, err := validateEnvironment(api, &tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("validateEnvironment() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateEnvironment() error = %v", err)
+			}
+
+			names := make([]string, len(ordered))
+			for i, guest := range ordered {
+				names[i] = guest.Name
+				if guest.Type != "qemu" || guest.Node != "pve" {
+					t.Errorf("guest %s has type %q and node %q, want the defaults qemu and pve", guest.Name, guest.Type, guest.Node)
+				}
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("validateEnvironment() order = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateEnvironmentGuestReleasesCTID(t *testing.T) {
+	// The fake only serves the cluster endpoints, so the create fails
+	api := fakeClusterAPI(t, nil, "7301")
+	spec := &EnvironmentSpec{Name: "staging"}
+	guest := &GuestSpec{Name: "cache", Type: "lxc", Node: "pve", Template: "local:vztmpl/debian-12.tar.zst"}
+
+	vmid, err := createEnvironmentGuest(api, spec, guest)
+	if err == nil {
+		t.Fatal("createEnvironmentGuest() returned no error")
+	}
+	if vmid != "7301" {
+		t.Fatalf("createEnvironmentGuest() vmid = %q, want the allocated 7301", vmid)
+	}
+
+	allocator := defaultVMIDAllocator()
+	allocator.mu.Lock()
+	_, reserved := allocator.reservations[7301]
+	allocator.mu.Unlock()
+	if reserved {
+		t.Error("the CTID is still reserved after the create failed")
+	}
+}
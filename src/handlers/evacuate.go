@@ -0,0 +1,550 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"rm-thierry/Proxmox-API/src/manager"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EvacuationRequest struct {
+	Targets        []string `json:"targets,omitempty"`
+	DryRun         bool     `json:"dry_run"`
+	Concurrency    int      `json:"concurrency,omitempty"`
+	IncludeStopped bool     `json:"include_stopped,omitempty"`
+	Timeout        int      `json:"timeout,omitempty"`
+}
+
+type GuestMigration struct {
+	VMID   string   `json:"vmid"`
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Status string   `json:"status"`
+	Memory int64    `json:"memory"`
+	CPUs   int      `json:"cpus"`
+	Tags   []string `json:"tags,omitempty"`
+	Source string   `json:"source"`
+	Target string   `json:"target,omitempty"`
+	TaskID string   `json:"task_id,omitempty"`
+	Result string   `json:"result,omitempty"`
+	Error  string   `json:"error,omitempty"`
+
+	// load is the guest's current CPU usage in cores
+	load float64
+}
+
+type EvacuationPlan struct {
+	Node       string           `json:"node"`
+	DryRun     bool             `json:"dry_run"`
+	Migrations []GuestMigration `json:"migrations"`
+	Unplaced   []GuestMigration `json:"unplaced,omitempty"`
+	Succeeded  int              `json:"succeeded"`
+	Failed     int              `json:"failed"`
+	// RecordError is set when the migrations ran but could not be recorded
+	// for a later return
+	RecordError string `json:"record_error,omitempty"`
+}
+
+type nodeCapacity struct {
+	name    string
+	freeMem int64
+	maxCPU  float64
+	usedCPU float64
+}
+
+// EvacuationStore records the guests migrated off each node so they can be
+// returned later, in the database when one is configured, otherwise in
+// EVACUATIONS_FILE (env/evacuations.json)
+type EvacuationStore struct {
+	mu      sync.Mutex
+	path    string
+	db      *manager.DBManager
+	entries map[string][]GuestMigration
+}
+
+var (
+	evacuationStoreOnce sync.Once
+	evacuationStore     *EvacuationStore
+)
+
+func defaultEvacuationStore() *EvacuationStore {
+	evacuationStoreOnce.Do(func() {
+		path := os.Getenv("EVACUATIONS_FILE")
+		if path == "" {
+			path = "env/evacuations.json"
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		evacuationStore = &EvacuationStore{path: path}
+	})
+	return evacuationStore
+}
+
+// SetEvacuationStore moves the evacuation records into the database, so
+// any instance can return the guests
+func SetEvacuationStore(db *manager.DBManager) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS evacuations (
+		node VARCHAR(64) PRIMARY KEY,
+		definition MEDIUMTEXT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create evacuation table: %w", err)
+	}
+
+	store := defaultEvacuationStore()
+	store.mu.Lock()
+	store.db = db
+	store.entries = nil
+	store.mu.Unlock()
+	return nil
+}
+
+// PlanEvacuation decides where every guest on the node should go, placing the
+// largest guests first on the node with the most free memory
+func PlanEvacuation(api *manager.APIManager, node string, req *EvacuationRequest) (*EvacuationPlan, error) {
+	capacities, err := evacuationTargets(api, node, req.Targets)
+	if err != nil {
+		return nil, err
+	}
+	if len(capacities) == 0 {
+		return nil, fmt.Errorf("no online target nodes available to evacuate %s", node)
+	}
+
+	guests, err := listNodeGuests(api, node)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &EvacuationPlan{Node: node, DryRun: req.DryRun, Migrations: []GuestMigration{}}
+
+	var candidates []GuestMigration
+	for _, guest := range guests {
+		if guest.Status != "running" && !req.IncludeStopped {
+			continue
+		}
+		candidates = append(candidates, guest)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Memory > candidates[j].Memory
+	})
+
+	for _, guest := range candidates {
+		target := pickEvacuationTarget(capacities, guest)
+		if target == nil {
+			guest.Error = "no target node has enough free memory and CPU"
+			plan.Unplaced = append(plan.Unplaced, guest)
+			continue
+		}
+
+		target.freeMem -= guest.Memory
+		target.usedCPU += guest.load
+		guest.Target = target.name
+		plan.Migrations = append(plan.Migrations, guest)
+	}
+
+	return plan, nil
+}
+
+// EvacuateNode migrates every guest off the node according to the plan and
+// remembers the successful migrations so they can be returned later
+func EvacuateNode(api *manager.APIManager, node string, req *EvacuationRequest) (*EvacuationPlan, error) {
+	plan, err := PlanEvacuation(api, node, req)
+	if err != nil {
+		return nil, err
+	}
+	if req.DryRun {
+		return plan, nil
+	}
+
+	runMigrations(api, plan, req)
+
+	var migrated []GuestMigration
+	for _, m := range plan.Migrations {
+		if m.Result == "migrated" {
+			migrated = append(migrated, m)
+		}
+	}
+
+	if len(migrated) > 0 {
+		if err := defaultEvacuationStore().add(node, migrated); err != nil {
+			plan.RecordError = err.Error()
+		}
+	}
+
+	return plan, nil
+}
+
+// ReturnGuests moves guests that were evacuated from the node back to it
+func ReturnGuests(api *manager.APIManager, node string, req *EvacuationRequest) (*EvacuationPlan, error) {
+	recorded, err := defaultEvacuationStore().get(node)
+	if err != nil {
+		return nil, err
+	}
+	if len(recorded) == 0 {
+		return nil, fmt.Errorf("no evacuation record found for node %s", node)
+	}
+
+	plan := &EvacuationPlan{Node: node, DryRun: req.DryRun}
+	for _, m := range recorded {
+		plan.Migrations = append(plan.Migrations, GuestMigration{
+			VMID:   m.VMID,
+			Name:   m.Name,
+			Type:   m.Type,
+			Status: m.Status,
+			Memory: m.Memory,
+			CPUs:   m.CPUs,
+			Source: m.Target,
+			Target: node,
+		})
+	}
+	if req.DryRun {
+		return plan, nil
+	}
+
+	runMigrations(api, plan, req)
+
+	var remaining []GuestMigration
+	for i, m := range plan.Migrations {
+		if m.Result != "migrated" {
+			remaining = append(remaining, recorded[i])
+		}
+	}
+
+	if err := defaultEvacuationStore().set(node, remaining); err != nil {
+		plan.RecordError = err.Error()
+	}
+
+	return plan, nil
+}
+
+// MigrateGuest starts a migration of a VM (qemu) or container (lxc) and
+// returns the Proxmox task ID
+func MigrateGuest(api *manager.APIManager, guestType, node, vmid, target string, online bool) (string, error) {
+	payload := map[string]interface{}{"target": target}
+	if online {
+		if guestType == "lxc" {
+			payload["restart"] = 1
+		} else {
+			payload["online"] = 1
+		}
+	}
+
+	response, err := api.ApiCall("POST", fmt.Sprintf("/nodes/%s/%s/%s/migrate", node, guestType, vmid), payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to migrate %s %s: %w", guestType, vmid, err)
+	}
+
+	result, err := parseResponse(response)
+	if err != nil {
+		return "", err
+	}
+
+	taskID, _ := result["task_id"].(string)
+	return taskID, nil
+}
+
+func runMigrations(api *manager.APIManager, plan *EvacuationPlan, req *EvacuationRequest) {
+	concurrency := req.Concurrency
+	if concurrency <= 0 {
+		concurrency = 2
+	}
+	timeout := time.Duration(req.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Minute
+	}
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range plan.Migrations {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(m *GuestMigration) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			taskID, err := MigrateGuest(api, m.Type, m.Source, m.VMID, m.Target, m.Status == "running")
+			if err == nil && taskID != "" {
+				m.TaskID = taskID
+				_, err = WaitForTask(api, m.Source, taskID, timeout)
+			}
+			if err != nil {
+				m.Result = "failed"
+				m.Error = err.Error()
+				return
+			}
+			m.Result = "migrated"
+		}(&plan.Migrations[i])
+	}
+	wg.Wait()
+
+	for _, m := range plan.Migrations {
+		if m.Result == "migrated" {
+			plan.Succeeded++
+		} else {
+			plan.Failed++
+		}
+	}
+}
+
+func evacuationTargets(api *manager.APIManager, node string, targets []string) ([]*nodeCapacity, error) {
+	nodes, err := GetNodes(api)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := make(map[string]bool)
+	for _, t := range targets {
+		allowed[t] = true
+	}
+
+	sourceFound := false
+	var capacities []*nodeCapacity
+	for _, n := range nodes {
+		name, _ := n["node"].(string)
+		if name == node {
+			sourceFound = true
+			continue
+		}
+		if status, _ := n["status"].(string); status != "online" {
+			continue
+		}
+		if len(allowed) > 0 && !allowed[name] {
+			continue
+		}
+
+		maxMem, _ := n["maxmem"].(float64)
+		mem, _ := n["mem"].(float64)
+		maxCPU, _ := n["maxcpu"].(float64)
+		cpu, _ := n["cpu"].(float64)
+		capacities = append(capacities, &nodeCapacity{
+			name:    name,
+			freeMem: int64(maxMem - mem),
+			maxCPU:  maxCPU,
+			usedCPU: cpu * maxCPU,
+		})
+	}
+
+	if !sourceFound {
+		return nil, fmt.Errorf("node %s not found", node)
+	}
+
+	return capacities, nil
+}
+
+// pickEvacuationTarget places the guest on the node with the most free
+// memory that also has the CPU headroom for the guest's current load and
+// at least as many cores as the guest
+func pickEvacuationTarget(capacities []*nodeCapacity, guest GuestMigration) *nodeCapacity {
+	var best *nodeCapacity
+	for _, c := range capacities {
+		if c.freeMem < guest.Memory {
+			continue
+		}
+		if float64(guest.CPUs) > c.maxCPU || c.usedCPU+guest.load > c.maxCPU {
+			continue
+		}
+		if best == nil || c.freeMem > best.freeMem ||
+			(c.freeMem == best.freeMem && c.usedCPU/c.maxCPU < best.usedCPU/best.maxCPU) {
+			best = c
+		}
+	}
+	return best
+}
+
+func listNodeGuests(api *manager.APIManager, node string) ([]GuestMigration, error) {
+	vms, err := ListVMs(api, node)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := GetContainers(api, node)
+	if err != nil {
+		return nil, err
+	}
+
+	var guests []GuestMigration
+	for _, vm := range vms {
+		guests = append(guests, guestFromListing(vm, "qemu", node))
+	}
+	for _, ct := range containers {
+		guests = append(guests, guestFromListing(ct, "lxc", node))
+	}
+
+	return guests, nil
+}
+
+func guestFromListing(item map[string]interface{}, guestType, node string) GuestMigration {
+	name, _ := item["name"].(string)
+	status, _ := item["status"].(string)
+	maxMem, _ := item["maxmem"].(float64)
+	cpus, _ := item["cpus"].(float64)
+	cpu, _ := item["cpu"].(float64)
+
+	return GuestMigration{
+		VMID:   guestID(item["vmid"]),
+		Name:   name,
+		Type:   guestType,
+		Status: status,
+		Memory: int64(maxMem),
+		CPUs:   int(cpus),
+		Tags:   parseTags(item["tags"]),
+		Source: node,
+		load:   cpu * cpus,
+	}
+}
+
+// guestID normalizes a vmid field, which Proxmox returns as a number for
+// VMs and as a string for containers
+func guestID(v interface{}) string {
+	switch id := v.(type) {
+	case float64:
+		return fmt.Sprintf("%.0f", id)
+	case string:
+		return id
+	}
+	return ""
+}
+
+func (s *EvacuationStore) get(node string) ([]GuestMigration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.loadLocked()
+	if err != nil {
+		return nil, err
+	}
+	return append([]GuestMigration(nil), entries[node]...), nil
+}
+
+// add appends guests to the node's record, as a node can be evacuated again
+// before its guests were returned
+func (s *EvacuationStore) add(node string, guests []GuestMigration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.loadLocked()
+	if err != nil {
+		return err
+	}
+	return s.saveLocked(node, append(append([]GuestMigration(nil), entries[node]...), guests...))
+}
+
+// set replaces the node's record, an empty list removes it
+func (s *EvacuationStore) set(node string, guests []GuestMigration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.loadLocked(); err != nil {
+		return err
+	}
+	return s.saveLocked(node, guests)
+}
+
+// loadLocked reads the records. With a database they are read on every
+// call, as another instance may have evacuated or returned a node
+func (s *EvacuationStore) loadLocked() (map[string][]GuestMigration, error) {
+	if s.db == nil && s.entries != nil {
+		return s.entries, nil
+	}
+
+	entries := make(map[string][]GuestMigration)
+	if s.db != nil {
+		rows, err := s.db.Query("SELECT node, definition FROM evacuations")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read evacuations: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var node, definition string
+			if err := rows.Scan(&node, &definition); err != nil {
+				return nil, fmt.Errorf("failed to read evacuations: %w", err)
+			}
+			var guests []GuestMigration
+			if err := json.Unmarshal([]byte(definition), &guests); err != nil {
+				continue
+			}
+			entries[node] = guests
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read evacuations: %w", err)
+		}
+	} else {
+		file, err := os.ReadFile(s.path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read evacuations file: %w", err)
+		}
+		if err == nil && len(strings.TrimSpace(string(file))) > 0 {
+			var data struct {
+				Evacuations map[string][]GuestMigration `json:"evacuations"`
+			}
+			if err := json.Unmarshal(file, &data); err != nil {
+				return nil, fmt.Errorf("failed to parse evacuations file: %w", err)
+			}
+			for node, guests := range data.Evacuations {
+				entries[node] = guests
+			}
+		}
+	}
+
+	if s.db == nil {
+		s.entries = entries
+	}
+	return entries, nil
+}
+
+func (s *EvacuationStore) saveLocked(node string, guests []GuestMigration) error {
+	if s.db != nil {
+		var err error
+		if len(guests) == 0 {
+			_, err = s.db.Exec("DELETE FROM evacuations WHERE node = ?", node)
+		} else {
+			definition, marshalErr := json.Marshal(guests)
+			if marshalErr != nil {
+				return marshalErr
+			}
+			_, err = s.db.Exec("INSERT INTO evacuations (node, definition) VALUES (?, ?) ON DUPLICATE KEY UPDATE definition = VALUES(definition)",
+				node, string(definition))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to save evacuation: %w", err)
+		}
+		return nil
+	}
+
+	entries := make(map[string][]GuestMigration, len(s.entries))
+	for name, recorded := range s.entries {
+		entries[name] = recorded
+	}
+	if len(guests) == 0 {
+		delete(entries, node)
+	} else {
+		entries[node] = guests
+	}
+
+	var data struct {
+		Evacuations map[string][]GuestMigration `json:"evacuations"`
+	}
+	data.Evacuations = entries
+	encoded, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("failed to write evacuations file: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, encoded, 0o644); err != nil {
+		return fmt.Errorf("failed to write evacuations file: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to write evacuations file: %w", err)
+	}
+	s.entries = entries
+	return nil
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"rm-thierry/Proxmox-API/src/logging"
+	"rm-thierry/Proxmox-API/src/manager"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DependencyStatus is the result of one readiness check. Status is ok,
+// failed or skipped for dependencies that are not configured
+type DependencyStatus struct {
+	Status    string                 `json:"status"`
+	Error     string                 `json:"error,omitempty"`
+	LatencyMS float64                `json:"latency_ms,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+type Readiness struct {
+	Ready  bool                        `json:"ready"`
+	Checks map[string]DependencyStatus `json:"checks"`
+}
+
+var readinessDB struct {
+	mu         sync.Mutex
+	configured bool
+	db         *manager.DBManager
+	err        error
+}
+
+// SetReadinessDatabase tells the readiness check a database is configured.
+// db is nil when connecting failed, with the error in connectErr
+func SetReadinessDatabase(db *manager.DBManager, connectErr error) {
+	readinessDB.mu.Lock()
+	defer readinessDB.mu.Unlock()
+	readinessDB.configured = true
+	readinessDB.db = db
+	readinessDB.err = connectErr
+}
+
+// CheckReadiness checks Proxmox, the database and the template registry at
+// the same time, each within timeout
+func CheckReadiness(api *manager.APIManager, timeout time.Duration) Readiness {
+	checks := map[string]func() (map[string]interface{}, error){
+		"proxmox":           func() (map[string]interface{}, error) { return checkProxmox(api) },
+		"database":          func() (map[string]interface{}, error) { return checkDatabase(timeout) },
+		"template_registry": checkTemplateRegistry,
+	}
+
+	readiness := Readiness{Ready: true, Checks: make(map[string]DependencyStatus)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func() (map[string]interface{}, error)) {
+			defer wg.Done()
+			status := runCheck(check, timeout)
+			mu.Lock()
+			defer mu.Unlock()
+			readiness.Checks[name] = status
+			if status.Status == "failed" {
+				readiness.Ready = false
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	return readiness
+}
+
+// StatusOnly drops the errors, latencies and details of the checks, which
+// name nodes, versions and URLs, for callers without a token
+func (r Readiness) StatusOnly() Readiness {
+	summary := Readiness{Ready: r.Ready, Checks: make(map[string]DependencyStatus, len(r.Checks))}
+	for name, check := range r.Checks {
+		summary.Checks[name] = DependencyStatus{Status: check.Status}
+	}
+	return summary
+}
+
+// errSkipped marks a dependency that is not configured
+var errSkipped = fmt.Errorf("not configured")
+
+func runCheck(check func() (map[string]interface{}, error), timeout time.Duration) DependencyStatus {
+	type outcome struct {
+		details map[string]interface{}
+		err     error
+	}
+
+	started := time.Now()
+	done := make(chan outcome, 1)
+	go func() {
+		details, err := check()
+		done <- outcome{details, err}
+	}()
+
+	var result outcome
+	select {
+	case result = <-done:
+	case <-time.After(timeout):
+		result.err = fmt.Errorf("timed out after %s", timeout)
+	}
+
+	status := DependencyStatus{
+		Status:    "ok",
+		LatencyMS: float64(time.Since(started).Microseconds()) / 1000,
+		Details:   result.details,
+	}
+	switch {
+	case result.err == errSkipped:
+		status.Status = "skipped"
+	case result.err != nil:
+		status.Status = "failed"
+		status.Error = logging.RedactString(result.err.Error())
+	}
+	return status
+}
+
+// checkProxmox calls /version, which needs a valid API token
+func checkProxmox(api *manager.APIManager) (map[string]interface{}, error) {
+	details := map[string]interface{}{"node": api.Node}
+	response, err := api.ApiCall("GET", "/version", nil)
+	if err != nil {
+		if strings.Contains(err.Error(), "Status 401") || strings.Contains(err.Error(), "Status 403") {
+			return details, fmt.Errorf("authentication failed: %w", err)
+		}
+		if strings.Contains(err.Error(), "error performing request") {
+			return details, fmt.Errorf("unreachable: %w", err)
+		}
+		return details, err
+	}
+
+	var result struct {
+		Data struct {
+			Version string `json:"version"`
+			Release string `json:"release"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(response, &result); err != nil {
+		return details, fmt.Errorf("failed to parse version: %w", err)
+	}
+	details["version"] = result.Data.Version
+	details["release"] = result.Data.Release
+	return details, nil
+}
+
+func checkDatabase(timeout time.Duration) (map[string]interface{}, error) {
+	readinessDB.mu.Lock()
+	configured, db, connectErr := readinessDB.configured, readinessDB.db, readinessDB.err
+	readinessDB.mu.Unlock()
+
+	if !configured {
+		return nil, errSkipped
+	}
+	if db == nil {
+		return nil, fmt.Errorf("not connected: %w", connectErr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := db.Ping(ctx); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func checkTemplateRegistry() (map[string]interface{}, error) {
+	registry := defaultTemplateRegistry()
+	entries, err := registry.load()
+	if err != nil {
+		return nil, err
+	}
+
+	registry.mu.Lock()
+	store := "file"
+	if registry.db != nil {
+		store = "database"
+	}
+	registry.mu.Unlock()
+	return map[string]interface{}{"templates": len(entries), "store": store}, nil
+}
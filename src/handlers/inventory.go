@@ -0,0 +1,364 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"rm-thierry/Proxmox-API/src/manager"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type InventoryItem struct {
+	ID       string   `json:"id"`
+	Type     string   `json:"type"`
+	VMID     int      `json:"vmid,omitempty"`
+	Name     string   `json:"name"`
+	Node     string   `json:"node"`
+	Status   string   `json:"status"`
+	Pool     string   `json:"pool,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Template bool     `json:"template,omitempty"`
+	CPU      float64  `json:"cpu"`
+	MaxCPU   float64  `json:"maxcpu"`
+	Mem      int64    `json:"mem"`
+	MaxMem   int64    `json:"maxmem"`
+	Disk     int64    `json:"disk"`
+	MaxDisk  int64    `json:"maxdisk"`
+	Uptime   int64    `json:"uptime,omitempty"`
+}
+
+type InventoryQuery struct {
+	Type   string
+	Status string
+	Node   string
+	Tag    string
+	Pool   string
+	Name   string
+	Sort   string
+	Fields []string
+	Limit  int
+	Cursor string
+}
+
+type InventoryPage struct {
+	Items      []map[string]interface{} `json:"items"`
+	Total      int                      `json:"total"`
+	NextCursor string                   `json:"next_cursor,omitempty"`
+}
+
+// GetInventory returns every VM, container, storage and node in the
+// cluster from a single /cluster/resources call
+func GetInventory(api *manager.APIManager, query *InventoryQuery) (*InventoryPage, error) {
+	resources, err := GetClusterResources(api, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var items []InventoryItem
+	for _, resource := range resources {
+		item := inventoryItemFromResource(resource)
+		if item.Type == "qemu" || item.Type == "lxc" || item.Type == "storage" || item.Type == "node" {
+			items = append(items, item)
+		}
+	}
+
+	return QueryInventory(items, query)
+}
+
+// ListVMItems returns the VMs of a single node as inventory items so the
+// per-node listing supports the same query options as the inventory
+func ListVMItems(api *manager.APIManager, node string) ([]InventoryItem, error) {
+	vms, err := ListVMs(api, node)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]InventoryItem, len(vms))
+	for i, vm := range vms {
+		vm["type"] = "qemu"
+		vm["node"] = node
+		items[i] = inventoryItemFromResource(vm)
+	}
+	return items, fillPools(api, items)
+}
+
+// ListContainerItems returns the containers of a single node as inventory
+// items so the listing supports the inventory query options
+func ListContainerItems(api *manager.APIManager, node string) ([]InventoryItem, error) {
+	containers, err := GetContainers(api, node)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]InventoryItem, len(containers))
+	for i, ct := range containers {
+		ct["type"] = "lxc"
+		ct["node"] = node
+		items[i] = inventoryItemFromResource(ct)
+	}
+	return items, fillPools(api, items)
+}
+
+// fillPools sets the pool of a node's guests, which only /cluster/resources
+// reports
+func fillPools(api *manager.APIManager, items []InventoryItem) error {
+	resources, err := GetClusterResources(api, "vm")
+	if err != nil {
+		return err
+	}
+
+	pools := make(map[string]string, len(resources))
+	for _, resource := range resources {
+		item := inventoryItemFromResource(resource)
+		pools[item.ID] = item.Pool
+	}
+	for i := range items {
+		items[i].Pool = pools[items[i].ID]
+	}
+	return nil
+}
+
+// QueryInventory filters, sorts, paginates and projects inventory items
+func QueryInventory(items []InventoryItem, query *InventoryQuery) (*InventoryPage, error) {
+	var filtered []InventoryItem
+	for _, item := range items {
+		matched, err := matchesInventoryQuery(item, query)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			filtered = append(filtered, item)
+		}
+	}
+
+	if err := sortInventory(filtered, query.Sort); err != nil {
+		return nil, err
+	}
+
+	offset, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	if offset > len(filtered) {
+		offset = len(filtered)
+	}
+
+	end := len(filtered)
+	if query.Limit > 0 && offset+query.Limit < end {
+		end = offset + query.Limit
+	}
+
+	page := &InventoryPage{Items: []map[string]interface{}{}, Total: len(filtered)}
+	for _, item := range filtered[offset:end] {
+		page.Items = append(page.Items, projectInventoryItem(item, query.Fields))
+	}
+	if end < len(filtered) {
+		page.NextCursor = encodeCursor(end)
+	}
+
+	return page, nil
+}
+
+func inventoryItemFromResource(resource map[string]interface{}) InventoryItem {
+	item := InventoryItem{Tags: parseTags(resource["tags"])}
+	item.ID, _ = resource["id"].(string)
+	item.Type, _ = resource["type"].(string)
+	item.Name, _ = resource["name"].(string)
+	item.Node, _ = resource["node"].(string)
+	item.Status, _ = resource["status"].(string)
+	item.Pool, _ = resource["pool"].(string)
+	item.CPU, _ = resource["cpu"].(float64)
+	item.MaxCPU, _ = resource["maxcpu"].(float64)
+	if cpus, ok := resource["cpus"].(float64); ok && item.MaxCPU == 0 {
+		item.MaxCPU = cpus
+	}
+	if template, ok := resource["template"].(float64); ok {
+		item.Template = template == 1
+	}
+
+	for key, field := range map[string]*int64{
+		"mem": &item.Mem, "maxmem": &item.MaxMem, "disk": &item.Disk,
+		"maxdisk": &item.MaxDisk, "uptime": &item.Uptime,
+	} {
+		if value, ok := resource[key].(float64); ok {
+			*field = int64(value)
+		}
+	}
+
+	if vmid := guestID(resource["vmid"]); vmid != "" {
+		item.VMID, _ = strconv.Atoi(vmid)
+	}
+
+	switch item.Type {
+	case "storage":
+		item.Name, _ = resource["storage"].(string)
+	case "node":
+		item.Name = item.Node
+	}
+
+	if item.ID == "" {
+		if item.VMID != 0 {
+			item.ID = fmt.Sprintf("%s/%d", item.Type, item.VMID)
+		} else {
+			item.ID = item.Type + "/" + item.Name
+		}
+	}
+
+	return item
+}
+
+func matchesInventoryQuery(item InventoryItem, query *InventoryQuery) (bool, error) {
+	if query.Type != "" && !containsValue(query.Type, item.Type) {
+		return false, nil
+	}
+	if query.Status != "" && !containsValue(query.Status, item.Status) {
+		return false, nil
+	}
+	if query.Node != "" && !containsValue(query.Node, item.Node) {
+		return false, nil
+	}
+	if query.Pool != "" && !containsValue(query.Pool, item.Pool) {
+		return false, nil
+	}
+	if query.Tag != "" && !hasAllTags(item.Tags, strings.Split(query.Tag, ",")) {
+		return false, nil
+	}
+	if query.Name != "" {
+		matched, err := path.Match(query.Name, item.Name)
+		if err != nil {
+			return false, fmt.Errorf("invalid name pattern '%s'", query.Name)
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// containsValue matches a value against a comma-separated filter list
+func containsValue(filter, value string) bool {
+	for _, f := range strings.Split(filter, ",") {
+		if strings.TrimSpace(f) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// sortInventory sorts by comma-separated fields, a leading '-' sorts
+// descending (e.g. "node,-mem")
+func sortInventory(items []InventoryItem, sortBy string) error {
+	if sortBy == "" {
+		sortBy = "type,vmid,name"
+	}
+
+	keys := strings.Split(sortBy, ",")
+	for i, key := range keys {
+		key = strings.TrimSpace(key)
+		keys[i] = key
+		if _, ok := inventorySortValue(InventoryItem{}, strings.TrimPrefix(key, "-")); !ok {
+			return fmt.Errorf("invalid sort field '%s'", key)
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		for _, key := range keys {
+			desc := strings.HasPrefix(key, "-")
+			field := strings.TrimPrefix(key, "-")
+			a, _ := inventorySortValue(items[i], field)
+			b, _ := inventorySortValue(items[j], field)
+			if a == b {
+				continue
+			}
+			less := false
+			switch av := a.(type) {
+			case string:
+				less = av < b.(string)
+			case float64:
+				less = av < b.(float64)
+			}
+			if desc {
+				return !less
+			}
+			return less
+		}
+		return false
+	})
+	return nil
+}
+
+func inventorySortValue(item InventoryItem, field string) (interface{}, bool) {
+	switch field {
+	case "id":
+		return item.ID, true
+	case "type":
+		return item.Type, true
+	case "vmid":
+		return float64(item.VMID), true
+	case "name":
+		return item.Name, true
+	case "node":
+		return item.Node, true
+	case "status":
+		return item.Status, true
+	case "pool":
+		return item.Pool, true
+	case "cpu":
+		return item.CPU, true
+	case "maxcpu":
+		return item.MaxCPU, true
+	case "mem":
+		return float64(item.Mem), true
+	case "maxmem":
+		return float64(item.MaxMem), true
+	case "disk":
+		return float64(item.Disk), true
+	case "maxdisk":
+		return float64(item.MaxDisk), true
+	case "uptime":
+		return float64(item.Uptime), true
+	}
+	return nil, false
+}
+
+func projectInventoryItem(item InventoryItem, fields []string) map[string]interface{} {
+	encoded, _ := json.Marshal(item)
+	var full map[string]interface{}
+	_ = json.Unmarshal(encoded, &full)
+
+	if len(fields) == 0 {
+		return full
+	}
+
+	projected := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		if value, ok := full[field]; ok {
+			projected[field] = value
+		}
+	}
+	return projected
+}
+
+func encodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("offset:" + strconv.Itoa(offset)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(decoded), "offset:") {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+
+	offset, err := strconv.Atoi(strings.TrimPrefix(string(decoded), "offset:"))
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	return offset, nil
+}
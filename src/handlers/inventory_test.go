@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func inventoryFixture() []InventoryItem {
+	return []InventoryItem{
+		{ID: "qemu/101", Type: "qemu", VMID: 101, Name: "web-01", Node: "pve1", Status: "running", Pool: "prod", Tags: []string{"web", "prod"}, Mem: 2048},
+		{ID: "storage/pve1/local", Type: "storage", Name: "local", Node: "pve1", Status: "available", Disk: 100},
+		{ID: "qemu/102", Type: "qemu", VMID: 102, Name: "web-02", Node: "pve2", Status: "stopped", Tags: []string{"web"}, Mem: 4096},
+		{ID: "node/pve1", Type: "node", Name: "pve1", Node: "pve1", Status: "online", Mem: 8192},
+		{ID: "lxc/201", Type: "lxc", VMID: 201, Name: "cache", Node: "pve1", Status: "running", Pool: "prod", Tags: []string{"cache", "prod"}, Mem: 512},
+	}
+}
+
+func inventoryIDs(page *InventoryPage) []string {
+	ids := make([]string, len(page.Items))
+	for i, item := range page.Items {
+		ids[i], _ = item["id"].(string)
+	}
+	return ids
+}
+
+func TestQueryInventory(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   InventoryQuery
+		want    []string
+		wantErr string
+	}{
+		{
+			name:  "default sort by type, vmid and name",
+			query: InventoryQuery{},
+			want:  []string{"lxc/201", "node/pve1", "qemu/101", "qemu/102", "storage/pve1/local"},
+		},
+		{name: "type", query: InventoryQuery{Type: "qemu"}, want: []string{"qemu/101", "qemu/102"}},
+		{name: "several types", query: InventoryQuery{Type: "qemu,lxc"}, want: []string{"lxc/201", "qemu/101", "qemu/102"}},
+		{name: "status", query: InventoryQuery{Status: "stopped"}, want: []string{"qemu/102"}},
+		{name: "several statuses", query: InventoryQuery{Status: "running, stopped"}, want: []string{"lxc/201", "qemu/101", "qemu/102"}},
+		{name: "node", query: InventoryQuery{Node: "pve2"}, want: []string{"qemu/102"}},
+		{name: "pool", query: InventoryQuery{Pool: "prod"}, want: []string{"lxc/201", "qemu/101"}},
+		{name: "tag", query: InventoryQuery{Tag: "web"}, want: []string{"qemu/101", "qemu/102"}},
+		{name: "all tags must match", query: InventoryQuery{Tag: "web,prod"}, want: []string{"qemu/101"}},
+		{name: "name glob", query: InventoryQuery{Name: "web-*"}, want: []string{"qemu/101", "qemu/102"}},
+		{name: "filters combined", query: InventoryQuery{Type: "qemu,lxc", Node: "pve1", Tag: "prod"}, want: []string{"lxc/201", "qemu/101"}},
+		{name: "no match", query: InventoryQuery{Node: "pve9"}, want: []string{}},
+		{name: "bad glob", query: InventoryQuery{Name: "web-["}, wantErr: "invalid name pattern 'web-['"},
+		{
+			name:  "descending sort",
+			query: InventoryQuery{Sort: "-mem"},
+			want:  []string{"node/pve1", "qemu/102", "qemu/101", "lxc/201", "storage/pve1/local"},
+		},
+		{
+			name:  "several sort fields",
+			query: InventoryQuery{Type: "qemu,lxc", Sort: "node, -vmid"},
+			want:  []string{"lxc/201", "qemu/101", "qemu/102"},
+		},
+		{name: "invalid sort field", query: InventoryQuery{Sort: "node,-memory"}, wantErr: "invalid sort field '-memory'"},
+		{name: "invalid cursor", query: InventoryQuery{Cursor: "not a cursor"}, wantErr: "invalid cursor"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := QueryInventory(inventoryFixture(), &tt.query)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("QueryInventory() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("QueryInventory() error = %v", err)
+			}
+			if got := inventoryIDs(page); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("QueryInventory() = %v, want %v", got, tt.want)
+			}
+			if page.Total != len(tt.want) || page.NextCursor != "" {
+				t.Errorf("QueryInventory() total = %d, next_cursor = %q, want %d and none", page.Total, page.NextCursor, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestQueryInventoryPages(t *testing.T) {
+	want := [][]string{
+		{"lxc/201", "node/pve1"},
+		{"qemu/101", "qemu/102"},
+		{"storage/pve1/local"},
+	}
+
+	query := &InventoryQuery{Limit: 2}
+	for i, wantIDs := range want {
+		page, err := QueryInventory(inventoryFixture(), query)
+		if err != nil {
+			t.Fatalf("page %d: %v", i, err)
+		}
+		if got := inventoryIDs(page); !reflect.DeepEqual(got, wantIDs) {
+			t.Errorf("page %d = %v, want %v", i, got, wantIDs)
+		}
+		if page.Total != 5 {
+			t.Errorf("page %d total = %d, want 5", i, page.Total)
+		}
+		last := i == len(want)-1
+		if last != (page.NextCursor == "") {
+			t.Fatalf("page %d next_cursor = %q", i, page.NextCursor)
+		}
+		query.Cursor = page.NextCursor
+	}
+}
+
+func TestQueryInventoryFields(t *testing.T) {
+	page, err := QueryInventory(inventoryFixture(), &InventoryQuery{Type: "lxc", Fields: []string{"id", "name", "mem", "unknown"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]interface{}{{"id": "lxc/201", "name": "cache", "mem": float64(512)}}
+	if !reflect.DeepEqual(page.Items, want) {
+		t.Errorf("QueryInventory() items = %v, want %v", page.Items, want)
+	}
+}
+
+func TestDecodeCursor(t *testing.T) {
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+	tests := []struct {
+		name    string
+		cursor  string
+		want    int
+		wantErr bool
+	}{
+		{name: "empty", cursor: "", want: 0},
+		{name: "encoded offset", cursor: encodeCursor(40), want: 40},
+		{name: "not base64", cursor: "!!!", wantErr: true},
+		{name: "wrong prefix", cursor: encode("page:2"), wantErr: true},
+		{name: "not a number", cursor: encode("offset:two"), wantErr: true},
+		{name: "negative", cursor: encode("offset:-1"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeCursor(tt.cursor)
+			if tt.wantErr {
+				if err == nil || err.Error() != "invalid cursor" {
+					t.Fatalf("decodeCursor(%q) = %d, %v, want invalid cursor", tt.cursor, got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("decodeCursor(%q) = %d, %v, want %d", tt.cursor, got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"fmt"
+	"rm-thierry/Proxmox-API/src/manager"
+	"strconv"
+	"strings"
+)
+
+type GuestRef struct {
+	VMID string   `json:"vmid"`
+	Node string   `json:"node"`
+	Type string   `json:"type"`
+	Name string   `json:"name"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+// FindGuests returns all guests of the type ("qemu", "lxc" or empty for
+// both) in the cluster that match the name and every given tag
+func FindGuests(api *manager.APIManager, guestType, name string, tags []string) ([]GuestRef, error) {
+	resources, err := GetClusterResources(api, "vm")
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []GuestRef
+	for _, resource := range resources {
+		item := inventoryItemFromResource(resource)
+		if guestType != "" && item.Type != guestType {
+			continue
+		}
+		if name != "" && item.Name != name {
+			continue
+		}
+		if !hasAllTags(item.Tags, tags) {
+			continue
+		}
+		matches = append(matches, GuestRef{
+			VMID: strconv.Itoa(item.VMID),
+			Node: item.Node,
+			Type: item.Type,
+			Name: item.Name,
+			Tags: item.Tags,
+		})
+	}
+
+	return matches, nil
+}
+
+// ResolveGuest turns a route reference into a guest. The reference is either
+// a numeric ID or "name:<hostname>". Numeric IDs are looked up cluster-wide
+// unless a node is given, names must be unique in the cluster
+func ResolveGuest(api *manager.APIManager, guestType, ref, node string) (*GuestRef, error) {
+	if name, ok := strings.CutPrefix(ref, "name:"); ok {
+		return ResolveGuestByName(api, guestType, name)
+	}
+
+	if _, err := strconv.Atoi(ref); err != nil {
+		return nil, fmt.Errorf("invalid VMID format")
+	}
+
+	if node != "" {
+		return &GuestRef{VMID: ref, Node: node, Type: guestType}, nil
+	}
+
+	guests, err := FindGuests(api, guestType, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, guest := range guests {
+		if guest.VMID == ref {
+			return &guest, nil
+		}
+	}
+
+	return nil, fmt.Errorf("guest %s not found", ref)
+}
+
+func ResolveGuestByName(api *manager.APIManager, guestType, name string) (*GuestRef, error) {
+	if name == "" {
+		return nil, fmt.Errorf("invalid guest name")
+	}
+
+	guests, err := FindGuests(api, guestType, name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(guests) {
+	case 0:
+		return nil, fmt.Errorf("guest with name '%s' not found", name)
+	case 1:
+		return &guests[0], nil
+	}
+
+	ids := make([]string, len(guests))
+	for i, guest := range guests {
+		ids[i] = guest.Node + "/" + guest.VMID
+	}
+	return nil, fmt.Errorf("guest name '%s' is ambiguous, matches %s", name, strings.Join(ids, ", "))
+}
+
+// hasAllTags reports whether the guest has every wanted tag. Tag filters
+// mean the same on lookup, inventory, listings and bulk selectors
+func hasAllTags(have, want []string) bool {
+	for _, w := range want {
+		w = strings.TrimSpace(w)
+		if w == "" {
+			continue
+		}
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"log/slog"
+	"rm-thierry/Proxmox-API/src/manager"
+	"rm-thierry/Proxmox-API/src/metrics"
+	"time"
+)
+
+// StartMetricsCollector exports cluster gauges from /cluster/resources every
+// interval until the process exits
+func StartMetricsCollector(api *manager.APIManager, interval time.Duration) {
+	go func() {
+		for {
+			if err := CollectClusterMetrics(api); err != nil {
+				metrics.CollectorErrors.Inc()
+				slog.Warn("metrics collector failed", "error", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// CollectClusterMetrics sets the node, guest and storage gauges from one
+// /cluster/resources call. The new values replace the old ones at once, so
+// guests and storages that no longer exist are dropped
+func CollectClusterMetrics(api *manager.APIManager) error {
+	resources, err := GetClusterResources(api, "")
+	if err != nil {
+		return err
+	}
+
+	var stats metrics.ClusterStats
+	guests := make(map[[3]string]int)
+	var guestKeys [][3]string
+
+	for _, r := range resources {
+		node, _ := r["node"].(string)
+		status, _ := r["status"].(string)
+		switch r["type"] {
+		case "node":
+			stats.Nodes = append(stats.Nodes, metrics.NodeStats{
+				Node:        node,
+				Up:          status == "online",
+				CPU:         floatValue(r["cpu"]),
+				CPUs:        floatValue(r["maxcpu"]),
+				MemoryUsed:  floatValue(r["mem"]),
+				MemoryTotal: floatValue(r["maxmem"]),
+			})
+		case "qemu", "lxc":
+			guestType, _ := r["type"].(string)
+			if status == "" {
+				status = "unknown"
+			}
+			key := [3]string{node, guestType, status}
+			if guests[key] == 0 {
+				guestKeys = append(guestKeys, key)
+			}
+			guests[key]++
+		case "storage":
+			storage, _ := r["storage"].(string)
+			stats.Storages = append(stats.Storages, metrics.StorageStats{
+				Node:    node,
+				Storage: storage,
+				Used:    floatValue(r["disk"]),
+				Total:   floatValue(r["maxdisk"]),
+			})
+		}
+	}
+	for _, key := range guestKeys {
+		stats.Guests = append(stats.Guests, metrics.GuestCount{Node: key[0], Type: key[1], Status: key[2], Count: guests[key]})
+	}
+	metrics.Cluster.Set(stats)
+
+	metrics.CollectorLastSuccess.SetToCurrentTime()
+	return nil
+}
+
+func floatValue(value interface{}) float64 {
+	f, _ := value.(float64)
+	return f
+}
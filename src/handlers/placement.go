@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"fmt"
+	"rm-thierry/Proxmox-API/src/manager"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const AutoNode = "auto"
+
+type PlacementRequest struct {
+	Strategy     string   `json:"strategy,omitempty"`
+	Memory       int64    `json:"memory"`
+	Cores        int      `json:"cores"`
+	Storage      string   `json:"storage,omitempty"`
+	Disk         int64    `json:"disk,omitempty"`
+	Affinity     []string `json:"affinity,omitempty"`
+	AntiAffinity []string `json:"anti_affinity,omitempty"`
+}
+
+type PlacementCandidate struct {
+	Node    string
+	FreeMem int64
+	MaxMem  int64
+	MaxCPU  float64
+	CPULoad float64
+	Guests  int
+	Tags    map[string]int
+}
+
+type PlacementDecision struct {
+	Node     string `json:"node"`
+	Strategy string `json:"strategy"`
+	Reason   string `json:"reason"`
+}
+
+// PlacementStrategy picks one of the candidates, which have already been
+// filtered for capacity and affinity, and explains the choice
+type PlacementStrategy func(candidates []*PlacementCandidate, req *PlacementRequest) (*PlacementCandidate, string)
+
+var (
+	placementMu         sync.RWMutex
+	placementStrategies = map[string]PlacementStrategy{
+		"memory":  leastLoadedMemory,
+		"spread":  spreadGuests,
+		"binpack": binPack,
+	}
+)
+
+func RegisterPlacementStrategy(name string, strategy PlacementStrategy) {
+	placementMu.Lock()
+	defer placementMu.Unlock()
+	placementStrategies[name] = strategy
+}
+
+// PlaceGuest chooses a node for a new guest using live node status,
+// storage availability and the requested strategy
+func PlaceGuest(api *manager.APIManager, req *PlacementRequest) (*PlacementDecision, error) {
+	strategyName := req.Strategy
+	if strategyName == "" {
+		strategyName = "memory"
+	}
+
+	placementMu.RLock()
+	strategy, ok := placementStrategies[strategyName]
+	placementMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("invalid placement strategy '%s'", strategyName)
+	}
+
+	candidates, err := placementCandidates(api, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no node has enough free resources for placement")
+	}
+
+	candidates, note := applyAffinity(candidates, req)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no node satisfies the anti-affinity rules %v", req.AntiAffinity)
+	}
+
+	// Keep the order stable so strategies break ties by node name
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Node < candidates[j].Node })
+
+	chosen, reason := strategy(candidates, req)
+	if note != "" {
+		reason = note + "; " + reason
+	}
+
+	return &PlacementDecision{Node: chosen.Node, Strategy: strategyName, Reason: reason}, nil
+}
+
+func placementCandidates(api *manager.APIManager, req *PlacementRequest) ([]*PlacementCandidate, error) {
+	nodes, err := GetNodes(api)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []*PlacementCandidate
+	for _, n := range nodes {
+		name, _ := n["node"].(string)
+		if status, _ := n["status"].(string); status != "online" {
+			continue
+		}
+
+		maxMem, _ := n["maxmem"].(float64)
+		mem, _ := n["mem"].(float64)
+		maxCPU, _ := n["maxcpu"].(float64)
+		cpu, _ := n["cpu"].(float64)
+
+		candidate := &PlacementCandidate{
+			Node:    name,
+			FreeMem: int64(maxMem - mem),
+			MaxMem:  int64(maxMem),
+			MaxCPU:  maxCPU,
+			CPULoad: cpu,
+			Tags:    make(map[string]int),
+		}
+
+		if candidate.FreeMem < req.Memory || (req.Cores > 0 && float64(req.Cores) > maxCPU) {
+			continue
+		}
+
+		if req.Storage != "" && !storageHasSpace(api, name, req.Storage, req.Disk) {
+			continue
+		}
+
+		guests, err := listNodeGuests(api, name)
+		if err != nil {
+			continue
+		}
+		candidate.Guests = len(guests)
+		for _, g := range guests {
+			for _, tag := range g.Tags {
+				candidate.Tags[tag]++
+			}
+		}
+
+		candidates = append(candidates, candidate)
+	}
+
+	return candidates, nil
+}
+
+func storageHasSpace(api *manager.APIManager, node, storage string, size int64) bool {
+	storages, err := GetStorages(api, node)
+	if err != nil {
+		return false
+	}
+
+	for _, s := range storages {
+		if name, _ := s["storage"].(string); name != storage {
+			continue
+		}
+		if active, ok := s["active"].(float64); ok && active == 0 {
+			return false
+		}
+		avail, _ := s["avail"].(float64)
+		return int64(avail) >= size
+	}
+
+	return false
+}
+
+func applyAffinity(candidates []*PlacementCandidate, req *PlacementRequest) ([]*PlacementCandidate, string) {
+	var notes []string
+
+	if len(req.AntiAffinity) > 0 {
+		var filtered []*PlacementCandidate
+		for _, c := range candidates {
+			if !hasAnyTag(c, req.AntiAffinity) {
+				filtered = append(filtered, c)
+			}
+		}
+		candidates = filtered
+		notes = append(notes, fmt.Sprintf("avoided nodes with tags %v", req.AntiAffinity))
+	}
+
+	if len(req.Affinity) > 0 {
+		var preferred []*PlacementCandidate
+		for _, c := range candidates {
+			if hasAnyTag(c, req.Affinity) {
+				preferred = append(preferred, c)
+			}
+		}
+		if len(preferred) > 0 {
+			candidates = preferred
+			notes = append(notes, fmt.Sprintf("preferred nodes with tags %v", req.Affinity))
+		} else {
+			notes = append(notes, fmt.Sprintf("no node has tags %v", req.Affinity))
+		}
+	}
+
+	return candidates, strings.Join(notes, "; ")
+}
+
+func hasAnyTag(c *PlacementCandidate, tags []string) bool {
+	for _, tag := range tags {
+		if c.Tags[tag] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func leastLoadedMemory(candidates []*PlacementCandidate, req *PlacementRequest) (*PlacementCandidate, string) {
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.FreeMem > best.FreeMem {
+			best = c
+		}
+	}
+	return best, fmt.Sprintf("most free memory (%d MB)", best.FreeMem/1024/1024)
+}
+
+func spreadGuests(candidates []*PlacementCandidate, req *PlacementRequest) (*PlacementCandidate, string) {
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.Guests < best.Guests || (c.Guests == best.Guests && c.CPULoad < best.CPULoad) {
+			best = c
+		}
+	}
+	return best, fmt.Sprintf("fewest guests (%d)", best.Guests)
+}
+
+func binPack(candidates []*PlacementCandidate, req *PlacementRequest) (*PlacementCandidate, string) {
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.FreeMem < best.FreeMem {
+			best = c
+		}
+	}
+	return best, fmt.Sprintf("least free memory that fits (%d MB)", best.FreeMem/1024/1024)
+}
+
+// parseTags splits the Proxmox tags field, which is separated by ';'
+func parseTags(v interface{}) []string {
+	raw, _ := v.(string)
+	if raw == "" {
+		return nil
+	}
+
+	var tags []string
+	for _, tag := range strings.FieldsFunc(raw, func(r rune) bool { return r == ';' || r == ',' || r == ' ' }) {
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// parseSizeGB converts a size such as "20", "20G" or "512M" to bytes,
+// treating bare numbers as gigabytes
+func parseSizeGB(size string) int64 {
+	size = strings.TrimSpace(strings.ToUpper(size))
+	multiplier := int64(1024 * 1024 * 1024)
+	switch {
+	case strings.HasSuffix(size, "T"):
+		multiplier *= 1024
+		size = strings.TrimSuffix(size, "T")
+	case strings.HasSuffix(size, "G"):
+		size = strings.TrimSuffix(size, "G")
+	case strings.HasSuffix(size, "M"):
+		multiplier = 1024 * 1024
+		size = strings.TrimSuffix(size, "M")
+	}
+
+	value, err := strconv.ParseFloat(size, 64)
+	if err != nil {
+		return 0
+	}
+	return int64(value * float64(multiplier))
+}
+
+func resolveVMNode(api *manager.APIManager, req *VMCreateRequest) (*PlacementDecision, error) {
+	if req.Node != AutoNode {
+		return nil, nil
+	}
+
+	placement := &PlacementRequest{
+		Strategy:     req.Placement,
+		Memory:       int64(req.Memory) * 1024 * 1024,
+		Cores:        req.Cores * max(req.Sockets, 1),
+		Affinity:     req.Affinity,
+		AntiAffinity: req.AntiAffinity,
+	}
+	if parts := strings.SplitN(req.Disk, ":", 2); len(parts) == 2 {
+		placement.Storage = parts[0]
+		placement.Disk = parseSizeGB(parts[1])
+	}
+
+	decision, err := PlaceGuest(api, placement)
+	if err != nil {
+		return nil, fmt.Errorf("failed to place VM: %w", err)
+	}
+	req.Node = decision.Node
+	return decision, nil
+}
+
+func resolveContainerNode(api *manager.APIManager, config *ContainerConfig) (*PlacementDecision, error) {
+	if config.Node != AutoNode {
+		return nil, nil
+	}
+
+	decision, err := PlaceGuest(api, &PlacementRequest{
+		Strategy:     config.Placement,
+		Memory:       int64(config.Memory) * 1024 * 1024,
+		Cores:        config.Cores,
+		Storage:      config.Storage,
+		Disk:         int64(config.Disk) * 1024 * 1024 * 1024,
+		Affinity:     config.Affinity,
+		AntiAffinity: config.AntiAffinity,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to place container: %w", err)
+	}
+	config.Node = decision.Node
+	return decision, nil
+}
+
+func addPlacement(result map[string]interface{}, node string, decision *PlacementDecision) map[string]interface{} {
+	if result == nil || decision == nil {
+		return result
+	}
+	result["node"] = node
+	result["placement"] = decision
+	return result
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"fmt"
+	"rm-thierry/Proxmox-API/src/manager"
+	"strconv"
+	"time"
+)
+
+type PowerOptions struct {
+	// Timeout is how long an ACPI shutdown may take, in seconds
+	Timeout int
+	// ForceStop powers the VM off when the shutdown timeout expires
+	ForceStop bool
+	// ToDisk hibernates the VM instead of pausing it in RAM
+	ToDisk bool
+	// Wait blocks until the VM reaches the state the operation leads to
+	Wait        bool
+	WaitTimeout time.Duration
+}
+
+// VMPowerOperation runs any power operation by name, used by the HTTP
+// handlers so every operation can wait for its resulting state
+func VMPowerOperation(api *manager.APIManager, node, vmid, operation string, opts PowerOptions) (map[string]interface{}, error) {
+	switch operation {
+	case "start":
+		return vmPowerAction(api, node, vmid, "start", nil, "running", opts)
+	case "stop":
+		return vmPowerAction(api, node, vmid, "stop", nil, "stopped", opts)
+	case "reboot":
+		return vmPowerAction(api, node, vmid, "reboot", nil, "running", opts)
+	case "shutdown":
+		return ShutdownVM(api, node, vmid, opts)
+	case "suspend":
+		return SuspendVM(api, node, vmid, opts)
+	case "resume":
+		return ResumeVM(api, node, vmid, opts)
+	case "reset":
+		return ResetVM(api, node, vmid, opts)
+	}
+	return nil, fmt.Errorf("invalid power operation '%s'", operation)
+}
+
+// ShutdownVM asks the guest OS to power off through ACPI
+func ShutdownVM(api *manager.APIManager, node, vmid string, opts PowerOptions) (map[string]interface{}, error) {
+	payload := map[string]interface{}{}
+	if opts.Timeout > 0 {
+		payload["timeout"] = opts.Timeout
+	}
+	if opts.ForceStop {
+		payload["forceStop"] = 1
+	}
+	return vmPowerAction(api, node, vmid, "shutdown", payload, "stopped", opts)
+}
+
+// SuspendVM pauses the VM in RAM, or saves its state to disk and stops it
+func SuspendVM(api *manager.APIManager, node, vmid string, opts PowerOptions) (map[string]interface{}, error) {
+	payload := map[string]interface{}{}
+	state := "paused"
+	if opts.ToDisk {
+		payload["todisk"] = 1
+		state = "stopped"
+	}
+	return vmPowerAction(api, node, vmid, "suspend", payload, state, opts)
+}
+
+func ResumeVM(api *manager.APIManager, node, vmid string, opts PowerOptions) (map[string]interface{}, error) {
+	return vmPowerAction(api, node, vmid, "resume", nil, "running", opts)
+}
+
+// ResetVM is a hard reset, like pressing the reset button
+func ResetVM(api *manager.APIManager, node, vmid string, opts PowerOptions) (map[string]interface{}, error) {
+	return vmPowerAction(api, node, vmid, "reset", nil, "running", opts)
+}
+
+// WaitForVMState polls the VM until it reaches the state. "paused" and
+// "running" are matched against the QEMU status, so a paused VM is not
+// reported as running
+func WaitForVMState(api *manager.APIManager, node, vmid, state string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		current, err := vmState(api, node, vmid)
+		if err != nil {
+			return "", err
+		}
+		if current == state {
+			return current, nil
+		}
+		if time.Now().After(deadline) {
+			return current, fmt.Errorf("timed out waiting for VM %s to be %s, it is %s", vmid, state, current)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func vmState(api *manager.APIManager, node, vmid string) (string, error) {
+	vm, err := GetVM(api, node, vmid)
+	if err != nil {
+		return "", err
+	}
+
+	status, _ := vm["status"].(string)
+	if qmpStatus, ok := vm["qmpstatus"].(string); ok && status == "running" {
+		// QEMU reports "prelaunch" or "suspended" for some paused states
+		if qmpStatus == "prelaunch" || qmpStatus == "suspended" {
+			return "paused", nil
+		}
+		return qmpStatus, nil
+	}
+	return status, nil
+}
+
+func vmPowerAction(api *manager.APIManager, node, vmid, action string, payload map[string]interface{}, state string, opts PowerOptions) (map[string]interface{}, error) {
+	if _, err := strconv.Atoi(vmid); err != nil {
+		return nil, fmt.Errorf("invalid VMID format")
+	}
+
+	if exists, _ := VMExists(api, node, vmid); !exists {
+		return nil, fmt.Errorf("VM with ID %s not found", vmid)
+	}
+
+	endpoint := fmt.Sprintf("/nodes/%s/qemu/%s/status/%s", node, vmid, action)
+	var response []byte
+	var err error
+	if len(payload) > 0 {
+		response, err = api.ApiCall("POST", endpoint, payload)
+	} else {
+		response, err = api.ApiCallWithOptions("POST", endpoint, nil, false)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to %s VM: %w", action, err)
+	}
+
+	result, err := parseResponse(response)
+	if err != nil {
+		return nil, err
+	}
+
+	if !opts.Wait {
+		return result, nil
+	}
+
+	timeout := opts.WaitTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+	if opts.Timeout > 0 && time.Duration(opts.Timeout+30)*time.Second > timeout {
+		timeout = time.Duration(opts.Timeout+30) * time.Second
+	}
+
+	if taskID, ok := result["task_id"].(string); ok {
+		if _, err := WaitForTask(api, node, taskID, timeout); err != nil {
+			return result, fmt.Errorf("failed to %s VM: %w", action, err)
+		}
+	}
+
+	current, err := WaitForVMState(api, node, vmid, state, timeout)
+	result["status"] = current
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"fmt"
+	"rm-thierry/Proxmox-API/src/manager"
+	"rm-thierry/Proxmox-API/src/metrics"
+	"rm-thierry/Proxmox-API/src/tracing"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TaskType extracts the task type, e.g. qmclone, from a Proxmox UPID
+func TaskType(upid string) string {
+	parts := strings.Split(upid, ":")
+	if len(parts) < 6 || parts[0] != "UPID" || parts[5] == "" {
+		return "unknown"
+	}
+	return parts[5]
+}
+
+// TaskStartTime extracts when a task started from its Proxmox UPID, which
+// holds the start time as hex Unix seconds
+func TaskStartTime(upid string) (time.Time, bool) {
+	parts := strings.Split(upid, ":")
+	if len(parts) < 5 || parts[0] != "UPID" {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(parts[4], 16, 64)
+	if err != nil || seconds <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
+
+// TaskNode extracts the node name from a Proxmox UPID
+// (UPID:node:pid:pstart:starttime:type:id:user:)
+func TaskNode(upid string) string {
+	parts := strings.Split(upid, ":")
+	if len(parts) < 2 || parts[0] != "UPID" {
+		return ""
+	}
+	return parts[1]
+}
+
+// TaskSucceeded reports whether a task's exit status is a success. Tasks
+// that finished with warnings, e.g. a backup that skipped a file, end with
+// "WARNINGS: n"
+func TaskSucceeded(exitStatus string) bool {
+	return exitStatus == "OK" || strings.HasPrefix(exitStatus, "WARNINGS")
+}
+
+// TaskWarnings returns the number of warnings of a task that finished with
+// "WARNINGS: n", and 0 for any other exit status
+func TaskWarnings(exitStatus string) int {
+	count, ok := strings.CutPrefix(exitStatus, "WARNINGS")
+	if !ok {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(count, ":")))
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
+
+func GetTaskStatus(api *manager.APIManager, node, upid string) (map[string]interface{}, error) {
+	if node == "" {
+		node = TaskNode(upid)
+	}
+	if node == "" {
+		return nil, fmt.Errorf("invalid task ID '%s'", upid)
+	}
+
+	response, err := api.ApiCall("GET", fmt.Sprintf("/nodes/%s/tasks/%s/status", node, upid), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get task status: %w", err)
+	}
+
+	return parseResponse(response)
+}
+
+// WaitForTask polls a Proxmox task until it stops and returns an error if
+// the task failed. Tasks that end with "WARNINGS: n" succeeded
+func WaitForTask(api *manager.APIManager, node, upid string, timeout time.Duration) (map[string]interface{}, error) {
+	// The span covers the task itself from when Proxmox started it, but not
+	// before its parent, as UPIDs only have whole seconds
+	opts := []trace.SpanStartOption{trace.WithAttributes(tracing.Attributes(
+		"proxmox.upid", upid,
+		"proxmox.node", node,
+		"proxmox.task_type", TaskType(upid))...)}
+	if started, ok := TaskStartTime(upid); ok {
+		if parentStart, ok := tracing.StartTime(api.Context()); !ok || started.After(parentStart) {
+			opts = append(opts, trace.WithTimestamp(started))
+		}
+	}
+	ctx, span := tracing.Tracer().Start(api.Context(), "task "+TaskType(upid), opts...)
+	api = api.WithContext(ctx)
+
+	status, err := waitForTask(api, node, upid, timeout)
+	if exit, ok := status["exitstatus"].(string); ok {
+		span.SetAttributes(tracing.Attributes("proxmox.exit_status", exit)...)
+	}
+	tracing.End(span, err)
+	return status, err
+}
+
+func waitForTask(api *manager.APIManager, node, upid string, timeout time.Duration) (map[string]interface{}, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := GetTaskStatus(api, node, upid)
+		if err != nil {
+			metrics.Tasks.WithLabelValues(TaskType(upid), "error").Inc()
+			return nil, err
+		}
+
+		if state, _ := status["status"].(string); state == "stopped" {
+			if exit, _ := status["exitstatus"].(string); !TaskSucceeded(exit) {
+				metrics.Tasks.WithLabelValues(TaskType(upid), "failed").Inc()
+				return status, fmt.Errorf("task %s failed: %s", upid, exit)
+			}
+			metrics.Tasks.WithLabelValues(TaskType(upid), "ok").Inc()
+			return status, nil
+		}
+
+		if time.Now().After(deadline) {
+			metrics.Tasks.WithLabelValues(TaskType(upid), "timeout").Inc()
+			return status, fmt.Errorf("timed out waiting for task %s", upid)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"rm-thierry/Proxmox-API/src/manager"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTaskExitStatus(t *testing.T) {
+	tests := []struct {
+		exitStatus string
+		succeeded  bool
+		warnings   int
+	}{
+		{"OK", true, 0},
+		{"WARNINGS: 3", true, 3},
+		{"WARNINGS", true, 1},
+		{"", false, 0},
+		{"unexpected status", false, 0},
+		{"command 'qm start 101' failed: exit code 1", false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.exitStatus, func(t *testing.T) {
+			if got := TaskSucceeded(tt.exitStatus); got != tt.succeeded {
+				t.Errorf("TaskSucceeded(%q) = %v, want %v", tt.exitStatus, got, tt.succeeded)
+			}
+			if got := TaskWarnings(tt.exitStatus); got != tt.warnings {
+				t.Errorf("TaskWarnings(%q) = %d, want %d", tt.exitStatus, got, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestWaitForTask(t *testing.T) {
+	const upid = "UPID:pve:0001:0002:6AD50000:qmclone:101:root@pam:"
+
+	tests := []struct {
+		exitStatus string
+		wantErr    string
+	}{
+		{exitStatus: "OK"},
+		{exitStatus: "WARNINGS: 2"},
+		{exitStatus: "clone failed: storage full", wantErr: "task " + upid + " failed: clone failed: storage full"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.exitStatus, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasPrefix(r.URL.Path, "/nodes/pve/tasks/") {
+					http.NotFound(w, r)
+					return
+				}
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{
+					"data": map[string]interface{}{"status": "stopped", "exitstatus": tt.exitStatus},
+				})
+			}))
+			defer server.Close()
+
+			api := &manager.APIManager{BaseURL: server.URL, Node: "other"}
+			_, err := WaitForTask(api, "", upid, time.Second)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("WaitForTask() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Fatalf("WaitForTask() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
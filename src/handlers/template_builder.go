@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"rm-thierry/Proxmox-API/src/manager"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// templateBuildTag marks VMs created by BuildVMTemplate, so a build that
+// failed halfway can be cleaned up by the next run
+const templateBuildTag = "template-build"
+
+var templateVersionPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// TemplateBuildRequest builds a template named "{name}-{version}" from a
+// cloud image. Image is a volume ID ("local:iso/noble-server-cloudimg-amd64.img")
+// or an absolute path on the node, which Proxmox only allows for root@pam
+type TemplateBuildRequest struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Node        string `json:"node"`
+	VMID        string `json:"vmid,omitempty"`
+	Image       string `json:"image"`
+	Storage     string `json:"storage"`
+	DiskSize    string `json:"disk_size,omitempty"`
+	Memory      int    `json:"memory,omitempty"`
+	Cores       int    `json:"cores,omitempty"`
+	Bridge      string `json:"bridge,omitempty"`
+	OS          string `json:"os,omitempty"`
+	DefaultUser string `json:"default_user,omitempty"`
+	MinDisk     int    `json:"min_disk,omitempty"`
+	Description string `json:"description,omitempty"`
+	Timeout     int    `json:"timeout,omitempty"`
+}
+
+// BuildVMTemplate creates a VM from a cloud image, adds a cloud-init drive,
+// serial console and guest agent, converts it to a template and registers
+// it. The versioned entry "{name}-{version}" is kept until it is deleted,
+// while the entry "{name}" moves to the new version. Building a version
+// that already exists only updates the registry
+func BuildVMTemplate(api *manager.APIManager, req *TemplateBuildRequest) (map[string]interface{}, error) {
+	if err := validateTemplateBuild(req); err != nil {
+		return nil, err
+	}
+
+	vmName := req.Name + "-" + req.Version
+	timeout := time.Duration(req.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Minute
+	}
+
+	existing, err := findTemplateBuild(api, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.Template {
+		if err := registerTemplateBuild(req, vmName); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"status":   "exists",
+			"template": vmName,
+			"node":     existing.Node,
+			"vmid":     strconv.Itoa(existing.VMID),
+		}, nil
+	}
+
+	result := map[string]interface{}{"template": vmName, "node": req.Node}
+	if existing != nil {
+		// Left behind by a build that failed before the conversion
+		if err := DeleteVM(api, existing.Node, strconv.Itoa(existing.VMID)); err != nil {
+			return nil, fmt.Errorf("failed to remove incomplete build %d: %w", existing.VMID, err)
+		}
+		result["removed_incomplete"] = existing.VMID
+	}
+
+	allocated := false
+	if req.VMID == "" {
+		vmid, err := AllocateVMID(api, "template")
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate VMID: %w", err)
+		}
+		req.VMID = strconv.Itoa(vmid)
+		allocated = true
+	}
+	result["vmid"] = req.VMID
+
+	response, err := api.ApiCall("POST", fmt.Sprintf("/nodes/%s/qemu", req.Node), buildTemplatePayload(req, vmName))
+	if err != nil {
+		releaseAllocatedVMID(req.VMID, allocated)
+		return nil, fmt.Errorf("failed to create template VM: %w", err)
+	}
+	if err := waitForResponseTask(api, req.Node, response, timeout); err != nil {
+		return nil, fmt.Errorf("failed to import image: %w", err)
+	}
+
+	if req.DiskSize != "" {
+		payload := map[string]interface{}{"disk": "scsi0", "size": req.DiskSize}
+		response, err := api.ApiCall("PUT", fmt.Sprintf("/nodes/%s/qemu/%s/resize", req.Node, req.VMID), payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resize template disk: %w", err)
+		}
+		if err := waitForResponseTask(api, req.Node, response, timeout); err != nil {
+			return nil, fmt.Errorf("failed to resize template disk: %w", err)
+		}
+	}
+
+	response, err = api.ApiCallWithOptions("POST", fmt.Sprintf("/nodes/%s/qemu/%s/template", req.Node, req.VMID), nil, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert VM to template: %w", err)
+	}
+	if err := waitForResponseTask(api, req.Node, response, timeout); err != nil {
+		return nil, fmt.Errorf("failed to convert VM to template: %w", err)
+	}
+
+	if err := registerTemplateBuild(req, vmName); err != nil {
+		return nil, fmt.Errorf("template built but not registered: %w", err)
+	}
+
+	result["status"] = "created"
+	return result, nil
+}
+
+func validateTemplateBuild(req *TemplateBuildRequest) error {
+	if req.Name == "" || req.Version == "" || req.Image == "" || req.Storage == "" {
+		return fmt.Errorf("name, version, image and storage are required")
+	}
+	if !templateNamePattern.MatchString(req.Name) {
+		return fmt.Errorf("invalid template name '%s'", req.Name)
+	}
+	if !templateVersionPattern.MatchString(req.Version) {
+		return fmt.Errorf("invalid template version '%s'", req.Version)
+	}
+	if !strings.HasPrefix(req.Image, "/") && !strings.Contains(req.Image, ":") {
+		return fmt.Errorf("invalid image '%s', must be a volume ID or an absolute path", req.Image)
+	}
+	if req.DiskSize != "" && !diskSizeValue.MatchString(req.DiskSize) {
+		return fmt.Errorf("invalid disk_size '%s'", req.DiskSize)
+	}
+	if req.VMID != "" {
+		if _, err := strconv.Atoi(req.VMID); err != nil {
+			return fmt.Errorf("invalid VMID format")
+		}
+	}
+
+	if req.Memory <= 0 {
+		req.Memory = 2048
+	}
+	if req.Cores <= 0 {
+		req.Cores = 2
+	}
+	if req.Bridge == "" {
+		req.Bridge = "vmbr0"
+	}
+	return nil
+}
+
+func buildTemplatePayload(req *TemplateBuildRequest, vmName string) map[string]interface{} {
+	payload := map[string]interface{}{
+		"vmid":    req.VMID,
+		"name":    vmName,
+		"memory":  req.Memory,
+		"cores":   req.Cores,
+		"ostype":  "l26",
+		"scsihw":  "virtio-scsi-pci",
+		"scsi0":   fmt.Sprintf("%s:0,import-from=%s", req.Storage, req.Image),
+		"ide2":    fmt.Sprintf("%s:cloudinit", req.Storage),
+		"boot":    "order=scsi0",
+		"serial0": "socket",
+		"vga":     "serial0",
+		"agent":   "enabled=1",
+		"net0":    fmt.Sprintf("virtio,bridge=%s", req.Bridge),
+		"tags":    templateBuildTag + ";" + req.Name,
+	}
+	if req.Description != "" {
+		payload["description"] = req.Description
+	}
+	return payload
+}
+
+// findTemplateBuild looks for a VM from an earlier build of the same version
+func findTemplateBuild(api *manager.APIManager, vmName string) (*InventoryItem, error) {
+	resources, err := GetClusterResources(api, "vm")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, resource := range resources {
+		item := inventoryItemFromResource(resource)
+		if item.Type != "qemu" || item.Name != vmName {
+			continue
+		}
+		if !item.Template && !containsString(item.Tags, templateBuildTag) {
+			return nil, fmt.Errorf("VM %d is already named %s and was not created by a template build", item.VMID, vmName)
+		}
+		return &item, nil
+	}
+	return nil, nil
+}
+
+// registerTemplateBuild adds "{name}-{version}" and points "{name}" at it.
+// Metadata not given in the request is kept from the existing entries
+func registerTemplateBuild(req *TemplateBuildRequest, vmName string) error {
+	registry := defaultTemplateRegistry()
+	entries, err := registry.load()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{vmName, req.Name} {
+		entry, exists := entries[name]
+		entry.Name = name
+		entry.Match = vmName
+		entry.VMIDs = nil
+		entry.Version = req.Version
+		if req.OS != "" {
+			entry.OS = req.OS
+		}
+		if req.DefaultUser != "" {
+			entry.DefaultUser = req.DefaultUser
+		}
+		if req.MinDisk > 0 {
+			entry.MinDisk = req.MinDisk
+		}
+		if req.Description != "" {
+			entry.Description = req.Description
+		}
+
+		if err := registry.put(entry, exists); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitForResponseTask waits for the task a Proxmox call returned, if any
+func waitForResponseTask(api *manager.APIManager, node string, response []byte, timeout time.Duration) error {
+	result, err := parseResponse(response)
+	if err != nil {
+		// Calls without a task return no data
+		return nil
+	}
+	upid, _ := result["task_id"].(string)
+	if upid == "" {
+		return nil
+	}
+	_, err = WaitForTask(api, node, upid, timeout)
+	return err
+}
@@ -0,0 +1,439 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"rm-thierry/Proxmox-API/src/manager"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var templateNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// VMTemplate is a curated alias for one or more Proxmox templates. Copies
+// are filled in from /cluster/resources and never persisted
+type VMTemplate struct {
+	Name string `json:"name"`
+	// Match is the name of the template VM in Proxmox, it defaults to Name
+	Match       string         `json:"match,omitempty"`
+	VMIDs       []string       `json:"vmids,omitempty"`
+	OS          string         `json:"os,omitempty"`
+	Version     string         `json:"version,omitempty"`
+	DefaultUser string         `json:"default_user,omitempty"`
+	MinDisk     int            `json:"min_disk,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Curated     bool           `json:"curated,omitempty"`
+	Copies      []TemplateCopy `json:"copies,omitempty"`
+}
+
+type TemplateCopy struct {
+	Node string `json:"node"`
+	VMID string `json:"vmid"`
+	Name string `json:"name"`
+}
+
+// TemplateRegistry keeps the curated templates in the database when one is
+// configured, otherwise in TEMPLATE_REGISTRY_FILE (env/templates.json)
+type TemplateRegistry struct {
+	mu      sync.Mutex
+	path    string
+	db      *manager.DBManager
+	entries map[string]VMTemplate
+}
+
+var (
+	templateRegistryOnce sync.Once
+	templateRegistry     *TemplateRegistry
+)
+
+func defaultTemplateRegistry() *TemplateRegistry {
+	templateRegistryOnce.Do(func() {
+		path := os.Getenv("TEMPLATE_REGISTRY_FILE")
+		if path == "" {
+			path = "env/templates.json"
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		templateRegistry = &TemplateRegistry{path: path}
+	})
+	return templateRegistry
+}
+
+// SetTemplateRegistryStore moves the registry into the database. Entries
+// from the file are imported the first time so existing aliases keep working
+func SetTemplateRegistryStore(db *manager.DBManager) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS vm_templates (
+		name VARCHAR(64) PRIMARY KEY,
+		definition TEXT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create template table: %w", err)
+	}
+
+	registry := defaultTemplateRegistry()
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM vm_templates").Scan(&count); err != nil {
+		return fmt.Errorf("failed to read template table: %w", err)
+	}
+	if count == 0 {
+		entries, err := registry.loadFile()
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := saveTemplateRow(db, entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	registry.db = db
+	registry.entries = nil
+	return nil
+}
+
+// ListVMTemplates merges the curated templates with the templates found on
+// all nodes. Templates that are not curated are listed under their Proxmox name
+func ListVMTemplates(api *manager.APIManager) ([]VMTemplate, error) {
+	curated, err := defaultTemplateRegistry().load()
+	if err != nil {
+		return nil, err
+	}
+
+	copies, err := discoverTemplates(api)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make(map[string]*VMTemplate)
+	claimed := make(map[string]bool)
+	for name, entry := range curated {
+		t := entry
+		t.Curated = true
+		match := t.Match
+		if match == "" {
+			match = t.Name
+		}
+		for _, c := range copies {
+			if c.Name == match || containsString(t.VMIDs, c.VMID) {
+				t.Copies = append(t.Copies, c)
+				claimed[c.VMID] = true
+			}
+		}
+		templates[name] = &t
+	}
+
+	for _, c := range copies {
+		if claimed[c.VMID] {
+			continue
+		}
+		name := c.Name
+		if name == "" {
+			name = "template-" + c.VMID
+		}
+		t, ok := templates[name]
+		if !ok {
+			t = &VMTemplate{Name: name}
+			templates[name] = t
+		}
+		t.Copies = append(t.Copies, c)
+	}
+
+	result := make([]VMTemplate, 0, len(templates))
+	for _, t := range templates {
+		sort.Slice(t.Copies, func(i, j int) bool { return t.Copies[i].Node < t.Copies[j].Node })
+		result = append(result, *t)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+func GetVMTemplate(api *manager.APIManager, name string) (*VMTemplate, error) {
+	templates, err := ListVMTemplates(api)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range templates {
+		if t.Name == name {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("template '%s' not found", name)
+}
+
+func CreateVMTemplateEntry(entry *VMTemplate) error {
+	if err := validateTemplateEntry(entry); err != nil {
+		return err
+	}
+	return defaultTemplateRegistry().put(*entry, false)
+}
+
+func UpdateVMTemplateEntry(name string, entry *VMTemplate) error {
+	if entry.Name == "" {
+		entry.Name = name
+	}
+	if entry.Name != name {
+		return fmt.Errorf("invalid template: name cannot be changed")
+	}
+	if err := validateTemplateEntry(entry); err != nil {
+		return err
+	}
+	return defaultTemplateRegistry().put(*entry, true)
+}
+
+func DeleteVMTemplateEntry(name string) error {
+	return defaultTemplateRegistry().remove(name)
+}
+
+// ResolveTemplateCopy picks the copy of a template to clone for the node:
+// one on the node itself, otherwise the first copy on another node, which
+// Proxmox clones across when the template's storage is shared
+func ResolveTemplateCopy(api *manager.APIManager, name, node string) (*VMTemplate, *TemplateCopy, error) {
+	template, err := GetVMTemplate(api, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(template.Copies) == 0 {
+		return nil, nil, fmt.Errorf("template '%s' not found on any node", name)
+	}
+
+	for _, c := range template.Copies {
+		if c.Node == node {
+			return template, &c, nil
+		}
+	}
+	return template, &template.Copies[0], nil
+}
+
+func discoverTemplates(api *manager.APIManager) ([]TemplateCopy, error) {
+	resources, err := GetClusterResources(api, "vm")
+	if err != nil {
+		return nil, err
+	}
+
+	var copies []TemplateCopy
+	for _, resource := range resources {
+		if kind, _ := resource["type"].(string); kind != "qemu" {
+			continue
+		}
+		if template, _ := resource["template"].(float64); template != 1 {
+			continue
+		}
+
+		c := TemplateCopy{VMID: guestID(resource["vmid"])}
+		c.Node, _ = resource["node"].(string)
+		c.Name, _ = resource["name"].(string)
+		copies = append(copies, c)
+	}
+	return copies, nil
+}
+
+func validateTemplateEntry(entry *VMTemplate) error {
+	if !templateNamePattern.MatchString(entry.Name) {
+		return fmt.Errorf("invalid template name '%s'", entry.Name)
+	}
+	for _, vmid := range entry.VMIDs {
+		if _, err := strconv.Atoi(vmid); err != nil {
+			return fmt.Errorf("invalid template VMID '%s'", vmid)
+		}
+	}
+	if entry.MinDisk < 0 {
+		return fmt.Errorf("invalid min_disk: must not be negative")
+	}
+	entry.Curated = false
+	entry.Copies = nil
+	return nil
+}
+
+func (r *TemplateRegistry) load() (map[string]VMTemplate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.loadLocked()
+}
+
+func (r *TemplateRegistry) loadLocked() (map[string]VMTemplate, error) {
+	if r.db != nil {
+		return r.loadDB()
+	}
+	if r.entries == nil {
+		entries, err := r.loadFile()
+		if err != nil {
+			return nil, err
+		}
+		r.entries = entries
+	}
+
+	entries := make(map[string]VMTemplate, len(r.entries))
+	for name, entry := range r.entries {
+		entries[name] = entry
+	}
+	return entries, nil
+}
+
+func (r *TemplateRegistry) put(entry VMTemplate, replace bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries, err := r.loadLocked()
+	if err != nil {
+		return err
+	}
+
+	_, exists := entries[entry.Name]
+	if exists && !replace {
+		return fmt.Errorf("template '%s' already exists", entry.Name)
+	}
+	if !exists && replace {
+		return fmt.Errorf("template '%s' not found", entry.Name)
+	}
+
+	if r.db != nil {
+		return saveTemplateRow(r.db, entry)
+	}
+	entries[entry.Name] = entry
+	if err := r.saveFile(entries); err != nil {
+		return err
+	}
+	r.entries = entries
+	return nil
+}
+
+func (r *TemplateRegistry) remove(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries, err := r.loadLocked()
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[name]; !ok {
+		return fmt.Errorf("template '%s' not found", name)
+	}
+
+	if r.db != nil {
+		if _, err := r.db.Exec("DELETE FROM vm_templates WHERE name = ?", name); err != nil {
+			return fmt.Errorf("failed to delete template: %w", err)
+		}
+		return nil
+	}
+	delete(entries, name)
+	if err := r.saveFile(entries); err != nil {
+		return err
+	}
+	r.entries = entries
+	return nil
+}
+
+func (r *TemplateRegistry) loadDB() (map[string]VMTemplate, error) {
+	rows, err := r.db.Query("SELECT name, definition FROM vm_templates")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load templates: %w", err)
+	}
+	defer rows.Close()
+
+	entries := make(map[string]VMTemplate)
+	for rows.Next() {
+		var name, definition string
+		if err := rows.Scan(&name, &definition); err != nil {
+			return nil, fmt.Errorf("failed to load templates: %w", err)
+		}
+		var entry VMTemplate
+		if err := json.Unmarshal([]byte(definition), &entry); err != nil {
+			return nil, fmt.Errorf("failed to parse template %s: %w", name, err)
+		}
+		entry.Name = name
+		entries[name] = entry
+	}
+	return entries, rows.Err()
+}
+
+// loadFile reads {"templates": {"debian": {...}}}. The older format that
+// maps a name to a VMID ({"debian": "9000"}) is still accepted
+func (r *TemplateRegistry) loadFile() (map[string]VMTemplate, error) {
+	entries := make(map[string]VMTemplate)
+
+	file, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read templates file: %w", err)
+	}
+
+	var data struct {
+		Templates map[string]json.RawMessage `json:"templates"`
+	}
+	if err := json.Unmarshal(file, &data); err != nil {
+		return nil, fmt.Errorf("failed to parse templates: %w", err)
+	}
+
+	for name, raw := range data.Templates {
+		var entry VMTemplate
+		var vmid string
+		if err := json.Unmarshal(raw, &vmid); err == nil {
+			entry.VMIDs = []string{vmid}
+		} else if err := json.Unmarshal(raw, &entry); err != nil {
+			return nil, fmt.Errorf("failed to parse template %s: %w", name, err)
+		}
+		entry.Name = name
+		entries[name] = entry
+	}
+	return entries, nil
+}
+
+func (r *TemplateRegistry) saveFile(entries map[string]VMTemplate) error {
+	data := struct {
+		Templates map[string]VMTemplate `json:"templates"`
+	}{Templates: entries}
+
+	file, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return fmt.Errorf("failed to write templates file: %w", err)
+	}
+	// Write to a temporary file first so a crash never leaves half a registry
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, file, 0644); err != nil {
+		return fmt.Errorf("failed to write templates file: %w", err)
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return fmt.Errorf("failed to write templates file: %w", err)
+	}
+	return nil
+}
+
+func saveTemplateRow(db *manager.DBManager, entry VMTemplate) error {
+	definition, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT INTO vm_templates (name, definition) VALUES (?, ?) ON DUPLICATE KEY UPDATE definition = VALUES(definition)",
+		entry.Name, string(definition))
+	if err != nil {
+		return fmt.Errorf("failed to save template: %w", err)
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
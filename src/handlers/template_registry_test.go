@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestTemplateRegistryFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "registry", "templates.json")
+	registry := &TemplateRegistry{path: path}
+
+	steps := []struct {
+		name    string
+		run     func() error
+		wantErr bool
+	}{
+		{"add to a missing directory", func() error { return registry.put(VMTemplate{Name: "debian-12", OS: "debian"}, false) }, false},
+		{"add twice", func() error { return registry.put(VMTemplate{Name: "debian-12"}, false) }, true},
+		{"replace", func() error { return registry.put(VMTemplate{Name: "debian-12", OS: "debian", Version: "12"}, true) }, false},
+		{"replace unknown", func() error { return registry.put(VMTemplate{Name: "ubuntu"}, true) }, true},
+	}
+	for _, step := range steps {
+		if err := step.run(); (err != nil) != step.wantErr {
+			t.Fatalf("%s: error = %v, want error %v", step.name, err, step.wantErr)
+		}
+	}
+
+	// A new registry reads what the first one wrote
+	entries, err := (&TemplateRegistry{path: path}).load()
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if got := entries["debian-12"]; got.OS != "debian" || got.Version != "12" {
+		t.Errorf("load() debian-12 = %+v, want the replaced entry", got)
+	}
+}
@@ -0,0 +1,15 @@
+package handlers
+
+import (
+	"rm-thierry/Proxmox-API/src/manager"
+	"rm-thierry/Proxmox-API/src/tracing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startStep starts a span for a step of a handler and returns the API
+// manager whose calls become children of that span
+func startStep(api *manager.APIManager, name string, attrs ...interface{}) (*manager.APIManager, trace.Span) {
+	ctx, span := tracing.Start(api.Context(), name, attrs...)
+	return api.WithContext(ctx), span
+}
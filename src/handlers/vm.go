@@ -3,32 +3,55 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
-	"os"
 	"rm-thierry/Proxmox-API/src/manager"
+	"rm-thierry/Proxmox-API/src/tracing"
 	"strconv"
 	"strings"
 	"time"
 )
 
 type VMCreateRequest struct {
-	Node         string `json:"node"`
-	VMID         string `json:"vmid"`
-	Name         string `json:"name"`
-	Cores        int    `json:"cores"`
-	Memory       int    `json:"memory"`
-	Disk         string `json:"disk"`
-	Net          string `json:"net"`
-	ISO          string `json:"iso"`
-	OSType       string `json:"ostype"`
-	CPU          string `json:"cpu"`
-	Sockets      int    `json:"sockets"`
-	Template     string `json:"template,omitempty"`
-	CloudInit    bool   `json:"cloudinit,omitempty"`
-	SSHKeys      string `json:"sshkeys,omitempty"`
-	Nameserver   string `json:"nameserver,omitempty"`
-	Searchdomain string `json:"searchdomain,omitempty"`
-	Ciuser       string `json:"ciuser,omitempty"`
-	Cipassword   string `json:"cipassword,omitempty"`
+	Node         string   `json:"node"`
+	VMID         string   `json:"vmid"`
+	Name         string   `json:"name"`
+	Cores        int      `json:"cores"`
+	Memory       int      `json:"memory"`
+	Disk         string   `json:"disk"`
+	Net          string   `json:"net"`
+	ISO          string   `json:"iso"`
+	OSType       string   `json:"ostype"`
+	CPU          string   `json:"cpu"`
+	Sockets      int      `json:"sockets"`
+	Template     string   `json:"template,omitempty"`
+	CloudInit    bool     `json:"cloudinit,omitempty"`
+	SSHKeys      string   `json:"sshkeys,omitempty"`
+	Nameserver   string   `json:"nameserver,omitempty"`
+	Searchdomain string   `json:"searchdomain,omitempty"`
+	Ciuser       string   `json:"ciuser,omitempty"`
+	Cipassword   string   `json:"cipassword,omitempty"`
+	Placement    string   `json:"placement,omitempty"`
+	Affinity     []string `json:"affinity,omitempty"`
+	AntiAffinity []string `json:"anti_affinity,omitempty"`
+	Team         string   `json:"team,omitempty"`
+	WaitForIP    bool     `json:"wait_for_ip,omitempty"`
+	WaitTimeout  int      `json:"wait_timeout,omitempty"`
+	CloneType    string   `json:"clone_type,omitempty"`
+	DryRun       bool     `json:"dry_run,omitempty"`
+	// KeepOnFailure leaves the clone of a failed deploy for debugging
+	KeepOnFailure bool `json:"keep_on_failure,omitempty"`
+}
+
+// CloneOptions are passed on to /clone. CloneType is "full", "linked" or
+// empty for a full clone
+type CloneOptions struct {
+	CloneType   string `json:"clone_type,omitempty"`
+	Storage     string `json:"storage,omitempty"`
+	Format      string `json:"format,omitempty"`
+	Pool        string `json:"pool,omitempty"`
+	Description string `json:"description,omitempty"`
+	Snapshot    string `json:"snapshot,omitempty"`
+	BWLimit     int    `json:"bwlimit,omitempty"`
+	DryRun      bool   `json:"dry_run,omitempty"`
 }
 
 func ListVMs(api *manager.APIManager, node string) ([]map[string]interface{}, error) {
@@ -55,7 +78,7 @@ func ListVMs(api *manager.APIManager, node string) ([]map[string]interface{}, er
 	return vms, nil
 }
 
-func CloneVM(api *manager.APIManager, sourceNode string, sourceVMID string, targetNode string, targetVMID string, name string) (map[string]interface{}, error) {
+func CloneVM(api *manager.APIManager, sourceNode string, sourceVMID string, targetNode string, targetVMID string, name string, opts CloneOptions) (map[string]interface{}, error) {
 	if sourceVMID == "" {
 		return nil, fmt.Errorf("source VMID is required")
 	}
@@ -64,12 +87,13 @@ func CloneVM(api *manager.APIManager, sourceNode string, sourceVMID string, targ
 		return nil, fmt.Errorf("source VMID must be a number")
 	}
 
+	allocated := false
 	if targetVMID == "" {
-		vmid, err := generateVMID(api, targetNode)
+		var err error
+		targetVMID, allocated, err = allocateVMID(api, "qemu", opts.DryRun)
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate target VMID: %w", err)
 		}
-		targetVMID = strconv.Itoa(vmid)
 	}
 
 	if _, err := strconv.Atoi(targetVMID); err != nil {
@@ -77,28 +101,105 @@ func CloneVM(api *manager.APIManager, sourceNode string, sourceVMID string, targ
 	}
 
 	if exists, _ := VMExists(api, targetNode, targetVMID); exists {
+		releaseAllocatedVMID(targetVMID, allocated)
 		return nil, fmt.Errorf("VM with ID %s already exists", targetVMID)
 	}
 
+	sourceConfig, err := GetVMConfig(api, sourceNode, sourceVMID)
+	if err != nil {
+		releaseAllocatedVMID(targetVMID, allocated)
+		return nil, err
+	}
+	isTemplate, _ := sourceConfig["template"].(float64)
+
+	cloneType, err := resolveCloneType(opts, isTemplate == 1)
+	if err != nil {
+		releaseAllocatedVMID(targetVMID, allocated)
+		return nil, err
+	}
+
 	// Prepare clone payload
 	payload := map[string]interface{}{
 		"newid":  targetVMID,
-		"full":   1, // Full clone (not linked)
 		"target": targetNode,
 	}
+	if cloneType == "full" {
+		payload["full"] = 1
+	} else {
+		payload["full"] = 0
+	}
 
 	if name != "" {
 		payload["name"] = name
 	}
+	if opts.Storage != "" {
+		payload["storage"] = opts.Storage
+	}
+	if opts.Format != "" {
+		payload["format"] = opts.Format
+	}
+	if opts.Pool != "" {
+		payload["pool"] = opts.Pool
+	}
+	if opts.Description != "" {
+		payload["description"] = opts.Description
+	}
+	if opts.Snapshot != "" {
+		payload["snapname"] = opts.Snapshot
+	}
+	if opts.BWLimit > 0 {
+		payload["bwlimit"] = opts.BWLimit
+	}
 
 	// Execute the clone operation
 	endpoint := fmt.Sprintf("/nodes/%s/qemu/%s/clone", sourceNode, sourceVMID)
+	if opts.DryRun {
+		result := dryRunResult(PlannedCall{Method: "POST", Endpoint: endpoint, Payload: payload})
+		result["vmid"] = targetVMID
+		result["clone_type"] = cloneType
+		return result, nil
+	}
 	response, err := api.ApiCall("POST", endpoint, payload)
 	if err != nil {
+		releaseAllocatedVMID(targetVMID, allocated)
 		return nil, fmt.Errorf("failed to clone VM: %w", err)
 	}
 
-	return parseResponse(response)
+	result, err := parseResponse(response)
+	if err != nil {
+		return nil, err
+	}
+	result["vmid"] = targetVMID
+	result["clone_type"] = cloneType
+	return result, nil
+}
+
+// resolveCloneType checks the options against what Proxmox allows: linked
+// clones need a template source and keep the template's storage and format.
+// Clones are full unless linked is asked for, as a linked clone depends on
+// its template
+func resolveCloneType(opts CloneOptions, isTemplate bool) (string, error) {
+	if opts.Format != "" && opts.Format != "raw" && opts.Format != "qcow2" && opts.Format != "vmdk" {
+		return "", fmt.Errorf("invalid clone format '%s', must be raw, qcow2 or vmdk", opts.Format)
+	}
+	if opts.BWLimit < 0 {
+		return "", fmt.Errorf("invalid bwlimit: must not be negative")
+	}
+
+	needsFull := opts.Storage != "" || opts.Format != "" || opts.Snapshot != ""
+	switch opts.CloneType {
+	case "", "full":
+		return "full", nil
+	case "linked":
+		if !isTemplate {
+			return "", fmt.Errorf("invalid clone type: linked clones require a template as source")
+		}
+		if needsFull {
+			return "", fmt.Errorf("invalid clone type: storage, format and snapshot require a full clone")
+		}
+		return "linked", nil
+	}
+	return "", fmt.Errorf("invalid clone type '%s', must be full or linked", opts.CloneType)
 }
 
 func CreateVM(api *manager.APIManager, req *VMCreateRequest) (map[string]interface{}, error) {
@@ -107,6 +208,11 @@ func CreateVM(api *manager.APIManager, req *VMCreateRequest) (map[string]interfa
 		return CreateVMFromTemplate(api, req)
 	}
 
+	decision, err := resolveVMNode(api, req)
+	if err != nil {
+		return nil, err
+	}
+
 	// Validate required fields for standard VM creation
 	if req.Name == "" {
 		return nil, fmt.Errorf("VM name is required")
@@ -128,12 +234,12 @@ func CreateVM(api *manager.APIManager, req *VMCreateRequest) (map[string]interfa
 		return nil, fmt.Errorf("ISO is required when not using cloud-init")
 	}
 
+	allocated := false
 	if req.VMID == "" {
-		vmid, err := generateVMID(api, req.Node)
+		req.VMID, allocated, err = allocateVMID(api, vmidScope(req.Team, "qemu"), req.DryRun)
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate VMID: %w", err)
 		}
-		req.VMID = strconv.Itoa(vmid)
 	}
 
 	if _, err := strconv.Atoi(req.VMID); err != nil {
@@ -141,42 +247,62 @@ func CreateVM(api *manager.APIManager, req *VMCreateRequest) (map[string]interfa
 	}
 
 	if exists, _ := VMExists(api, req.Node, req.VMID); exists {
+		releaseAllocatedVMID(req.VMID, allocated)
 		return nil, fmt.Errorf("VM with ID %s already exists", req.VMID)
 	}
 
-	if err := validateResources(api, req); err != nil {
+	validateAPI, span := startStep(api, "validateResources", "proxmox.node", req.Node, "vmid", req.VMID)
+	err = validateResources(validateAPI, req)
+	tracing.End(span, err)
+	if err != nil {
+		releaseAllocatedVMID(req.VMID, allocated)
 		return nil, err
 	}
 
 	payload := buildVMPayload(req)
-	response, err := api.ApiCall("POST", fmt.Sprintf("/nodes/%s/qemu", req.Node), payload)
+	endpoint := fmt.Sprintf("/nodes/%s/qemu", req.Node)
+	if req.DryRun {
+		result := dryRunResult(PlannedCall{Method: "POST", Endpoint: endpoint, Payload: payload})
+		result["vmid"] = req.VMID
+		return addPlacement(result, req.Node, decision), nil
+	}
+	response, err := api.ApiCall("POST", endpoint, payload)
 	if err != nil {
+		releaseAllocatedVMID(req.VMID, allocated)
 		return nil, fmt.Errorf("failed to create VM: %w", err)
 	}
 
-	return parseResponse(response)
+	result, err := parseResponse(response)
+	if err != nil {
+		return nil, err
+	}
+	return addPlacement(result, req.Node, decision), nil
 }
 
 func CreateVMFromTemplate(api *manager.APIManager, req *VMCreateRequest) (map[string]interface{}, error) {
-	// Get template configurations
-	templates, err := GetVMTemplates()
+	decision, err := resolveVMNode(api, req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load templates: %w", err)
+		return nil, err
 	}
 
-	// Check if the requested template exists
-	templateVMID, ok := templates[req.Template]
-	if !ok {
-		return nil, fmt.Errorf("template '%s' not found", req.Template)
+	validateAPI, span := startStep(api, "validateResources", "proxmox.node", req.Node, "template", req.Template)
+	template, source, err := validateTemplateRequest(validateAPI, req)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Ciuser == "" {
+		req.Ciuser = template.DefaultUser
 	}
 
 	// Generate a VMID if not provided
+	allocated := false
 	if req.VMID == "" {
-		vmid, err := generateVMID(api, req.Node)
+		req.VMID, allocated, err = allocateVMID(api, vmidScope(req.Team, "qemu"), req.DryRun)
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate VMID: %w", err)
 		}
-		req.VMID = strconv.Itoa(vmid)
 	}
 
 	// Default the name if not provided
@@ -184,17 +310,159 @@ func CreateVMFromTemplate(api *manager.APIManager, req *VMCreateRequest) (map[st
 		req.Name = fmt.Sprintf("%s-vm-%s", req.Template, req.VMID)
 	}
 
+	// Journal each step so the deploy is resumed or rolled back if the
+	// service stops half way, and undone if a step fails
+	deploy := templateDeploy{Request: *req, SourceNode: source.Node, SourceVMID: source.VMID, Allocated: allocated}
+	var wf *Workflow
+	if !req.DryRun {
+		wf = StartWorkflow(templateWorkflow, req.Node, req.VMID, deploy)
+		if allocated {
+			wf.Complete("allocate_vmid", req.VMID)
+		}
+	}
+
 	// Clone the template VM
-	// We assume the template is on the same node for simplicity
-	result, err := CloneVM(api, req.Node, templateVMID, req.Node, req.VMID, req.Name)
+	cloneOpts := CloneOptions{CloneType: req.CloneType, DryRun: req.DryRun}
+	cloneAPI, span := startStep(api, "CloneVM",
+		"proxmox.node", req.Node, "source_node", source.Node, "source_vmid", source.VMID, "vmid", req.VMID)
+	result, err := CloneVM(cloneAPI, source.Node, source.VMID, req.Node, req.VMID, req.Name, cloneOpts)
+	step := "clone"
+	if err == nil && !req.DryRun {
+		upid, _ := result["task_id"].(string)
+		wf.Complete(step, upid)
+		step = "clone_wait"
+		if err = waitForClone(cloneAPI, source.Node, result, req.WaitTimeout); err == nil {
+			wf.Complete(step, "")
+		}
+	}
+	tracing.End(span, err)
 	if err != nil {
-		return nil, fmt.Errorf("failed to clone template VM: %w", err)
+		err = fmt.Errorf("failed to clone template VM: %w", err)
+		if req.DryRun {
+			return nil, err
+		}
+		return nil, failTemplateDeploy(api, wf, &deploy, step, err)
 	}
 
-	// Wait for clone to complete
-	// This is a simple approach - in production you might want to poll the task status
-	time.Sleep(3 * time.Second)
+	if req.DryRun {
+		// The clone starts with the template's config
+		sourceConfig, err := GetVMConfig(api, source.Node, source.VMID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get template config: %w", err)
+		}
+
+		calls := plannedCalls(result)
+		if updatePayload := templateConfigPayload(req, sourceConfig); len(updatePayload) > 0 {
+			calls = append(calls, PlannedCall{Method: "POST", Endpoint: fmt.Sprintf("/nodes/%s/qemu/%s/config", req.Node, req.VMID), Payload: updatePayload})
+		}
+		if req.CloudInit {
+			calls = append(calls, guestActionCall("qemu", req.Node, req.VMID, "start"))
+		}
+		result["calls"] = calls
+		result["template"] = map[string]interface{}{"name": template.Name, "node": source.Node, "vmid": source.VMID}
+		return addPlacement(result, req.Node, decision), nil
+	}
+
+	configAPI, span := startStep(api, "UpdateVMConfig", "proxmox.node", req.Node, "vmid", req.VMID)
+	err = applyTemplateConfig(configAPI, req)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, failTemplateDeploy(api, wf, &deploy, "configure", err)
+	}
+	wf.Complete("configure", "")
+
+	// Start the VM if CloudInit is configured
+	if req.CloudInit {
+		startAPI, span := startStep(api, "StartVM", "proxmox.node", req.Node, "vmid", req.VMID)
+		err = StartVM(startAPI, req.Node, req.VMID)
+		tracing.End(span, err)
+		if err != nil {
+			return nil, failTemplateDeploy(api, wf, &deploy, "start", fmt.Errorf("VM cloned and configured but failed to start: %w", err))
+		}
+		wf.Complete("start", "")
+	}
+	wf.Finish("completed", nil)
+	result["workflow_id"] = wf.ID
+	result["steps"] = wf.History()
+
+	// Report the address the VM got from DHCP once the guest agent is up
+	if req.WaitForIP {
+		timeout := time.Duration(req.WaitTimeout) * time.Second
+		if timeout <= 0 {
+			timeout = 5 * time.Minute
+		}
+		ips, err := WaitForAgentIP(api, req.Node, req.VMID, timeout)
+		if err != nil {
+			result["ip_error"] = err.Error()
+		} else {
+			result["ip_addresses"] = ips
+		}
+	}
+
+	result["template"] = map[string]interface{}{"name": template.Name, "node": source.Node, "vmid": source.VMID}
+	return addPlacement(result, req.Node, decision), nil
+}
+
+// validateTemplateRequest picks the copy of the template closest to the
+// target node and checks the disk fits the template and the storage
+func validateTemplateRequest(api *manager.APIManager, req *VMCreateRequest) (*VMTemplate, *TemplateCopy, error) {
+	template, source, err := ResolveTemplateCopy(api, req.Template, req.Node)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if template.MinDisk > 0 && req.Disk != "" {
+		if parts := strings.SplitN(req.Disk, ":", 2); len(parts) == 2 && parseSizeGB(parts[1]) < int64(template.MinDisk)*1024*1024*1024 {
+			return nil, nil, fmt.Errorf("invalid disk size: template '%s' needs at least %dG", req.Template, template.MinDisk)
+		}
+	}
+	if parts := strings.SplitN(req.Disk, ":", 2); len(parts) == 2 {
+		if err := checkStorageSpace(api, req.Node, parts[0], parseSizeGB(parts[1])); err != nil {
+			return nil, nil, err
+		}
+	}
+	return template, source, nil
+}
+
+// waitForClone waits for the clone task so the config update does not run
+// into the lock the clone holds
+func waitForClone(api *manager.APIManager, sourceNode string, result map[string]interface{}, waitTimeout int) error {
+	upid, _ := result["task_id"].(string)
+	if upid == "" {
+		return nil
+	}
+	node := TaskNode(upid)
+	if node == "" {
+		node = sourceNode
+	}
+
+	_, err := WaitForTask(api, node, upid, deployTimeout(waitTimeout))
+	return err
+}
+
+// applyTemplateConfig applies the requested settings to a VM cloned from a
+// template
+func applyTemplateConfig(api *manager.APIManager, req *VMCreateRequest) error {
+	// For CloudInit, only set the drive if it doesn't already exist
+	// We'll check the current config first to avoid the "already exists" error
+	vmConfig, err := GetVMConfig(api, req.Node, req.VMID)
+	if err != nil {
+		return fmt.Errorf("failed to get VM config: %w", err)
+	}
 
+	// Apply the configuration updates
+	if updatePayload := templateConfigPayload(req, vmConfig); len(updatePayload) > 0 {
+		_, err = api.ApiCall("POST", fmt.Sprintf("/nodes/%s/qemu/%s/config", req.Node, req.VMID), updatePayload)
+		if err != nil {
+			return fmt.Errorf("VM cloned but failed to update configuration: %w", err)
+		}
+	}
+	return nil
+}
+
+// templateConfigPayload builds the config update applied to a VM cloned
+// from a template, given the config the clone currently has
+func templateConfigPayload(req *VMCreateRequest, vmConfig map[string]interface{}) map[string]interface{} {
 	// Update VM configuration based on request
 	updatePayload := make(map[string]interface{})
 
@@ -232,13 +500,6 @@ func CreateVMFromTemplate(api *manager.APIManager, req *VMCreateRequest) (map[st
 		updatePayload["virtio0"] = fmt.Sprintf("%s:%s,format=raw", storage, size)
 	}
 
-	// For CloudInit, only set the drive if it doesn't already exist
-	// We'll check the current config first to avoid the "already exists" error
-	vmConfig, err := GetVMConfig(api, req.Node, req.VMID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get VM config: %w", err)
-	}
-
 	// Only set the CloudInit drive if it's not already configured
 	// This prevents the "Logical Volume already exists" error
 	if _, hasCloudInit := vmConfig["ide2"]; !hasCloudInit {
@@ -248,6 +509,11 @@ func CreateVMFromTemplate(api *manager.APIManager, req *VMCreateRequest) (map[st
 	// Always set DHCP for CloudInit
 	updatePayload["ipconfig0"] = "ip=dhcp"
 
+	// The IP can only be read back through the guest agent
+	if req.WaitForIP {
+		updatePayload["agent"] = "1"
+	}
+
 	if req.SSHKeys != "" {
 		// Proxmox expects the SSH keys to be properly formatted with newlines
 		updatePayload["sshkeys"] = strings.ReplaceAll(req.SSHKeys, " ", "\n")
@@ -271,41 +537,7 @@ func CreateVMFromTemplate(api *manager.APIManager, req *VMCreateRequest) (map[st
 		updatePayload["cipassword"] = req.Cipassword
 	}
 
-	// Apply the configuration updates
-	if len(updatePayload) > 0 {
-		_, err = api.ApiCall("POST", fmt.Sprintf("/nodes/%s/qemu/%s/config", req.Node, req.VMID), updatePayload)
-		if err != nil {
-			return nil, fmt.Errorf("VM cloned but failed to update configuration: %w", err)
-		}
-	}
-
-	// Start the VM if CloudInit is configured
-	if req.CloudInit {
-		err = StartVM(api, req.Node, req.VMID)
-		if err != nil {
-			return result, fmt.Errorf("VM cloned and configured but failed to start: %w", err)
-		}
-	}
-
-	return result, nil
-}
-
-func GetVMTemplates() (map[string]string, error) {
-	// Load templates from the JSON file
-	file, err := os.ReadFile("env/templates.json")
-	if err != nil {
-		return nil, fmt.Errorf("failed to read templates file: %w", err)
-	}
-
-	var templateData struct {
-		Templates map[string]string `json:"templates"`
-	}
-
-	if err := json.Unmarshal(file, &templateData); err != nil {
-		return nil, fmt.Errorf("failed to parse templates: %w", err)
-	}
-
-	return templateData.Templates, nil
+	return updatePayload
 }
 
 func GetVM(api *manager.APIManager, node, vmid string) (map[string]interface{}, error) {
@@ -322,12 +554,8 @@ func GetVM(api *manager.APIManager, node, vmid string) (map[string]interface{},
 }
 
 func DeleteVM(api *manager.APIManager, node, vmid string) error {
-	if _, err := strconv.Atoi(vmid); err != nil {
-		return fmt.Errorf("invalid VMID format")
-	}
-
-	if exists, _ := VMExists(api, node, vmid); !exists {
-		return fmt.Errorf("VM with ID %s not found", vmid)
+	if err := validateDeleteVM(api, node, vmid); err != nil {
+		return err
 	}
 
 	_, err := api.ApiCall("DELETE", fmt.Sprintf("/nodes/%s/qemu/%s", node, vmid), nil)
@@ -338,41 +566,23 @@ func DeleteVM(api *manager.APIManager, node, vmid string) error {
 	return nil
 }
 
-func StartVM(api *manager.APIManager, node, vmid string) error {
-	endpoint := fmt.Sprintf("/nodes/%s/qemu/%s/status/start", node, vmid)
-	_, err := api.ApiCallWithOptions("POST", endpoint, nil, false)
-	if err != nil {
-		return fmt.Errorf("failed to start VM: %w", err)
-	}
-	return nil
-}
-
-func StopVM(api *manager.APIManager, node, vmid string) error {
-	return vmOperation(api, node, vmid, "stop")
-}
-
-func RebootVM(api *manager.APIManager, node, vmid string) error {
-	return vmOperation(api, node, vmid, "reboot")
-}
-
-func vmOperation(api *manager.APIManager, node, vmid, operation string) error {
-	// Validate VMID
+func validateDeleteVM(api *manager.APIManager, node, vmid string) error {
 	if _, err := strconv.Atoi(vmid); err != nil {
 		return fmt.Errorf("invalid VMID format")
 	}
 
-	// Check if VM exists
 	if exists, _ := VMExists(api, node, vmid); !exists {
 		return fmt.Errorf("VM with ID %s not found", vmid)
 	}
+	return nil
+}
 
-	// Send API request to perform the operation without JSON content type
-	endpoint := fmt.Sprintf("/nodes/%s/qemu/%s/status/%s", node, vmid, operation)
+func StartVM(api *manager.APIManager, node, vmid string) error {
+	endpoint := fmt.Sprintf("/nodes/%s/qemu/%s/status/start", node, vmid)
 	_, err := api.ApiCallWithOptions("POST", endpoint, nil, false)
 	if err != nil {
-		return fmt.Errorf("failed to %s VM: %w", operation, err)
+		return fmt.Errorf("failed to start VM: %w", err)
 	}
-
 	return nil
 }
 
@@ -529,28 +739,6 @@ func GetISOs(api *manager.APIManager, node string) ([]map[string]interface{}, er
 
 	return isos, nil
 }
-func generateVMID(api *manager.APIManager, node string) (int, error) {
-	vms, err := ListVMs(api, node)
-	if err != nil {
-		return 0, err
-	}
-
-	usedVMIDs := make(map[int]bool)
-	for _, vm := range vms {
-		if vmid, ok := vm["vmid"].(float64); ok {
-			usedVMIDs[int(vmid)] = true
-		}
-	}
-
-	for vmid := 2000; vmid <= 3000; vmid++ {
-		if !usedVMIDs[vmid] {
-			return vmid, nil
-		}
-	}
-
-	return 0, fmt.Errorf("no available VMID in the range 2000-3000")
-}
-
 func validateResources(api *manager.APIManager, req *VMCreateRequest) error {
 	storageParts := strings.Split(req.Disk, ":")
 	if len(storageParts) != 2 {
@@ -566,6 +754,9 @@ func validateResources(api *manager.APIManager, req *VMCreateRequest) error {
 	for _, storage := range storages {
 		if name, ok := storage["storage"].(string); ok && name == storageParts[0] {
 			storageValid = true
+			if err := storageCapacityError(storage, parseSizeGB(storageParts[1])); err != nil {
+				return err
+			}
 			break
 		}
 	}
@@ -611,6 +802,33 @@ func validateResources(api *manager.APIManager, req *VMCreateRequest) error {
 	return nil
 }
 
+// checkStorageSpace fails when the storage reports less free space than size
+// bytes. Storages that do not report their usage are not checked
+func checkStorageSpace(api *manager.APIManager, node, storage string, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+
+	storages, err := GetStorages(api, node)
+	if err != nil {
+		return fmt.Errorf("failed to validate storage: %w", err)
+	}
+	for _, s := range storages {
+		if name, _ := s["storage"].(string); name == storage {
+			return storageCapacityError(s, size)
+		}
+	}
+	return fmt.Errorf("storage '%s' not found", storage)
+}
+
+func storageCapacityError(storage map[string]interface{}, size int64) error {
+	avail, ok := storage["avail"].(float64)
+	if !ok || int64(avail) >= size {
+		return nil
+	}
+	return fmt.Errorf("invalid disk size: storage '%s' has %s free, %s requested", storage["storage"], formatGB(int64(avail)), formatGB(size))
+}
+
 func buildVMPayload(req *VMCreateRequest) map[string]interface{} {
 	diskParts := strings.Split(req.Disk, ":")
 	storage := diskParts[0]
@@ -682,6 +900,50 @@ func GetVMConfig(api *manager.APIManager, node, vmid string) (map[string]interfa
 	return parseResponse(response)
 }
 
+// UpdateVMConfig sets Proxmox config options as they are, e.g.
+// {"memory": 4096, "delete": "ide2"}
+func UpdateVMConfig(api *manager.APIManager, node, vmid string, options map[string]interface{}) (map[string]interface{}, error) {
+	call, err := planUpdateVMConfig(api, node, vmid, options)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := api.ApiCall(call.Method, call.Endpoint, call.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update VM config: %w", err)
+	}
+
+	result, err := parseAPIResponse(response)
+	if err != nil {
+		return nil, err
+	}
+	result["changed"] = sortedKeys(call.Payload)
+	return result, nil
+}
+
+func planUpdateVMConfig(api *manager.APIManager, node, vmid string, options map[string]interface{}) (PlannedCall, error) {
+	if _, err := strconv.Atoi(vmid); err != nil {
+		return PlannedCall{}, fmt.Errorf("invalid VMID format")
+	}
+	if len(options) == 0 {
+		return PlannedCall{}, fmt.Errorf("no configuration changes given")
+	}
+	if exists, _ := VMExists(api, node, vmid); !exists {
+		return PlannedCall{}, fmt.Errorf("VM with ID %s not found", vmid)
+	}
+
+	// Proxmox expects tags as one string
+	if tags, ok := options["tags"].([]interface{}); ok {
+		names := make([]string, len(tags))
+		for i, tag := range tags {
+			names[i] = fmt.Sprint(tag)
+		}
+		options["tags"] = strings.Join(names, ";")
+	}
+
+	return PlannedCall{Method: "PUT", Endpoint: fmt.Sprintf("/nodes/%s/qemu/%s/config", node, vmid), Payload: options}, nil
+}
+
 func parseResponse(response []byte) (map[string]interface{}, error) {
 	var result map[string]interface{}
 	if err := json.Unmarshal(response, &result); err != nil {
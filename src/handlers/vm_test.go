@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveCloneType(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       CloneOptions
+		isTemplate bool
+		want       string
+		wantErr    string
+	}{
+		{name: "template defaults to full", isTemplate: true, want: "full"},
+		{name: "VM defaults to full", want: "full"},
+		{name: "full from a VM", opts: CloneOptions{CloneType: "full"}, want: "full"},
+		{name: "linked from a template", opts: CloneOptions{CloneType: "linked"}, isTemplate: true, want: "linked"},
+		{name: "full to another storage", opts: CloneOptions{Storage: "ceph", Format: "raw"}, isTemplate: true, want: "full"},
+		{name: "full from a snapshot", opts: CloneOptions{Snapshot: "before-upgrade"}, want: "full"},
+		{name: "linked from a VM", opts: CloneOptions{CloneType: "linked"}, wantErr: "linked clones require a template"},
+		{name: "linked to another storage", opts: CloneOptions{CloneType: "linked", Storage: "ceph"}, isTemplate: true, wantErr: "require a full clone"},
+		{name: "linked from a snapshot", opts: CloneOptions{CloneType: "linked", Snapshot: "s1"}, isTemplate: true, wantErr: "require a full clone"},
+		{name: "unknown type", opts: CloneOptions{CloneType: "thin"}, wantErr: "invalid clone type 'thin'"},
+		{name: "unknown format", opts: CloneOptions{Format: "vdi"}, wantErr: "invalid clone format 'vdi'"},
+		{name: "negative bwlimit", opts: CloneOptions{BWLimit: -1}, wantErr: "invalid bwlimit"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveCloneType(tt.opts, tt.isTemplate)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolveCloneType() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveCloneType() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("resolveCloneType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
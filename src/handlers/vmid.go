@@ -0,0 +1,313 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"rm-thierry/Proxmox-API/src/manager"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type VMIDRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// VMIDAllocator hands out guest IDs that are free across the whole cluster
+// and holds a short-lived reservation for each one, so concurrent creates
+// never pick the same ID before Proxmox knows about the guest
+type VMIDAllocator struct {
+	mu           sync.Mutex
+	ranges       map[string]VMIDRange
+	reservations map[int]time.Time
+	ttl          time.Duration
+	db           *manager.DBManager
+}
+
+var (
+	vmidAllocatorOnce sync.Once
+	vmidAllocator     *VMIDAllocator
+)
+
+// defaultVMIDAllocator is created lazily so VMID_RANGES from env/.env is
+// loaded before it is read
+func defaultVMIDAllocator() *VMIDAllocator {
+	vmidAllocatorOnce.Do(func() {
+		vmidAllocator = NewVMIDAllocator()
+	})
+	return vmidAllocator
+}
+
+// NewVMIDAllocator reads ranges from VMID_RANGES, e.g.
+// "qemu=2000-2999,lxc=100-1999,team-a=5000-5999". Scopes without a range
+// fall back to /cluster/nextid
+func NewVMIDAllocator() *VMIDAllocator {
+	allocator := &VMIDAllocator{
+		ranges: map[string]VMIDRange{
+			"qemu": {Min: 2000, Max: 3000},
+		},
+		reservations: make(map[int]time.Time),
+		ttl:          5 * time.Minute,
+	}
+
+	for _, entry := range strings.Split(os.Getenv("VMID_RANGES"), ",") {
+		scope, bounds, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		lo, hi, ok := strings.Cut(bounds, "-")
+		if !ok {
+			continue
+		}
+		min, err1 := strconv.Atoi(lo)
+		max, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || min > max {
+			continue
+		}
+		allocator.ranges[scope] = VMIDRange{Min: min, Max: max}
+	}
+
+	if ttl, err := time.ParseDuration(os.Getenv("VMID_RESERVATION_TTL")); err == nil && ttl > 0 {
+		allocator.ttl = ttl
+	}
+
+	return allocator
+}
+
+// SetVMIDReservationStore persists reservations in the database so that
+// several instances of this API share them
+func SetVMIDReservationStore(db *manager.DBManager) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS vmid_reservations (
+		vmid INT PRIMARY KEY,
+		scope VARCHAR(64) NOT NULL,
+		expires_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create reservation table: %w", err)
+	}
+
+	allocator := defaultVMIDAllocator()
+	allocator.mu.Lock()
+	allocator.db = db
+	allocator.mu.Unlock()
+	return nil
+}
+
+// AllocateVMID reserves a free ID for the scope, which is a team name or
+// the guest type ("qemu" or "lxc")
+func AllocateVMID(api *manager.APIManager, scope string) (int, error) {
+	return defaultVMIDAllocator().Allocate(api, scope)
+}
+
+func ReleaseVMID(vmid string) {
+	id, err := strconv.Atoi(vmid)
+	if err != nil {
+		return
+	}
+	defaultVMIDAllocator().Release(id)
+}
+
+// allocateVMID picks the ID for a create. Dry runs only look up the ID the
+// create would get, without reserving it, and report allocated as false
+func allocateVMID(api *manager.APIManager, scope string, dryRun bool) (vmid string, allocated bool, err error) {
+	allocator := defaultVMIDAllocator()
+	if dryRun {
+		id, err := allocator.Peek(api, scope)
+		if err != nil {
+			return "", false, err
+		}
+		return strconv.Itoa(id), false, nil
+	}
+	id, err := allocator.Allocate(api, scope)
+	if err != nil {
+		return "", false, err
+	}
+	return strconv.Itoa(id), true, nil
+}
+
+// releaseAllocatedVMID gives back a VMID this request allocated. An ID the
+// caller chose is never released, it may be another request's reservation
+func releaseAllocatedVMID(vmid string, allocated bool) {
+	if allocated {
+		ReleaseVMID(vmid)
+	}
+}
+
+func (a *VMIDAllocator) Allocate(api *manager.APIManager, scope string) (int, error) {
+	return a.next(api, scope, true)
+}
+
+// Peek returns the ID Allocate would hand out without reserving it or
+// changing any stored reservation
+func (a *VMIDAllocator) Peek(api *manager.APIManager, scope string) (int, error) {
+	return a.next(api, scope, false)
+}
+
+func (a *VMIDAllocator) next(api *manager.APIManager, scope string, reserve bool) (int, error) {
+	used, err := clusterVMIDs(api)
+	if err != nil {
+		return 0, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var stored map[int]bool
+	if reserve {
+		a.purgeExpired()
+	} else if stored, err = a.storedReservations(); err != nil {
+		return 0, err
+	}
+
+	r, ok := a.ranges[scope]
+	if !ok {
+		next, err := clusterNextID(api)
+		if err != nil {
+			return 0, err
+		}
+		r = VMIDRange{Min: next, Max: 999999999}
+	}
+
+	now := time.Now()
+	for vmid := r.Min; vmid <= r.Max; vmid++ {
+		if used[vmid] || stored[vmid] {
+			continue
+		}
+		if expires, reserved := a.reservations[vmid]; reserved && now.Before(expires) {
+			continue
+		}
+		if !reserve {
+			return vmid, nil
+		}
+		reserved, err := a.reserve(vmid, scope)
+		if err != nil {
+			return 0, err
+		}
+		if !reserved {
+			continue
+		}
+		return vmid, nil
+	}
+
+	return 0, fmt.Errorf("no available VMID in the range %d-%d", r.Min, r.Max)
+}
+
+func (a *VMIDAllocator) Release(vmid int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.reservations, vmid)
+	if a.db != nil {
+		_, _ = a.db.Exec("DELETE FROM vmid_reservations WHERE vmid = ?", vmid)
+	}
+}
+
+// reserve reports false when another instance already reserved the ID, and
+// an error when the reservation could not be made at all
+func (a *VMIDAllocator) reserve(vmid int, scope string) (bool, error) {
+	expires := time.Now().Add(a.ttl)
+
+	if a.db != nil {
+		// The primary key rejects IDs already reserved by another instance
+		_, err := a.db.Exec("INSERT INTO vmid_reservations (vmid, scope, expires_at) VALUES (?, ?, ?)",
+			vmid, scope, expires.UTC())
+		if manager.IsDuplicateKey(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to reserve VMID %d: %w", vmid, err)
+		}
+	}
+
+	a.reservations[vmid] = expires
+	return true, nil
+}
+
+// storedReservations reads the unexpired reservations of all instances
+func (a *VMIDAllocator) storedReservations() (map[int]bool, error) {
+	if a.db == nil {
+		return nil, nil
+	}
+
+	rows, err := a.db.Query("SELECT vmid FROM vmid_reservations WHERE expires_at >= ?", time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VMID reservations: %w", err)
+	}
+	defer rows.Close()
+
+	stored := make(map[int]bool)
+	for rows.Next() {
+		var vmid int
+		if err := rows.Scan(&vmid); err != nil {
+			return nil, fmt.Errorf("failed to read VMID reservations: %w", err)
+		}
+		stored[vmid] = true
+	}
+	return stored, rows.Err()
+}
+
+func (a *VMIDAllocator) purgeExpired() {
+	now := time.Now()
+	for vmid, expires := range a.reservations {
+		if now.After(expires) {
+			delete(a.reservations, vmid)
+		}
+	}
+
+	if a.db != nil {
+		_, _ = a.db.Exec("DELETE FROM vmid_reservations WHERE expires_at < ?", now.UTC())
+	}
+}
+
+func clusterVMIDs(api *manager.APIManager) (map[int]bool, error) {
+	resources, err := GetClusterResources(api, "vm")
+	if err != nil {
+		return nil, err
+	}
+
+	used := make(map[int]bool, len(resources))
+	for _, resource := range resources {
+		if vmid, ok := resource["vmid"].(float64); ok {
+			used[int(vmid)] = true
+		}
+	}
+	return used, nil
+}
+
+func clusterNextID(api *manager.APIManager) (int, error) {
+	response, err := api.ApiCall("GET", "/cluster/nextid", nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get next VMID: %w", err)
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(response, &result); err != nil {
+		return 0, fmt.Errorf("failed to parse next VMID: %w", err)
+	}
+
+	switch next := result["data"].(type) {
+	case string:
+		return strconv.Atoi(next)
+	case float64:
+		return int(next), nil
+	}
+	return 0, fmt.Errorf("invalid next VMID format")
+}
+
+// vmidScope picks the team's ID range when one is configured and the
+// guest type's range otherwise
+func vmidScope(team, guestType string) string {
+	if team != "" {
+		allocator := defaultVMIDAllocator()
+		allocator.mu.Lock()
+		_, ok := allocator.ranges[team]
+		allocator.mu.Unlock()
+		if ok {
+			return team
+		}
+	}
+	return guestType
+}
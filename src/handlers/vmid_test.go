@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"rm-thierry/Proxmox-API/src/manager"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClusterAPI serves /cluster/resources with the given guest IDs and
+// /cluster/nextid
+func fakeClusterAPI(t *testing.T, used []int, nextID string) *manager.APIManager {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data interface{}
+		switch r.URL.Path {
+		case "/cluster/resources":
+			guests := make([]map[string]interface{}, 0, len(used))
+			for _, vmid := range used {
+				guests = append(guests, map[string]interface{}{"type": "qemu", "vmid": vmid})
+			}
+			data = guests
+		case "/cluster/nextid":
+			data = nextID
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	t.Cleanup(server.Close)
+	return &manager.APIManager{BaseURL: server.URL, Node: "pve"}
+}
+
+func TestVMIDAllocatorAllocate(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name         string
+		scope        string
+		used         []int
+		reservations map[int]time.Time
+		want         int
+		wantErr      string
+	}{
+		{name: "first free ID", scope: "qemu", want: 2000},
+		{name: "skips guests", scope: "qemu", used: []int{2000, 2001}, want: 2002},
+		{name: "skips reservations", scope: "qemu", used: []int{2000}, reservations: map[int]time.Time{2001: now.Add(time.Minute)}, want: 2002},
+		{name: "reuses expired reservations", scope: "qemu", reservations: map[int]time.Time{2000: now.Add(-time.Minute)}, want: 2000},
+		{name: "team range", scope: "team-a", used: []int{5000}, want: 5001},
+		{name: "scope without range uses nextid", scope: "lxc", used: []int{150}, want: 151},
+		{name: "range exhausted", scope: "team-a", used: []int{5000, 5001, 5002}, wantErr: "no available VMID in the range 5000-5002"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := fakeClusterAPI(t, tt.used, "150")
+			reservations := make(map[int]time.Time)
+			for vmid, expires := range tt.reservations {
+				reservations[vmid] = expires
+			}
+			allocator := &VMIDAllocator{
+				ranges:       map[string]VMIDRange{"qemu": {Min: 2000, Max: 2005}, "team-a": {Min: 5000, Max: 5002}},
+				reservations: reservations,
+				ttl:          time.Minute,
+			}
+
+			peeked, peekErr := allocator.Peek(api, tt.scope)
+			got, err := allocator.Allocate(api, tt.scope)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Allocate() error = %v, want %q", err, tt.wantErr)
+				}
+				if peekErr == nil {
+					t.Errorf("Peek() returned %d, want an error", peeked)
+				}
+				return
+			}
+			if err != nil || peekErr != nil {
+				t.Fatalf("Allocate() error = %v, Peek() error = %v", err, peekErr)
+			}
+			if got != tt.want {
+				t.Errorf("Allocate() = %d, want %d", got, tt.want)
+			}
+			if peeked != got {
+				t.Errorf("Peek() = %d, want the ID Allocate returns (%d)", peeked, got)
+			}
+			if _, reserved := allocator.reservations[got]; !reserved {
+				t.Errorf("Allocate() did not reserve %d", got)
+			}
+		})
+	}
+}
+
+func TestVMIDAllocatorReservations(t *testing.T) {
+	api := fakeClusterAPI(t, nil, "150")
+	allocator := &VMIDAllocator{
+		ranges:       map[string]VMIDRange{"qemu": {Min: 2000, Max: 2005}},
+		reservations: make(map[int]time.Time),
+		ttl:          time.Minute,
+	}
+
+	steps := []struct {
+		action string
+		want   int
+	}{
+		{"peek", 2000},
+		{"peek", 2000},
+		{"allocate", 2000},
+		{"peek", 2001},
+		{"allocate", 2001},
+		{"release 2000", 0},
+		{"allocate", 2000},
+		{"allocate", 2002},
+	}
+
+	for i, step := range steps {
+		var got int
+		var err error
+		switch step.action {
+		case "peek":
+			got, err = allocator.Peek(api, "qemu")
+		case "allocate":
+			got, err = allocator.Allocate(api, "qemu")
+		default:
+			allocator.Release(2000)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("step %d (%s): %v", i, step.action, err)
+		}
+		if got != step.want {
+			t.Errorf("step %d (%s) = %d, want %d", i, step.action, got, step.want)
+		}
+	}
+}
+
+func TestNewVMIDAllocatorRanges(t *testing.T) {
+	tests := []struct {
+		env  string
+		want map[string]VMIDRange
+	}{
+		{"", map[string]VMIDRange{"qemu": {Min: 2000, Max: 3000}}},
+		{"qemu=100-199, lxc=200-299", map[string]VMIDRange{"qemu": {Min: 100, Max: 199}, "lxc": {Min: 200, Max: 299}}},
+		{"team-a=5000-5999,broken,bad=9-1,nan=a-b", map[string]VMIDRange{"qemu": {Min: 2000, Max: 3000}, "team-a": {Min: 5000, Max: 5999}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv("VMID_RANGES", tt.env)
+			if got := NewVMIDAllocator().ranges; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ranges = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,510 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"rm-thierry/Proxmox-API/src/logging"
+	"rm-thierry/Proxmox-API/src/manager"
+	"rm-thierry/Proxmox-API/src/metrics"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// deliveryLogSize is how many deliveries are kept in memory
+	deliveryLogSize = 1000
+	// deliveryRetention is how long finished deliveries stay in the database
+	deliveryRetention = 7 * 24 * time.Hour
+	deliveryWorkers   = 8
+)
+
+// Event is the JSON body of a webhook request. Source is "api" for changes
+// made through this service and "cluster" for tasks found on the cluster
+type Event struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	Time      time.Time              `json:"time"`
+	Source    string                 `json:"source"`
+	Node      string                 `json:"node,omitempty"`
+	VMID      string                 `json:"vmid,omitempty"`
+	TaskID    string                 `json:"task_id,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+type DeliveryAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS float64   `json:"duration_ms"`
+}
+
+// WebhookDelivery is an event sent to one webhook. Status is pending while
+// attempts are left, then delivered or failed
+type WebhookDelivery struct {
+	ID           string            `json:"id"`
+	WebhookID    string            `json:"webhook_id"`
+	Event        Event             `json:"event"`
+	Status       string            `json:"status"`
+	Attempts     []DeliveryAttempt `json:"attempts"`
+	NextAttempt  *time.Time        `json:"next_attempt,omitempty"`
+	RedeliveryOf string            `json:"redelivery_of,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+}
+
+// webhookDispatcher sends deliveries and retries them with exponential
+// backoff. The delivery log is kept in memory, and in the database when
+// one is configured
+type webhookDispatcher struct {
+	mu          sync.Mutex
+	db          *manager.DBManager
+	deliveries  map[string]*WebhookDelivery
+	inflight    map[string]bool
+	wake        chan struct{}
+	client      *http.Client
+	maxAttempts int
+	started     sync.Once
+}
+
+var (
+	webhookDispatcherOnce sync.Once
+	dispatcher            *webhookDispatcher
+)
+
+func defaultWebhookDispatcher() *webhookDispatcher {
+	webhookDispatcherOnce.Do(func() {
+		maxAttempts, err := strconv.Atoi(os.Getenv("WEBHOOK_MAX_ATTEMPTS"))
+		if err != nil || maxAttempts <= 0 {
+			maxAttempts = 8
+		}
+		timeout, err := time.ParseDuration(os.Getenv("WEBHOOK_TIMEOUT"))
+		if err != nil || timeout <= 0 {
+			timeout = 10 * time.Second
+		}
+		dispatcher = &webhookDispatcher{
+			deliveries:  make(map[string]*WebhookDelivery),
+			inflight:    make(map[string]bool),
+			wake:        make(chan struct{}, 1),
+			client:      &http.Client{Timeout: timeout},
+			maxAttempts: maxAttempts,
+		}
+	})
+	return dispatcher
+}
+
+// EmitEvent sends the event to every active webhook subscribed to its type
+func EmitEvent(event Event) {
+	if event.ID == "" {
+		event.ID = "evt-" + randomToken(8)
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	webhooks, err := defaultWebhookStore().load()
+	if err != nil {
+		slog.Warn("unable to load webhooks", "event", event.Type, "error", err)
+		return
+	}
+	for _, webhook := range webhooks {
+		if webhook.Active && webhook.subscribes(event.Type) {
+			defaultWebhookDispatcher().enqueue(newDelivery(webhook.ID, event, ""))
+		}
+	}
+}
+
+// PingWebhook sends a ping event to the webhook, whatever it subscribed to
+func PingWebhook(id string) (*WebhookDelivery, error) {
+	if _, err := getWebhook(id); err != nil {
+		return nil, err
+	}
+	event := Event{
+		ID:     "evt-" + randomToken(8),
+		Type:   "ping",
+		Time:   time.Now().UTC(),
+		Source: "api",
+	}
+	delivery := newDelivery(id, event, "")
+	defaultWebhookDispatcher().enqueue(delivery)
+	return delivery.snapshot(), nil
+}
+
+// Redeliver sends the event of a delivery again as a new delivery. The
+// event keeps its ID so receivers can ignore events they already handled
+func Redeliver(webhookID, deliveryID string) (*WebhookDelivery, error) {
+	original, err := GetDelivery(webhookID, deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := getWebhook(webhookID); err != nil {
+		return nil, err
+	}
+	delivery := newDelivery(webhookID, original.Event, original.ID)
+	defaultWebhookDispatcher().enqueue(delivery)
+	return delivery.snapshot(), nil
+}
+
+// ListDeliveries returns the newest deliveries of a webhook first, filtered
+// by status when it is not empty
+func ListDeliveries(webhookID, status string, limit int) ([]WebhookDelivery, error) {
+	if _, err := getWebhook(webhookID); err != nil {
+		return nil, err
+	}
+	if limit <= 0 || limit > deliveryLogSize {
+		limit = 100
+	}
+	return defaultWebhookDispatcher().list(webhookID, status, limit)
+}
+
+func GetDelivery(webhookID, deliveryID string) (*WebhookDelivery, error) {
+	d := defaultWebhookDispatcher()
+	d.mu.Lock()
+	delivery, ok := d.deliveries[deliveryID]
+	db := d.db
+	if ok {
+		delivery = delivery.snapshotLocked()
+	}
+	d.mu.Unlock()
+
+	if !ok && db != nil {
+		var definition string
+		err := db.QueryRow("SELECT definition FROM webhook_deliveries WHERE id = ?", deliveryID).Scan(&definition)
+		if err == nil {
+			delivery = &WebhookDelivery{}
+			ok = json.Unmarshal([]byte(definition), delivery) == nil
+		}
+	}
+	if !ok || delivery.WebhookID != webhookID {
+		return nil, fmt.Errorf("delivery '%s' not found", deliveryID)
+	}
+	return delivery, nil
+}
+
+func newDelivery(webhookID string, event Event, redeliveryOf string) *WebhookDelivery {
+	now := time.Now().UTC()
+	return &WebhookDelivery{
+		ID:           "whd-" + randomToken(8),
+		WebhookID:    webhookID,
+		Event:        event,
+		Status:       "pending",
+		Attempts:     []DeliveryAttempt{},
+		NextAttempt:  &now,
+		RedeliveryOf: redeliveryOf,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+}
+
+// useDatabase persists the delivery log and picks up the deliveries that
+// were still pending when the service stopped
+func (d *webhookDispatcher) useDatabase(db *manager.DBManager) error {
+	rows, err := db.Query("SELECT definition FROM webhook_deliveries WHERE status = 'pending'")
+	if err != nil {
+		return fmt.Errorf("failed to read webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var pending []*WebhookDelivery
+	for rows.Next() {
+		var definition string
+		if err := rows.Scan(&definition); err != nil {
+			return fmt.Errorf("failed to read webhook deliveries: %w", err)
+		}
+		var delivery WebhookDelivery
+		if err := json.Unmarshal([]byte(definition), &delivery); err == nil {
+			pending = append(pending, &delivery)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read webhook deliveries: %w", err)
+	}
+
+	d.mu.Lock()
+	d.db = db
+	for _, delivery := range pending {
+		d.deliveries[delivery.ID] = delivery
+	}
+	d.mu.Unlock()
+
+	if len(pending) > 0 {
+		d.started.Do(func() { go d.run() })
+		d.signal()
+	}
+	return nil
+}
+
+func (d *webhookDispatcher) enqueue(delivery *WebhookDelivery) {
+	d.mu.Lock()
+	d.deliveries[delivery.ID] = delivery
+	d.pruneLocked()
+	d.saveLocked(delivery)
+	d.mu.Unlock()
+
+	d.started.Do(func() { go d.run() })
+	d.signal()
+}
+
+func (d *webhookDispatcher) signal() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run starts the deliveries that are due and sleeps until the next one is
+func (d *webhookDispatcher) run() {
+	workers := make(chan struct{}, deliveryWorkers)
+	for {
+		now := time.Now()
+		next := now.Add(time.Minute)
+
+		d.mu.Lock()
+		var due []*WebhookDelivery
+		for id, delivery := range d.deliveries {
+			if delivery.Status != "pending" || d.inflight[id] || delivery.NextAttempt == nil {
+				continue
+			}
+			if delivery.NextAttempt.After(now) {
+				if delivery.NextAttempt.Before(next) {
+					next = *delivery.NextAttempt
+				}
+				continue
+			}
+			d.inflight[id] = true
+			due = append(due, delivery)
+		}
+		d.mu.Unlock()
+
+		for _, delivery := range due {
+			workers <- struct{}{}
+			go func(delivery *WebhookDelivery) {
+				defer func() { <-workers }()
+				d.attempt(delivery)
+				d.signal()
+			}(delivery)
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-d.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// attempt sends the delivery once and schedules the next attempt if it
+// failed and attempts are left
+func (d *webhookDispatcher) attempt(delivery *WebhookDelivery) {
+	started := time.Now()
+	statusCode, err := d.send(delivery)
+	attempt := DeliveryAttempt{
+		At:         started.UTC(),
+		StatusCode: statusCode,
+		DurationMS: float64(time.Since(started).Microseconds()) / 1000,
+	}
+	if err != nil {
+		attempt.Error = logging.RedactString(err.Error())
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.inflight, delivery.ID)
+
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	delivery.UpdatedAt = time.Now().UTC()
+	switch {
+	case err == nil:
+		delivery.Status = "delivered"
+		delivery.NextAttempt = nil
+		metrics.WebhookDeliveries.WithLabelValues(delivery.Event.Type, "delivered").Inc()
+	case len(delivery.Attempts) >= d.maxAttempts || statusCode == -1:
+		delivery.Status = "failed"
+		delivery.NextAttempt = nil
+		metrics.WebhookDeliveries.WithLabelValues(delivery.Event.Type, "failed").Inc()
+		slog.Warn("webhook delivery failed", "webhook", delivery.WebhookID, "delivery", delivery.ID,
+			"event", delivery.Event.Type, "attempts", len(delivery.Attempts), "error", attempt.Error)
+	default:
+		next := time.Now().UTC().Add(retryDelay(len(delivery.Attempts)))
+		delivery.NextAttempt = &next
+		metrics.WebhookDeliveries.WithLabelValues(delivery.Event.Type, "retry").Inc()
+	}
+	d.saveLocked(delivery)
+}
+
+// send posts the event signed with the webhook secret. It returns -1 when
+// the webhook is gone, so the delivery is not retried
+func (d *webhookDispatcher) send(delivery *WebhookDelivery) (int, error) {
+	webhook, err := getWebhook(delivery.WebhookID)
+	if err != nil {
+		return -1, err
+	}
+	if !webhook.Active && delivery.Event.Type != "ping" {
+		return -1, fmt.Errorf("webhook '%s' is inactive", webhook.ID)
+	}
+
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return -1, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "proxmox-api-webhooks")
+	req.Header.Set("X-Webhook-ID", webhook.ID)
+	req.Header.Set("X-Webhook-Event", delivery.Event.Type)
+	req.Header.Set("X-Webhook-Delivery", delivery.ID)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+SignWebhook(webhook.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("receiver returned status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// SignWebhook is the hex HMAC-SHA256 of "<timestamp>.<body>" with the
+// webhook secret, as sent in X-Webhook-Signature
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryDelay doubles from 30 seconds up to an hour
+func retryDelay(attempts int) time.Duration {
+	delay := 30 * time.Second
+	for i := 1; i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
+
+func (d *webhookDispatcher) list(webhookID, status string, limit int) ([]WebhookDelivery, error) {
+	d.mu.Lock()
+	db := d.db
+	var deliveries []WebhookDelivery
+	if db == nil {
+		for _, delivery := range d.deliveries {
+			if delivery.WebhookID == webhookID && (status == "" || delivery.Status == status) {
+				deliveries = append(deliveries, *delivery.snapshotLocked())
+			}
+		}
+	}
+	d.mu.Unlock()
+
+	if db != nil {
+		query := "SELECT definition FROM webhook_deliveries WHERE webhook_id = ?"
+		args := []interface{}{webhookID}
+		if status != "" {
+			query += " AND status = ?"
+			args = append(args, status)
+		}
+		query += " ORDER BY created_at DESC LIMIT ?"
+		args = append(args, limit)
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read webhook deliveries: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var definition string
+			if err := rows.Scan(&definition); err != nil {
+				return nil, fmt.Errorf("failed to read webhook deliveries: %w", err)
+			}
+			var delivery WebhookDelivery
+			if err := json.Unmarshal([]byte(definition), &delivery); err == nil {
+				deliveries = append(deliveries, delivery)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read webhook deliveries: %w", err)
+		}
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt) })
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	if deliveries == nil {
+		deliveries = []WebhookDelivery{}
+	}
+	return deliveries, nil
+}
+
+func (d *webhookDispatcher) saveLocked(delivery *WebhookDelivery) {
+	if d.db == nil {
+		return
+	}
+	definition, err := json.Marshal(delivery)
+	if err != nil {
+		return
+	}
+	_, err = d.db.Exec(`INSERT INTO webhook_deliveries (id, webhook_id, status, created_at, definition) VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE status = VALUES(status), definition = VALUES(definition)`,
+		delivery.ID, delivery.WebhookID, delivery.Status, delivery.CreatedAt, string(definition))
+	if err != nil {
+		slog.Warn("unable to save webhook delivery", "delivery", delivery.ID, "error", err)
+	}
+}
+
+// pruneLocked drops the oldest finished deliveries from memory, and from
+// the database once they are older than deliveryRetention
+func (d *webhookDispatcher) pruneLocked() {
+	if len(d.deliveries) > deliveryLogSize {
+		var finished []*WebhookDelivery
+		for _, delivery := range d.deliveries {
+			if delivery.Status != "pending" {
+				finished = append(finished, delivery)
+			}
+		}
+		sort.Slice(finished, func(i, j int) bool { return finished[i].CreatedAt.Before(finished[j].CreatedAt) })
+		for i := 0; i < len(finished) && len(d.deliveries) > deliveryLogSize; i++ {
+			delete(d.deliveries, finished[i].ID)
+		}
+	}
+
+	if d.db != nil {
+		_, _ = d.db.Exec("DELETE FROM webhook_deliveries WHERE status <> 'pending' AND created_at < ?",
+			time.Now().UTC().Add(-deliveryRetention))
+	}
+}
+
+func (w *WebhookDelivery) snapshot() *WebhookDelivery {
+	d := defaultWebhookDispatcher()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return w.snapshotLocked()
+}
+
+func (w *WebhookDelivery) snapshotLocked() *WebhookDelivery {
+	copied := *w
+	copied.Attempts = append([]DeliveryAttempt{}, w.Attempts...)
+	return &copied
+}
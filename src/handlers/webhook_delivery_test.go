@@ -0,0 +1,25 @@
+package handlers
+
+import "testing"
+
+func TestSignWebhook(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		body      string
+		want      string
+	}{
+		{"ping", "s3cret", "1715249708", `{"type":"ping"}`, "d68afa5a761820e591879446f2fe2b3b56627f22e98a469ae581edd08dfbf4f9"},
+		{"other secret", "other", "1715249708", `{"type":"ping"}`, "b6bf628899b51ee446639cb67cd3efcc7555dcfe2859de0eab98ea36a8e74044"},
+		{"empty", "", "0", "", "b849d5a581847b281957065739df36df2463d1977ea8d6e1e4e6cf33fadc68c3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SignWebhook(tt.secret, tt.timestamp, []byte(tt.body)); got != tt.want {
+				t.Errorf("SignWebhook() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"rm-thierry/Proxmox-API/src/logging"
+	"rm-thierry/Proxmox-API/src/manager"
+	"strings"
+	"time"
+)
+
+// guestEvents maps a change made through this service, as method and
+// Proxmox path with the node and VMID left out, to its event
+var guestEvents = map[string]string{
+	"POST /qemu":                 "vm.created",
+	"POST /qemu/clone":           "vm.created",
+	"DELETE /qemu":               "vm.deleted",
+	"POST /qemu/status/start":    "vm.started",
+	"POST /qemu/status/stop":     "vm.stopped",
+	"POST /qemu/status/shutdown": "vm.stopped",
+	"POST /lxc":                  "ct.created",
+}
+
+// taskEvents maps the type of a finished Proxmox task to its event
+var taskEvents = map[string]string{
+	"qmcreate":   "vm.created",
+	"qmrestore":  "vm.created",
+	"qmclone":    "vm.created",
+	"qmdestroy":  "vm.deleted",
+	"qmstart":    "vm.started",
+	"qmstop":     "vm.stopped",
+	"qmshutdown": "vm.stopped",
+	"vzcreate":   "ct.created",
+	"vzrestore":  "ct.created",
+}
+
+// eventTaskTimeout is how long an API event waits for its task to finish
+const eventTaskTimeout = time.Hour
+
+// ObserveProxmoxCall turns the changes made through this service into
+// events. Changes that run as a Proxmox task are sent once the task
+// succeeded. It is registered with manager.SetCallObserver
+func ObserveProxmoxCall(api *manager.APIManager, method, endpoint string, payload interface{}, response []byte) {
+	path, _, _ := strings.Cut(endpoint, "?")
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) < 3 || segments[0] != "nodes" {
+		return
+	}
+	node := segments[1]
+
+	// /nodes/{node}/qemu/{vmid}/status/start becomes /qemu/status/start
+	key := "/" + segments[2]
+	vmid := ""
+	if len(segments) > 3 {
+		vmid = segments[3]
+		key += "/" + strings.Join(segments[4:], "/")
+	}
+	eventType, ok := guestEvents[method+" "+strings.TrimSuffix(key, "/")]
+	if !ok {
+		return
+	}
+
+	var fields map[string]interface{}
+	if data, err := json.Marshal(payload); err == nil {
+		_ = json.Unmarshal(data, &fields)
+	}
+
+	event := Event{
+		Type:      eventType,
+		Source:    "api",
+		Node:      node,
+		VMID:      vmid,
+		RequestID: logging.RequestID(api.Context()),
+		Data:      make(map[string]interface{}),
+	}
+	switch {
+	case strings.HasSuffix(key, "/clone"):
+		event.VMID = fmt.Sprint(fields["newid"])
+		event.Data["source_vmid"] = vmid
+		if target, ok := fields["target"].(string); ok && target != "" {
+			event.Node = target
+		}
+	case vmid == "" && fields["vmid"] != nil:
+		event.VMID = fmt.Sprint(fields["vmid"])
+	}
+	for _, name := range []string{"name", "hostname"} {
+		if value, ok := fields[name].(string); ok && value != "" {
+			event.Data[name] = value
+		}
+	}
+
+	var result struct {
+		Data interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(response, &result); err == nil {
+		if upid, ok := result.Data.(string); ok {
+			event.TaskID = upid
+		}
+	}
+	if event.TaskID == "" {
+		EmitEvent(event)
+		return
+	}
+
+	// The request's context ends with the request, the task usually does not
+	go emitAfterTask(api.WithContext(context.Background()), event)
+}
+
+// emitAfterTask sends the event when its task succeeded. Failed tasks are
+// reported as task.failed by the task poller
+func emitAfterTask(api *manager.APIManager, event Event) {
+	deadline := time.Now().Add(eventTaskTimeout)
+	for {
+		status, err := GetTaskStatus(api, TaskNode(event.TaskID), event.TaskID)
+		if err != nil {
+			slog.Warn("event dropped, task status unknown", "event", event.Type, "task", event.TaskID, "error", err)
+			return
+		}
+
+		if state, _ := status["status"].(string); state == "stopped" {
+			exit, _ := status["exitstatus"].(string)
+			if !TaskSucceeded(exit) {
+				return
+			}
+			if warnings := TaskWarnings(exit); warnings > 0 {
+				event.Data["warnings"] = warnings
+			}
+			EmitEvent(event)
+			return
+		}
+
+		if time.Now().After(deadline) {
+			slog.Warn("event dropped, task did not finish", "event", event.Type, "task", event.TaskID)
+			return
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// StartTaskPoller polls /cluster/tasks every interval for tasks that
+// finished since the last poll. Changes made outside this service become
+// events, as do failed tasks and backups whoever started them
+func StartTaskPoller(api *manager.APIManager, interval time.Duration) {
+	poller := &taskPoller{api: api, seen: make(map[string]bool)}
+	go func() {
+		for {
+			if err := poller.poll(); err != nil {
+				slog.Warn("webhook task poll failed", "error", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+type clusterTask struct {
+	UPID    string  `json:"upid"`
+	Node    string  `json:"node"`
+	Type    string  `json:"type"`
+	ID      string  `json:"id"`
+	User    string  `json:"user"`
+	Status  string  `json:"status"`
+	EndTime float64 `json:"endtime"`
+}
+
+type taskPoller struct {
+	api    *manager.APIManager
+	seen   map[string]bool
+	primed bool
+}
+
+func (p *taskPoller) poll() error {
+	response, err := p.api.ApiCall("GET", "/cluster/tasks", nil)
+	if err != nil {
+		return fmt.Errorf("failed to list cluster tasks: %w", err)
+	}
+	var result struct {
+		Data []clusterTask `json:"data"`
+	}
+	if err := json.Unmarshal(response, &result); err != nil {
+		return fmt.Errorf("failed to parse cluster tasks: %w", err)
+	}
+
+	var finished []clusterTask
+	listed := make(map[string]bool)
+	for _, task := range result.Data {
+		if task.EndTime == 0 || task.UPID == "" {
+			continue
+		}
+		listed[task.UPID] = true
+		if !p.seen[task.UPID] {
+			finished = append(finished, task)
+		}
+	}
+	// /cluster/tasks only lists recent tasks, forget the ones that left it
+	p.seen = listed
+
+	// Tasks that finished before the service started are not announced
+	if p.primed {
+		for _, task := range finished {
+			for _, event := range p.taskEvents(task) {
+				EmitEvent(event)
+			}
+		}
+	}
+	p.primed = true
+	return nil
+}
+
+// taskEvents returns the events of a finished task. Guest changes made with
+// this service's token were announced when they were made
+func (p *taskPoller) taskEvents(task clusterTask) []Event {
+	base := Event{
+		Source: "cluster",
+		Node:   task.Node,
+		VMID:   task.ID,
+		TaskID: task.UPID,
+		Time:   time.Unix(int64(task.EndTime), 0).UTC(),
+		Data: map[string]interface{}{
+			"task_type": task.Type,
+			"user":      task.User,
+			"status":    task.Status,
+		},
+	}
+
+	var events []Event
+	add := func(eventType string) {
+		event := base
+		event.Type = eventType
+		event.ID = taskEventID(task.UPID, eventType)
+		event.Data = make(map[string]interface{}, len(base.Data)+1)
+		for key, value := range base.Data {
+			event.Data[key] = value
+		}
+		if task.Type == "qmclone" {
+			// The task is listed under the VM that was cloned
+			event.VMID = ""
+			event.Data["source_vmid"] = task.ID
+		}
+		events = append(events, event)
+	}
+
+	ok := TaskSucceeded(task.Status)
+	if !ok {
+		add("task.failed")
+	}
+	if warnings := TaskWarnings(task.Status); warnings > 0 {
+		base.Data["warnings"] = warnings
+	}
+	if task.Type == "vzdump" {
+		add("backup.finished")
+	}
+	if eventType, known := taskEvents[task.Type]; known && ok && task.User != p.api.TokenID {
+		add(eventType)
+	}
+	return events
+}
+
+// taskEventID is the same for every instance that polls the task, so
+// receivers can drop duplicates
+func taskEventID(upid, eventType string) string {
+	sum := sha256.Sum256([]byte(upid + " " + eventType))
+	return "evt-" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,394 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"rm-thierry/Proxmox-API/src/manager"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebhookEvents are the event types a webhook can subscribe to. A webhook
+// can also subscribe to "*" or to a prefix like "vm.*"
+var WebhookEvents = []string{
+	"vm.created", "vm.deleted", "vm.started", "vm.stopped",
+	"ct.created", "task.failed", "backup.finished",
+}
+
+// Webhook receives the events it subscribed to as signed POST requests.
+// The secret is only returned when the webhook is created
+type Webhook struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Events      []string  `json:"events"`
+	Secret      string    `json:"secret,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Active      bool      `json:"active"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// WebhookRequest creates or updates a webhook. Omitted fields keep their
+// value on update, a new secret is generated when none is given on create
+type WebhookRequest struct {
+	URL         string   `json:"url"`
+	Events      []string `json:"events"`
+	Secret      string   `json:"secret,omitempty"`
+	Description *string  `json:"description,omitempty"`
+	Active      *bool    `json:"active,omitempty"`
+}
+
+// WebhookStore keeps the webhooks in the database when one is configured,
+// otherwise in WEBHOOKS_FILE (env/webhooks.json)
+type WebhookStore struct {
+	mu      sync.Mutex
+	path    string
+	db      *manager.DBManager
+	entries map[string]Webhook
+}
+
+var (
+	webhookStoreOnce sync.Once
+	webhookStore     *WebhookStore
+)
+
+func defaultWebhookStore() *WebhookStore {
+	webhookStoreOnce.Do(func() {
+		path := os.Getenv("WEBHOOKS_FILE")
+		if path == "" {
+			path = "env/webhooks.json"
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		webhookStore = &WebhookStore{path: path}
+	})
+	return webhookStore
+}
+
+// SetWebhookStore moves the webhooks and their delivery log into the
+// database, so pending retries survive a restart
+func SetWebhookStore(db *manager.DBManager) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS webhooks (
+		id VARCHAR(32) PRIMARY KEY,
+		definition TEXT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create webhook table: %w", err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id VARCHAR(32) PRIMARY KEY,
+		webhook_id VARCHAR(32) NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		created_at DATETIME(6) NOT NULL,
+		definition MEDIUMTEXT NOT NULL,
+		INDEX (webhook_id, created_at)
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create webhook delivery table: %w", err)
+	}
+
+	store := defaultWebhookStore()
+	store.mu.Lock()
+	store.db = db
+	store.entries = nil
+	store.mu.Unlock()
+
+	return defaultWebhookDispatcher().useDatabase(db)
+}
+
+func ListWebhooks() ([]Webhook, error) {
+	entries, err := defaultWebhookStore().load()
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := make([]Webhook, 0, len(entries))
+	for _, webhook := range entries {
+		webhook.Secret = ""
+		webhooks = append(webhooks, webhook)
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt) })
+	return webhooks, nil
+}
+
+func GetWebhook(id string) (*Webhook, error) {
+	webhook, err := getWebhook(id)
+	if err != nil {
+		return nil, err
+	}
+	webhook.Secret = ""
+	return webhook, nil
+}
+
+func getWebhook(id string) (*Webhook, error) {
+	entries, err := defaultWebhookStore().load()
+	if err != nil {
+		return nil, err
+	}
+	webhook, ok := entries[id]
+	if !ok {
+		return nil, fmt.Errorf("webhook '%s' not found", id)
+	}
+	return &webhook, nil
+}
+
+func CreateWebhook(req *WebhookRequest) (*Webhook, error) {
+	if err := validateWebhook(req.URL, req.Events); err != nil {
+		return nil, err
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		secret = randomToken(32)
+	}
+	now := time.Now().UTC()
+	webhook := Webhook{
+		ID:        "wh-" + randomToken(8),
+		URL:       req.URL,
+		Events:    req.Events,
+		Secret:    secret,
+		Active:    true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if req.Description != nil {
+		webhook.Description = *req.Description
+	}
+	if req.Active != nil {
+		webhook.Active = *req.Active
+	}
+
+	if err := defaultWebhookStore().put(webhook); err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+func UpdateWebhook(id string, req *WebhookRequest) (*Webhook, error) {
+	webhook, err := getWebhook(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.URL != "" {
+		webhook.URL = req.URL
+	}
+	if req.Events != nil {
+		webhook.Events = req.Events
+	}
+	if err := validateWebhook(webhook.URL, webhook.Events); err != nil {
+		return nil, err
+	}
+	if req.Secret != "" {
+		webhook.Secret = req.Secret
+	}
+	if req.Description != nil {
+		webhook.Description = *req.Description
+	}
+	if req.Active != nil {
+		webhook.Active = *req.Active
+	}
+	webhook.UpdatedAt = time.Now().UTC()
+
+	if err := defaultWebhookStore().put(*webhook); err != nil {
+		return nil, err
+	}
+	webhook.Secret = ""
+	return webhook, nil
+}
+
+func DeleteWebhook(id string) error {
+	if _, err := getWebhook(id); err != nil {
+		return err
+	}
+	return defaultWebhookStore().remove(id)
+}
+
+func validateWebhook(rawURL string, events []string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid webhook URL '%s', must be an http or https URL", rawURL)
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("invalid webhook: no events, use \"*\" for all events")
+	}
+	for _, event := range events {
+		known := event == "*"
+		for _, name := range WebhookEvents {
+			if name == event || (strings.HasSuffix(event, ".*") && strings.HasPrefix(name, strings.TrimSuffix(event, "*"))) {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("invalid webhook event '%s', must be one of %s", event, strings.Join(WebhookEvents, ", "))
+		}
+	}
+	return nil
+}
+
+// subscribes reports whether the webhook wants events of the type
+func (w *Webhook) subscribes(eventType string) bool {
+	for _, event := range w.Events {
+		if event == "*" || event == eventType ||
+			(strings.HasSuffix(event, ".*") && strings.HasPrefix(eventType, strings.TrimSuffix(event, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *WebhookStore) load() (map[string]Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.entries != nil {
+		return copyWebhooks(s.entries), nil
+	}
+
+	entries := make(map[string]Webhook)
+	if s.db != nil {
+		rows, err := s.db.Query("SELECT definition FROM webhooks")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read webhooks: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var definition string
+			if err := rows.Scan(&definition); err != nil {
+				return nil, fmt.Errorf("failed to read webhooks: %w", err)
+			}
+			var webhook Webhook
+			if err := json.Unmarshal([]byte(definition), &webhook); err != nil {
+				continue
+			}
+			entries[webhook.ID] = webhook
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read webhooks: %w", err)
+		}
+	} else {
+		file, err := os.ReadFile(s.path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read webhooks file: %w", err)
+		}
+		if err == nil && len(strings.TrimSpace(string(file))) > 0 {
+			var data struct {
+				Webhooks []Webhook `json:"webhooks"`
+			}
+			if err := json.Unmarshal(file, &data); err != nil {
+				return nil, fmt.Errorf("failed to parse webhooks file: %w", err)
+			}
+			for _, webhook := range data.Webhooks {
+				entries[webhook.ID] = webhook
+			}
+		}
+	}
+
+	s.entries = entries
+	return copyWebhooks(entries), nil
+}
+
+func (s *WebhookStore) put(webhook Webhook) error {
+	if _, err := s.load(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db != nil {
+		definition, err := json.Marshal(webhook)
+		if err != nil {
+			return err
+		}
+		_, err = s.db.Exec("INSERT INTO webhooks (id, definition) VALUES (?, ?) ON DUPLICATE KEY UPDATE definition = VALUES(definition)",
+			webhook.ID, string(definition))
+		if err != nil {
+			return fmt.Errorf("failed to save webhook: %w", err)
+		}
+		s.entries[webhook.ID] = webhook
+		return nil
+	}
+
+	entries := copyWebhooks(s.entries)
+	entries[webhook.ID] = webhook
+	if err := s.writeFile(entries); err != nil {
+		return err
+	}
+	s.entries = entries
+	return nil
+}
+
+func (s *WebhookStore) remove(id string) error {
+	if _, err := s.load(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db != nil {
+		if _, err := s.db.Exec("DELETE FROM webhooks WHERE id = ?", id); err != nil {
+			return fmt.Errorf("failed to delete webhook: %w", err)
+		}
+		delete(s.entries, id)
+		return nil
+	}
+
+	entries := copyWebhooks(s.entries)
+	delete(entries, id)
+	if err := s.writeFile(entries); err != nil {
+		return err
+	}
+	s.entries = entries
+	return nil
+}
+
+// writeFile replaces the file atomically, readable only by the owner as it
+// holds the signing secrets
+func (s *WebhookStore) writeFile(entries map[string]Webhook) error {
+	var data struct {
+		Webhooks []Webhook `json:"webhooks"`
+	}
+	data.Webhooks = make([]Webhook, 0, len(entries))
+	for _, webhook := range entries {
+		data.Webhooks = append(data.Webhooks, webhook)
+	}
+	sort.Slice(data.Webhooks, func(i, j int) bool { return data.Webhooks[i].CreatedAt.Before(data.Webhooks[j].CreatedAt) })
+
+	encoded, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("failed to write webhooks file: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, encoded, 0o600); err != nil {
+		return fmt.Errorf("failed to write webhooks file: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to write webhooks file: %w", err)
+	}
+	return nil
+}
+
+func copyWebhooks(entries map[string]Webhook) map[string]Webhook {
+	copied := make(map[string]Webhook, len(entries))
+	for id, webhook := range entries {
+		copied[id] = webhook
+	}
+	return copied
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,493 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"rm-thierry/Proxmox-API/src/logging"
+	"rm-thierry/Proxmox-API/src/manager"
+	"rm-thierry/Proxmox-API/src/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// workflowLease is how long a running workflow belongs to its instance
+	// without a heartbeat before another instance may recover it
+	workflowLease     = 2 * time.Minute
+	workflowHeartbeat = 30 * time.Second
+	// workflowRetention is how long finished workflows are listed
+	workflowRetention = 24 * time.Hour
+)
+
+// WorkflowStep is a step of a workflow that completed or failed. Detail
+// holds what later steps or a recovery need, e.g. the UPID of a task
+type WorkflowStep struct {
+	Name   string    `json:"name"`
+	Status string    `json:"status"`
+	Detail string    `json:"detail,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// Workflow is a multi-step operation, such as a template deploy, journaled
+// after every step so it can be resumed or rolled back after a restart.
+// State is what the workflow needs to continue and is dropped once it is
+// finished, as it can contain passwords
+type Workflow struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Node      string          `json:"node"`
+	VMID      string          `json:"vmid"`
+	Status    string          `json:"status"`
+	Steps     []WorkflowStep  `json:"steps"`
+	Error     string          `json:"error,omitempty"`
+	Owner     string          `json:"owner,omitempty"`
+	Recovered bool            `json:"recovered,omitempty"`
+	State     json.RawMessage `json:"state,omitempty"`
+	StartedAt time.Time       `json:"started_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// WorkflowJournal keeps workflows in the database when one is configured,
+// otherwise in WORKFLOW_STATE_FILE (env/workflows.json)
+type WorkflowJournal struct {
+	mu          sync.Mutex
+	path        string
+	db          *manager.DBManager
+	entries     map[string]*Workflow
+	active      map[string]*Workflow
+	owner       string
+	interrupted bool
+	heartbeat   sync.Once
+}
+
+var (
+	workflowJournalOnce sync.Once
+	workflowJournal     *WorkflowJournal
+)
+
+func defaultWorkflowJournal() *WorkflowJournal {
+	workflowJournalOnce.Do(func() {
+		path := os.Getenv("WORKFLOW_STATE_FILE")
+		if path == "" {
+			path = "env/workflows.json"
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		hostname, _ := os.Hostname()
+		workflowJournal = &WorkflowJournal{
+			path:   path,
+			active: make(map[string]*Workflow),
+			owner:  fmt.Sprintf("%s/%d", hostname, os.Getpid()),
+		}
+	})
+	return workflowJournal
+}
+
+// SetWorkflowStore moves the workflow journal into the database so that
+// any instance can recover the workflows of another
+func SetWorkflowStore(db *manager.DBManager) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS workflows (
+		id VARCHAR(32) PRIMARY KEY,
+		type VARCHAR(32) NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		updated_at DATETIME(6) NOT NULL,
+		definition MEDIUMTEXT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create workflow table: %w", err)
+	}
+
+	journal := defaultWorkflowJournal()
+	journal.mu.Lock()
+	journal.db = db
+	journal.entries = nil
+	journal.mu.Unlock()
+	return nil
+}
+
+// StartWorkflow journals a new running workflow. The journal is best effort:
+// when it cannot be written the operation still runs, it just cannot be
+// recovered
+func StartWorkflow(workflowType, node, vmid string, state interface{}) *Workflow {
+	journal := defaultWorkflowJournal()
+	now := workflowNow()
+	wf := &Workflow{
+		ID:        newWorkflowID(),
+		Type:      workflowType,
+		Node:      node,
+		VMID:      vmid,
+		Status:    "running",
+		Steps:     []WorkflowStep{},
+		Owner:     journal.owner,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+	if data, err := json.Marshal(state); err == nil {
+		wf.State = data
+	}
+
+	journal.mu.Lock()
+	journal.active[wf.ID] = wf
+	journal.mu.Unlock()
+	journal.heartbeat.Do(func() { go journal.runHeartbeat() })
+
+	journal.save(wf)
+	return wf
+}
+
+// Done reports whether step completed
+func (w *Workflow) Done(step string) bool {
+	if w == nil {
+		return false
+	}
+	for _, s := range w.Steps {
+		if s.Name == step && s.Status == "done" {
+			return true
+		}
+	}
+	return false
+}
+
+// Detail returns the detail recorded for a completed step
+func (w *Workflow) Detail(step string) string {
+	if w == nil {
+		return ""
+	}
+	for _, s := range w.Steps {
+		if s.Name == step && s.Status == "done" {
+			return s.Detail
+		}
+	}
+	return ""
+}
+
+// Complete records a step as done
+func (w *Workflow) Complete(step, detail string) {
+	w.record(WorkflowStep{Name: step, Status: "done", Detail: detail})
+}
+
+// Fail records a step as failed
+func (w *Workflow) Fail(step string, err error) {
+	w.record(WorkflowStep{Name: step, Status: "failed", Error: logging.RedactString(err.Error())})
+}
+
+// Skip records a step that was left out on purpose, with the reason in detail
+func (w *Workflow) Skip(step, detail string) {
+	w.record(WorkflowStep{Name: step, Status: "skipped", Detail: detail})
+}
+
+// History returns the steps recorded so far
+func (w *Workflow) History() []WorkflowStep {
+	if w == nil {
+		return []WorkflowStep{}
+	}
+	journal := defaultWorkflowJournal()
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	return append([]WorkflowStep{}, w.Steps...)
+}
+
+func (w *Workflow) record(step WorkflowStep) {
+	if w == nil {
+		return
+	}
+	journal := defaultWorkflowJournal()
+	journal.mu.Lock()
+	step.At = workflowNow()
+	w.Steps = append(w.Steps, step)
+	journal.mu.Unlock()
+	journal.save(w)
+}
+
+// Finish ends the workflow with status completed, failed or rolled_back
+func (w *Workflow) Finish(status string, err error) {
+	if w == nil {
+		return
+	}
+	journal := defaultWorkflowJournal()
+	journal.mu.Lock()
+	w.Status = status
+	w.State = nil
+	if err != nil {
+		w.Error = logging.RedactString(err.Error())
+	}
+	delete(journal.active, w.ID)
+	journal.mu.Unlock()
+	journal.save(w)
+	metrics.Workflows.WithLabelValues(w.Type, status).Inc()
+}
+
+// InterruptWorkflows hands the workflows still running in this process over
+// to the next instance, which recovers them right away instead of waiting
+// for the lease to run out. It is called when shutdown could not drain them
+func InterruptWorkflows() {
+	journal := defaultWorkflowJournal()
+	journal.mu.Lock()
+	journal.interrupted = true
+	var running []*Workflow
+	for _, wf := range journal.active {
+		running = append(running, wf)
+	}
+	journal.mu.Unlock()
+
+	for _, wf := range running {
+		slog.Warn("workflow interrupted by shutdown", "workflow", wf.ID, "type", wf.Type, "vmid", wf.VMID)
+		journal.save(wf)
+	}
+}
+
+// ListWorkflows returns running workflows and those finished in the last
+// day, newest first
+func ListWorkflows() ([]Workflow, error) {
+	workflows, err := defaultWorkflowJournal().list()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Workflow, 0, len(workflows))
+	for _, wf := range workflows {
+		copied := *wf
+		copied.State = nil
+		list = append(list, copied)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.After(list[j].StartedAt) })
+	return list, nil
+}
+
+func GetWorkflow(id string) (*Workflow, error) {
+	workflows, err := ListWorkflows()
+	if err != nil {
+		return nil, err
+	}
+	for _, wf := range workflows {
+		if wf.ID == id {
+			return &wf, nil
+		}
+	}
+	return nil, fmt.Errorf("workflow '%s' not found", id)
+}
+
+func (j *WorkflowJournal) save(wf *Workflow) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	wf.UpdatedAt = workflowNow()
+	if j.interrupted && wf.Status == "running" {
+		wf.UpdatedAt = time.Time{}
+	}
+	if err := j.saveLocked(wf); err != nil {
+		slog.Warn("unable to journal workflow", "workflow", wf.ID, "error", err)
+	}
+}
+
+func (j *WorkflowJournal) saveLocked(wf *Workflow) error {
+	data, err := json.Marshal(wf)
+	if err != nil {
+		return err
+	}
+
+	if j.db != nil {
+		_, err := j.db.Exec(`INSERT INTO workflows (id, type, status, updated_at, definition) VALUES (?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE status = VALUES(status), updated_at = VALUES(updated_at), definition = VALUES(definition)`,
+			wf.ID, wf.Type, wf.Status, wf.UpdatedAt, string(data))
+		if err != nil {
+			return fmt.Errorf("failed to save workflow: %w", err)
+		}
+		_, _ = j.db.Exec("DELETE FROM workflows WHERE status <> 'running' AND updated_at < ?", workflowNow().Add(-workflowRetention))
+		return nil
+	}
+
+	entries, err := j.loadFileLocked()
+	if err != nil {
+		return err
+	}
+	var copied Workflow
+	if err := json.Unmarshal(data, &copied); err != nil {
+		return err
+	}
+	entries[wf.ID] = &copied
+	return j.writeFileLocked(entries)
+}
+
+func (j *WorkflowJournal) list() ([]*Workflow, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.db != nil {
+		rows, err := j.db.Query("SELECT definition FROM workflows WHERE status = 'running' OR updated_at >= ?",
+			workflowNow().Add(-workflowRetention))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read workflows: %w", err)
+		}
+		defer rows.Close()
+
+		var workflows []*Workflow
+		for rows.Next() {
+			var definition string
+			if err := rows.Scan(&definition); err != nil {
+				return nil, fmt.Errorf("failed to read workflows: %w", err)
+			}
+			var wf Workflow
+			if err := json.Unmarshal([]byte(definition), &wf); err != nil {
+				continue
+			}
+			workflows = append(workflows, &wf)
+		}
+		return workflows, rows.Err()
+	}
+
+	entries, err := j.loadFileLocked()
+	if err != nil {
+		return nil, err
+	}
+	workflows := make([]*Workflow, 0, len(entries))
+	for _, wf := range entries {
+		copied := *wf
+		workflows = append(workflows, &copied)
+	}
+	return workflows, nil
+}
+
+// claim takes over a running workflow whose lease ran out. It fails when
+// another instance claimed or updated it since seen
+func (j *WorkflowJournal) claim(wf *Workflow) (bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	seen := wf.UpdatedAt
+	wf.Owner = j.owner
+	wf.Recovered = true
+	wf.UpdatedAt = workflowNow()
+	data, err := json.Marshal(wf)
+	if err != nil {
+		return false, err
+	}
+
+	if j.db != nil {
+		result, err := j.db.Exec("UPDATE workflows SET updated_at = ?, definition = ? WHERE id = ? AND status = 'running' AND updated_at = ?",
+			wf.UpdatedAt, string(data), wf.ID, seen)
+		if err != nil {
+			return false, fmt.Errorf("failed to claim workflow: %w", err)
+		}
+		if affected, _ := result.RowsAffected(); affected != 1 {
+			return false, nil
+		}
+	} else {
+		entries, err := j.loadFileLocked()
+		if err != nil {
+			return false, err
+		}
+		current, ok := entries[wf.ID]
+		if !ok || current.Status != "running" || !current.UpdatedAt.Equal(seen) {
+			return false, nil
+		}
+		var copied Workflow
+		if err := json.Unmarshal(data, &copied); err != nil {
+			return false, err
+		}
+		entries[wf.ID] = &copied
+		if err := j.writeFileLocked(entries); err != nil {
+			return false, err
+		}
+	}
+
+	j.active[wf.ID] = wf
+	j.heartbeat.Do(func() { go j.runHeartbeat() })
+	return true, nil
+}
+
+// runHeartbeat renews the lease of the workflows running in this process
+func (j *WorkflowJournal) runHeartbeat() {
+	for {
+		time.Sleep(workflowHeartbeat)
+
+		j.mu.Lock()
+		var running []*Workflow
+		for _, wf := range j.active {
+			running = append(running, wf)
+		}
+		j.mu.Unlock()
+
+		for _, wf := range running {
+			j.save(wf)
+		}
+	}
+}
+
+func (j *WorkflowJournal) loadFileLocked() (map[string]*Workflow, error) {
+	if j.entries != nil {
+		return j.entries, nil
+	}
+
+	entries := make(map[string]*Workflow)
+	file, err := os.ReadFile(j.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read workflow file: %w", err)
+	}
+	if err == nil && len(strings.TrimSpace(string(file))) > 0 {
+		var data struct {
+			Workflows []*Workflow `json:"workflows"`
+		}
+		if err := json.Unmarshal(file, &data); err != nil {
+			return nil, fmt.Errorf("failed to parse workflow file: %w", err)
+		}
+		for _, wf := range data.Workflows {
+			entries[wf.ID] = wf
+		}
+	}
+	j.entries = entries
+	return entries, nil
+}
+
+// writeFileLocked replaces the file atomically, readable only by the owner
+// as running workflows can hold passwords
+func (j *WorkflowJournal) writeFileLocked(entries map[string]*Workflow) error {
+	cutoff := workflowNow().Add(-workflowRetention)
+	var data struct {
+		Workflows []*Workflow `json:"workflows"`
+	}
+	for id, wf := range entries {
+		if wf.Status != "running" && wf.UpdatedAt.Before(cutoff) {
+			delete(entries, id)
+			continue
+		}
+		data.Workflows = append(data.Workflows, wf)
+	}
+	sort.Slice(data.Workflows, func(a, b int) bool { return data.Workflows[a].StartedAt.Before(data.Workflows[b].StartedAt) })
+
+	encoded, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o755); err != nil {
+		return fmt.Errorf("failed to write workflow file: %w", err)
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, encoded, 0o600); err != nil {
+		return fmt.Errorf("failed to write workflow file: %w", err)
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("failed to write workflow file: %w", err)
+	}
+	return nil
+}
+
+// workflowNow is truncated to what DATETIME(6) stores, so claims compare equal
+func workflowNow() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+func newWorkflowID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return "wf-" + hex.EncodeToString(b)
+}
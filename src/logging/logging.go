@@ -0,0 +1,119 @@
+// Package logging sets up JSON logs with secrets redacted and keeps track of
+// the Proxmox calls made while serving a request
+package logging
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+// secretField matches password=..., "cipassword":"..." and similar pairs in
+// free text such as Proxmox error bodies
+var secretField = regexp.MustCompile(`(?i)("?[a-z_]*(?:password|secret)"?\s*[:=]\s*"?)([^"&,\s}]+)`)
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// AddSecret redacts value wherever it shows up in a log message or attribute
+func AddSecret(value string) {
+	if len(value) < 4 {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secrets = append(secrets, value)
+}
+
+// ParseLevel reads debug, info, warn or error, defaulting to info
+func ParseLevel(value string) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// Setup makes a JSON (or, with format "text", logfmt) logger writing to w
+// the default for slog and the log package
+func Setup(w io.Writer, level slog.Level, format string) {
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: replaceAttr}
+	var handler slog.Handler = slog.NewJSONHandler(w, options)
+	if format == "text" {
+		handler = slog.NewTextHandler(w, options)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+func replaceAttr(groups []string, attr slog.Attr) slog.Attr {
+	if isSecretKey(attr.Key) {
+		return slog.String(attr.Key, redacted)
+	}
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, RedactString(attr.Value.String()))
+	case slog.KindAny:
+		if err, ok := attr.Value.Any().(error); ok {
+			return slog.String(attr.Key, RedactString(err.Error()))
+		}
+	}
+	return attr
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	return strings.Contains(key, "password") || strings.Contains(key, "secret") ||
+		key == "token" || key == "authorization"
+}
+
+// RedactString removes registered secrets and password or secret fields
+func RedactString(value string) string {
+	secretsMu.RLock()
+	for _, secret := range secrets {
+		value = strings.ReplaceAll(value, secret, redacted)
+	}
+	secretsMu.RUnlock()
+	return secretField.ReplaceAllString(value, "${1}"+redacted)
+}
+
+// RedactPayload returns a request payload as a map with password and secret
+// fields redacted
+func RedactPayload(payload interface{}) interface{} {
+	if payload == nil {
+		return nil
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil
+	}
+	return redactValue(value)
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, nested := range v {
+			if isSecretKey(key) {
+				v[key] = redacted
+			} else {
+				v[key] = redactValue(nested)
+			}
+		}
+	case []interface{}:
+		for i, nested := range v {
+			v[i] = redactValue(nested)
+		}
+	}
+	return value
+}
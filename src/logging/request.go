@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+)
+
+// UpstreamCall is a Proxmox call made while serving a request
+type UpstreamCall struct {
+	Method     string  `json:"method"`
+	Endpoint   string  `json:"endpoint"`
+	Node       string  `json:"node,omitempty"`
+	Status     int     `json:"status"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// RequestLog collects what is logged once a request is done
+type RequestLog struct {
+	ID string
+
+	mu    sync.Mutex
+	calls []UpstreamCall
+}
+
+type contextKey struct{}
+
+// NewRequestLog uses id, or generates one when it is empty or unusable
+func NewRequestLog(id string) *RequestLog {
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	return &RequestLog{ID: id}
+}
+
+// NewContext returns ctx carrying the request log
+func NewContext(ctx context.Context, requestLog *RequestLog) context.Context {
+	return context.WithValue(ctx, contextKey{}, requestLog)
+}
+
+// FromContext returns the request log of ctx, or nil outside a request
+func FromContext(ctx context.Context) *RequestLog {
+	if ctx == nil {
+		return nil
+	}
+	requestLog, _ := ctx.Value(contextKey{}).(*RequestLog)
+	return requestLog
+}
+
+// RequestID returns the request ID of ctx, or an empty string
+func RequestID(ctx context.Context) string {
+	if requestLog := FromContext(ctx); requestLog != nil {
+		return requestLog.ID
+	}
+	return ""
+}
+
+func (r *RequestLog) AddCall(call UpstreamCall) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+func (r *RequestLog) Calls() []UpstreamCall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]UpstreamCall{}, r.calls...)
+}
+
+// validRequestID accepts propagated IDs of printable ASCII up to 128 bytes so
+// they cannot break log lines or response headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -1,16 +1,27 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	api "rm-thierry/Proxmox-API/src/API"
 	"rm-thierry/Proxmox-API/src/auth"
+	"rm-thierry/Proxmox-API/src/cli"
 	"rm-thierry/Proxmox-API/src/handlers"
+	"rm-thierry/Proxmox-API/src/logging"
 	"rm-thierry/Proxmox-API/src/manager"
+	"rm-thierry/Proxmox-API/src/tracing"
+	"rm-thierry/Proxmox-API/src/version"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -18,59 +29,93 @@ import (
 
 func main() {
 	// Set up command-line flags
-	inputFile := flag.String("input", "", "Path to JSON input file")
+	inputFile := flag.String("input", "", "Path to an input file with VMs and containers (YAML, JSON or JSON Lines), - for stdin")
+	parallelism := flag.Int("parallel", 0, "Guests to create at the same time from the input file (default 4)")
+	dryRun := flag.Bool("dry-run", false, "Validate the input file and print the Proxmox calls without making them")
+	envFile := flag.String("env", "", "Path to an environment spec (YAML or JSON)")
+	envAction := flag.String("action", "plan", "Environment action: plan, apply or destroy")
+	prune := flag.Bool("prune", false, "Let apply delete guests that were removed from the environment spec")
+	showVersion := flag.Bool("version", false, "Print build information and exit")
 	flag.Parse()
 
+	if *showVersion {
+		info := version.Get()
+		fmt.Printf("proxmox-api %s (commit %s, built %s, %s, %s)\n",
+			info.Version, info.Commit, info.BuildDate, info.GoVersion, info.Platform)
+		return
+	}
+
 	// Load environment variables
 	_ = godotenv.Load("env/.env")
 
+	// JSON logs with secrets redacted, LOG_FORMAT=text for logfmt. The CLI
+	// logs its Proxmox calls too, so this comes before the subcommands
+	logging.Setup(os.Stderr, logging.ParseLevel(os.Getenv("LOG_LEVEL")), os.Getenv("LOG_FORMAT"))
+	for _, name := range []string{"PROXMOX_TOKEN_SECRET", "API_TOKEN", "DBPASS", "METRICS_TOKEN"} {
+		logging.AddSecret(os.Getenv(name))
+	}
+
+	// The CLI, environments and input files reserve VMIDs and record
+	// deploys too, so the stores are set up before any of them runs
+	if dbManager := setupDatabase(); dbManager != nil {
+		defer dbManager.Close()
+	}
+
+	// Subcommands run the CLI, which may not need Proxmox credentials
+	if flag.NArg() > 0 {
+		os.Exit(cli.Run(flag.Args()))
+	}
+
+	// Spans go to an OTLP collector, stdout or a file when TRACING_EXPORTER is set
+	if err := tracing.Setup(tracing.ConfigFromEnv()); err != nil {
+		fatal("unable to set up tracing", "error", err)
+	}
+	defer tracing.Shutdown()
+
 	// Initialize API manager
 	apiManager := manager.NewAPIManager()
 	if apiManager.TokenID == "" || apiManager.TokenSecret == "" {
-		log.Fatal("Error: Proxmox API credentials not found. Please set PROXMOX_TOKEN_ID and PROXMOX_TOKEN_SECRET environment variables.")
+		fatal("Proxmox API credentials not found, set PROXMOX_TOKEN_ID and PROXMOX_TOKEN_SECRET")
+	}
+
+	if *envFile != "" {
+		processEnvironment(*envFile, *envAction, *prune, apiManager)
+		return
 	}
 
 	// Check if we're using file input
 	if *inputFile != "" {
-		processFileInput(*inputFile, apiManager)
+		processFileInput(*inputFile, *parallelism, *dryRun, apiManager)
 		return
 	}
 
-	// Continue with API server setup if no input file provided
-	// Database configuration - only initialize if all required environment variables are present
-	dbHost := os.Getenv("DBHOST")
-	dbUser := os.Getenv("DBUSER")
-	dbPass := os.Getenv("DBPASS")
-	dbName := os.Getenv("DBNAME")
-
-	var dbManager *manager.DBManager
+	// Export cluster gauges on /metrics
+	handlers.StartMetricsCollector(apiManager, envDuration("METRICS_INTERVAL", 30*time.Second))
 
-	if dbHost != "" && dbUser != "" && dbName != "" {
-		config := manager.DBConfig{
-			Host:     dbHost,
-			Port:     3306,
-			User:     dbUser,
-			Password: dbPass,
-			DBName:   dbName,
-		}
+	// Resume or roll back deploys an earlier instance did not finish
+	handlers.StartWorkflowRecovery(apiManager, time.Minute)
 
-		var err error
-		dbManager, err = manager.NewDBManager(config)
-		if err != nil {
-			log.Printf("Warning: unable to connect to database: %v", err)
-		} else {
-			log.Println("Successfully connected to database at", dbHost)
-			defer dbManager.Close()
-		}
-	} else {
-		log.Println("Database connection skipped - environment variables not configured")
+	// Announce changes made through the API and, unless
+	// WEBHOOK_POLL_INTERVAL is 0, tasks found on the cluster
+	manager.SetCallObserver(handlers.ObserveProxmoxCall)
+	if pollInterval := os.Getenv("WEBHOOK_POLL_INTERVAL"); pollInterval != "0" {
+		handlers.StartTaskPoller(apiManager, envDuration("WEBHOOK_POLL_INTERVAL", 30*time.Second))
 	}
 
 	// Initialize auth service
 	authService := auth.NewService()
 
 	// Setup HTTP server
-	router := gin.Default()
+	// Requests are logged by the API's JSON request logger, gin's own
+	// debug output goes to the debug level
+	gin.DebugPrintFunc = func(format string, values ...interface{}) {
+		slog.Debug(strings.TrimSpace(fmt.Sprintf(format, values...)))
+	}
+	gin.DebugPrintRouteFunc = func(method, path, handlerName string, handlers int) {
+		slog.Debug("route", "method", method, "path", path, "handler", handlerName)
+	}
+	router := gin.New()
+	router.Use(gin.Recovery())
 
 	// Trust only local proxy
 	router.SetTrustedProxies([]string{"127.0.0.1", "::1"})
@@ -83,67 +128,216 @@ func main() {
 	if port == "" {
 		port = "8080"
 	}
-	log.Printf("Starting server on port %s", port)
-	router.Run(":" + port)
+	// Clone waits hold a request open for minutes, so the write timeout is
+	// far longer than the read timeout
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           router,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       envDuration("HTTP_READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:      envDuration("HTTP_WRITE_TIMEOUT", 15*time.Minute),
+		IdleTimeout:       envDuration("HTTP_IDLE_TIMEOUT", 2*time.Minute),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("starting server", "port", port)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("server failed", "error", err)
+		}
+		return
+	case <-ctx.Done():
+	}
+	stop()
+
+	// Stop accepting connections and let in-flight requests finish. Deploys
+	// still running after the drain timeout are left to the next instance
+	drainTimeout := envDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+	slog.Info("shutting down, draining requests", "timeout", drainTimeout.String())
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := server.Shutdown(drainCtx); err != nil {
+		slog.Warn("requests still running after drain timeout", "error", err)
+	}
+	handlers.InterruptWorkflows()
+	slog.Info("server stopped")
+}
+
+// envDuration reads a duration such as 30s or 15m, or returns def when the
+// variable is unset or invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return def
+	}
+	return value
 }
 
-func processFileInput(filename string, apiManager *manager.APIManager) {
-	// Read the JSON file
-	data, err := ioutil.ReadFile(filename)
+// setupDatabase connects to the database when DBHOST, DBUSER and DBNAME are
+// set and moves the stores into it. It returns nil without a database
+func setupDatabase() *manager.DBManager {
+	dbHost := os.Getenv("DBHOST")
+	dbUser := os.Getenv("DBUSER")
+	dbName := os.Getenv("DBNAME")
+	if dbHost == "" || dbUser == "" || dbName == "" {
+		slog.Info("database connection skipped, environment variables not configured")
+		return nil
+	}
+
+	config := manager.DBConfig{
+		Host:     dbHost,
+		Port:     3306,
+		User:     dbUser,
+		Password: os.Getenv("DBPASS"),
+		DBName:   dbName,
+	}
+	dbManager, err := manager.NewDBManager(config)
+	handlers.SetReadinessDatabase(dbManager, err)
 	if err != nil {
-		log.Fatalf("Error reading input file: %v", err)
+		slog.Warn("unable to connect to database", "error", err)
+		return nil
 	}
+	slog.Info("connected to database", "host", dbHost)
 
-	// Parse the JSON into a VM create request
-	var vmRequest handlers.VMCreateRequest
-	if err := json.Unmarshal(data, &vmRequest); err != nil {
-		log.Fatalf("Error parsing JSON: %v", err)
+	if err := handlers.SetVMIDReservationStore(dbManager); err != nil {
+		slog.Warn("VMID reservations will be kept in memory", "error", err)
+	}
+	if err := handlers.SetEvacuationStore(dbManager); err != nil {
+		slog.Warn("evacuations will be kept in the evacuations file", "error", err)
+	}
+	if err := handlers.SetTemplateRegistryStore(dbManager); err != nil {
+		slog.Warn("template registry will be kept in the templates file", "error", err)
+	}
+	if err := handlers.SetWorkflowStore(dbManager); err != nil {
+		slog.Warn("workflows will be kept in the workflow state file", "error", err)
+	}
+	if err := handlers.SetWebhookStore(dbManager); err != nil {
+		slog.Warn("webhooks will be kept in the webhooks file, deliveries in memory", "error", err)
 	}
+	return dbManager
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	tracing.Shutdown()
+	os.Exit(1)
+}
 
-	// Set default node if not specified
-	if vmRequest.Node == "" {
-		vmRequest.Node = apiManager.Node
+// processFileInput creates the VMs and containers of an input file and
+// exits with 1 when any of them failed
+func processFileInput(filename string, parallelism int, dryRun bool, apiManager *manager.APIManager) {
+	var data []byte
+	var err error
+	if filename == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(filename)
+	}
+	if err != nil {
+		fatal("error reading input file", "error", err)
 	}
 
-	// Create the VM
-	fmt.Println("Creating VM with the following configuration:")
-	fmt.Printf("  VMID: %s\n", vmRequest.VMID)
-	fmt.Printf("  Name: %s\n", vmRequest.Name)
-	fmt.Printf("  Node: %s\n", vmRequest.Node)
-	fmt.Printf("  Cores: %d\n", vmRequest.Cores)
-	fmt.Printf("  Memory: %d MB\n", vmRequest.Memory)
-	fmt.Printf("  Disk: %s\n", vmRequest.Disk)
-	fmt.Printf("  Network: %s\n", vmRequest.Net)
+	batch, err := handlers.ParseBatch(data, os.LookupEnv)
+	if err != nil {
+		fatal("error parsing input file", "error", err)
+	}
 
-	// Show ISO info only if not using CloudInit
-	if !vmRequest.CloudInit {
-		fmt.Printf("  ISO: %s\n", vmRequest.ISO)
+	if dryRun {
+		fmt.Printf("Validating %d guests (dry run)\n", len(batch.Items))
 	} else {
-		fmt.Println("  Using CloudInit: Yes")
-		// Using DHCP by default
-		fmt.Println("  IP Configuration: DHCP")
-		if vmRequest.Nameserver != "" {
-			fmt.Printf("  Nameservers: %s\n", vmRequest.Nameserver)
-		}
-		if vmRequest.Searchdomain != "" {
-			fmt.Printf("  Search Domain: %s\n", vmRequest.Searchdomain)
-		}
-		if vmRequest.SSHKeys != "" {
-			fmt.Println("  SSH Keys: Configured")
-		}
+		fmt.Printf("Creating %d guests\n", len(batch.Items))
+	}
+	results := handlers.RunBatch(apiManager, batch, parallelism, dryRun)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tKIND\tNAME\tVMID\tNODE\tSTATUS\tTIME\tERROR")
+	for _, r := range results {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%.1fs\t%s\n", r.Index, r.Kind, r.Name, r.VMID, r.Node, r.Status, r.Duration, r.Error)
+	}
+	w.Flush()
+
+	succeeded, failed := handlers.BatchSummary(results)
+	fmt.Printf("%d succeeded, %d failed\n", succeeded, failed)
+	if failed > 0 {
+		tracing.Shutdown()
+		os.Exit(1)
 	}
+}
 
-	fmt.Printf("  OS Type: %s\n", vmRequest.OSType)
-	fmt.Printf("  CPU: %s\n", vmRequest.CPU)
-	fmt.Printf("  Sockets: %d\n", vmRequest.Sockets)
+func processEnvironment(filename, action string, prune bool, apiManager *manager.APIManager) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		fatal("error reading environment file", "error", err)
+	}
+
+	spec, err := handlers.ParseEnvironmentSpec(data)
+	if err != nil {
+		fatal("error parsing environment", "error", err)
+	}
 
-	vm, err := handlers.CreateVM(apiManager, &vmRequest)
+	var plan *handlers.EnvironmentPlan
+	var result *handlers.EnvironmentResult
+	switch action {
+	case "plan":
+		plan, err = handlers.PlanEnvironment(apiManager, spec)
+	case "apply":
+		result, err = handlers.ApplyEnvironment(apiManager, spec, prune)
+	case "destroy":
+		result, err = handlers.DestroyEnvironment(apiManager, spec)
+	default:
+		fatal("unknown action, use plan, apply or destroy", "action", action)
+	}
 	if err != nil {
-		log.Fatalf("Error creating VM: %v", err)
+		fatal("error running environment action", "action", action, "error", err)
+	}
+	if result != nil {
+		plan = result.Plan
+	}
+
+	fmt.Printf("Environment %s: %d to create, %d to update, %d to delete\n",
+		plan.Environment, plan.Creates, plan.Updates, plan.Deletes)
+	for _, a := range plan.Actions {
+		if a.Action == "none" {
+			continue
+		}
+		fmt.Printf("  %-7s %s %s %s\n", a.Action, a.Type, a.Name, a.VMID)
+		for _, change := range a.Changes {
+			note := ""
+			if change.RebootRequired {
+				note = " (reboot required)"
+			}
+			fmt.Printf("          %s: %q -> %q%s\n", change.Field, change.From, change.To, note)
+		}
+		for _, warning := range a.Warnings {
+			fmt.Printf("          warning: %s\n", warning)
+		}
 	}
 
-	// Print the result
-	fmt.Println("VM created successfully!")
-	resultJSON, _ := json.MarshalIndent(vm, "", "  ")
-	fmt.Println(string(resultJSON))
-}
\ No newline at end of file
+	if result == nil {
+		return
+	}
+	for _, step := range result.Steps {
+		line := fmt.Sprintf("%s %s: %s", step.Action, step.Name, step.Status)
+		if step.Error != "" {
+			line += " (" + step.Error + ")"
+		}
+		if step.Note != "" {
+			line += " (" + step.Note + ")"
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("%d succeeded, %d failed, %d skipped, %d kept\n", result.Succeeded, result.Failed, result.Skipped, result.Kept)
+	if result.Failed > 0 || result.Skipped > 0 {
+		tracing.Shutdown()
+		os.Exit(1)
+	}
+}
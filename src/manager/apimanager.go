@@ -2,21 +2,51 @@ package manager
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"rm-thierry/Proxmox-API/src/logging"
+	"rm-thierry/Proxmox-API/src/metrics"
+	"rm-thierry/Proxmox-API/src/tracing"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/joho/godotenv"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// CallObserver is told about every call that changed something in Proxmox
+// and succeeded, e.g. to announce the changes made through this service. api
+// is the manager that made the call
+type CallObserver func(api *APIManager, method, endpoint string, payload interface{}, response []byte)
+
+var (
+	observerMu   sync.RWMutex
+	callObserver CallObserver
+)
+
+// SetCallObserver registers the observer of successful changes
+func SetCallObserver(observer CallObserver) {
+	observerMu.Lock()
+	defer observerMu.Unlock()
+	callObserver = observer
+}
+
 type APIManager struct {
 	BaseURL     string
 	Node        string
 	TokenID     string
 	TokenSecret string
+
+	// ctx ties Proxmox calls to the request that made them
+	ctx context.Context
 }
 
 func NewAPIManager() *APIManager {
@@ -40,6 +70,9 @@ func NewAPIManager() *APIManager {
 
 	if node != "" && tokenID != "" && tokenSecret != "" {
 		response, err := apiManager.ApiCall("GET", "/nodes", nil)
+		if err != nil {
+			slog.Warn("unable to reach Proxmox, see /readyz", "url", baseURL, "error", err)
+		}
 		if err == nil {
 			var result map[string]interface{}
 			if err := json.Unmarshal(response, &result); err == nil {
@@ -59,6 +92,7 @@ func NewAPIManager() *APIManager {
 					}
 
 					if !nodeValid && len(availableNodes) > 0 {
+						slog.Warn("configured node not found, falling back", "node", node, "fallback", availableNodes[0])
 						apiManager.Node = availableNodes[0]
 					}
 				}
@@ -69,11 +103,109 @@ func NewAPIManager() *APIManager {
 	return apiManager
 }
 
+// WithContext returns a copy of the manager whose calls are logged with the
+// request of ctx
+func (manager *APIManager) WithContext(ctx context.Context) *APIManager {
+	copied := *manager
+	copied.ctx = ctx
+	return &copied
+}
+
+// Context returns the context of the manager, never nil
+func (manager *APIManager) Context() context.Context {
+	if manager.ctx == nil {
+		return context.Background()
+	}
+	return manager.ctx
+}
+
 func (manager *APIManager) ApiCall(method, endpoint string, payload interface{}) ([]byte, error) {
 	return manager.ApiCallWithOptions(method, endpoint, payload, true)
 }
 
+// ApiCallWithOptions calls the Proxmox API, records metrics and logs the
+// call with the request it belongs to
 func (manager *APIManager) ApiCallWithOptions(method, endpoint string, payload interface{}, useJsonContentType bool) ([]byte, error) {
+	label, node := metrics.Endpoint(endpoint)
+	_, span := tracing.Tracer().Start(manager.Context(), "proxmox "+method+" "+label,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(tracing.Attributes(
+			"http.method", method,
+			"proxmox.endpoint", label,
+			"proxmox.node", node)...))
+
+	started := time.Now()
+	responseBody, status, err := manager.doCall(method, endpoint, payload, useJsonContentType)
+	duration := time.Since(started)
+
+	if status > 0 {
+		span.SetAttributes(tracing.Attributes("http.status_code", status)...)
+	}
+	tracing.End(span, err)
+
+	statusLabel := "error"
+	if status > 0 {
+		statusLabel = strconv.Itoa(status)
+		metrics.UpstreamRequestDuration.WithLabelValues(method, label, node).Observe(duration.Seconds())
+	}
+	metrics.UpstreamRequests.WithLabelValues(method, label, node, statusLabel).Inc()
+	switch {
+	case status == 0:
+		metrics.UpstreamErrors.WithLabelValues(method, label, node, "request").Inc()
+	case status >= 400:
+		metrics.UpstreamErrors.WithLabelValues(method, label, node, "status_"+statusLabel).Inc()
+	case err != nil:
+		metrics.UpstreamErrors.WithLabelValues(method, label, node, "read").Inc()
+	}
+
+	ctx := manager.Context()
+	call := logging.UpstreamCall{
+		Method:     method,
+		Endpoint:   label,
+		Node:       node,
+		Status:     status,
+		DurationMS: float64(duration.Microseconds()) / 1000,
+	}
+	if err != nil {
+		call.Error = logging.RedactString(err.Error())
+	}
+	if requestLog := logging.FromContext(ctx); requestLog != nil {
+		requestLog.AddCall(call)
+	}
+
+	level := slog.LevelDebug
+	if status == 0 {
+		level = slog.LevelWarn
+	}
+	if slog.Default().Enabled(ctx, level) {
+		attrs := []any{"method", method, "path", endpoint, "node", node, "status", status, "duration_ms", call.DurationMS}
+		if requestID := logging.RequestID(ctx); requestID != "" {
+			attrs = append(attrs, "request_id", requestID)
+		}
+		if payload != nil {
+			attrs = append(attrs, "payload", logging.RedactPayload(payload))
+		}
+		if call.Error != "" {
+			attrs = append(attrs, "error", call.Error)
+		}
+		slog.Log(ctx, level, "proxmox call", attrs...)
+	}
+
+	if err == nil && method != "GET" {
+		observerMu.RLock()
+		observer := callObserver
+		observerMu.RUnlock()
+		if observer != nil {
+			observer(manager, method, endpoint, payload, responseBody)
+		}
+	}
+
+	return responseBody, err
+}
+
+// doCall makes the request and returns the status code, 0 when no response
+// was received
+func (manager *APIManager) doCall(method, endpoint string, payload interface{}, useJsonContentType bool) ([]byte, int, error) {
 	url := manager.BaseURL + endpoint
 
 	var body []byte
@@ -81,13 +213,13 @@ func (manager *APIManager) ApiCallWithOptions(method, endpoint string, payload i
 		var err error
 		body, err = json.Marshal(payload)
 		if err != nil {
-			return nil, fmt.Errorf("error encoding payload: %v", err)
+			return nil, 0, fmt.Errorf("error encoding payload: %v", err)
 		}
 	}
 
 	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
 	if err != nil {
-		return nil, fmt.Errorf("error creating request: %v", err)
+		return nil, 0, fmt.Errorf("error creating request: %v", err)
 	}
 
 	if manager.TokenID != "" && manager.TokenSecret != "" {
@@ -105,13 +237,13 @@ func (manager *APIManager) ApiCallWithOptions(method, endpoint string, payload i
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error performing request to %s: %v", url, err)
+		return nil, 0, fmt.Errorf("error performing request to %s: %v", url, err)
 	}
 	defer resp.Body.Close()
 
 	responseBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("error reading response: %v", err)
+		return nil, resp.StatusCode, fmt.Errorf("error reading response: %v", err)
 	}
 
 	if resp.StatusCode >= 400 {
@@ -129,19 +261,27 @@ func (manager *APIManager) ApiCallWithOptions(method, endpoint string, payload i
 					}
 				}
 
-				if data == nil && resp.StatusCode == 500 {
-					errorDetails = "Proxmox API returned an internal server error. This could be due to invalid VM parameters, " +
-						"insufficient disk space, missing privileges, or an issue with the storage configuration."
-				}
 			}
 		}
 
-		if errorDetails != "" {
-			return nil, fmt.Errorf("API error (Status %d): %s - Details: %s", resp.StatusCode, responseBody, errorDetails)
-		} else {
-			return nil, fmt.Errorf("API error (Status %d): %s", resp.StatusCode, responseBody)
+		// The body is only logged, errors reach API clients
+		slog.DebugContext(manager.Context(), "proxmox error response", "path", endpoint,
+			"status", resp.StatusCode, "body", logging.RedactString(string(responseBody)))
+
+		// Proxmox puts the reason in the status line, e.g. "500 VM 101 not running"
+		reason := strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)))
+		switch {
+		case errorDetails != "":
+		case reason != "" && reason != http.StatusText(resp.StatusCode):
+			errorDetails = reason
+		case resp.StatusCode == 500:
+			errorDetails = "Proxmox API returned an internal server error. This could be due to invalid VM parameters, " +
+				"insufficient disk space, missing privileges, or an issue with the storage configuration."
+		default:
+			errorDetails = reason
 		}
+		return nil, resp.StatusCode, fmt.Errorf("API error (Status %d): %s", resp.StatusCode, logging.RedactString(errorDetails))
 	}
 
-	return responseBody, nil
+	return responseBody, resp.StatusCode, nil
 }
@@ -0,0 +1,112 @@
+package manager
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"rm-thierry/Proxmox-API/src/logging"
+	"strings"
+	"testing"
+)
+
+// rawProxmox answers every request with the status line and body, as
+// Proxmox puts its error reasons into the status line
+func rawProxmox(t *testing.T, status, body string) *APIManager {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil || line == "\r\n" {
+					break
+				}
+			}
+			fmt.Fprintf(conn, "HTTP/1.1 %s\r\nContent-Type: application/json\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", status, len(body), body)
+			conn.Close()
+		}
+	}()
+	return &APIManager{BaseURL: "http://" + listener.Addr().String(), Node: "pve"}
+}
+
+func TestApiCallErrors(t *testing.T) {
+	logging.AddSecret("hunter2-secret")
+
+	tests := []struct {
+		name    string
+		status  string
+		body    string
+		want    string
+		notWant []string
+	}{
+		{
+			name:    "parameter errors",
+			status:  "400 Parameter verification failed.",
+			body:    `{"errors":{"memory":"value must have a minimum value of 16"},"data":null,"leak":"raw-body-marker"}`,
+			want:    `API error (Status 400): {"memory":"value must have a minimum value of 16"}`,
+			notWant: []string{"raw-body-marker", "data"},
+		},
+		{
+			name:    "message in data",
+			status:  "500 Internal Server Error",
+			body:    `{"data":{"msg":"storage full"},"leak":"raw-body-marker"}`,
+			want:    "API error (Status 500): storage full",
+			notWant: []string{"raw-body-marker"},
+		},
+		{
+			name:    "reason in the status line",
+			status:  "500 VM 101 not running",
+			body:    `{"data":null,"leak":"raw-body-marker"}`,
+			want:    "API error (Status 500): VM 101 not running",
+			notWant: []string{"raw-body-marker"},
+		},
+		{
+			name:   "plain internal server error",
+			status: "500 Internal Server Error",
+			body:   `{"data":null}`,
+			want:   "API error (Status 500): Proxmox API returned an internal server error",
+		},
+		{
+			name:    "body that is not JSON",
+			status:  "401 authentication failure",
+			body:    "<html>token hunter2-secret rejected</html>",
+			want:    "API error (Status 401): authentication failure",
+			notWant: []string{"html", "hunter2-secret"},
+		},
+		{
+			name:    "secrets in details are redacted",
+			status:  "400 Parameter verification failed.",
+			body:    `{"errors":{"cipassword":"hunter2-secret is too short"}}`,
+			want:    "API error (Status 400): ",
+			notWant: []string{"hunter2-secret"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := rawProxmox(t, tt.status, tt.body)
+			_, err := api.ApiCall("GET", "/version", nil)
+			if err == nil {
+				t.Fatal("ApiCall() returned no error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ApiCall() error = %q, want it to contain %q", err, tt.want)
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(err.Error(), notWant) {
+					t.Errorf("ApiCall() error = %q, must not contain %q", err, notWant)
+				}
+			}
+		})
+	}
+}
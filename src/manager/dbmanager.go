@@ -1,10 +1,12 @@
 package manager
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
 type DBManager struct {
@@ -63,7 +65,7 @@ func (m *DBManager) QueryRow(query string, args ...interface{}) *sql.Row {
 func (m *DBManager) Exec(query string, args ...interface{}) (sql.Result, error) {
 	result, err := m.db.Exec(query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("error executing statement: %v", err)
+		return nil, fmt.Errorf("error executing statement: %w", err)
 	}
 	return result, nil
 }
@@ -79,3 +81,15 @@ func (m *DBManager) Prepare(query string) (*sql.Stmt, error) {
 func (m *DBManager) GetDB() *sql.DB {
 	return m.db
 }
+
+// Ping checks the database is still reachable
+func (m *DBManager) Ping(ctx context.Context) error {
+	return m.db.PingContext(ctx)
+}
+
+// IsDuplicateKey reports whether a statement failed because a row with the
+// same primary or unique key already exists
+func IsDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	nodeUpDesc = prometheus.NewDesc("proxmox_node_up",
+		"Whether the node is online", []string{"node"}, nil)
+	nodeCPUDesc = prometheus.NewDesc("proxmox_node_cpu_ratio",
+		"CPU usage of the node between 0 and 1", []string{"node"}, nil)
+	nodeCPUsDesc = prometheus.NewDesc("proxmox_node_cpus",
+		"CPU cores of the node", []string{"node"}, nil)
+	nodeMemoryUsedDesc = prometheus.NewDesc("proxmox_node_memory_used_bytes",
+		"Memory used on the node", []string{"node"}, nil)
+	nodeMemoryTotalDesc = prometheus.NewDesc("proxmox_node_memory_total_bytes",
+		"Memory of the node", []string{"node"}, nil)
+	guestsDesc = prometheus.NewDesc("proxmox_guests",
+		"VMs and containers, by node, type and state", []string{"node", "type", "status"}, nil)
+	storageUsedDesc = prometheus.NewDesc("proxmox_storage_used_bytes",
+		"Space used on the storage", []string{"node", "storage"}, nil)
+	storageTotalDesc = prometheus.NewDesc("proxmox_storage_total_bytes",
+		"Size of the storage", []string{"node", "storage"}, nil)
+)
+
+// ClusterStats are the node, guest and storage values of one
+// /cluster/resources call
+type ClusterStats struct {
+	Nodes    []NodeStats
+	Guests   []GuestCount
+	Storages []StorageStats
+}
+
+type NodeStats struct {
+	Node        string
+	Up          bool
+	CPU         float64
+	CPUs        float64
+	MemoryUsed  float64
+	MemoryTotal float64
+}
+
+// GuestCount is the number of guests of a type and state on a node
+type GuestCount struct {
+	Node   string
+	Type   string
+	Status string
+	Count  int
+}
+
+type StorageStats struct {
+	Node    string
+	Storage string
+	Used    float64
+	Total   float64
+}
+
+// ClusterCollector exports the cluster gauges of the last ClusterStats set,
+// so a scrape sees all old or all new values and guests that no longer exist
+// are dropped
+type ClusterCollector struct {
+	mu    sync.RWMutex
+	stats ClusterStats
+}
+
+// Cluster is the registered collector of the cluster gauges
+var Cluster = NewClusterCollector()
+
+func init() {
+	prometheus.MustRegister(Cluster)
+}
+
+func NewClusterCollector() *ClusterCollector {
+	return &ClusterCollector{}
+}
+
+// Set replaces the exported values
+func (c *ClusterCollector) Set(stats ClusterStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats = stats
+}
+
+func (c *ClusterCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{nodeUpDesc, nodeCPUDesc, nodeCPUsDesc, nodeMemoryUsedDesc,
+		nodeMemoryTotalDesc, guestsDesc, storageUsedDesc, storageTotalDesc} {
+		ch <- desc
+	}
+}
+
+func (c *ClusterCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+	}
+	for _, n := range c.stats.Nodes {
+		up := 0.0
+		if n.Up {
+			up = 1
+		}
+		gauge(nodeUpDesc, up, n.Node)
+		gauge(nodeCPUDesc, n.CPU, n.Node)
+		gauge(nodeCPUsDesc, n.CPUs, n.Node)
+		gauge(nodeMemoryUsedDesc, n.MemoryUsed, n.Node)
+		gauge(nodeMemoryTotalDesc, n.MemoryTotal, n.Node)
+	}
+	for _, g := range c.stats.Guests {
+		gauge(guestsDesc, float64(g.Count), g.Node, g.Type, g.Status)
+	}
+	for _, s := range c.stats.Storages {
+		gauge(storageUsedDesc, s.Used, s.Node, s.Storage)
+		gauge(storageTotalDesc, s.Total, s.Node, s.Storage)
+	}
+}
@@ -0,0 +1,116 @@
+// Package metrics defines the Prometheus metrics of the service and serves
+// them with the Prometheus client
+package metrics
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultBuckets suit Proxmox calls, which range from milliseconds to
+// minutes for clones and migrations
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+var (
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxmox_api_http_requests_total",
+		Help: "HTTP requests served, by route and status code",
+	}, []string{"method", "route", "status"})
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxmox_api_http_request_duration_seconds",
+		Help:    "Latency of HTTP requests served, by route",
+		Buckets: DefaultBuckets,
+	}, []string{"method", "route"})
+
+	UpstreamRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxmox_api_upstream_requests_total",
+		Help: "Calls to the Proxmox API, by endpoint, node and status code",
+	}, []string{"method", "endpoint", "node", "status"})
+	UpstreamRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxmox_api_upstream_request_duration_seconds",
+		Help:    "Latency of calls to the Proxmox API, by endpoint and node",
+		Buckets: DefaultBuckets,
+	}, []string{"method", "endpoint", "node"})
+	UpstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxmox_api_upstream_errors_total",
+		Help: "Failed calls to the Proxmox API, by endpoint, node and reason",
+	}, []string{"method", "endpoint", "node", "reason"})
+
+	Tasks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxmox_api_tasks_total",
+		Help: "Proxmox tasks waited for, by task type and outcome",
+	}, []string{"type", "status"})
+
+	Workflows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxmox_api_workflows_total",
+		Help: "Finished multi-step operations, by type and outcome",
+	}, []string{"type", "status"})
+
+	WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxmox_api_webhook_deliveries_total",
+		Help: "Webhook delivery attempts, by event type and outcome",
+	}, []string{"event", "status"})
+
+	AuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxmox_api_auth_failures_total",
+		Help: "Rejected API requests, by reason",
+	}, []string{"reason"})
+
+	CollectorLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "proxmox_api_collector_last_success_timestamp_seconds",
+		Help: "Unix time the cluster collector last succeeded",
+	})
+	CollectorErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxmox_api_collector_errors_total",
+		Help: "Failed runs of the cluster collector",
+	})
+)
+
+// Handler serves every registered metric
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// placeholders names the path segment that follows a fixed segment
+var placeholders = map[string]string{
+	"nodes":   "{node}",
+	"qemu":    "{vmid}",
+	"lxc":     "{vmid}",
+	"tasks":   "{upid}",
+	"storage": "{storage}",
+	"content": "{volume}",
+	"pools":   "{pool}",
+	"groups":  "{group}",
+}
+
+// Endpoint turns a Proxmox API path into a label without IDs, e.g.
+// /nodes/pve/qemu/101/status/start becomes
+// /nodes/{node}/qemu/{vmid}/status/start, and returns the node it targets
+func Endpoint(path string) (endpoint, node string) {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 0; i < len(segments); i++ {
+		segment := segments[i]
+		if placeholder, ok := placeholders[segment]; ok && i+1 < len(segments) {
+			if segment == "nodes" {
+				node, _ = url.PathUnescape(segments[i+1])
+			}
+			segments[i+1] = placeholder
+			i++
+			continue
+		}
+		if _, err := strconv.Atoi(segment); err == nil {
+			segments[i] = "{id}"
+		}
+	}
+	return "/" + strings.Join(segments, "/"), node
+}
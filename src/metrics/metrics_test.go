@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEndpoint(t *testing.T) {
+	tests := []struct {
+		path     string
+		endpoint string
+		node     string
+	}{
+		{"/nodes/pve/qemu/101/status/start", "/nodes/{node}/qemu/{vmid}/status/start", "pve"},
+		{"/nodes/pve/lxc/200/config?digest=abc", "/nodes/{node}/lxc/{vmid}/config", "pve"},
+		{"/nodes/pve%2D2/tasks/UPID:pve-2:0001:qmclone/status", "/nodes/{node}/tasks/{upid}/status", "pve-2"},
+		{"/nodes/pve/storage/local-lvm/content/local-lvm:vm-101-disk-0", "/nodes/{node}/storage/{storage}/content/{volume}", "pve"},
+		{"/cluster/resources", "/cluster/resources", ""},
+		{"/pools/web", "/pools/{pool}", ""},
+		{"/nodes", "/nodes", ""},
+		{"/cluster/backup/42", "/cluster/backup/{id}", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			endpoint, node := Endpoint(tt.path)
+			if endpoint != tt.endpoint || node != tt.node {
+				t.Errorf("Endpoint(%q) = %q, %q, want %q, %q", tt.path, endpoint, node, tt.endpoint, tt.node)
+			}
+		})
+	}
+}
+
+func TestClusterCollector(t *testing.T) {
+	collector := NewClusterCollector()
+	collector.Set(ClusterStats{
+		Nodes:    []NodeStats{{Node: "gone", Up: true, CPUs: 4}},
+		Guests:   []GuestCount{{Node: "gone", Type: "qemu", Status: "running", Count: 3}},
+		Storages: []StorageStats{{Node: "gone", Storage: "local", Used: 1, Total: 2}},
+	})
+	collector.Set(ClusterStats{
+		Nodes:    []NodeStats{{Node: "pve", Up: true, CPU: 0.25, CPUs: 8, MemoryUsed: 1024, MemoryTotal: 4096}, {Node: "pve2"}},
+		Guests:   []GuestCount{{Node: "pve", Type: "lxc", Status: "stopped", Count: 2}},
+		Storages: []StorageStats{{Node: "pve", Storage: "local-lvm", Used: 10, Total: 100}},
+	})
+
+	want := `
+# HELP proxmox_guests VMs and containers, by node, type and state
+# TYPE proxmox_guests gauge
+proxmox_guests{node="pve",status="stopped",type="lxc"} 2
+# HELP proxmox_node_cpus CPU cores of the node
+# TYPE proxmox_node_cpus gauge
+proxmox_node_cpus{node="pve"} 8
+proxmox_node_cpus{node="pve2"} 0
+# HELP proxmox_node_up Whether the node is online
+# TYPE proxmox_node_up gauge
+proxmox_node_up{node="pve"} 1
+proxmox_node_up{node="pve2"} 0
+# HELP proxmox_storage_used_bytes Space used on the storage
+# TYPE proxmox_storage_used_bytes gauge
+proxmox_storage_used_bytes{node="pve",storage="local-lvm"} 10
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(want),
+		"proxmox_guests", "proxmox_node_cpus", "proxmox_node_up", "proxmox_storage_used_bytes"); err != nil {
+		t.Error(err)
+	}
+	if got := testutil.CollectAndCount(collector); got != 13 {
+		t.Errorf("collected %d metrics, want 13 without the values of the first Set", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	AuthFailures.WithLabelValues("say \"hi\"\nC:\\vm").Inc()
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(recorder.Body)
+
+	for _, want := range []string{
+		"# TYPE proxmox_api_auth_failures_total counter",
+		`proxmox_api_auth_failures_total{reason="say \"hi\"\nC:\\vm"} 1`,
+		"# TYPE proxmox_api_collector_errors_total counter",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("/metrics misses %q", want)
+		}
+	}
+}
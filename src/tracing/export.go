@@ -0,0 +1,133 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Config selects the exporter. Exporter is otlp, stdout, file or empty to
+// disable tracing. The OTLP exporter reads the standard
+// OTEL_EXPORTER_OTLP_* variables itself
+type Config struct {
+	Exporter    string
+	ServiceName string
+	// File receives the spans as JSON for the file exporter
+	File string
+}
+
+// ConfigFromEnv reads TRACING_EXPORTER, TRACING_FILE and OTEL_SERVICE_NAME
+func ConfigFromEnv() Config {
+	return Config{
+		Exporter:    strings.ToLower(os.Getenv("TRACING_EXPORTER")),
+		ServiceName: os.Getenv("OTEL_SERVICE_NAME"),
+		File:        os.Getenv("TRACING_FILE"),
+	}
+}
+
+var (
+	mu       sync.RWMutex
+	provider *sdktrace.TracerProvider
+	// traceFile is the file of the file exporter, closed on Shutdown
+	traceFile *os.File
+)
+
+// Enabled reports whether spans are recorded
+func Enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return provider != nil
+}
+
+// Setup installs the tracer provider and the W3C trace context propagator.
+// It does nothing when no exporter is set
+func Setup(config Config) error {
+	var exporter sdktrace.SpanExporter
+	var file *os.File
+	var err error
+	switch config.Exporter {
+	case "", "none":
+		return nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		path := config.File
+		if path == "" {
+			path = "traces.jsonl"
+		}
+		file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open trace file: %w", err)
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background())
+	default:
+		return fmt.Errorf("invalid tracing exporter '%s', must be otlp, stdout or file", config.Exporter)
+	}
+	if err != nil {
+		closeFile(file)
+		return fmt.Errorf("failed to create %s trace exporter: %w", config.Exporter, err)
+	}
+
+	service := config.ServiceName
+	if service == "" {
+		service = "proxmox-api"
+	}
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", service)))
+	if err != nil {
+		closeFile(file)
+		return fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	mu.Lock()
+	provider = tp
+	traceFile = file
+	mu.Unlock()
+	return nil
+}
+
+// Shutdown exports the spans that are still queued and closes the trace
+// file
+func Shutdown() {
+	mu.Lock()
+	tp, file := provider, traceFile
+	provider, traceFile = nil, nil
+	mu.Unlock()
+	if tp == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tp.Shutdown(ctx); err != nil {
+		slog.Warn("tracing: failed to export spans on shutdown", "error", err)
+	}
+	closeFile(file)
+}
+
+func closeFile(file *os.File) {
+	if file == nil {
+		return
+	}
+	if err := file.Close(); err != nil {
+		slog.Warn("tracing: failed to close trace file", "error", err)
+	}
+}
@@ -0,0 +1,41 @@
+package tracing
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileExporterShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	if err := Setup(Config{Exporter: "file", File: path}); err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+
+	mu.RLock()
+	file := traceFile
+	mu.RUnlock()
+	if file == nil {
+		t.Fatal("Setup() did not keep the trace file")
+	}
+
+	_, span := Tracer().Start(context.Background(), "test span")
+	span.End()
+	Shutdown()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "test span") {
+		t.Errorf("trace file = %q, want the span flushed before the file is closed", data)
+	}
+	if _, err := file.Write([]byte("x")); err == nil {
+		t.Error("trace file is still open after Shutdown()")
+	}
+	if Enabled() {
+		t.Error("Enabled() = true after Shutdown()")
+	}
+}
@@ -0,0 +1,83 @@
+// Package tracing sets up OpenTelemetry for requests, handler steps and
+// Proxmox calls and exports their spans over OTLP/HTTP or as JSON
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"rm-thierry/Proxmox-API/src/logging"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentation = "rm-thierry/Proxmox-API"
+
+// Tracer returns the tracer of this service. It records nothing until
+// Setup installed an exporter
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentation)
+}
+
+// Start begins a span as a child of the span in ctx. Attributes are given as
+// key, value pairs like slog
+func Start(ctx context.Context, name string, attrs ...interface{}) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, trace.WithAttributes(Attributes(attrs...)...))
+}
+
+// Attributes converts key, value pairs like slog to span attributes
+func Attributes(attrs ...interface{}) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs)/2)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		key, ok := attrs[i].(string)
+		if !ok {
+			continue
+		}
+		switch value := attrs[i+1].(type) {
+		case string:
+			kvs = append(kvs, attribute.String(key, value))
+		case int:
+			kvs = append(kvs, attribute.Int(key, value))
+		case int64:
+			kvs = append(kvs, attribute.Int64(key, value))
+		case float64:
+			kvs = append(kvs, attribute.Float64(key, value))
+		case bool:
+			kvs = append(kvs, attribute.Bool(key, value))
+		default:
+			kvs = append(kvs, attribute.String(key, fmt.Sprint(value)))
+		}
+	}
+	return kvs
+}
+
+// End finishes the span and marks it failed when err is not nil. The error
+// is redacted like the logs
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(codes.Error, logging.RedactString(err.Error()))
+	}
+	span.End()
+}
+
+// StartTime returns when the span of ctx started, if it is recorded
+func StartTime(ctx context.Context) (time.Time, bool) {
+	span, ok := trace.SpanFromContext(ctx).(sdktrace.ReadOnlySpan)
+	if !ok {
+		return time.Time{}, false
+	}
+	return span.StartTime(), true
+}
+
+// TraceID returns the trace of ctx, or an empty string
+func TraceID(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}